@@ -0,0 +1,85 @@
+package cron
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNext(t *testing.T) {
+	// 1 March 2026 is a Sunday
+	at := func(month time.Month, day, hour, minute int) time.Time {
+		return time.Date(2026, month, day, hour, minute, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		expr     string
+		from     time.Time
+		want     time.Time
+		wantNone bool
+	}{
+		{expr: "0 9 1 * *", from: at(1, 15, 10, 0), want: at(2, 1, 9, 0)},
+		{expr: "0 9 1 * *", from: at(2, 1, 9, 0), want: at(3, 1, 9, 0)},
+		{expr: "*/15 * * * *", from: at(3, 4, 10, 7), want: at(3, 4, 10, 15)},
+		{expr: "0-30/10 8 * * *", from: at(3, 4, 8, 21), want: at(3, 4, 8, 30)},
+		{expr: "5/20 * * * *", from: at(3, 4, 8, 46), want: at(3, 4, 9, 5)},
+		{expr: "0 0 * * 0", from: at(3, 4, 0, 0), want: at(3, 8, 0, 0)},
+		{expr: "0 0 * * 7", from: at(3, 4, 0, 0), want: at(3, 8, 0, 0)},
+		{expr: "0 0 * 6 1-5", from: at(3, 4, 0, 0), want: at(6, 1, 0, 0)},
+		// Either day field matches when both are restricted
+		{expr: "0 0 1 * 1", from: at(3, 1, 12, 0), want: at(3, 2, 0, 0)},
+		// but a field starting with "*" counts as unrestricted, so both must
+		{expr: "0 0 */2 * 1", from: at(3, 1, 12, 0), want: at(3, 9, 0, 0)},
+		{expr: "0 0 1 * */2", from: at(3, 1, 12, 0), want: at(8, 1, 0, 0)},
+		{expr: "0 12 29 2 *", from: at(3, 1, 0, 0), want: time.Date(2028, 2, 29, 12, 0, 0, 0, time.UTC)},
+		{expr: "0 0 30 2 *", from: at(3, 1, 0, 0), wantNone: true},
+	}
+	for _, tt := range tests {
+		s, err := Parse(tt.expr)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tt.expr, err)
+			continue
+		}
+		got := s.Next(tt.from)
+		if tt.wantNone {
+			if !got.IsZero() {
+				t.Errorf("%q after %s: %s, want never", tt.expr, tt.from, got)
+			}
+		} else if !got.Equal(tt.want) {
+			t.Errorf("%q after %s: %s, want %s", tt.expr, tt.from, got, tt.want)
+		}
+	}
+}
+
+func TestNextKeepsLocation(t *testing.T) {
+	loc := time.FixedZone("AEST", 10*60*60)
+	s, err := Parse("30 9 * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := s.Next(time.Date(2026, 3, 4, 10, 0, 0, 0, loc))
+	if want := time.Date(2026, 3, 5, 9, 30, 0, 0, loc); !got.Equal(want) || got.Location() != loc {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"a * * * *",
+		"1-x * * * *",
+		"* * * JAN *",
+	} {
+		if _, err := Parse(expr); err == nil {
+			t.Errorf("Parse(%q) succeeded, want an error", expr)
+		}
+	}
+}
@@ -1,70 +1,168 @@
 package dbutil
 
 import (
+	"errors"
 	"fmt"
-	"log"
+	"strings"
 	"time"
+)
 
-	"golang.org/x/crypto/bcrypt"
+// Account types.
+const (
+	AccountChecking = "checking"
+	AccountSavings  = "savings"
 )
 
-type Account struct {
-	Id                 int           `json:"id"`
-	First_name         string        `json:"first_name"`
-	Last_name          string        `json:"last_name"`
-	Email              string        `json:"email"`
-	Phone_number       int           `json:"phone_number,omitempty"`
-	Encrypted_password string        `json:"encrypted_password"`
-	Balance            float64       `json:"balance"`
-	Created_at         time.Time     `json:"created_at"`
-	Updated_at         time.Time     `json:"updated_at"`
-	Transactions       []Transaction `json:"transactions,omitempty"`
+// AccountTypes lists every valid account type.
+var AccountTypes = []string{AccountChecking, AccountSavings}
+
+// ValidAccountType reports whether accountType is one of AccountTypes.
+func ValidAccountType(accountType string) bool {
+	for _, t := range AccountTypes {
+		if t == accountType {
+			return true
+		}
+	}
+	return false
 }
 
-func (a *Account) ChangeName(first_name, last_name string) {
-	a.First_name = first_name
-	a.Last_name = last_name
+// Account statuses. Money cannot move into or out of a frozen account, but
+// its owner can still see it and its history. A closed account cannot be
+// used at all; its row is kept so that its transactions still name both
+// parties. A customer whose accounts are all closed can no longer log in.
+const (
+	StatusActive = "active"
+	StatusFrozen = "frozen"
+	StatusClosed = "closed"
+)
+
+// Statuses lists every valid status.
+var Statuses = []string{StatusActive, StatusFrozen, StatusClosed}
+
+// ValidStatus reports whether status is one of Statuses.
+func ValidStatus(status string) bool {
+	for _, s := range Statuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
 }
 
-func (a *Account) ChangeEmail(email string) {
-	a.Email = email
+// statusChanges lists the statuses each status may change to. Closing is
+// final.
+var statusChanges = map[string][]string{
+	StatusActive: {StatusFrozen, StatusClosed},
+	StatusFrozen: {StatusActive, StatusClosed},
 }
 
-func (a *Account) ChangePhoneNumber(number int) {
-	a.Phone_number = number
+// CanChangeStatus reports whether an account may go from one status to
+// another.
+func CanChangeStatus(from, to string) bool {
+	for _, s := range statusChanges[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
 }
 
-func (a *Account) ChangePassword(password string) {
-	// encrypt password
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), 10)
-	if err != nil {
-		log.Println(err)
-		return
+var (
+	// ErrAccountFrozen and ErrAccountClosed are returned when money would
+	// move into or out of an account that is not active.
+	ErrAccountFrozen = errors.New("account is frozen")
+	ErrAccountClosed = errors.New("account is closed")
+
+	// ErrSameAccount is returned for a payment from an account to itself.
+	ErrSameAccount = errors.New("payment to the account it is paid from")
+
+	// ErrInvalidStatusChange is returned for a status change that
+	// CanChangeStatus does not allow.
+	ErrInvalidStatusChange = errors.New("invalid account status change")
+
+	// ErrBalanceNotZero is returned when closing an account that still
+	// holds money.
+	ErrBalanceNotZero = errors.New("account balance is not zero")
+)
+
+// Account holds a balance for the customer that owns it. A customer can have
+// several, told apart by type and nickname. The balance is in the currency
+// the account was opened in, which never changes.
+//
+// Balance is the ledger balance, the sum of the account's posted entries.
+// Held is the part of it set aside by pending holds, which cannot be spent;
+// see Available.
+type Account struct {
+	Id                int           `json:"id"`
+	Customer_id       int           `json:"customer_id"`
+	Type              string        `json:"type"`
+	Nickname          string        `json:"nickname,omitempty"`
+	Balance           Money         `json:"balance"`
+	Held              Money         `json:"held"`
+	Created_at        time.Time     `json:"created_at"`
+	Updated_at        time.Time     `json:"updated_at"`
+	Status            string        `json:"status"`
+	Status_reason     string        `json:"status_reason,omitempty"`
+	Status_changed_at *time.Time    `json:"status_changed_at,omitempty"`
+	Transactions      []Transaction `json:"transactions,omitempty"`
+}
+
+// Name is how the account is shown to its owner: the nickname if it has
+// one, otherwise its type.
+func (a *Account) Name() string {
+	if a.Nickname != "" {
+		return a.Nickname
 	}
+	return strings.ToUpper(a.Type[:1]) + a.Type[1:]
+}
 
-	a.Encrypted_password = string(hashedPassword)
+// Currency returns the ISO 4217 code the account is held in.
+func (a *Account) Currency() string {
+	return a.Balance.Currency
+}
+
+// Available returns what can still be spent from the account: its ledger
+// balance less what pending holds have set aside.
+func (a *Account) Available() Money {
+	return a.Balance.Sub(a.Held)
+}
+
+// Closed reports whether the account has been closed.
+func (a *Account) Closed() bool {
+	return a.Status == StatusClosed
+}
+
+// CheckActive returns ErrAccountFrozen or ErrAccountClosed unless money may
+// move into and out of the account.
+func (a *Account) CheckActive() error {
+	switch a.Status {
+	case StatusFrozen:
+		return ErrAccountFrozen
+	case StatusClosed:
+		return ErrAccountClosed
+	}
+	return nil
 }
 
-func (a *Account) Transfer(account *Account, amount float64) {
-	if (a.Balance - amount) < 0 {
+func (a *Account) Transfer(account *Account, amount Money) {
+	if a.Balance.LessThan(amount) {
 		fmt.Println(`not enough funds in your account.`)
 		return
 	}
-	a.Balance -= amount
-	account.Balance += amount
+	a.Balance = a.Balance.Sub(amount)
+	account.Balance = account.Balance.Add(amount)
 }
 
 func (a *Account) Print() {
 	fmt.Println(fmt.Sprintf(`
 		Account:
 			id: %v,
-			first_name: %s,
-			last_name: %s,
-			email: %s,
-			phone_number %d,
-			encrypted_password: %s,
-			balance: %f,
+			customer_id: %v,
+			type: %s,
+			nickname: %s,
+			balance: %s,
+			status: %s,
 			created_at: %q,
 			updated_at: %q
-		`, a.Id, a.First_name, a.Last_name, a.Email, a.Phone_number, a.Encrypted_password, a.Balance, a.Created_at, a.Updated_at))
+		`, a.Id, a.Customer_id, a.Type, a.Nickname, a.Balance, a.Status, a.Created_at, a.Updated_at))
 }
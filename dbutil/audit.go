@@ -0,0 +1,37 @@
+package dbutil
+
+import "time"
+
+// Audit events.
+const (
+	AuditAccountLocked   = "account_locked"
+	AuditAccountUnlocked = "account_unlocked"
+
+	AuditTwoFactorEnabled     = "two_factor_enabled"
+	AuditTwoFactorDisabled    = "two_factor_disabled"
+	AuditRecoveryCodeUsed     = "recovery_code_used"
+	AuditRecoveryCodesRenewed = "recovery_codes_renewed"
+
+	AuditPasswordReset = "password_reset"
+	AuditEmailVerified = "email_verified"
+
+	AuditAccountStatusChanged = "account_status_changed"
+
+	AuditExchangeRateChanged = "exchange_rate_changed"
+
+	AuditTransactionReversed = "transaction_reversed"
+)
+
+// AuditEvent records a security-relevant action. CustomerId is the customer
+// it concerns and AccountId the account, each 0 if there is none; ActorId is
+// the customer that caused it, if any.
+type AuditEvent struct {
+	Id         int       `json:"id"`
+	CustomerId int       `json:"customer_id,omitempty"`
+	AccountId  int       `json:"account_id,omitempty"`
+	ActorId    int       `json:"actor_id,omitempty"`
+	Event      string    `json:"event"`
+	Detail     string    `json:"detail"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"created_at"`
+}
@@ -0,0 +1,31 @@
+package dbutil
+
+import "fmt"
+
+// BatchPayment is one payment of a bulk payment file: Amount, in the paying
+// account's currency, to ToAccount, with the payer's Reference. Key makes
+// retrying the payment safe, as it does for a transfer. TransferBatch sets
+// TransactionId once the payment is made.
+type BatchPayment struct {
+	ToAccount     int
+	Amount        Money
+	Reference     string
+	Key           IdempotencyKey
+	TransactionId int
+}
+
+// BatchError is returned by Database.TransferBatch when the payment at
+// Index could not be made, which leaves the whole batch unmade. It unwraps
+// to the reason, such as ErrInsufficientFunds.
+type BatchError struct {
+	Index int
+	Err   error
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("payment %d of the batch: %v", e.Index+1, e.Err)
+}
+
+func (e *BatchError) Unwrap() error {
+	return e.Err
+}
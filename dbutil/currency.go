@@ -0,0 +1,183 @@
+package dbutil
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+	"time"
+)
+
+// currencyExponents gives the ISO 4217 exponent of every currency an
+// account can be held in: how many decimal places its amounts have, and so
+// how many minor units make up one unit.
+var currencyExponents = map[string]int{
+	"AUD": 2,
+	"CAD": 2,
+	"CHF": 2,
+	"CNY": 2,
+	"EUR": 2,
+	"GBP": 2,
+	"HKD": 2,
+	"JPY": 0,
+	"KRW": 0,
+	"KWD": 3,
+	"NZD": 2,
+	"SGD": 2,
+	"USD": 2,
+}
+
+// Currencies lists every supported currency code in alphabetical order.
+func Currencies() []string {
+	codes := make([]string, 0, len(currencyExponents))
+	for code := range currencyExponents {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	return codes
+}
+
+// ValidCurrency reports whether currency is one of Currencies.
+func ValidCurrency(currency string) bool {
+	_, ok := currencyExponents[currency]
+	return ok
+}
+
+// Exponent returns the number of decimal places of currency. Unknown codes
+// are treated as having two.
+func Exponent(currency string) int {
+	if exponent, ok := currencyExponents[currency]; ok {
+		return exponent
+	}
+	return 2
+}
+
+func pow10(n int) int64 {
+	p := int64(1)
+	for i := 0; i < n; i++ {
+		p *= 10
+	}
+	return p
+}
+
+// roundMinor rounds an exact number of minor units to a whole one, halves
+// away from zero, which is the rounding rule for every converted amount and
+// fee. It fails if the result does not fit in an int64.
+func roundMinor(r *big.Rat) (int64, error) {
+	num := new(big.Int).Abs(r.Num())
+	quo, rem := new(big.Int).QuoRem(num, r.Denom(), new(big.Int))
+	if rem.Mul(rem, big.NewInt(2)).Cmp(r.Denom()) >= 0 {
+		quo.Add(quo, big.NewInt(1))
+	}
+	if r.Sign() < 0 {
+		quo.Neg(quo)
+	}
+	if !quo.IsInt64() {
+		return 0, fmt.Errorf("amount out of range")
+	}
+	return quo.Int64(), nil
+}
+
+var (
+	// ErrNoExchangeRate is returned for a payment between two currencies
+	// that have no rate in the exchange rate table.
+	ErrNoExchangeRate = errors.New("no exchange rate between these currencies")
+
+	// ErrCurrencyMismatch is returned when an amount is not in the currency
+	// of the account it is paid from.
+	ErrCurrencyMismatch = errors.New("amount is not in the account's currency")
+
+	// ErrAmountTooSmall is returned for a payment that would credit the
+	// receiving account with nothing, such as one so small that converting
+	// it rounds to zero. The payer would lose the money, and it could never
+	// be refunded.
+	ErrAmountTooSmall = errors.New("amount is too small to pay")
+)
+
+// MaxFeeBasisPoints caps the conversion fee at 10%.
+const MaxFeeBasisPoints = 1000
+
+// ExchangeRate says how many units of Quote one unit of Base buys. Rate is
+// kept as the exact decimal string it was given in so that conversions are
+// reproducible. FeeBasisPoints is charged on top of every conversion from
+// Base to Quote, in hundredths of a percent of the amount converted.
+//
+// Rates are directional: converting Quote back into Base needs its own
+// entry.
+type ExchangeRate struct {
+	Base           string    `json:"base"`
+	Quote          string    `json:"quote"`
+	Rate           string    `json:"rate"`
+	FeeBasisPoints int       `json:"fee_basis_points"`
+	UpdatedAt      time.Time `json:"updated_at"`
+}
+
+// ParseRate parses an exchange rate given as a positive decimal such as
+// "0.6512" or "97". Fractions and exponents are not accepted, so that a
+// stored rate always reads back the same.
+func ParseRate(s string) (*big.Rat, error) {
+	whole, frac, _ := strings.Cut(s, ".")
+	if whole+frac == "" || len(frac) > 12 {
+		return nil, fmt.Errorf("invalid exchange rate %q", s)
+	}
+	for _, r := range whole + frac {
+		if r < '0' || r > '9' {
+			return nil, fmt.Errorf("invalid exchange rate %q", s)
+		}
+	}
+	rate, ok := new(big.Rat).SetString(s)
+	if !ok || rate.Sign() <= 0 {
+		return nil, fmt.Errorf("invalid exchange rate %q", s)
+	}
+	return rate, nil
+}
+
+// Validate checks the currencies, rate and fee of an exchange rate.
+func (r *ExchangeRate) Validate() error {
+	if !ValidCurrency(r.Base) || !ValidCurrency(r.Quote) {
+		return fmt.Errorf("unsupported currency pair %s/%s", r.Base, r.Quote)
+	}
+	if r.Base == r.Quote {
+		return fmt.Errorf("cannot set a rate from %s to itself", r.Base)
+	}
+	if _, err := ParseRate(r.Rate); err != nil {
+		return err
+	}
+	if r.FeeBasisPoints < 0 || r.FeeBasisPoints > MaxFeeBasisPoints {
+		return fmt.Errorf("fee must be between 0 and %d basis points", MaxFeeBasisPoints)
+	}
+	return nil
+}
+
+// Convert returns what amount, in Base, is worth in Quote and the fee for
+// converting it, in Base. Both are rounded to whole minor units of their
+// currency, halves away from zero.
+func (r *ExchangeRate) Convert(amount Money) (converted, fee Money, err error) {
+	if amount.Currency != r.Base {
+		return Money{}, Money{}, fmt.Errorf("cannot convert %s at a %s/%s rate: %w", amount.Currency, r.Base, r.Quote, ErrCurrencyMismatch)
+	}
+	rate, err := ParseRate(r.Rate)
+	if err != nil {
+		return Money{}, Money{}, err
+	}
+
+	// minor units of Base -> units of Base -> units of Quote -> minor units
+	// of Quote
+	exact := new(big.Rat).SetInt64(amount.Minor)
+	exact.Mul(exact, rate)
+	exact.Mul(exact, new(big.Rat).SetFrac64(pow10(Exponent(r.Quote)), pow10(Exponent(r.Base))))
+	minor, err := roundMinor(exact)
+	if err != nil {
+		return Money{}, Money{}, fmt.Errorf("error converting %s %s: %w", amount, amount.Currency, err)
+	}
+
+	exactFee := new(big.Rat).SetInt64(amount.Minor)
+	exactFee.Mul(exactFee, big.NewRat(int64(r.FeeBasisPoints), 10000))
+	feeMinor, err := roundMinor(exactFee)
+	if err != nil {
+		return Money{}, Money{}, fmt.Errorf("error charging fee on %s %s: %w", amount, amount.Currency, err)
+	}
+
+	return NewMoney(minor, r.Quote), NewMoney(feeMinor, r.Base), nil
+}
@@ -0,0 +1,75 @@
+package dbutil
+
+import (
+	"log"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Customer roles. Customers can only see and act on their own accounts,
+// tellers can also view every account and transaction, and admins can
+// additionally close accounts and change roles.
+const (
+	RoleCustomer = "customer"
+	RoleTeller   = "teller"
+	RoleAdmin    = "admin"
+)
+
+// Roles lists every valid role.
+var Roles = []string{RoleCustomer, RoleTeller, RoleAdmin}
+
+// ValidRole reports whether role is one of Roles.
+func ValidRole(role string) bool {
+	for _, r := range Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// Customer is a person who banks here. A customer logs in with their email
+// address and password, and owns one or more accounts.
+type Customer struct {
+	Id                 int        `json:"id"`
+	First_name         string     `json:"first_name"`
+	Last_name          string     `json:"last_name"`
+	Email              string     `json:"email"`
+	Phone_number       int        `json:"phone_number,omitempty"`
+	Encrypted_password string     `json:"encrypted_password"`
+	Role               string     `json:"role"`
+	Email_verified_at  *time.Time `json:"email_verified_at,omitempty"`
+	Created_at         time.Time  `json:"created_at"`
+	Updated_at         time.Time  `json:"updated_at"`
+}
+
+// EmailVerified reports whether the customer has proved they control their
+// email address.
+func (c *Customer) EmailVerified() bool {
+	return c.Email_verified_at != nil
+}
+
+func (c *Customer) ChangeName(first_name, last_name string) {
+	c.First_name = first_name
+	c.Last_name = last_name
+}
+
+func (c *Customer) ChangeEmail(email string) {
+	c.Email = email
+}
+
+func (c *Customer) ChangePhoneNumber(number int) {
+	c.Phone_number = number
+}
+
+func (c *Customer) ChangePassword(password string) {
+	// encrypt password
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), 10)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	c.Encrypted_password = string(hashedPassword)
+}
@@ -1,24 +1,86 @@
 package dbutil
 
-import "database/sql"
+import (
+	"context"
+	"database/sql"
+	"minibank/dbutil/migrate"
+	"time"
+)
 
+// Database is implemented by each storage backend. Every method takes the
+// caller's context, so a cancelled or timed-out request aborts its queries
+// and rolls back any transaction it opened.
 type Database interface {
-	Init()
+	Init(ctx context.Context)
+	Migrator(ctx context.Context) (*migrate.Migrator, error)
 
-	GetAccount(id int) (*Account, error)
-	GetAccounts() []Account
-	GetAccountByEmail(email string) (*Account, error)
-	GetAccountByPhoneNumber(number int) (*Account, error)
-	CreateAccount(account *Account) error
-	UpdateAccountBalance(tx *sql.Tx, account *Account) error
-	DeleteAccount(id int) error
-	Transfer(fromAccountId, toAccountId int, amount float64) (int, error)
+	GetCustomer(ctx context.Context, id int) (*Customer, error)
+	GetCustomers(ctx context.Context) []Customer
+	GetCustomerByEmail(ctx context.Context, email string) (*Customer, error)
+	GetCustomerByPhoneNumber(ctx context.Context, number int) (*Customer, error)
+	CreateCustomer(ctx context.Context, customer *Customer, account *Account) error
+	SetCustomerRole(ctx context.Context, id int, role string) error
+	SetCustomerPassword(ctx context.Context, id int, encryptedPassword string) error
+	SetEmailVerified(ctx context.Context, id int, at time.Time) error
 
-	ListTransactionsFromAccount(id int) ([]Transaction, error)
-	MakeTransaction(tx *sql.Tx, transaction *Transaction) error
-	GetTransaction(transactionID int) (*Transaction, error)
+	GetAccount(ctx context.Context, id int) (*Account, error)
+	GetAccounts(ctx context.Context) []Account
+	ListCustomerAccounts(ctx context.Context, customerId int) ([]Account, error)
+	CreateAccount(ctx context.Context, account *Account) error
+	UpdateAccountBalance(ctx context.Context, tx *sql.Tx, account *Account) error
+	SetAccountStatus(ctx context.Context, id int, status, reason string, at time.Time) error
+	Transfer(ctx context.Context, fromAccountId, toAccountId int, amount Money, key IdempotencyKey) (int, error)
+	TransferBatch(ctx context.Context, fromAccountId int, payments []BatchPayment) error
+	Authorize(ctx context.Context, fromAccountId, toAccountId int, amount Money, key IdempotencyKey, expiresAt time.Time) (int, error)
+	CaptureHold(ctx context.Context, id int, at time.Time) error
+	VoidHold(ctx context.Context, id int, at time.Time) error
+	ExpireHolds(ctx context.Context, now time.Time) (int, error)
+	Reverse(ctx context.Context, id int, amount Money, key IdempotencyKey) (int, error)
+	ListReversals(ctx context.Context, id int) ([]Transaction, error)
+	GetExchangeRate(ctx context.Context, base, quote string) (*ExchangeRate, error)
+	ListExchangeRates(ctx context.Context) ([]ExchangeRate, error)
+	SetExchangeRate(ctx context.Context, rate *ExchangeRate) error
+	CreateScheduledPayment(ctx context.Context, payment *ScheduledPayment) error
+	GetScheduledPayment(ctx context.Context, id int) (*ScheduledPayment, error)
+	ListScheduledPayments(ctx context.Context, customerId int) ([]ScheduledPayment, error)
+	ListDueScheduledPayments(ctx context.Context, now time.Time, limit int) ([]ScheduledPayment, error)
+	RecordScheduledPaymentRun(ctx context.Context, payment *ScheduledPayment, run *ScheduledPaymentRun) error
+	CancelScheduledPayment(ctx context.Context, customerId, id int, at time.Time) error
+	ListScheduledPaymentRuns(ctx context.Context, scheduledPaymentId int) ([]ScheduledPaymentRun, error)
 
-	Stimulus(tx *sql.Tx, account *Account) error
-	MockData()
-	Begin() (*sql.Tx, error)
+	ListTransactionsFromAccount(ctx context.Context, filter TransactionFilter) (*TransactionPage, error)
+	AccountBalanceAt(ctx context.Context, accountId int, at time.Time) (Money, error)
+	MakeTransaction(ctx context.Context, tx *sql.Tx, transaction *Transaction) error
+	GetTransaction(ctx context.Context, transactionID int) (*Transaction, error)
+	CheckLedger(ctx context.Context) error
+	CreateAPIKey(ctx context.Context, key *APIKey) error
+	GetAPIKeyByHash(ctx context.Context, hash string) (*APIKey, error)
+	ListAPIKeys(ctx context.Context, customerId int) ([]APIKey, error)
+	RevokeAPIKey(ctx context.Context, customerId, id int) error
+	TouchAPIKey(ctx context.Context, id int, at time.Time) error
+	SaveSession(ctx context.Context, session *Session) error
+	GetSession(ctx context.Context, id string) (*Session, error)
+	ListSessions(ctx context.Context, customerId int) ([]Session, error)
+	DeleteSession(ctx context.Context, id string) error
+	DeleteCustomerSessions(ctx context.Context, customerId int, except string) (int, error)
+	GetLoginThrottle(ctx context.Context, key string) (*LoginThrottle, error)
+	RecordLoginFailure(ctx context.Context, key string, at, resetBefore time.Time) (*LoginThrottle, error)
+	LockLogin(ctx context.Context, key string, until time.Time) error
+	ClearLoginThrottle(ctx context.Context, key string) error
+	CreateAuditEvent(ctx context.Context, event *AuditEvent) error
+	GetTwoFactor(ctx context.Context, customerId int) (*TwoFactor, error)
+	SaveTwoFactor(ctx context.Context, tf *TwoFactor) error
+	ConfirmTwoFactor(ctx context.Context, customerId int, step int64, at time.Time, recoveryHashes []string) error
+	UseTwoFactorStep(ctx context.Context, customerId int, step int64) error
+	ReplaceRecoveryCodes(ctx context.Context, customerId int, hashes []string) error
+	UseRecoveryCode(ctx context.Context, customerId int, hash string, at time.Time) error
+	CountRecoveryCodes(ctx context.Context, customerId int) (int, error)
+	DeleteTwoFactor(ctx context.Context, customerId int) error
+	CreateEmailToken(ctx context.Context, token *EmailToken) error
+	UseEmailToken(ctx context.Context, purpose, hash string, at time.Time) (*EmailToken, error)
+	DeleteEmailTokens(ctx context.Context, customerId int, purpose string) error
+
+	Stimulus(ctx context.Context, tx *sql.Tx, account *Account) error
+	MockData(ctx context.Context)
+	Begin(ctx context.Context) (*sql.Tx, error)
 }
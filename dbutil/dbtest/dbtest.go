@@ -0,0 +1,700 @@
+// Package dbtest is the conformance suite for dbutil.Database backends. Each
+// backend's tests call Run with a function that opens an empty, migrated
+// database, so every backend is held to the same behaviour.
+package dbtest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"minibank/dbutil"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Open returns an empty database with every migration applied. It is called
+// once per test, and should arrange its own clean-up with t.Cleanup.
+type Open func(t *testing.T) dbutil.Database
+
+// Run runs the whole suite against the databases open returns.
+func Run(t *testing.T, open Open) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, db dbutil.Database)
+	}{
+		{"Transfer", testTransfer},
+		{"TransferInsufficientFunds", testTransferInsufficientFunds},
+		{"TransferInactiveAccount", testTransferInactiveAccount},
+		{"TransferSameAccount", testTransferSameAccount},
+		{"TransferTooSmall", testTransferTooSmall},
+		{"TransferIdempotencyKey", testTransferIdempotencyKey},
+		{"ConcurrentTransfers", testConcurrentTransfers},
+		{"ConcurrentIdempotencyKey", testConcurrentIdempotencyKey},
+		{"TransferBatch", testTransferBatch},
+		{"TransferBatchRollback", testTransferBatchRollback},
+		{"Holds", testHolds},
+		{"Reverse", testReverse},
+		{"History", testHistory},
+		{"AccountBalanceAt", testAccountBalanceAt},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.test(t, open(t))
+		})
+	}
+}
+
+// phoneNumbers hands out the unique phone numbers customers need.
+var phoneNumbers atomic.Int64
+
+// NewCustomer stores a customer with a verified email address and a
+// checking account in currency, funded with dbutil.StimulusAmount.
+func NewCustomer(t *testing.T, db dbutil.Database, email, currency string) (*dbutil.Customer, *dbutil.Account) {
+	t.Helper()
+	ctx := context.Background()
+
+	now := time.Now().UTC()
+	customer := &dbutil.Customer{
+		First_name:         "Test",
+		Last_name:          email,
+		Email:              email,
+		Phone_number:       400000000 + int(phoneNumbers.Add(1)),
+		Encrypted_password: "",
+		Role:               dbutil.RoleCustomer,
+		Email_verified_at:  &now,
+		Created_at:         now,
+		Updated_at:         now,
+	}
+	account := &dbutil.Account{
+		Type:       dbutil.AccountChecking,
+		Balance:    dbutil.NewMoney(0, currency),
+		Held:       dbutil.NewMoney(0, currency),
+		Created_at: now,
+		Updated_at: now,
+		Status:     dbutil.StatusActive,
+	}
+	if err := db.CreateCustomer(ctx, customer, account); err != nil {
+		t.Fatalf("creating customer %s: %v", email, err)
+	}
+	Fund(t, db, account)
+	return customer, account
+}
+
+// Fund credits account with dbutil.StimulusAmount from the funding account.
+func Fund(t *testing.T, db dbutil.Database, account *dbutil.Account) {
+	t.Helper()
+	if err := stimulus(db, account); err != nil {
+		t.Fatalf("funding account %d: %v", account.Id, err)
+	}
+}
+
+// stimulus gives account the stimulus in a transaction of its own.
+func stimulus(db dbutil.Database, account *dbutil.Account) error {
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	err = db.Stimulus(ctx, tx, account)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Balance returns the ledger balance of account id.
+func Balance(t *testing.T, db dbutil.Database, id int) dbutil.Money {
+	t.Helper()
+	account, err := db.GetAccount(context.Background(), id)
+	if err != nil {
+		t.Fatalf("fetching account %d: %v", id, err)
+	}
+	return account.Balance
+}
+
+// Total returns the sum of every account balance in currency, which no
+// payment within that currency may change.
+func Total(t *testing.T, db dbutil.Database, currency string) dbutil.Money {
+	t.Helper()
+	total := dbutil.NewMoney(0, currency)
+	for _, account := range db.GetAccounts(context.Background()) {
+		if account.Currency() == currency {
+			total = total.Add(account.Balance)
+		}
+	}
+	return total
+}
+
+// CheckLedger fails t if the ledger does not balance.
+func CheckLedger(t *testing.T, db dbutil.Database) {
+	t.Helper()
+	if err := db.CheckLedger(context.Background()); err != nil {
+		t.Fatalf("ledger check: %v", err)
+	}
+}
+
+// aud returns an amount of Australian dollars in cents.
+func aud(cents int64) dbutil.Money {
+	return dbutil.NewMoney(cents, "AUD")
+}
+
+func key(k string) dbutil.IdempotencyKey {
+	return dbutil.IdempotencyKey{Key: k, ExpiresAt: time.Now().Add(time.Hour)}
+}
+
+func testTransfer(t *testing.T, db dbutil.Database) {
+	ctx := context.Background()
+	_, from := NewCustomer(t, db, "payer@example.com", "AUD")
+	_, to := NewCustomer(t, db, "payee@example.com", "AUD")
+	total := Total(t, db, "AUD")
+
+	id, err := db.Transfer(ctx, from.Id, to.Id, aud(1234), dbutil.IdempotencyKey{})
+	if err != nil {
+		t.Fatalf("Transfer: %v", err)
+	}
+	transaction, err := db.GetTransaction(ctx, id)
+	if err != nil {
+		t.Fatalf("GetTransaction: %v", err)
+	}
+	if transaction.FromAccount != from.Id || transaction.ToAccount != to.Id || transaction.Amount != aud(1234) ||
+		transaction.Status != dbutil.TransactionPosted || transaction.TransactionType != "Transfer" {
+		t.Errorf("transaction = %+v", transaction)
+	}
+
+	if got, want := Balance(t, db, from.Id), from.Balance.Sub(aud(1234)); got != want {
+		t.Errorf("payer balance = %v, want %v", got, want)
+	}
+	if got, want := Balance(t, db, to.Id), to.Balance.Add(aud(1234)); got != want {
+		t.Errorf("payee balance = %v, want %v", got, want)
+	}
+	if got := Total(t, db, "AUD"); got != total {
+		t.Errorf("total = %v, want %v", got, total)
+	}
+	CheckLedger(t, db)
+}
+
+func testTransferInsufficientFunds(t *testing.T, db dbutil.Database) {
+	ctx := context.Background()
+	_, from := NewCustomer(t, db, "payer@example.com", "AUD")
+	_, to := NewCustomer(t, db, "payee@example.com", "AUD")
+
+	_, err := db.Transfer(ctx, from.Id, to.Id, from.Balance.Add(aud(1)), dbutil.IdempotencyKey{})
+	if !errors.Is(err, dbutil.ErrInsufficientFunds) {
+		t.Fatalf("Transfer of more than the balance: err = %v, want ErrInsufficientFunds", err)
+	}
+	if got := Balance(t, db, from.Id); got != from.Balance {
+		t.Errorf("payer balance = %v, want %v", got, from.Balance)
+	}
+	if got := Balance(t, db, to.Id); got != to.Balance {
+		t.Errorf("payee balance = %v, want %v", got, to.Balance)
+	}
+	CheckLedger(t, db)
+}
+
+func testTransferInactiveAccount(t *testing.T, db dbutil.Database) {
+	ctx := context.Background()
+	_, from := NewCustomer(t, db, "payer@example.com", "AUD")
+	_, to := NewCustomer(t, db, "payee@example.com", "AUD")
+
+	if err := db.SetAccountStatus(ctx, to.Id, dbutil.StatusFrozen, "test", time.Now()); err != nil {
+		t.Fatalf("freezing account: %v", err)
+	}
+	_, err := db.Transfer(ctx, from.Id, to.Id, aud(100), dbutil.IdempotencyKey{})
+	if !errors.Is(err, dbutil.ErrAccountFrozen) {
+		t.Errorf("Transfer to a frozen account: err = %v, want ErrAccountFrozen", err)
+	}
+	_, err = db.Transfer(ctx, to.Id, from.Id, aud(100), dbutil.IdempotencyKey{})
+	if !errors.Is(err, dbutil.ErrAccountFrozen) {
+		t.Errorf("Transfer from a frozen account: err = %v, want ErrAccountFrozen", err)
+	}
+	if got := Balance(t, db, from.Id); got != from.Balance {
+		t.Errorf("payer balance = %v, want %v", got, from.Balance)
+	}
+
+	// Nor can a frozen or closed account be given the stimulus
+	if err := stimulus(db, to); !errors.Is(err, dbutil.ErrAccountFrozen) {
+		t.Errorf("Stimulus to a frozen account: err = %v, want ErrAccountFrozen", err)
+	}
+	_, empty := NewCustomer(t, db, "empty@example.com", "AUD")
+	if _, err := db.Transfer(ctx, empty.Id, from.Id, empty.Balance, dbutil.IdempotencyKey{}); err != nil {
+		t.Fatalf("emptying account: %v", err)
+	}
+	if err := db.SetAccountStatus(ctx, empty.Id, dbutil.StatusClosed, "test", time.Now()); err != nil {
+		t.Fatalf("closing account: %v", err)
+	}
+	if err := stimulus(db, empty); !errors.Is(err, dbutil.ErrAccountClosed) {
+		t.Errorf("Stimulus to a closed account: err = %v, want ErrAccountClosed", err)
+	}
+	if got := Balance(t, db, empty.Id); !got.IsZero() {
+		t.Errorf("closed account balance = %v, want 0", got)
+	}
+	CheckLedger(t, db)
+}
+
+func testTransferSameAccount(t *testing.T, db dbutil.Database) {
+	ctx := context.Background()
+	_, account := NewCustomer(t, db, "payer@example.com", "AUD")
+
+	_, err := db.Transfer(ctx, account.Id, account.Id, aud(100), dbutil.IdempotencyKey{})
+	if !errors.Is(err, dbutil.ErrSameAccount) {
+		t.Errorf("Transfer to the paying account: err = %v, want ErrSameAccount", err)
+	}
+	_, err = db.Authorize(ctx, account.Id, account.Id, aud(100), dbutil.IdempotencyKey{}, time.Now().Add(time.Hour))
+	if !errors.Is(err, dbutil.ErrSameAccount) {
+		t.Errorf("Authorize to the paying account: err = %v, want ErrSameAccount", err)
+	}
+	payments := []dbutil.BatchPayment{{ToAccount: account.Id, Amount: aud(100)}}
+	if err := db.TransferBatch(ctx, account.Id, payments); !errors.Is(err, dbutil.ErrSameAccount) {
+		t.Errorf("TransferBatch to the paying account: err = %v, want ErrSameAccount", err)
+	}
+	if got := Balance(t, db, account.Id); got != account.Balance {
+		t.Errorf("balance = %v, want %v", got, account.Balance)
+	}
+	CheckLedger(t, db)
+}
+
+// testTransferTooSmall checks that a payment crediting nothing, here one
+// that converts to less than half a cent, is refused rather than losing the
+// payer's money.
+func testTransferTooSmall(t *testing.T, db dbutil.Database) {
+	ctx := context.Background()
+	_, from := NewCustomer(t, db, "payer@example.com", "KRW")
+	_, to := NewCustomer(t, db, "payee@example.com", "USD")
+	err := db.SetExchangeRate(ctx, &dbutil.ExchangeRate{Base: "KRW", Quote: "USD", Rate: "0.00072", UpdatedAt: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 6 KRW is worth 0.432 US cents
+	_, err = db.Transfer(ctx, from.Id, to.Id, dbutil.NewMoney(6, "KRW"), dbutil.IdempotencyKey{})
+	if !errors.Is(err, dbutil.ErrAmountTooSmall) {
+		t.Errorf("Transfer of 6 KRW to USD: err = %v, want ErrAmountTooSmall", err)
+	}
+	_, err = db.Authorize(ctx, from.Id, to.Id, dbutil.NewMoney(6, "KRW"), dbutil.IdempotencyKey{}, time.Now().Add(time.Hour))
+	if !errors.Is(err, dbutil.ErrAmountTooSmall) {
+		t.Errorf("Authorize of 6 KRW to USD: err = %v, want ErrAmountTooSmall", err)
+	}
+	err = db.TransferBatch(ctx, from.Id, []dbutil.BatchPayment{{ToAccount: to.Id, Amount: dbutil.NewMoney(6, "KRW")}})
+	if !errors.Is(err, dbutil.ErrAmountTooSmall) {
+		t.Errorf("TransferBatch of 6 KRW to USD: err = %v, want ErrAmountTooSmall", err)
+	}
+	if got := Balance(t, db, from.Id); got != from.Balance {
+		t.Errorf("payer balance = %v, want %v", got, from.Balance)
+	}
+	if got := Balance(t, db, to.Id); got != to.Balance {
+		t.Errorf("payee balance = %v, want %v", got, to.Balance)
+	}
+
+	// 7 KRW is worth 0.504 cents, which rounds up to one
+	_, err = db.Transfer(ctx, from.Id, to.Id, dbutil.NewMoney(7, "KRW"), dbutil.IdempotencyKey{})
+	if err != nil {
+		t.Fatalf("Transfer of 7 KRW to USD: %v", err)
+	}
+	if got, want := Balance(t, db, to.Id), to.Balance.Add(dbutil.NewMoney(1, "USD")); got != want {
+		t.Errorf("payee balance = %v, want %v", got, want)
+	}
+	CheckLedger(t, db)
+}
+
+func testTransferIdempotencyKey(t *testing.T, db dbutil.Database) {
+	ctx := context.Background()
+	_, from := NewCustomer(t, db, "payer@example.com", "AUD")
+	_, to := NewCustomer(t, db, "payee@example.com", "AUD")
+
+	first, err := db.Transfer(ctx, from.Id, to.Id, aud(500), key("k1"))
+	if err != nil {
+		t.Fatalf("Transfer: %v", err)
+	}
+	again, err := db.Transfer(ctx, from.Id, to.Id, aud(500), key("k1"))
+	if err != nil {
+		t.Fatalf("Transfer retried: %v", err)
+	}
+	if again != first {
+		t.Errorf("retried Transfer made transaction %d, want %d", again, first)
+	}
+	if got, want := Balance(t, db, from.Id), from.Balance.Sub(aud(500)); got != want {
+		t.Errorf("payer balance = %v, want %v", got, want)
+	}
+
+	_, err = db.Transfer(ctx, from.Id, to.Id, aud(600), key("k1"))
+	if !errors.Is(err, dbutil.ErrIdempotencyKeyReused) {
+		t.Errorf("Transfer of another amount with the same key: err = %v, want ErrIdempotencyKeyReused", err)
+	}
+	CheckLedger(t, db)
+}
+
+// testConcurrentTransfers pays out more than an account holds from many
+// goroutines at once. Exactly as many payments as the balance covers must
+// go through, and no money may appear or disappear.
+func testConcurrentTransfers(t *testing.T, db dbutil.Database) {
+	ctx := context.Background()
+	_, from := NewCustomer(t, db, "payer@example.com", "AUD")
+	var payees []*dbutil.Account
+	for i := 0; i < 4; i++ {
+		_, to := NewCustomer(t, db, fmt.Sprintf("payee%d@example.com", i), "AUD")
+		payees = append(payees, to)
+	}
+	total := Total(t, db, "AUD")
+
+	// Each payment is a quarter of the balance, so only 4 of them fit
+	amount := dbutil.NewMoney(from.Balance.Minor/4, "AUD")
+	const payments = 20
+	var paid, refused atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < payments; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := db.Transfer(ctx, from.Id, payees[i%len(payees)].Id, amount, dbutil.IdempotencyKey{})
+			switch {
+			case err == nil:
+				paid.Add(1)
+			case errors.Is(err, dbutil.ErrInsufficientFunds):
+				refused.Add(1)
+			default:
+				t.Errorf("Transfer: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if paid.Load() != 4 || refused.Load() != payments-4 {
+		t.Errorf("%d payments made and %d refused, want 4 and %d", paid.Load(), refused.Load(), payments-4)
+	}
+	if got, want := Balance(t, db, from.Id), from.Balance.Sub(dbutil.NewMoney(4*amount.Minor, "AUD")); got != want {
+		t.Errorf("payer balance = %v, want %v", got, want)
+	}
+	if got := Total(t, db, "AUD"); got != total {
+		t.Errorf("total = %v, want %v", got, total)
+	}
+	CheckLedger(t, db)
+}
+
+// testConcurrentIdempotencyKey retries one payment from many goroutines at
+// once. Every retry must get the same transaction back.
+func testConcurrentIdempotencyKey(t *testing.T, db dbutil.Database) {
+	ctx := context.Background()
+	_, from := NewCustomer(t, db, "payer@example.com", "AUD")
+	_, to := NewCustomer(t, db, "payee@example.com", "AUD")
+
+	const retries = 10
+	ids := make([]int, retries)
+	var wg sync.WaitGroup
+	for i := range ids {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var err error
+			ids[i], err = db.Transfer(ctx, from.Id, to.Id, aud(700), key("same"))
+			if err != nil {
+				t.Errorf("Transfer: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for i, id := range ids {
+		if id != ids[0] {
+			t.Errorf("retry %d made transaction %d, want %d", i, id, ids[0])
+		}
+	}
+	if got, want := Balance(t, db, from.Id), from.Balance.Sub(aud(700)); got != want {
+		t.Errorf("payer balance = %v, want %v", got, want)
+	}
+	CheckLedger(t, db)
+}
+
+func testTransferBatch(t *testing.T, db dbutil.Database) {
+	ctx := context.Background()
+	_, from := NewCustomer(t, db, "payer@example.com", "AUD")
+	_, first := NewCustomer(t, db, "first@example.com", "AUD")
+	_, second := NewCustomer(t, db, "second@example.com", "AUD")
+
+	batch := func() []dbutil.BatchPayment {
+		return []dbutil.BatchPayment{
+			{ToAccount: first.Id, Amount: aud(100), Reference: "Invoice 1", Key: key("batch:1")},
+			{ToAccount: second.Id, Amount: aud(200), Reference: "Invoice 2", Key: key("batch:2")},
+		}
+	}
+	payments := batch()
+	if err := db.TransferBatch(ctx, from.Id, payments); err != nil {
+		t.Fatalf("TransferBatch: %v", err)
+	}
+	for i, payment := range payments {
+		transaction, err := db.GetTransaction(ctx, payment.TransactionId)
+		if err != nil {
+			t.Fatalf("payment %d: GetTransaction: %v", i, err)
+		}
+		if transaction.ToAccount != payment.ToAccount || transaction.Amount != payment.Amount || transaction.Reference != payment.Reference {
+			t.Errorf("payment %d: transaction = %+v", i, transaction)
+		}
+	}
+
+	// Retrying the batch makes nothing new
+	retried := batch()
+	if err := db.TransferBatch(ctx, from.Id, retried); err != nil {
+		t.Fatalf("TransferBatch retried: %v", err)
+	}
+	for i := range retried {
+		if retried[i].TransactionId != payments[i].TransactionId {
+			t.Errorf("retried payment %d made transaction %d, want %d", i, retried[i].TransactionId, payments[i].TransactionId)
+		}
+	}
+	if got, want := Balance(t, db, from.Id), from.Balance.Sub(aud(300)); got != want {
+		t.Errorf("payer balance = %v, want %v", got, want)
+	}
+	CheckLedger(t, db)
+}
+
+// testTransferBatchRollback makes a batch whose last payment cannot be made,
+// which must leave every account as it was and say which payment failed.
+func testTransferBatchRollback(t *testing.T, db dbutil.Database) {
+	ctx := context.Background()
+	_, from := NewCustomer(t, db, "payer@example.com", "AUD")
+	_, to := NewCustomer(t, db, "payee@example.com", "AUD")
+	total := Total(t, db, "AUD")
+
+	payments := []dbutil.BatchPayment{
+		{ToAccount: to.Id, Amount: aud(100), Key: key("batch:1")},
+		{ToAccount: to.Id, Amount: aud(200), Key: key("batch:2")},
+		{ToAccount: to.Id, Amount: from.Balance, Key: key("batch:3")},
+	}
+	err := db.TransferBatch(ctx, from.Id, payments)
+	var batchErr *dbutil.BatchError
+	if !errors.As(err, &batchErr) {
+		t.Fatalf("TransferBatch: err = %v, want a *dbutil.BatchError", err)
+	}
+	if batchErr.Index != 2 || !errors.Is(err, dbutil.ErrInsufficientFunds) {
+		t.Errorf("TransferBatch: err = %v with index %d, want ErrInsufficientFunds at index 2", err, batchErr.Index)
+	}
+	for i, payment := range payments {
+		if payment.TransactionId != 0 {
+			t.Errorf("payment %d has transaction %d after the batch failed", i, payment.TransactionId)
+		}
+	}
+	if got := Balance(t, db, from.Id); got != from.Balance {
+		t.Errorf("payer balance = %v, want %v", got, from.Balance)
+	}
+	if got := Total(t, db, "AUD"); got != total {
+		t.Errorf("total = %v, want %v", got, total)
+	}
+
+	// The keys of the payments that were undone are free to use again
+	payments = payments[:2]
+	if err := db.TransferBatch(ctx, from.Id, payments); err != nil {
+		t.Fatalf("TransferBatch of the payments that fit: %v", err)
+	}
+	if got, want := Balance(t, db, from.Id), from.Balance.Sub(aud(300)); got != want {
+		t.Errorf("payer balance = %v, want %v", got, want)
+	}
+	CheckLedger(t, db)
+}
+
+func testHolds(t *testing.T, db dbutil.Database) {
+	ctx := context.Background()
+	_, from := NewCustomer(t, db, "payer@example.com", "AUD")
+	_, to := NewCustomer(t, db, "payee@example.com", "AUD")
+	now := time.Now()
+
+	captured, err := db.Authorize(ctx, from.Id, to.Id, aud(300), dbutil.IdempotencyKey{}, now.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("Authorize: %v", err)
+	}
+	voided, err := db.Authorize(ctx, from.Id, to.Id, aud(200), dbutil.IdempotencyKey{}, now.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("Authorize: %v", err)
+	}
+	account, err := db.GetAccount(ctx, from.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if account.Balance != from.Balance || account.Held != aud(500) {
+		t.Errorf("after holds balance = %v and held = %v, want %v and 5.00", account.Balance, account.Held, from.Balance)
+	}
+	CheckLedger(t, db)
+
+	if err := db.CaptureHold(ctx, captured, now); err != nil {
+		t.Fatalf("CaptureHold: %v", err)
+	}
+	if err := db.VoidHold(ctx, voided, now); err != nil {
+		t.Fatalf("VoidHold: %v", err)
+	}
+	if err := db.CaptureHold(ctx, voided, now); !errors.Is(err, dbutil.ErrNotPending) {
+		t.Errorf("CaptureHold of a voided hold: err = %v, want ErrNotPending", err)
+	}
+
+	account, err = db.GetAccount(ctx, from.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := from.Balance.Sub(aud(300)); account.Balance != want || !account.Held.IsZero() {
+		t.Errorf("after capture balance = %v and held = %v, want %v and 0", account.Balance, account.Held, want)
+	}
+	if got, want := Balance(t, db, to.Id), to.Balance.Add(aud(300)); got != want {
+		t.Errorf("payee balance = %v, want %v", got, want)
+	}
+	CheckLedger(t, db)
+}
+
+func testReverse(t *testing.T, db dbutil.Database) {
+	ctx := context.Background()
+	_, from := NewCustomer(t, db, "payer@example.com", "AUD")
+	_, to := NewCustomer(t, db, "payee@example.com", "AUD")
+
+	id, err := db.Transfer(ctx, from.Id, to.Id, aud(1000), dbutil.IdempotencyKey{})
+	if err != nil {
+		t.Fatalf("Transfer: %v", err)
+	}
+	refund, err := db.Reverse(ctx, id, aud(400), dbutil.IdempotencyKey{})
+	if err != nil {
+		t.Fatalf("Reverse: %v", err)
+	}
+	if _, err := db.Reverse(ctx, id, aud(601), dbutil.IdempotencyKey{}); !errors.Is(err, dbutil.ErrRefundTooLarge) {
+		t.Errorf("Reverse of more than is left: err = %v, want ErrRefundTooLarge", err)
+	}
+
+	refunds, err := db.ListReversals(ctx, id)
+	if err != nil {
+		t.Fatalf("ListReversals: %v", err)
+	}
+	if len(refunds) != 1 || refunds[0].Id != refund || refunds[0].Reverses != id || refunds[0].FromAccount != to.Id {
+		t.Errorf("refunds = %+v", refunds)
+	}
+	if got, want := Balance(t, db, from.Id), from.Balance.Sub(aud(600)); got != want {
+		t.Errorf("payer balance = %v, want %v", got, want)
+	}
+	CheckLedger(t, db)
+}
+
+func testHistory(t *testing.T, db dbutil.Database) {
+	ctx := context.Background()
+	_, account := NewCustomer(t, db, "payer@example.com", "AUD")
+	_, other := NewCustomer(t, db, "payee@example.com", "AUD")
+
+	for i := int64(1); i <= 5; i++ {
+		if _, err := db.Transfer(ctx, account.Id, other.Id, aud(i*100), dbutil.IdempotencyKey{}); err != nil {
+			t.Fatalf("Transfer: %v", err)
+		}
+	}
+	if _, err := db.Transfer(ctx, other.Id, account.Id, aud(50), dbutil.IdempotencyKey{}); err != nil {
+		t.Fatalf("Transfer: %v", err)
+	}
+
+	// Paging through the history two at a time gives every transaction once,
+	// the stimulus included, in order
+	for _, sort := range dbutil.Sorts {
+		filter := dbutil.TransactionFilter{AccountId: account.Id, Sort: sort, Limit: 2}
+		var seen []dbutil.Transaction
+		for {
+			page, err := db.ListTransactionsFromAccount(ctx, filter)
+			if err != nil {
+				t.Fatalf("ListTransactionsFromAccount(%s): %v", sort, err)
+			}
+			seen = append(seen, page.Transactions...)
+			if page.NextCursor == "" {
+				break
+			}
+			filter.After = page.NextCursor
+		}
+		all, err := db.ListTransactionsFromAccount(ctx, dbutil.TransactionFilter{AccountId: account.Id, Sort: sort})
+		if err != nil {
+			t.Fatalf("ListTransactionsFromAccount(%s): %v", sort, err)
+		}
+		if len(seen) != 7 || len(all.Transactions) != 7 {
+			t.Fatalf("sort %s: paged through %d transactions and listed %d, want 7", sort, len(seen), len(all.Transactions))
+		}
+		for i := range seen {
+			if seen[i].Id != all.Transactions[i].Id {
+				t.Errorf("sort %s: transaction %d is %d paged and %d listed", sort, i, seen[i].Id, all.Transactions[i].Id)
+			}
+		}
+	}
+
+	page, err := db.ListTransactionsFromAccount(ctx, dbutil.TransactionFilter{
+		AccountId: account.Id, Direction: dbutil.DirectionOut, MinAmount: &[]dbutil.Money{aud(300)}[0],
+	})
+	if err != nil {
+		t.Fatalf("ListTransactionsFromAccount: %v", err)
+	}
+	if len(page.Transactions) != 3 {
+		t.Errorf("payments out of at least 3.00: got %d, want 3", len(page.Transactions))
+	}
+}
+
+func testAccountBalanceAt(t *testing.T, db dbutil.Database) {
+	ctx := context.Background()
+	_, account := NewCustomer(t, db, "payer@example.com", "AUD")
+	_, other := NewCustomer(t, db, "payee@example.com", "AUD")
+
+	if _, err := db.Transfer(ctx, account.Id, other.Id, aud(250), dbutil.IdempotencyKey{}); err != nil {
+		t.Fatalf("Transfer: %v", err)
+	}
+	// A hold made before the moment but captured after it counts from the
+	// capture
+	hold, err := db.Authorize(ctx, account.Id, other.Id, aud(40), dbutil.IdempotencyKey{}, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("Authorize: %v", err)
+	}
+	// Stored times may be rounded, so leave a margin either side
+	time.Sleep(10 * time.Millisecond)
+	between := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	if _, err := db.Transfer(ctx, account.Id, other.Id, aud(100), dbutil.IdempotencyKey{}); err != nil {
+		t.Fatalf("Transfer: %v", err)
+	}
+	if err := db.CaptureHold(ctx, hold, time.Now()); err != nil {
+		t.Fatalf("CaptureHold: %v", err)
+	}
+
+	got, err := db.AccountBalanceAt(ctx, account.Id, between)
+	if err != nil {
+		t.Fatalf("AccountBalanceAt: %v", err)
+	}
+	if want := account.Balance.Sub(aud(250)); got != want {
+		t.Errorf("balance between the payments = %v, want %v", got, want)
+	}
+	got, err = db.AccountBalanceAt(ctx, account.Id, time.Now().Add(time.Second))
+	if err != nil {
+		t.Fatalf("AccountBalanceAt: %v", err)
+	}
+	if want := Balance(t, db, account.Id); got != want {
+		t.Errorf("balance now = %v, want %v", got, want)
+	}
+
+	// The settled history after the moment has the later payment and the
+	// captured hold, in the order they settled
+	page, err := db.ListTransactionsFromAccount(ctx, dbutil.TransactionFilter{
+		AccountId: account.Id, Since: &between, Settled: true, Sort: dbutil.SortOldest,
+	})
+	if err != nil {
+		t.Fatalf("ListTransactionsFromAccount: %v", err)
+	}
+	if len(page.Transactions) != 2 || page.Transactions[0].Amount != aud(100) || page.Transactions[1].Id != hold {
+		t.Errorf("settled since the moment = %+v, want the payment of 1.00 then hold %d", page.Transactions, hold)
+	}
+
+	// A payment from the account to itself, which older versions allowed,
+	// leaves the balance as it was
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	if err := db.MakeTransaction(ctx, tx, dbutil.NewTransaction(account.Id, account.Id, aud(500), "Transfer")); err != nil {
+		t.Fatalf("MakeTransaction: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	before := got
+	got, err = db.AccountBalanceAt(ctx, account.Id, time.Now().Add(time.Second))
+	if err != nil {
+		t.Fatalf("AccountBalanceAt: %v", err)
+	}
+	if got != before {
+		t.Errorf("balance after a payment to itself = %v, want %v", got, before)
+	}
+}
@@ -0,0 +1,52 @@
+package dbutil
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Email token purposes. A token only works for the purpose it was issued
+// for.
+const (
+	TokenPasswordReset     = "password_reset"
+	TokenEmailVerification = "email_verification"
+)
+
+// ErrEmailTokenNotFound is returned for a token that is unknown, expired,
+// already used or issued for another purpose.
+var ErrEmailTokenNotFound = errors.New("email token not found")
+
+// EmailToken is a single-use token sent by email to prove the recipient
+// controls the address. As with API keys, only a hash of the token is
+// stored.
+type EmailToken struct {
+	Id         int        `json:"id"`
+	CustomerId int        `json:"customer_id"`
+	Purpose    string     `json:"purpose"`
+	TokenHash  string     `json:"-"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	UsedAt     *time.Time `json:"used_at,omitempty"`
+}
+
+// NewEmailToken generates a token for purpose that expires after ttl and
+// returns it along with the token to send.
+func NewEmailToken(customerId int, purpose string, now time.Time, ttl time.Duration) (*EmailToken, string, error) {
+	secret := make([]byte, 32)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return nil, "", fmt.Errorf("error generating email token: %w", err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(secret)
+
+	return &EmailToken{
+		CustomerId: customerId,
+		Purpose:    purpose,
+		TokenHash:  HashAPIToken(token),
+		CreatedAt:  now,
+		ExpiresAt:  now.Add(ttl),
+	}, token, nil
+}
@@ -0,0 +1,155 @@
+package dbutil
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+)
+
+// Which way money moved, as seen from the account whose history is listed.
+const (
+	DirectionIn  = "in"
+	DirectionOut = "out"
+)
+
+// Orders a transaction history can be listed in. Ties are broken by id, so
+// the order is total and a cursor never skips or repeats a transaction.
+const (
+	SortNewest   = "newest"
+	SortOldest   = "oldest"
+	SortLargest  = "largest"
+	SortSmallest = "smallest"
+)
+
+// Sorts lists every valid sort order, the default first.
+var Sorts = []string{SortNewest, SortOldest, SortLargest, SortSmallest}
+
+// ValidSort reports whether sort is one of Sorts.
+func ValidSort(sort string) bool {
+	for _, s := range Sorts {
+		if s == sort {
+			return true
+		}
+	}
+	return false
+}
+
+// ErrInvalidCursor is returned for a cursor that was not made by
+// TransactionPage for the same sort order.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// TransactionFilter picks which of an account's transactions to list and in
+// what order. The zero value of each field leaves it out, so a filter with
+// only AccountId set lists the whole history, newest first.
+//
+// Amounts are compared with the amount as seen from the account, see
+// Transaction.AmountFor, so they are in the account's currency. Counterparty
+// matches part of the other account's nickname or its owner's name, email or
+// phone number, or the other account's id in full.
+//
+// Settled lists only posted transactions and dates them by when they were
+// settled rather than made, for Since, Until and the date orders, as a
+// statement does: a hold captured after the end of a period belongs to the
+// next one.
+type TransactionFilter struct {
+	AccountId    int
+	Since        *time.Time // created, or settled, at or after
+	Until        *time.Time // created, or settled, before
+	MinAmount    *Money
+	MaxAmount    *Money
+	Counterparty string
+	Direction    string
+	Type         string
+	Status       string
+	Settled      bool
+	Sort         string
+	// After is the NextCursor of the previous page, or "" for the first.
+	After string
+	// Limit is the most transactions to return; 0 returns them all.
+	Limit int
+}
+
+// SortOrder returns f.Sort, or the default order if it is unset.
+func (f *TransactionFilter) SortOrder() string {
+	if f.Sort == "" {
+		return SortNewest
+	}
+	return f.Sort
+}
+
+// CounterpartyId returns the account id Counterparty names, if it is a
+// number.
+func (f *TransactionFilter) CounterpartyId() (int, bool) {
+	id, err := strconv.Atoi(f.Counterparty)
+	return id, err == nil
+}
+
+// TransactionPage is one page of a transaction history. NextCursor is ""
+// on the last page.
+type TransactionPage struct {
+	Transactions []Transaction
+	NextCursor   string
+}
+
+// HistoryCursor is the position after the last transaction of a page: its
+// sort key, CreatedAt (the settlement time in a settled history) or Amount
+// depending on the order, and its id.
+type HistoryCursor struct {
+	Sort      string    `json:"s"`
+	CreatedAt time.Time `json:"t,omitempty"`
+	Amount    int64     `json:"a,omitempty"`
+	Id        int       `json:"i"`
+}
+
+// NewHistoryCursor returns the cursor after t in a history of accountId
+// listed in sort order, dated by settlement if settled is set.
+func NewHistoryCursor(sort string, accountId int, settled bool, t *Transaction) HistoryCursor {
+	cursor := HistoryCursor{Sort: sort, Id: t.Id}
+	if sort == SortLargest || sort == SortSmallest {
+		cursor.Amount = t.AmountFor(accountId).Minor
+	} else if settled && t.SettledAt != nil {
+		cursor.CreatedAt = *t.SettledAt
+	} else {
+		cursor.CreatedAt = t.CreatedAt
+	}
+	return cursor
+}
+
+// String encodes the cursor for use in a URL. Clients treat it as opaque.
+func (c HistoryCursor) String() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// ParseHistoryCursor decodes a cursor made by HistoryCursor.String for a
+// history listed in sort order.
+func ParseHistoryCursor(s, sort string) (HistoryCursor, error) {
+	var cursor HistoryCursor
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return cursor, ErrInvalidCursor
+	}
+	if err := json.Unmarshal(data, &cursor); err != nil {
+		return cursor, ErrInvalidCursor
+	}
+	if cursor.Sort != sort || cursor.Id <= 0 {
+		return cursor, ErrInvalidCursor
+	}
+	return cursor, nil
+}
+
+// NewTransactionPage makes a page of the history f lists from transactions,
+// the rows the query returned. Backends ask for one row more than f.Limit;
+// if it came back there is another page, which starts after the last
+// transaction kept.
+func NewTransactionPage(f *TransactionFilter, transactions []Transaction) *TransactionPage {
+	page := &TransactionPage{Transactions: transactions}
+	if f.Limit > 0 && len(transactions) > f.Limit {
+		page.Transactions = transactions[:f.Limit]
+		last := &page.Transactions[f.Limit-1]
+		page.NextCursor = NewHistoryCursor(f.SortOrder(), f.AccountId, f.Settled, last).String()
+	}
+	return page
+}
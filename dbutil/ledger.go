@@ -0,0 +1,36 @@
+package dbutil
+
+import (
+	"errors"
+	"time"
+)
+
+// FundingAccountEmail identifies the system customer whose accounts, one per
+// currency, money enters the bank from (opening balances, stimulus payments)
+// and that currency conversions pass through. Their balances are allowed to
+// go negative, and each always equals minus the money held by everyone else
+// in its currency.
+const FundingAccountEmail = "funding@minibank.internal"
+
+// ErrLedgerUnbalanced is returned by Database.CheckLedger when the journal no
+// longer sums to zero in some currency or an account balance disagrees with
+// its entries.
+var ErrLedgerUnbalanced = errors.New("ledger is unbalanced")
+
+// ErrInsufficientFunds is returned when a debit would take an account below
+// zero.
+var ErrInsufficientFunds = errors.New("insufficient funds")
+
+// LedgerEntry is one side of a posting, in the currency of its account.
+// Every transaction writes a debit (negative amount) against the paying
+// account and a matching credit (positive amount) against the receiving
+// account, with converted payments passing through the bank's accounts in
+// between, so the entries of a transaction sum to zero in each currency; see
+// Transaction.Entries.
+type LedgerEntry struct {
+	Id            int       `json:"id"`
+	TransactionId int       `json:"transaction_id"`
+	AccountId     int       `json:"account_id"`
+	Amount        Money     `json:"amount"`
+	CreatedAt     time.Time `json:"created_at"`
+}
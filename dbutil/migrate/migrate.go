@@ -0,0 +1,271 @@
+// Package migrate applies numbered schema migrations embedded in the database
+// backends and records them in a schema_migrations table.
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Dialect selects the placeholder syntax used for the bookkeeping queries.
+type Dialect int
+
+const (
+	SQLite Dialect = iota
+	Postgres
+)
+
+// Migration is one numbered schema change, loaded from a pair of files named
+// <version>_<name>.up.sql and <version>_<name>.down.sql.
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Status reports whether a migration has been applied, and when.
+type Status struct {
+	Migration
+	Applied   bool
+	AppliedAt time.Time
+}
+
+type Migrator struct {
+	db         *sql.DB
+	dialect    Dialect
+	migrations []Migration
+}
+
+var fileName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// Load reads every migration in dir of fsys, ordered by version. Each version
+// must have both an up and a down file.
+func Load(fsys fs.FS, dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading migrations: %w", err)
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		match := fileName.FindStringSubmatch(entry.Name())
+		if match == nil {
+			continue
+		}
+		version, _ := strconv.Atoi(match[1])
+		body, err := fs.ReadFile(fsys, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("error reading migration %s: %w", entry.Name(), err)
+		}
+
+		migration, ok := byVersion[version]
+		if !ok {
+			migration = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = migration
+		}
+		if migration.Name != match[2] {
+			return nil, fmt.Errorf("migration %d has two names: %s and %s", version, migration.Name, match[2])
+		}
+		if match[3] == "up" {
+			migration.Up = string(body)
+		} else {
+			migration.Down = string(body)
+		}
+	}
+
+	var migrations []Migration
+	for _, migration := range byVersion {
+		if migration.Up == "" || migration.Down == "" {
+			return nil, fmt.Errorf("migration %d_%s needs both an up and a down file", migration.Version, migration.Name)
+		}
+		migrations = append(migrations, *migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// New loads the migrations in dir of fsys for db.
+func New(db *sql.DB, dialect Dialect, fsys fs.FS, dir string) (*Migrator, error) {
+	migrations, err := Load(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{db: db, dialect: dialect, migrations: migrations}, nil
+}
+
+// placeholders returns the bind parameters for n arguments in the dialect.
+func (m *Migrator) placeholders(n int) []interface{} {
+	marks := make([]interface{}, n)
+	for i := range marks {
+		if m.dialect == Postgres {
+			marks[i] = "$" + strconv.Itoa(i+1)
+		} else {
+			marks[i] = "?"
+		}
+	}
+	return marks
+}
+
+func (m *Migrator) ensureTable(ctx context.Context) error {
+	_, err := m.db.ExecContext(ctx, `
+	CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at TIMESTAMP NOT NULL
+	)`)
+	if err != nil {
+		return fmt.Errorf("error creating schema_migrations: %w", err)
+	}
+	return nil
+}
+
+// TableExists reports whether schema_migrations has been created yet, which
+// lets a backend recognise databases created before migrations existed.
+func (m *Migrator) TableExists(ctx context.Context) (bool, error) {
+	query := "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'schema_migrations'"
+	if m.dialect == Postgres {
+		query = "SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = current_schema() AND table_name = 'schema_migrations'"
+	}
+	var count int
+	err := m.db.QueryRowContext(ctx, query).Scan(&count)
+	if err != nil {
+		return false, fmt.Errorf("error looking for schema_migrations: %w", err)
+	}
+	return count > 0, nil
+}
+
+func (m *Migrator) applied(ctx context.Context) (map[int]time.Time, error) {
+	err := m.ensureTable(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := m.db.QueryContext(ctx, "SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, fmt.Errorf("error reading schema_migrations: %w", err)
+	}
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, fmt.Errorf("error scanning schema_migrations: %w", err)
+		}
+		applied[version] = appliedAt
+	}
+	return applied, rows.Err()
+}
+
+// Status lists every known migration in order.
+func (m *Migrator) Status(ctx context.Context) ([]Status, error) {
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]Status, len(m.migrations))
+	for i, migration := range m.migrations {
+		appliedAt, ok := applied[migration.Version]
+		statuses[i] = Status{Migration: migration, Applied: ok, AppliedAt: appliedAt}
+	}
+	return statuses, nil
+}
+
+// Up applies every pending migration in order, each in its own transaction,
+// and returns how many ran.
+func (m *Migrator) Up(ctx context.Context) (int, error) {
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, migration := range m.migrations {
+		if _, ok := applied[migration.Version]; ok {
+			continue
+		}
+		insert := fmt.Sprintf("INSERT INTO schema_migrations (version, name, applied_at) VALUES (%s, %s, %s)", m.placeholders(3)...)
+		err := m.run(ctx, migration.Up, insert, migration.Version, migration.Name, time.Now().UTC())
+		if err != nil {
+			return count, fmt.Errorf("error applying migration %d_%s: %w", migration.Version, migration.Name, err)
+		}
+		count++
+	}
+	return count, nil
+}
+
+// Down reverts the most recently applied migration. It returns false if
+// nothing was applied.
+func (m *Migrator) Down(ctx context.Context) (bool, error) {
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	for i := len(m.migrations) - 1; i >= 0; i-- {
+		migration := m.migrations[i]
+		if _, ok := applied[migration.Version]; !ok {
+			continue
+		}
+		remove := fmt.Sprintf("DELETE FROM schema_migrations WHERE version = %s", m.placeholders(1)...)
+		err := m.run(ctx, migration.Down, remove, migration.Version)
+		if err != nil {
+			return false, fmt.Errorf("error reverting migration %d_%s: %w", migration.Version, migration.Name, err)
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// Baseline records every migration up to and including version as applied
+// without running it, for databases whose schema was created by hand.
+func (m *Migrator) Baseline(ctx context.Context, version int) error {
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, migration := range m.migrations {
+		if migration.Version > version {
+			break
+		}
+		if _, ok := applied[migration.Version]; ok {
+			continue
+		}
+		insert := fmt.Sprintf("INSERT INTO schema_migrations (version, name, applied_at) VALUES (%s, %s, %s)", m.placeholders(3)...)
+		_, err := m.db.ExecContext(ctx, insert, migration.Version, migration.Name, time.Now().UTC())
+		if err != nil {
+			return fmt.Errorf("error recording migration %d_%s: %w", migration.Version, migration.Name, err)
+		}
+	}
+	return nil
+}
+
+// run executes a migration script and its bookkeeping statement atomically.
+func (m *Migrator) run(ctx context.Context, script, bookkeeping string, args ...interface{}) error {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, script)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, bookkeeping, args...)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
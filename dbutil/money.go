@@ -0,0 +1,158 @@
+package dbutil
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// DefaultCurrency is the currency of accounts opened without choosing one,
+// and of amounts stored before accounts carried their own.
+const DefaultCurrency = "AUD"
+
+// Money is an amount held as an integer number of minor units (cents for
+// AUD, yen for JPY) together with its ISO 4217 currency code.
+type Money struct {
+	Minor    int64  `json:"minor"`
+	Currency string `json:"currency"`
+}
+
+func NewMoney(minor int64, currency string) Money {
+	return Money{Minor: minor, Currency: currency}
+}
+
+// ParseMoney parses a decimal string such as "12", "12.5" or "-0.05" into
+// Money without going through float64. It allows as many decimal places as
+// the currency has.
+func ParseMoney(s, currency string) (Money, error) {
+	exponent := Exponent(currency)
+
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return Money{}, fmt.Errorf("invalid amount: empty")
+	}
+
+	negative := false
+	switch s[0] {
+	case '-':
+		negative = true
+		s = s[1:]
+	case '+':
+		s = s[1:]
+	}
+
+	whole, frac, hasFrac := strings.Cut(s, ".")
+	if whole == "" && frac == "" {
+		return Money{}, fmt.Errorf("invalid amount: %q", s)
+	}
+	if hasFrac && len(frac) > exponent {
+		return Money{}, fmt.Errorf("invalid amount %q: at most %d decimal places allowed in %s", s, exponent, currency)
+	}
+	for _, r := range whole + frac {
+		if r < '0' || r > '9' {
+			return Money{}, fmt.Errorf("invalid amount: %q", s)
+		}
+	}
+
+	scale := pow10(exponent)
+	var units int64
+	if whole != "" {
+		n, err := strconv.ParseInt(whole, 10, 64)
+		if err != nil || n > math.MaxInt64/scale-1 {
+			return Money{}, fmt.Errorf("invalid amount: %q", s)
+		}
+		units = n * scale
+	}
+	for len(frac) < exponent {
+		frac += "0"
+	}
+	if frac != "" {
+		minor, _ := strconv.ParseInt(frac, 10, 64)
+		units += minor
+	}
+
+	if negative {
+		units = -units
+	}
+	return Money{Minor: units, Currency: currency}, nil
+}
+
+// String formats the amount as a plain decimal with as many decimal places
+// as its currency has, e.g. "1234.50" for AUD or "1234" for JPY.
+func (m Money) String() string {
+	sign := ""
+	minor := m.Minor
+	if minor < 0 {
+		sign = "-"
+		minor = -minor
+	}
+	exponent := Exponent(m.Currency)
+	if exponent == 0 {
+		return fmt.Sprintf("%s%d", sign, minor)
+	}
+	scale := pow10(exponent)
+	return fmt.Sprintf("%s%d.%0*d", sign, minor/scale, exponent, minor%scale)
+}
+
+func (m Money) IsPositive() bool {
+	return m.Minor > 0
+}
+
+func (m Money) IsNegative() bool {
+	return m.Minor < 0
+}
+
+func (m Money) IsZero() bool {
+	return m.Minor == 0
+}
+
+func (m Money) Add(o Money) Money {
+	return Money{Minor: m.Minor + o.Minor, Currency: m.Currency}
+}
+
+func (m Money) Sub(o Money) Money {
+	return Money{Minor: m.Minor - o.Minor, Currency: m.Currency}
+}
+
+func (m Money) LessThan(o Money) bool {
+	return m.Minor < o.Minor
+}
+
+// Value stores Money as its integer minor units.
+func (m Money) Value() (driver.Value, error) {
+	return m.Minor, nil
+}
+
+// Scan reads minor units from an INTEGER column. REAL values are only
+// expected from rows written before the cents migration and are rounded.
+func (m *Money) Scan(src interface{}) error {
+	if m.Currency == "" {
+		m.Currency = DefaultCurrency
+	}
+	switch v := src.(type) {
+	case int64:
+		m.Minor = v
+	case float64:
+		m.Minor = int64(math.Round(v))
+	case []byte:
+		return m.scanString(string(v))
+	case string:
+		return m.scanString(v)
+	case nil:
+		m.Minor = 0
+	default:
+		return fmt.Errorf("cannot scan %T into Money", src)
+	}
+	return nil
+}
+
+func (m *Money) scanString(s string) error {
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return fmt.Errorf("cannot scan %q into Money: %w", s, err)
+	}
+	m.Minor = n
+	return nil
+}
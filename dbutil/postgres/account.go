@@ -0,0 +1,158 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"minibank/dbutil"
+	"time"
+)
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// accountColumns lists the columns scanAccount expects, in order.
+const accountColumns = "id, customer_id, type, nickname, balance, held, currency, created_at, updated_at, status, status_reason, status_changed_at"
+
+// scanAccount scans a full account row.
+func scanAccount(row scanner, account *dbutil.Account) error {
+	var statusChangedAt sql.NullTime
+	var currency string
+	err := row.Scan(&account.Id, &account.Customer_id, &account.Type, &account.Nickname, &account.Balance, &account.Held, &currency, &account.Created_at, &account.Updated_at, &account.Status, &account.Status_reason, &statusChangedAt)
+	if err != nil {
+		return err
+	}
+	account.Balance.Currency = currency
+	account.Held.Currency = currency
+	if statusChangedAt.Valid {
+		account.Status_changed_at = &statusChangedAt.Time
+	}
+	return nil
+}
+
+// scanAccounts collects every account in rows and closes it.
+func scanAccounts(rows *sql.Rows) ([]dbutil.Account, error) {
+	defer rows.Close()
+	var accounts []dbutil.Account
+	for rows.Next() {
+		var account dbutil.Account
+		err := scanAccount(rows, &account)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning row: %w", err)
+		}
+		accounts = append(accounts, account)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over rows: %w", err)
+	}
+	return accounts, nil
+}
+
+// GetAccounts returns every account except the funding account.
+func (p *postgres) GetAccounts(ctx context.Context) []dbutil.Account {
+	rows, err := p.db.QueryContext(ctx, "SELECT "+accountColumns+" FROM account WHERE customer_id NOT IN (SELECT id FROM customers WHERE email = $1) ORDER BY id", dbutil.FundingAccountEmail)
+	if err != nil {
+		panic(err)
+	}
+	accounts, err := scanAccounts(rows)
+	if err != nil {
+		log.Println("Error listing accounts:", err)
+		return nil
+	}
+	return accounts
+}
+
+// ListCustomerAccounts returns the customer's accounts, oldest first.
+func (p *postgres) ListCustomerAccounts(ctx context.Context, customerId int) ([]dbutil.Account, error) {
+	rows, err := p.db.QueryContext(ctx, "SELECT "+accountColumns+" FROM account WHERE customer_id = $1 ORDER BY id", customerId)
+	if err != nil {
+		return nil, fmt.Errorf("error listing accounts: %w", err)
+	}
+	return scanAccounts(rows)
+}
+
+// getAccount reads an account through an open transaction.
+func getAccount(ctx context.Context, tx *sql.Tx, id int) (*dbutil.Account, error) {
+	var account dbutil.Account
+	err := scanAccount(tx.QueryRowContext(ctx, "SELECT "+accountColumns+" FROM account WHERE id = $1", id), &account)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("account not found: %w", err)
+		}
+		return nil, fmt.Errorf("error scanning row: %w", err)
+	}
+	return &account, nil
+}
+
+// queryRower is satisfied by both *sql.DB and *sql.Tx.
+type queryRower interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+func (p *postgres) CreateAccount(ctx context.Context, account *dbutil.Account) error {
+	return insertAccount(ctx, p.db, account)
+}
+
+// insertAccount stores a new account and sets its id.
+func insertAccount(ctx context.Context, q queryRower, account *dbutil.Account) error {
+	err := q.QueryRowContext(ctx, "INSERT INTO account(customer_id, type, nickname, balance, currency, created_at, updated_at, status) VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id",
+		account.Customer_id, account.Type, account.Nickname, account.Balance, account.Currency(), account.Created_at, account.Updated_at, account.Status).Scan(&account.Id)
+	if err != nil {
+		log.Println("error inserting account: ", err)
+		return fmt.Errorf("error inserting account: %w", err)
+	}
+	return nil
+}
+
+func (p *postgres) GetAccount(ctx context.Context, id int) (*dbutil.Account, error) {
+	var account dbutil.Account
+	err := scanAccount(p.db.QueryRowContext(ctx, "SELECT "+accountColumns+" FROM account WHERE id = $1", id), &account)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("account not found: %w", err)
+		}
+		return nil, fmt.Errorf("error scanning row: %w", err)
+	}
+
+	return &account, nil
+}
+
+// SetAccountStatus moves an account to status, recording why. The account
+// row is locked while the change is checked against its current status and,
+// when closing, its balance, so that a payment cannot land in between.
+func (p *postgres) SetAccountStatus(ctx context.Context, id int, status, reason string, at time.Time) (err error) {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		} else {
+			err = tx.Commit()
+		}
+	}()
+
+	err = lockAccounts(ctx, tx, id)
+	if err != nil {
+		return err
+	}
+	account, err := getAccount(ctx, tx, id)
+	if err != nil {
+		return err
+	}
+	if !dbutil.CanChangeStatus(account.Status, status) {
+		return fmt.Errorf("account %d is %s, cannot become %s: %w", id, account.Status, status, dbutil.ErrInvalidStatusChange)
+	}
+	if status == dbutil.StatusClosed && !account.Balance.IsZero() {
+		return dbutil.ErrBalanceNotZero
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE account SET status = $1, status_reason = $2, status_changed_at = $3, updated_at = $3 WHERE id = $4", status, reason, at, id)
+	if err != nil {
+		return fmt.Errorf("error updating account status: %w", err)
+	}
+	return nil
+}
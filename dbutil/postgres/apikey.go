@@ -0,0 +1,96 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"minibank/dbutil"
+	"time"
+)
+
+func (p *postgres) CreateAPIKey(ctx context.Context, key *dbutil.APIKey) error {
+	err := p.db.QueryRowContext(ctx, "INSERT INTO api_keys (customer_id, name, prefix, token_hash, scopes, created_at) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id",
+		key.CustomerId, key.Name, key.Prefix, key.TokenHash, dbutil.JoinScopes(key.Scopes), key.CreatedAt).Scan(&key.Id)
+	if err != nil {
+		return fmt.Errorf("error inserting api key: %w", err)
+	}
+	return nil
+}
+
+// GetAPIKeyByHash returns the unrevoked key with the given token hash.
+func (p *postgres) GetAPIKeyByHash(ctx context.Context, hash string) (*dbutil.APIKey, error) {
+	key, err := scanAPIKey(p.db.QueryRowContext(ctx, "SELECT "+apiKeyColumns+" FROM api_keys WHERE token_hash = $1 AND revoked_at IS NULL", hash))
+	if err == sql.ErrNoRows {
+		return nil, dbutil.ErrAPIKeyNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error fetching api key: %w", err)
+	}
+	return key, nil
+}
+
+func (p *postgres) ListAPIKeys(ctx context.Context, customerId int) ([]dbutil.APIKey, error) {
+	rows, err := p.db.QueryContext(ctx, "SELECT "+apiKeyColumns+" FROM api_keys WHERE customer_id = $1 ORDER BY id", customerId)
+	if err != nil {
+		return nil, fmt.Errorf("error querying api keys: %w", err)
+	}
+	defer rows.Close()
+
+	var keys []dbutil.APIKey
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning api key: %w", err)
+		}
+		keys = append(keys, *key)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over rows: %w", err)
+	}
+	return keys, nil
+}
+
+// RevokeAPIKey revokes one of the customer's keys. Revoking an unknown or
+// already revoked key returns dbutil.ErrAPIKeyNotFound.
+func (p *postgres) RevokeAPIKey(ctx context.Context, customerId, id int) error {
+	result, err := p.db.ExecContext(ctx, "UPDATE api_keys SET revoked_at = $1 WHERE id = $2 AND customer_id = $3 AND revoked_at IS NULL", time.Now(), id, customerId)
+	if err != nil {
+		return fmt.Errorf("error revoking api key: %w", err)
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error getting rows affected: %w", err)
+	}
+	if rows == 0 {
+		return dbutil.ErrAPIKeyNotFound
+	}
+	return nil
+}
+
+func (p *postgres) TouchAPIKey(ctx context.Context, id int, at time.Time) error {
+	_, err := p.db.ExecContext(ctx, "UPDATE api_keys SET last_used_at = $1 WHERE id = $2", at, id)
+	if err != nil {
+		return fmt.Errorf("error updating api key: %w", err)
+	}
+	return nil
+}
+
+const apiKeyColumns = "id, customer_id, name, prefix, token_hash, scopes, created_at, last_used_at, revoked_at"
+
+func scanAPIKey(row scanner) (*dbutil.APIKey, error) {
+	var key dbutil.APIKey
+	var scopes string
+	var lastUsed, revoked sql.NullTime
+	err := row.Scan(&key.Id, &key.CustomerId, &key.Name, &key.Prefix, &key.TokenHash, &scopes, &key.CreatedAt, &lastUsed, &revoked)
+	if err != nil {
+		return nil, err
+	}
+	key.Scopes = dbutil.SplitScopes(scopes)
+	if lastUsed.Valid {
+		key.LastUsedAt = &lastUsed.Time
+	}
+	if revoked.Valid {
+		key.RevokedAt = &revoked.Time
+	}
+	return &key, nil
+}
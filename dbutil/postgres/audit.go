@@ -0,0 +1,24 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"minibank/dbutil"
+)
+
+func (p *postgres) CreateAuditEvent(ctx context.Context, event *dbutil.AuditEvent) error {
+	err := p.db.QueryRowContext(ctx, "INSERT INTO audit_log (customer_id, account_id, actor_id, event, detail, ip, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id",
+		nullableId(event.CustomerId), nullableId(event.AccountId), nullableId(event.ActorId), event.Event, event.Detail, event.IP, event.CreatedAt).Scan(&event.Id)
+	if err != nil {
+		return fmt.Errorf("error inserting audit event: %w", err)
+	}
+	return nil
+}
+
+// nullableId stores an unset (zero) id as NULL.
+func nullableId(id int) interface{} {
+	if id == 0 {
+		return nil
+	}
+	return id
+}
@@ -0,0 +1,61 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"minibank/dbutil"
+)
+
+// TransferBatch makes payments from one account in a single database
+// transaction: either every payment is made, or one fails and none is,
+// with a *dbutil.BatchError saying which. Each payment is made as Transfer
+// makes it, idempotency key included, so retrying a batch that went
+// through returns the same transactions. Every account the batch touches is
+// locked before anything is read, as for Transfer.
+func (p *postgres) TransferBatch(ctx context.Context, fromAccountId int, payments []dbutil.BatchPayment) (err error) {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			tx.Rollback()
+			panic(r)
+		} else if err != nil {
+			log.Printf("Rolling back batch due to error: %v", err)
+			tx.Rollback()
+		} else {
+			err = tx.Commit()
+			if err != nil {
+				log.Printf("Error committing batch: %v", err)
+				err = fmt.Errorf("error committing transaction: %w", err)
+			}
+		}
+		// Nothing was made, so no payment has a transaction
+		if err != nil {
+			for i := range payments {
+				payments[i].TransactionId = 0
+			}
+		}
+	}()
+
+	ids := []int{fromAccountId}
+	for _, payment := range payments {
+		ids = append(ids, payment.ToAccount)
+	}
+	err = lockAccounts(ctx, tx, ids...)
+	if err != nil {
+		return err
+	}
+
+	for i := range payments {
+		payment := payments[i]
+		id, err := p.transfer(ctx, tx, fromAccountId, payment.ToAccount, payment.Amount, payment.Reference, payment.Key)
+		if err != nil {
+			return &dbutil.BatchError{Index: i, Err: err}
+		}
+		payments[i].TransactionId = id
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"minibank/dbutil"
+	"os"
+	"time"
+)
+
+func (p *postgres) GetCustomers(ctx context.Context) []dbutil.Customer {
+	sqlScript, err := os.ReadFile("./sql/queryUsers.sql")
+	if err != nil {
+		panic(err)
+	}
+	var customers []dbutil.Customer
+	rows, err := p.db.QueryContext(ctx, string(sqlScript))
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var customer dbutil.Customer
+		err := scanCustomer(rows, &customer)
+		if err != nil {
+			return nil
+		}
+		customers = append(customers, customer)
+	}
+	return customers
+}
+
+// customerColumns lists the columns scanCustomer expects, in order.
+const customerColumns = "id, first_name, last_name, email, phone_number, encrypted_password, role, email_verified_at, created_at, updated_at"
+
+// scanCustomer scans a full customer row. The phone number is nullable
+// because system customers such as the funding account's have none.
+func scanCustomer(row scanner, customer *dbutil.Customer) error {
+	var phoneNumber sql.NullInt64
+	var verifiedAt sql.NullTime
+	err := row.Scan(&customer.Id, &customer.First_name, &customer.Last_name, &customer.Email, &phoneNumber, &customer.Encrypted_password, &customer.Role, &verifiedAt, &customer.Created_at, &customer.Updated_at)
+	if err != nil {
+		return err
+	}
+	customer.Phone_number = int(phoneNumber.Int64)
+	if verifiedAt.Valid {
+		customer.Email_verified_at = &verifiedAt.Time
+	}
+	return nil
+}
+
+// CreateCustomer stores a new customer together with their first account, so
+// that no customer is ever without one.
+func (p *postgres) CreateCustomer(ctx context.Context, customer *dbutil.Customer, account *dbutil.Account) error {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx, "INSERT INTO customers(first_name, last_name, email, phone_number, encrypted_password, role, email_verified_at, created_at, updated_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id",
+		customer.First_name, customer.Last_name, customer.Email, customer.Phone_number, customer.Encrypted_password, customer.Role, customer.Email_verified_at, customer.Created_at, customer.Updated_at).Scan(&customer.Id)
+	if err != nil {
+		log.Println("error inserting customer: ", err)
+		return fmt.Errorf("error inserting customer: %w", err)
+	}
+
+	account.Customer_id = customer.Id
+	err = insertAccount(ctx, tx, account)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (p *postgres) GetCustomer(ctx context.Context, id int) (*dbutil.Customer, error) {
+	return p.getCustomerBy(ctx, "id", id)
+}
+
+func (p *postgres) GetCustomerByEmail(ctx context.Context, email string) (*dbutil.Customer, error) {
+	return p.getCustomerBy(ctx, "email", email)
+}
+
+func (p *postgres) GetCustomerByPhoneNumber(ctx context.Context, number int) (*dbutil.Customer, error) {
+	return p.getCustomerBy(ctx, "phone_number", number)
+}
+
+// getCustomerBy fetches the customer whose column equals value. column is
+// always a constant from this file, never user input.
+func (p *postgres) getCustomerBy(ctx context.Context, column string, value interface{}) (*dbutil.Customer, error) {
+	var customer dbutil.Customer
+	err := scanCustomer(p.db.QueryRowContext(ctx, "SELECT "+customerColumns+" FROM customers WHERE "+column+" = $1", value), &customer)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("customer not found: %w", err)
+		}
+		return nil, fmt.Errorf("error scanning row: %w", err)
+	}
+
+	return &customer, nil
+}
+
+func (p *postgres) SetCustomerRole(ctx context.Context, id int, role string) error {
+	result, err := p.db.ExecContext(ctx, "UPDATE customers SET role = $1, updated_at = $2 WHERE id = $3", role, time.Now(), id)
+	if err != nil {
+		return fmt.Errorf("error updating customer role: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error getting rows affected: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("no customer found with ID %d: %w", id, sql.ErrNoRows)
+	}
+
+	return nil
+}
+
+func (p *postgres) SetCustomerPassword(ctx context.Context, id int, encryptedPassword string) error {
+	result, err := p.db.ExecContext(ctx, "UPDATE customers SET encrypted_password = $1, updated_at = $2 WHERE id = $3", encryptedPassword, time.Now(), id)
+	if err != nil {
+		return fmt.Errorf("error updating customer password: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error getting rows affected: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("no customer found with ID %d: %w", id, sql.ErrNoRows)
+	}
+
+	return nil
+}
+
+// SetEmailVerified records that the customer proved they control their email
+// address. An earlier verification time is kept.
+func (p *postgres) SetEmailVerified(ctx context.Context, id int, at time.Time) error {
+	_, err := p.db.ExecContext(ctx, "UPDATE customers SET email_verified_at = $1 WHERE id = $2 AND email_verified_at IS NULL", at, id)
+	if err != nil {
+		return fmt.Errorf("error verifying customer email: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"minibank/dbutil"
+	"time"
+)
+
+func (p *postgres) CreateEmailToken(ctx context.Context, token *dbutil.EmailToken) error {
+	err := p.db.QueryRowContext(ctx, "INSERT INTO email_tokens (customer_id, purpose, token_hash, created_at, expires_at) VALUES ($1, $2, $3, $4, $5) RETURNING id",
+		token.CustomerId, token.Purpose, token.TokenHash, token.CreatedAt.UTC(), token.ExpiresAt.UTC()).Scan(&token.Id)
+	if err != nil {
+		return fmt.Errorf("error inserting email token: %w", err)
+	}
+	return nil
+}
+
+// UseEmailToken marks the unexpired, unused token with the given hash and
+// purpose as used and returns it. Marking and checking happen in one
+// statement, so a token cannot be used twice by racing requests.
+func (p *postgres) UseEmailToken(ctx context.Context, purpose, hash string, at time.Time) (*dbutil.EmailToken, error) {
+	var token dbutil.EmailToken
+	var usedAt time.Time
+	err := p.db.QueryRowContext(ctx, `
+		UPDATE email_tokens SET used_at = $1
+		WHERE token_hash = $2 AND purpose = $3 AND used_at IS NULL AND expires_at > $4
+		RETURNING id, customer_id, purpose, token_hash, created_at, expires_at, used_at`,
+		at.UTC(), hash, purpose, at.UTC()).
+		Scan(&token.Id, &token.CustomerId, &token.Purpose, &token.TokenHash, &token.CreatedAt, &token.ExpiresAt, &usedAt)
+	if err == sql.ErrNoRows {
+		return nil, dbutil.ErrEmailTokenNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error using email token: %w", err)
+	}
+	token.UsedAt = &usedAt
+	return &token, nil
+}
+
+// DeleteEmailTokens discards the customer's outstanding tokens for purpose,
+// along with any expired or used tokens of any customer.
+func (p *postgres) DeleteEmailTokens(ctx context.Context, customerId int, purpose string) error {
+	_, err := p.db.ExecContext(ctx, "DELETE FROM email_tokens WHERE (customer_id = $1 AND purpose = $2) OR used_at IS NOT NULL OR expires_at <= $3",
+		customerId, purpose, time.Now().UTC())
+	if err != nil {
+		return fmt.Errorf("error deleting email tokens: %w", err)
+	}
+	return nil
+}
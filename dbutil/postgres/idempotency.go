@@ -0,0 +1,72 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"minibank/dbutil"
+	"time"
+)
+
+// replayTransfer looks up a live idempotency key for the paying account. It
+// returns the id of the transaction the key was first used for, or 0 when the
+// key is new. A live key that was used for a different payment is rejected
+// with dbutil.ErrIdempotencyKeyReused.
+//
+// The key is locked until tx ends, so a concurrent request with the same key
+// waits here and then replays the payment this one makes instead of making
+// it again.
+func (p *postgres) replayTransfer(ctx context.Context, tx *sql.Tx, fromAccountId, toAccountId int, amount dbutil.Money, key dbutil.IdempotencyKey) (int, error) {
+	_, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock($1, hashtext($2))", fromAccountId, key.Key)
+	if err != nil {
+		return 0, fmt.Errorf("error locking idempotency key: %w", err)
+	}
+
+	var transactionId int
+	var previousTo int
+	var previousAmount dbutil.Money
+	err = tx.QueryRowContext(ctx, `
+		SELECT t.id, t.to_account, t.amount
+		FROM idempotency_keys k JOIN transactions t ON t.id = k.transaction_id
+		WHERE k.account_id = $1 AND k.key = $2 AND k.expires_at > $3`,
+		fromAccountId, key.Key, time.Now()).Scan(&transactionId, &previousTo, &previousAmount)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("error looking up idempotency key: %w", err)
+	}
+
+	if previousTo != toAccountId || previousAmount.Minor != amount.Minor {
+		return 0, dbutil.ErrIdempotencyKeyReused
+	}
+	return transactionId, nil
+}
+
+// saveIdempotencyKey records the transaction a key produced and drops keys
+// whose window has passed so they can be reused. An expired row for the same
+// key that is still there is taken over; a live one means the key was not
+// locked by replayTransfer, and is an error rather than a second payment.
+func (p *postgres) saveIdempotencyKey(ctx context.Context, tx *sql.Tx, fromAccountId int, key dbutil.IdempotencyKey, transactionId int) error {
+	_, err := tx.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE expires_at <= $1", time.Now())
+	if err != nil {
+		return fmt.Errorf("error deleting expired idempotency keys: %w", err)
+	}
+
+	result, err := tx.ExecContext(ctx, `
+		INSERT INTO idempotency_keys (account_id, key, transaction_id, expires_at) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (account_id, key) DO UPDATE SET transaction_id = EXCLUDED.transaction_id, expires_at = EXCLUDED.expires_at
+		WHERE idempotency_keys.expires_at <= $5`,
+		fromAccountId, key.Key, transactionId, key.ExpiresAt, time.Now())
+	if err != nil {
+		return fmt.Errorf("error saving idempotency key: %w", err)
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error getting rows affected: %w", err)
+	}
+	if rows == 0 {
+		return fmt.Errorf("idempotency key %q is in use by another payment", key.Key)
+	}
+	return nil
+}
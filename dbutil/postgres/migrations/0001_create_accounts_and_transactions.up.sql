@@ -0,0 +1,20 @@
+CREATE TABLE account (
+    id SERIAL PRIMARY KEY,
+    first_name VARCHAR(50),
+    last_name VARCHAR(50),
+    email VARCHAR(50) UNIQUE,
+    phone_number BIGINT UNIQUE,
+    encrypted_password VARCHAR(100),
+    balance BIGINT,
+    created_at TIMESTAMPTZ,
+    updated_at TIMESTAMPTZ
+);
+
+CREATE TABLE transactions (
+    id SERIAL PRIMARY KEY,
+    from_account INTEGER,
+    to_account INTEGER,
+    amount BIGINT,
+    transaction_type TEXT,
+    created_at TIMESTAMPTZ
+);
@@ -0,0 +1,3 @@
+-- PostgreSQL stored minor units from the start. This version is kept so
+-- migration numbers line up with the SQLite backend.
+SELECT 1;
@@ -0,0 +1,9 @@
+CREATE TABLE ledger_entries (
+    id SERIAL PRIMARY KEY,
+    transaction_id INTEGER NOT NULL REFERENCES transactions(id),
+    account_id INTEGER NOT NULL,
+    amount BIGINT NOT NULL,
+    created_at TIMESTAMPTZ
+);
+CREATE INDEX ledger_entries_account_id ON ledger_entries(account_id);
+CREATE INDEX ledger_entries_transaction_id ON ledger_entries(transaction_id);
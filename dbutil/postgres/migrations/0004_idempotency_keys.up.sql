@@ -0,0 +1,8 @@
+CREATE TABLE idempotency_keys (
+    account_id INTEGER NOT NULL,
+    key TEXT NOT NULL,
+    transaction_id INTEGER NOT NULL REFERENCES transactions(id),
+    expires_at TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY (account_id, key)
+);
+CREATE INDEX idempotency_keys_expires_at ON idempotency_keys(expires_at);
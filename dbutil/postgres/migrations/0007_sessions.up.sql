@@ -0,0 +1,12 @@
+CREATE TABLE sessions (
+    id TEXT PRIMARY KEY,
+    account_id INTEGER REFERENCES account(id) ON DELETE CASCADE,
+    data TEXT NOT NULL,
+    user_agent TEXT NOT NULL DEFAULT '',
+    ip TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL,
+    last_seen_at TIMESTAMPTZ NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL
+);
+CREATE INDEX sessions_account_id ON sessions(account_id);
+CREATE INDEX sessions_expires_at ON sessions(expires_at);
@@ -0,0 +1,17 @@
+CREATE TABLE login_throttles (
+    key TEXT PRIMARY KEY,
+    failures INTEGER NOT NULL,
+    last_failure_at TIMESTAMPTZ NOT NULL,
+    locked_until TIMESTAMPTZ
+);
+
+CREATE TABLE audit_log (
+    id SERIAL PRIMARY KEY,
+    account_id INTEGER,
+    actor_id INTEGER,
+    event TEXT NOT NULL,
+    detail TEXT NOT NULL DEFAULT '',
+    ip TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL
+);
+CREATE INDEX audit_log_account_id ON audit_log(account_id);
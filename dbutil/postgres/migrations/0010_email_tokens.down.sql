@@ -0,0 +1,2 @@
+DROP TABLE email_tokens;
+ALTER TABLE account DROP COLUMN email_verified_at;
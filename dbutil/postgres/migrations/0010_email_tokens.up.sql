@@ -0,0 +1,15 @@
+ALTER TABLE account ADD COLUMN email_verified_at TIMESTAMPTZ;
+
+-- Accounts opened before email verification existed keep sending payments
+UPDATE account SET email_verified_at = now();
+
+CREATE TABLE email_tokens (
+    id SERIAL PRIMARY KEY,
+    account_id INTEGER NOT NULL REFERENCES account(id) ON DELETE CASCADE,
+    purpose TEXT NOT NULL,
+    token_hash TEXT NOT NULL UNIQUE,
+    created_at TIMESTAMPTZ NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    used_at TIMESTAMPTZ
+);
+CREATE INDEX email_tokens_account_id ON email_tokens(account_id);
@@ -0,0 +1,3 @@
+ALTER TABLE account ADD COLUMN status TEXT NOT NULL DEFAULT 'active';
+ALTER TABLE account ADD COLUMN status_reason TEXT NOT NULL DEFAULT '';
+ALTER TABLE account ADD COLUMN status_changed_at TIMESTAMPTZ;
@@ -0,0 +1,60 @@
+-- Each customer's details go back on their first account. Any further
+-- accounts lose them, and credentials move to that first account.
+CREATE TEMPORARY TABLE first_accounts AS
+    SELECT customer_id, MIN(id) AS account_id FROM account GROUP BY customer_id;
+
+DROP INDEX audit_log_customer_id;
+UPDATE audit_log SET account_id = f.account_id FROM first_accounts f
+    WHERE audit_log.account_id IS NULL AND f.customer_id = audit_log.customer_id;
+ALTER TABLE audit_log DROP COLUMN customer_id;
+
+ALTER TABLE email_tokens DROP CONSTRAINT email_tokens_customer_id_fkey;
+UPDATE email_tokens SET customer_id = f.account_id FROM first_accounts f WHERE f.customer_id = email_tokens.customer_id;
+ALTER TABLE email_tokens RENAME COLUMN customer_id TO account_id;
+ALTER INDEX email_tokens_customer_id RENAME TO email_tokens_account_id;
+
+ALTER TABLE recovery_codes DROP CONSTRAINT recovery_codes_customer_id_fkey;
+UPDATE recovery_codes SET customer_id = f.account_id FROM first_accounts f WHERE f.customer_id = recovery_codes.customer_id;
+ALTER TABLE recovery_codes RENAME COLUMN customer_id TO account_id;
+ALTER INDEX recovery_codes_customer_id RENAME TO recovery_codes_account_id;
+
+ALTER TABLE two_factor DROP CONSTRAINT two_factor_customer_id_fkey;
+UPDATE two_factor SET customer_id = f.account_id FROM first_accounts f WHERE f.customer_id = two_factor.customer_id;
+ALTER TABLE two_factor RENAME COLUMN customer_id TO account_id;
+
+-- Session data names the customer, so existing logins cannot be carried over
+ALTER TABLE sessions DROP CONSTRAINT sessions_customer_id_fkey;
+DELETE FROM sessions;
+ALTER TABLE sessions RENAME COLUMN customer_id TO account_id;
+ALTER INDEX sessions_customer_id RENAME TO sessions_account_id;
+
+ALTER TABLE api_keys DROP CONSTRAINT api_keys_customer_id_fkey;
+UPDATE api_keys SET customer_id = f.account_id FROM first_accounts f WHERE f.customer_id = api_keys.customer_id;
+ALTER TABLE api_keys RENAME COLUMN customer_id TO account_id;
+ALTER INDEX api_keys_customer_id RENAME TO api_keys_account_id;
+
+DROP INDEX account_customer_id;
+ALTER TABLE account
+    ADD COLUMN first_name VARCHAR(50),
+    ADD COLUMN last_name VARCHAR(50),
+    ADD COLUMN email VARCHAR(50) UNIQUE,
+    ADD COLUMN phone_number BIGINT UNIQUE,
+    ADD COLUMN encrypted_password VARCHAR(100),
+    ADD COLUMN role TEXT NOT NULL DEFAULT 'customer',
+    ADD COLUMN email_verified_at TIMESTAMPTZ;
+UPDATE account SET first_name = c.first_name, last_name = c.last_name, encrypted_password = '', email_verified_at = c.email_verified_at
+    FROM customers c WHERE c.id = account.customer_id;
+UPDATE account SET email = c.email, phone_number = c.phone_number, encrypted_password = c.encrypted_password, role = c.role
+    FROM customers c, first_accounts f WHERE c.id = account.customer_id AND f.account_id = account.id;
+ALTER TABLE account
+    DROP COLUMN customer_id,
+    DROP COLUMN type,
+    DROP COLUMN nickname;
+DROP TABLE customers;
+
+ALTER TABLE api_keys ADD CONSTRAINT api_keys_account_id_fkey FOREIGN KEY (account_id) REFERENCES account(id) ON DELETE CASCADE;
+ALTER TABLE sessions ADD CONSTRAINT sessions_account_id_fkey FOREIGN KEY (account_id) REFERENCES account(id) ON DELETE CASCADE;
+ALTER TABLE two_factor ADD CONSTRAINT two_factor_account_id_fkey FOREIGN KEY (account_id) REFERENCES account(id) ON DELETE CASCADE;
+ALTER TABLE recovery_codes ADD CONSTRAINT recovery_codes_account_id_fkey FOREIGN KEY (account_id) REFERENCES account(id) ON DELETE CASCADE;
+ALTER TABLE email_tokens ADD CONSTRAINT email_tokens_account_id_fkey FOREIGN KEY (account_id) REFERENCES account(id) ON DELETE CASCADE;
+DROP TABLE first_accounts;
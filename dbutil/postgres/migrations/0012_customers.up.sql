@@ -0,0 +1,65 @@
+-- Split the person who logs in from the accounts that hold their money. Each
+-- existing account becomes its own customer with the same id, so sessions,
+-- API keys and the rest keep pointing at the right person.
+CREATE TABLE customers (
+    id SERIAL PRIMARY KEY,
+    first_name VARCHAR(50),
+    last_name VARCHAR(50),
+    email VARCHAR(50) UNIQUE,
+    phone_number BIGINT UNIQUE,
+    encrypted_password VARCHAR(100),
+    role TEXT NOT NULL DEFAULT 'customer',
+    email_verified_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ,
+    updated_at TIMESTAMPTZ
+);
+INSERT INTO customers (id, first_name, last_name, email, phone_number, encrypted_password, role, email_verified_at, created_at, updated_at)
+    SELECT id, first_name, last_name, email, phone_number, encrypted_password, role, email_verified_at, created_at, updated_at FROM account;
+SELECT setval('customers_id_seq', (SELECT COALESCE(MAX(id), 0) + 1 FROM customers), false);
+
+ALTER TABLE account
+    ADD COLUMN customer_id INTEGER REFERENCES customers(id),
+    ADD COLUMN type TEXT NOT NULL DEFAULT 'checking',
+    ADD COLUMN nickname TEXT NOT NULL DEFAULT '';
+UPDATE account SET customer_id = id;
+ALTER TABLE account
+    ALTER COLUMN customer_id SET NOT NULL,
+    DROP COLUMN first_name,
+    DROP COLUMN last_name,
+    DROP COLUMN email,
+    DROP COLUMN phone_number,
+    DROP COLUMN encrypted_password,
+    DROP COLUMN role,
+    DROP COLUMN email_verified_at;
+CREATE INDEX account_customer_id ON account(customer_id);
+
+-- Logins and their credentials belong to the customer
+ALTER TABLE api_keys DROP CONSTRAINT api_keys_account_id_fkey;
+ALTER TABLE api_keys RENAME COLUMN account_id TO customer_id;
+ALTER TABLE api_keys ADD CONSTRAINT api_keys_customer_id_fkey FOREIGN KEY (customer_id) REFERENCES customers(id) ON DELETE CASCADE;
+ALTER INDEX api_keys_account_id RENAME TO api_keys_customer_id;
+
+ALTER TABLE sessions DROP CONSTRAINT sessions_account_id_fkey;
+ALTER TABLE sessions RENAME COLUMN account_id TO customer_id;
+ALTER TABLE sessions ADD CONSTRAINT sessions_customer_id_fkey FOREIGN KEY (customer_id) REFERENCES customers(id) ON DELETE CASCADE;
+ALTER INDEX sessions_account_id RENAME TO sessions_customer_id;
+
+ALTER TABLE two_factor DROP CONSTRAINT two_factor_account_id_fkey;
+ALTER TABLE two_factor RENAME COLUMN account_id TO customer_id;
+ALTER TABLE two_factor ADD CONSTRAINT two_factor_customer_id_fkey FOREIGN KEY (customer_id) REFERENCES customers(id) ON DELETE CASCADE;
+
+ALTER TABLE recovery_codes DROP CONSTRAINT recovery_codes_account_id_fkey;
+ALTER TABLE recovery_codes RENAME COLUMN account_id TO customer_id;
+ALTER TABLE recovery_codes ADD CONSTRAINT recovery_codes_customer_id_fkey FOREIGN KEY (customer_id) REFERENCES customers(id) ON DELETE CASCADE;
+ALTER INDEX recovery_codes_account_id RENAME TO recovery_codes_customer_id;
+
+ALTER TABLE email_tokens DROP CONSTRAINT email_tokens_account_id_fkey;
+ALTER TABLE email_tokens RENAME COLUMN account_id TO customer_id;
+ALTER TABLE email_tokens ADD CONSTRAINT email_tokens_customer_id_fkey FOREIGN KEY (customer_id) REFERENCES customers(id) ON DELETE CASCADE;
+ALTER INDEX email_tokens_account_id RENAME TO email_tokens_customer_id;
+
+-- Only status changes were about an account rather than its owner
+ALTER TABLE audit_log ADD COLUMN customer_id INTEGER;
+UPDATE audit_log SET customer_id = account_id;
+UPDATE audit_log SET account_id = NULL WHERE event != 'account_status_changed';
+CREATE INDEX audit_log_customer_id ON audit_log(customer_id);
@@ -0,0 +1,13 @@
+-- Amounts in other currencies are left as they are and read back as
+-- Australian dollars, so only roll back before any have been used.
+DROP TABLE fx_rates;
+
+ALTER TABLE transactions
+    DROP COLUMN fee,
+    DROP COLUMN fx_rate,
+    DROP COLUMN destination_currency,
+    DROP COLUMN destination_amount,
+    DROP COLUMN currency;
+
+ALTER TABLE ledger_entries DROP COLUMN currency;
+ALTER TABLE account DROP COLUMN currency;
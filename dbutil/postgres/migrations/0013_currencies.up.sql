@@ -0,0 +1,20 @@
+-- Every existing account, payment and entry was in Australian dollars.
+ALTER TABLE account ADD COLUMN currency TEXT NOT NULL DEFAULT 'AUD';
+ALTER TABLE ledger_entries ADD COLUMN currency TEXT NOT NULL DEFAULT 'AUD';
+
+ALTER TABLE transactions
+    ADD COLUMN currency TEXT NOT NULL DEFAULT 'AUD',
+    ADD COLUMN destination_amount BIGINT NOT NULL DEFAULT 0,
+    ADD COLUMN destination_currency TEXT NOT NULL DEFAULT 'AUD',
+    ADD COLUMN fx_rate TEXT NOT NULL DEFAULT '',
+    ADD COLUMN fee BIGINT NOT NULL DEFAULT 0;
+UPDATE transactions SET destination_amount = amount;
+
+CREATE TABLE fx_rates (
+    base TEXT NOT NULL,
+    quote TEXT NOT NULL,
+    rate TEXT NOT NULL,
+    fee_basis_points INTEGER NOT NULL DEFAULT 0,
+    updated_at TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY (base, quote)
+);
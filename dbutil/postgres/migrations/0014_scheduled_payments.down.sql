@@ -0,0 +1,2 @@
+DROP TABLE scheduled_payment_runs;
+DROP TABLE scheduled_payments;
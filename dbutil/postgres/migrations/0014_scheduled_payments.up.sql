@@ -0,0 +1,33 @@
+CREATE TABLE scheduled_payments (
+    id SERIAL PRIMARY KEY,
+    customer_id INTEGER NOT NULL REFERENCES customers(id) ON DELETE CASCADE,
+    from_account INTEGER NOT NULL REFERENCES account(id),
+    to_account INTEGER NOT NULL REFERENCES account(id),
+    amount BIGINT NOT NULL,
+    currency TEXT NOT NULL,
+    frequency TEXT NOT NULL,
+    rule TEXT NOT NULL DEFAULT '',
+    start_at TIMESTAMPTZ NOT NULL,
+    end_at TIMESTAMPTZ,
+    due_at TIMESTAMPTZ NOT NULL,
+    attempt_at TIMESTAMPTZ NOT NULL,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    occurrences INTEGER NOT NULL DEFAULT 0,
+    status TEXT NOT NULL DEFAULT 'active',
+    created_at TIMESTAMPTZ NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL
+);
+CREATE INDEX scheduled_payments_customer_id ON scheduled_payments(customer_id);
+CREATE INDEX scheduled_payments_attempt_at ON scheduled_payments(status, attempt_at);
+
+CREATE TABLE scheduled_payment_runs (
+    id SERIAL PRIMARY KEY,
+    scheduled_payment_id INTEGER NOT NULL REFERENCES scheduled_payments(id) ON DELETE CASCADE,
+    due_at TIMESTAMPTZ NOT NULL,
+    attempt INTEGER NOT NULL,
+    status TEXT NOT NULL,
+    transaction_id INTEGER REFERENCES transactions(id),
+    error TEXT NOT NULL DEFAULT '',
+    ran_at TIMESTAMPTZ NOT NULL
+);
+CREATE INDEX scheduled_payment_runs_scheduled_payment_id ON scheduled_payment_runs(scheduled_payment_id);
@@ -0,0 +1,12 @@
+-- Pending and voided holds have no ledger entries; drop them so that what
+-- is left reads as the posted transactions it was before.
+DROP INDEX transactions_status_expires_at;
+DELETE FROM idempotency_keys WHERE transaction_id IN (SELECT id FROM transactions WHERE status != 'posted');
+DELETE FROM transactions WHERE status != 'posted';
+
+ALTER TABLE transactions
+    DROP COLUMN settled_at,
+    DROP COLUMN expires_at,
+    DROP COLUMN status;
+
+ALTER TABLE account DROP COLUMN held;
@@ -0,0 +1,12 @@
+-- Money set aside by pending holds. It stays in the balance, which only
+-- moves when entries are posted, but cannot be spent.
+ALTER TABLE account ADD COLUMN held BIGINT NOT NULL DEFAULT 0;
+
+-- Every existing transaction was posted when it was made.
+ALTER TABLE transactions
+    ADD COLUMN status TEXT NOT NULL DEFAULT 'posted',
+    ADD COLUMN expires_at TIMESTAMPTZ,
+    ADD COLUMN settled_at TIMESTAMPTZ;
+UPDATE transactions SET settled_at = created_at;
+
+CREATE INDEX transactions_status_expires_at ON transactions (status, expires_at);
@@ -0,0 +1,2 @@
+DROP INDEX transactions_to_account_created_at;
+DROP INDEX transactions_from_account_created_at;
@@ -0,0 +1,4 @@
+-- An account's history is listed by date from either side of its
+-- transactions. The id breaks ties, as it does for the cursor.
+CREATE INDEX transactions_from_account_created_at ON transactions (from_account, created_at, id);
+CREATE INDEX transactions_to_account_created_at ON transactions (to_account, created_at, id);
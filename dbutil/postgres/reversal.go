@@ -0,0 +1,105 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"minibank/dbutil"
+)
+
+// Reverse refunds amount of the transaction with the given id: a "Refund"
+// transaction that references it moves the money back from the account that
+// received it to the one that paid (see dbutil.Transaction.Reversal). The
+// refunds of a transaction never add up to more than it paid, and the
+// receiving account must still have the amount available.
+//
+// A non-empty idempotency key works as it does for Transfer, for the
+// account the refund is paid from.
+func (p *postgres) Reverse(ctx context.Context, id int, amount dbutil.Money, key dbutil.IdempotencyKey) (refundId int, err error) {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			log.Printf("Rolling back transaction due to error: %v", err)
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+		if err != nil {
+			refundId, err = 0, fmt.Errorf("error committing transaction: %w", err)
+		}
+	}()
+
+	original, err := getTransaction(ctx, tx, id)
+	if err != nil {
+		return 0, err
+	}
+	// Refunds of one payment all move money between the same two
+	// accounts, so locking them also serialises the refunds
+	err = lockAccounts(ctx, tx, original.FromAccount, original.ToAccount)
+	if err != nil {
+		return 0, err
+	}
+
+	if key.Key != "" {
+		refundId, err = p.replayTransfer(ctx, tx, original.ToAccount, original.FromAccount, amount, key)
+		if err != nil {
+			return 0, err
+		}
+		if refundId != 0 {
+			return refundId, nil
+		}
+	}
+
+	refunded := dbutil.NewMoney(0, original.DestinationAmount.Currency)
+	err = tx.QueryRowContext(ctx, "SELECT COALESCE(SUM(amount), 0) FROM transactions WHERE reverses = $1", id).Scan(&refunded.Minor)
+	if err != nil {
+		return 0, fmt.Errorf("error summing refunds: %w", err)
+	}
+	refund, err := original.Reversal(amount, refunded)
+	if err != nil {
+		return 0, err
+	}
+	_, _, err = transferAccounts(ctx, tx, refund.FromAccount, refund.ToAccount)
+	if err != nil {
+		return 0, err
+	}
+
+	err = p.post(ctx, tx, refund, true)
+	if err != nil {
+		return 0, fmt.Errorf("error posting refund: %w", err)
+	}
+
+	if key.Key != "" {
+		err = p.saveIdempotencyKey(ctx, tx, original.ToAccount, key, refund.Id)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return refund.Id, nil
+}
+
+// ListReversals returns the refunds of a transaction, oldest first.
+func (p *postgres) ListReversals(ctx context.Context, id int) ([]dbutil.Transaction, error) {
+	rows, err := p.db.QueryContext(ctx, "SELECT "+transactionColumns+" FROM transactions WHERE reverses = $1 ORDER BY id", id)
+	if err != nil {
+		return nil, fmt.Errorf("error querying refunds: %w", err)
+	}
+	defer rows.Close()
+
+	var refunds []dbutil.Transaction
+	for rows.Next() {
+		var refund dbutil.Transaction
+		err := scanTransaction(rows, &refund)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning refund: %w", err)
+		}
+		refunds = append(refunds, refund)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over rows: %w", err)
+	}
+	return refunds, nil
+}
@@ -0,0 +1,186 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"minibank/dbutil"
+	"time"
+)
+
+const scheduledPaymentColumns = "id, customer_id, from_account, to_account, amount, currency, frequency, rule, start_at, end_at, due_at, attempt_at, attempts, occurrences, status, created_at, updated_at"
+
+func scanScheduledPayment(row scanner) (*dbutil.ScheduledPayment, error) {
+	var p dbutil.ScheduledPayment
+	var currency string
+	var endAt sql.NullTime
+	err := row.Scan(&p.Id, &p.CustomerId, &p.FromAccount, &p.ToAccount, &p.Amount, &currency, &p.Frequency, &p.Rule,
+		&p.StartAt, &endAt, &p.DueAt, &p.AttemptAt, &p.Attempts, &p.Occurrences, &p.Status, &p.CreatedAt, &p.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	p.Amount.Currency = currency
+	if endAt.Valid {
+		p.EndAt = &endAt.Time
+	}
+	return &p, nil
+}
+
+// nullTime stores a missing time as NULL.
+func nullTime(t *time.Time) interface{} {
+	if t == nil {
+		return nil
+	}
+	return *t
+}
+
+func (p *postgres) CreateScheduledPayment(ctx context.Context, payment *dbutil.ScheduledPayment) error {
+	err := p.db.QueryRowContext(ctx, `
+		INSERT INTO scheduled_payments (customer_id, from_account, to_account, amount, currency, frequency, rule, start_at, end_at, due_at, attempt_at, attempts, occurrences, status, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16) RETURNING id`,
+		payment.CustomerId, payment.FromAccount, payment.ToAccount, payment.Amount, payment.Amount.Currency, payment.Frequency, payment.Rule, payment.StartAt, nullTime(payment.EndAt),
+		payment.DueAt, payment.AttemptAt, payment.Attempts, payment.Occurrences, payment.Status, payment.CreatedAt, payment.UpdatedAt).Scan(&payment.Id)
+	if err != nil {
+		return fmt.Errorf("error inserting scheduled payment: %w", err)
+	}
+	return nil
+}
+
+func (p *postgres) GetScheduledPayment(ctx context.Context, id int) (*dbutil.ScheduledPayment, error) {
+	payment, err := scanScheduledPayment(p.db.QueryRowContext(ctx, "SELECT "+scheduledPaymentColumns+" FROM scheduled_payments WHERE id = $1", id))
+	if err == sql.ErrNoRows {
+		return nil, dbutil.ErrScheduledPaymentNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error fetching scheduled payment: %w", err)
+	}
+	return payment, nil
+}
+
+// ListScheduledPayments returns the customer's scheduled payments, newest
+// first.
+func (p *postgres) ListScheduledPayments(ctx context.Context, customerId int) ([]dbutil.ScheduledPayment, error) {
+	return p.queryScheduledPayments(ctx, "SELECT "+scheduledPaymentColumns+" FROM scheduled_payments WHERE customer_id = $1 ORDER BY id DESC", customerId)
+}
+
+// ListDueScheduledPayments returns up to limit active payments whose next
+// attempt is at or before now, the longest overdue first.
+func (p *postgres) ListDueScheduledPayments(ctx context.Context, now time.Time, limit int) ([]dbutil.ScheduledPayment, error) {
+	return p.queryScheduledPayments(ctx, "SELECT "+scheduledPaymentColumns+" FROM scheduled_payments WHERE status = $1 AND attempt_at <= $2 ORDER BY attempt_at, id LIMIT $3",
+		dbutil.ScheduleActive, now, limit)
+}
+
+func (p *postgres) queryScheduledPayments(ctx context.Context, query string, args ...interface{}) ([]dbutil.ScheduledPayment, error) {
+	rows, err := p.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error querying scheduled payments: %w", err)
+	}
+	defer rows.Close()
+
+	var payments []dbutil.ScheduledPayment
+	for rows.Next() {
+		p, err := scanScheduledPayment(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning scheduled payment: %w", err)
+		}
+		payments = append(payments, *p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over rows: %w", err)
+	}
+	return payments, nil
+}
+
+// RecordScheduledPaymentRun saves run and the state p was left in by it in
+// one transaction. The update only applies if the payment is still active
+// and still at the occurrence and attempt the run was for, so a payment that
+// was cancelled or run by someone else meanwhile returns
+// dbutil.ErrScheduledPaymentNotFound and nothing is recorded.
+func (p *postgres) RecordScheduledPaymentRun(ctx context.Context, payment *dbutil.ScheduledPayment, run *dbutil.ScheduledPaymentRun) (err error) {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+		if err != nil {
+			err = fmt.Errorf("error committing transaction: %w", err)
+		}
+	}()
+
+	result, err := tx.ExecContext(ctx, `
+		UPDATE scheduled_payments SET due_at = $1, attempt_at = $2, attempts = $3, occurrences = $4, status = $5, updated_at = $6
+		WHERE id = $7 AND status = $8 AND due_at = $9 AND attempts = $10`,
+		payment.DueAt, payment.AttemptAt, payment.Attempts, payment.Occurrences, payment.Status, payment.UpdatedAt,
+		payment.Id, dbutil.ScheduleActive, run.DueAt, run.Attempt-1)
+	if err != nil {
+		return fmt.Errorf("error updating scheduled payment: %w", err)
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error getting rows affected: %w", err)
+	}
+	if rows == 0 {
+		return dbutil.ErrScheduledPaymentNotFound
+	}
+
+	var transactionId interface{}
+	if run.TransactionId != 0 {
+		transactionId = run.TransactionId
+	}
+	err = tx.QueryRowContext(ctx, "INSERT INTO scheduled_payment_runs (scheduled_payment_id, due_at, attempt, status, transaction_id, error, ran_at) VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id",
+		run.ScheduledPaymentId, run.DueAt, run.Attempt, run.Status, transactionId, run.Error, run.RanAt).Scan(&run.Id)
+	if err != nil {
+		return fmt.Errorf("error inserting scheduled payment run: %w", err)
+	}
+	return nil
+}
+
+// CancelScheduledPayment stops one of the customer's active scheduled
+// payments. Cancelling an unknown or inactive payment returns
+// dbutil.ErrScheduledPaymentNotFound.
+func (p *postgres) CancelScheduledPayment(ctx context.Context, customerId, id int, at time.Time) error {
+	result, err := p.db.ExecContext(ctx, "UPDATE scheduled_payments SET status = $1, updated_at = $2 WHERE id = $3 AND customer_id = $4 AND status = $5",
+		dbutil.ScheduleCancelled, at, id, customerId, dbutil.ScheduleActive)
+	if err != nil {
+		return fmt.Errorf("error cancelling scheduled payment: %w", err)
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error getting rows affected: %w", err)
+	}
+	if rows == 0 {
+		return dbutil.ErrScheduledPaymentNotFound
+	}
+	return nil
+}
+
+// ListScheduledPaymentRuns returns the history of a scheduled payment, most
+// recent first.
+func (p *postgres) ListScheduledPaymentRuns(ctx context.Context, scheduledPaymentId int) ([]dbutil.ScheduledPaymentRun, error) {
+	rows, err := p.db.QueryContext(ctx, `
+		SELECT id, scheduled_payment_id, due_at, attempt, status, COALESCE(transaction_id, 0), error, ran_at
+		FROM scheduled_payment_runs WHERE scheduled_payment_id = $1 ORDER BY id DESC`, scheduledPaymentId)
+	if err != nil {
+		return nil, fmt.Errorf("error querying scheduled payment runs: %w", err)
+	}
+	defer rows.Close()
+
+	var runs []dbutil.ScheduledPaymentRun
+	for rows.Next() {
+		var run dbutil.ScheduledPaymentRun
+		err := rows.Scan(&run.Id, &run.ScheduledPaymentId, &run.DueAt, &run.Attempt, &run.Status, &run.TransactionId, &run.Error, &run.RanAt)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning scheduled payment run: %w", err)
+		}
+		runs = append(runs, run)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over rows: %w", err)
+	}
+	return runs, nil
+}
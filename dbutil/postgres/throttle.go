@@ -0,0 +1,67 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"minibank/dbutil"
+	"time"
+)
+
+// GetLoginThrottle returns the failure count for key, which is zero if there
+// have been no failures.
+func (p *postgres) GetLoginThrottle(ctx context.Context, key string) (*dbutil.LoginThrottle, error) {
+	throttle, err := scanLoginThrottle(p.db.QueryRowContext(ctx, "SELECT key, failures, last_failure_at, locked_until FROM login_throttles WHERE key = $1", key))
+	if err == sql.ErrNoRows {
+		return &dbutil.LoginThrottle{Key: key}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error fetching login throttle: %w", err)
+	}
+	return throttle, nil
+}
+
+// RecordLoginFailure counts a failed login for key in a single statement, so
+// concurrent guesses cannot lose a count. Failures before resetBefore are
+// forgotten first.
+func (p *postgres) RecordLoginFailure(ctx context.Context, key string, at, resetBefore time.Time) (*dbutil.LoginThrottle, error) {
+	throttle, err := scanLoginThrottle(p.db.QueryRowContext(ctx, `
+		INSERT INTO login_throttles (key, failures, last_failure_at) VALUES ($1, 1, $2)
+		ON CONFLICT (key) DO UPDATE SET
+			failures = CASE WHEN login_throttles.last_failure_at < $3 THEN 1 ELSE login_throttles.failures + 1 END,
+			last_failure_at = excluded.last_failure_at
+		RETURNING key, failures, last_failure_at, locked_until`,
+		key, at.UTC(), resetBefore.UTC()))
+	if err != nil {
+		return nil, fmt.Errorf("error recording login failure: %w", err)
+	}
+	return throttle, nil
+}
+
+func (p *postgres) LockLogin(ctx context.Context, key string, until time.Time) error {
+	_, err := p.db.ExecContext(ctx, "UPDATE login_throttles SET locked_until = $1 WHERE key = $2", until.UTC(), key)
+	if err != nil {
+		return fmt.Errorf("error locking login: %w", err)
+	}
+	return nil
+}
+
+// ClearLoginThrottle forgets the failures and any lock for key.
+func (p *postgres) ClearLoginThrottle(ctx context.Context, key string) error {
+	_, err := p.db.ExecContext(ctx, "DELETE FROM login_throttles WHERE key = $1", key)
+	if err != nil {
+		return fmt.Errorf("error clearing login throttle: %w", err)
+	}
+	return nil
+}
+
+func scanLoginThrottle(row scanner) (*dbutil.LoginThrottle, error) {
+	var throttle dbutil.LoginThrottle
+	var lockedUntil sql.NullTime
+	err := row.Scan(&throttle.Key, &throttle.Failures, &throttle.LastFailureAt, &lockedUntil)
+	if err != nil {
+		return nil, err
+	}
+	throttle.LockedUntil = lockedUntil.Time
+	return &throttle, nil
+}
@@ -0,0 +1,223 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"minibank/dbutil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// transactionColumns lists the columns scanTransaction expects, in order.
+const transactionColumns = "id, from_account, to_account, amount, currency, destination_amount, destination_currency, fx_rate, fee, transaction_type, status, created_at, expires_at, settled_at, reverses, reference"
+
+// scanTransaction scans a full transaction row. The fee is in the same
+// currency as the amount.
+func scanTransaction(row scanner, transaction *dbutil.Transaction) error {
+	var currency, destinationCurrency string
+	var expiresAt, settledAt sql.NullTime
+	var reverses sql.NullInt64
+	err := row.Scan(&transaction.Id, &transaction.FromAccount, &transaction.ToAccount, &transaction.Amount, &currency,
+		&transaction.DestinationAmount, &destinationCurrency, &transaction.Rate, &transaction.Fee, &transaction.TransactionType,
+		&transaction.Status, &transaction.CreatedAt, &expiresAt, &settledAt, &reverses, &transaction.Reference)
+	if err != nil {
+		return err
+	}
+	transaction.Amount.Currency = currency
+	transaction.Fee.Currency = currency
+	transaction.DestinationAmount.Currency = destinationCurrency
+	if expiresAt.Valid {
+		transaction.ExpiresAt = &expiresAt.Time
+	}
+	if settledAt.Valid {
+		transaction.SettledAt = &settledAt.Time
+	}
+	transaction.Reverses = int(reverses.Int64)
+	return nil
+}
+
+// MakeTransaction inserts transaction and sets its id. A posted transaction
+// is settled as it is made; a pending one is not settled until it is
+// captured or voided.
+func (p *postgres) MakeTransaction(ctx context.Context, tx *sql.Tx, transaction *dbutil.Transaction) error {
+	now := time.Now()
+	var settledAt *time.Time
+	if transaction.Status == dbutil.TransactionPosted {
+		settledAt = &now
+	}
+	var reverses interface{}
+	if transaction.Reverses != 0 {
+		reverses = transaction.Reverses
+	}
+	err := tx.QueryRowContext(ctx, `
+		INSERT INTO transactions (from_account, to_account, amount, currency, destination_amount, destination_currency, fx_rate, fee, transaction_type, status, created_at, expires_at, settled_at, reverses, reference)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15) RETURNING id`,
+		transaction.FromAccount, transaction.ToAccount, transaction.Amount, transaction.Amount.Currency,
+		transaction.DestinationAmount, transaction.DestinationAmount.Currency, transaction.Rate, transaction.Fee, transaction.TransactionType,
+		transaction.Status, now, nullTime(transaction.ExpiresAt), nullTime(settledAt), reverses, transaction.Reference).Scan(&transaction.Id)
+	if err != nil {
+		return fmt.Errorf("error inserting transaction: %w", err)
+	}
+	return nil
+}
+
+// ListTransactionsFromAccount returns the page of filter.AccountId's
+// history that filter picks.
+func (p *postgres) ListTransactionsFromAccount(ctx context.Context, filter dbutil.TransactionFilter) (*dbutil.TransactionPage, error) {
+	query := `
+		SELECT ` + transactionColumns + `
+		FROM transactions
+		WHERE (from_account = $1 OR to_account = $1)`
+	args := []interface{}{filter.AccountId}
+	// arg adds v to args and returns its placeholder
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	// The amount as the account sees it, in its own currency
+	const amount = "CASE WHEN to_account = $1 THEN destination_amount ELSE amount END"
+
+	switch filter.Direction {
+	case dbutil.DirectionIn:
+		query += " AND to_account = $1"
+	case dbutil.DirectionOut:
+		query += " AND from_account = $1"
+	}
+	// When each transaction happened, for the dates and the date orders
+	at := "created_at"
+	if filter.Settled {
+		at = "settled_at"
+		query += " AND status = " + arg(dbutil.TransactionPosted)
+	}
+	if filter.Since != nil {
+		query += " AND " + at + " >= " + arg(filter.Since.UTC())
+	}
+	if filter.Until != nil {
+		query += " AND " + at + " < " + arg(filter.Until.UTC())
+	}
+	if filter.MinAmount != nil {
+		query += " AND " + amount + " >= " + arg(filter.MinAmount.Minor)
+	}
+	if filter.MaxAmount != nil {
+		query += " AND " + amount + " <= " + arg(filter.MaxAmount.Minor)
+	}
+	if filter.Type != "" {
+		query += " AND transaction_type = " + arg(filter.Type)
+	}
+	if filter.Status != "" {
+		query += " AND status = " + arg(filter.Status)
+	}
+	if filter.Counterparty != "" {
+		counterpartyID, _ := filter.CounterpartyId()
+		id := arg(counterpartyID)
+		like := arg("%" + strings.ToLower(filter.Counterparty) + "%")
+		query += `
+		AND CASE WHEN from_account = $1 THEN to_account ELSE from_account END IN (
+			SELECT a.id FROM account a JOIN customers c ON c.id = a.customer_id
+			WHERE a.id = ` + id + ` OR LOWER(a.nickname) LIKE ` + like + ` OR LOWER(c.first_name || ' ' || c.last_name) LIKE ` + like + `
+				OR LOWER(c.email) LIKE ` + like + ` OR CAST(c.phone_number AS TEXT) LIKE ` + like + `)`
+	}
+
+	sort := filter.SortOrder()
+	if filter.After != "" {
+		cursor, err := dbutil.ParseHistoryCursor(filter.After, sort)
+		if err != nil {
+			return nil, err
+		}
+		id := arg(cursor.Id)
+		switch sort {
+		case dbutil.SortNewest:
+			query += " AND (" + at + ", id) < (" + arg(cursor.CreatedAt.UTC()) + ", " + id + ")"
+		case dbutil.SortOldest:
+			query += " AND (" + at + ", id) > (" + arg(cursor.CreatedAt.UTC()) + ", " + id + ")"
+		case dbutil.SortLargest:
+			query += " AND (" + amount + ", id) < (" + arg(cursor.Amount) + ", " + id + ")"
+		case dbutil.SortSmallest:
+			query += " AND (" + amount + ", id) > (" + arg(cursor.Amount) + ", " + id + ")"
+		}
+	}
+
+	switch sort {
+	case dbutil.SortOldest:
+		query += " ORDER BY " + at + ", id"
+	case dbutil.SortLargest:
+		query += " ORDER BY " + amount + " DESC, id DESC"
+	case dbutil.SortSmallest:
+		query += " ORDER BY " + amount + ", id"
+	default:
+		query += " ORDER BY " + at + " DESC, id DESC"
+	}
+	if filter.Limit > 0 {
+		query += " LIMIT " + arg(filter.Limit+1)
+	}
+
+	rows, err := p.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error executing query: %w", err)
+	}
+	defer rows.Close()
+
+	var transactions []dbutil.Transaction
+	for rows.Next() {
+		var transaction dbutil.Transaction
+		err := scanTransaction(rows, &transaction)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning transaction: %w", err)
+		}
+
+		transactions = append(transactions, transaction)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over rows: %w", err)
+	}
+
+	return dbutil.NewTransactionPage(&filter, transactions), nil
+}
+
+// AccountBalanceAt returns what accountId's balance was at the given time,
+// counting the transactions settled before it, so a hold counts from when
+// it was captured. A payment from the account to itself counts for
+// nothing. Statements date transactions the same way, so one period's
+// closing balance is the next one's opening balance.
+func (p *postgres) AccountBalanceAt(ctx context.Context, accountID int, at time.Time) (dbutil.Money, error) {
+	var balance dbutil.Money
+	var currency string
+	err := p.db.QueryRowContext(ctx, `
+		SELECT COALESCE(SUM(CASE
+			WHEN t.from_account = t.to_account THEN 0
+			WHEN t.to_account = a.id THEN t.destination_amount
+			ELSE -(t.amount + t.fee) END), 0), a.currency
+		FROM account a
+		LEFT JOIN transactions t ON (t.from_account = a.id OR t.to_account = a.id) AND t.status = $1 AND t.settled_at < $2
+		WHERE a.id = $3
+		GROUP BY a.id, a.currency`, dbutil.TransactionPosted, at.UTC(), accountID).Scan(&balance, &currency)
+	if err != nil {
+		return balance, fmt.Errorf("error summing transactions of account %d: %w", accountID, err)
+	}
+	balance.Currency = currency
+	return balance, nil
+}
+
+func (p *postgres) GetTransaction(ctx context.Context, transactionID int) (*dbutil.Transaction, error) {
+	return getTransaction(ctx, p.db, transactionID)
+}
+
+// getTransaction reads a transaction through q, which may be an open
+// transaction.
+func getTransaction(ctx context.Context, q queryRower, transactionID int) (*dbutil.Transaction, error) {
+	var transaction dbutil.Transaction
+	row := q.QueryRowContext(ctx, "SELECT "+transactionColumns+" FROM transactions WHERE id = $1", transactionID)
+
+	err := scanTransaction(row, &transaction)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("transaction not found: %w", err)
+		}
+		return nil, fmt.Errorf("error fetching transaction: %w", err)
+	}
+	return &transaction, nil
+}
@@ -0,0 +1,199 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"minibank/dbutil"
+	"time"
+)
+
+// Transfer moves amount between two accounts in a single database
+// transaction. Both account rows are locked before anything is read, so
+// concurrent transfers (and retries carrying the same idempotency key) are
+// serialised per account, and the debit is still conditional on the funds
+// being there. Money set aside by pending holds is not available to pay with.
+//
+// amount must be in the paying account's currency. If the receiving account
+// is held in another currency the payment is converted at the current rate
+// from the exchange rate table, plus its fee, or fails with
+// dbutil.ErrNoExchangeRate if there is none.
+//
+// A non-empty idempotency key that is still live for the paying account
+// returns the transaction it was first used for without moving money again.
+func (p *postgres) Transfer(ctx context.Context, fromAccountId, toAccountId int, amount dbutil.Money, key dbutil.IdempotencyKey) (id int, err error) {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			tx.Rollback()
+			panic(r)
+		} else if err != nil {
+			log.Printf("Rolling back transaction due to error: %v", err)
+			tx.Rollback()
+		} else {
+			err = tx.Commit()
+			if err != nil {
+				log.Printf("Error committing transaction: %v", err)
+				id, err = 0, fmt.Errorf("error committing transaction: %w", err)
+			}
+		}
+	}()
+
+	err = lockAccounts(ctx, tx, fromAccountId, toAccountId)
+	if err != nil {
+		return 0, err
+	}
+
+	return p.transfer(ctx, tx, fromAccountId, toAccountId, amount, "", key)
+}
+
+// transfer makes one payment through tx, as Transfer describes, with the
+// payer's reference, and returns its transaction id. The caller must have
+// locked both accounts. Transfer and TransferBatch both make their payments
+// here.
+func (p *postgres) transfer(ctx context.Context, tx *sql.Tx, fromAccountId, toAccountId int, amount dbutil.Money, reference string, key dbutil.IdempotencyKey) (int, error) {
+	if key.Key != "" {
+		id, err := p.replayTransfer(ctx, tx, fromAccountId, toAccountId, amount, key)
+		if err != nil {
+			return 0, err
+		}
+		if id != 0 {
+			return id, nil
+		}
+	}
+
+	transaction, err := p.newTransfer(ctx, tx, fromAccountId, toAccountId, amount)
+	if err != nil {
+		return 0, err
+	}
+	transaction.Reference = reference
+
+	// Post the debit and credit entries, which also moves both balances
+	err = p.post(ctx, tx, transaction, true)
+	if err != nil {
+		return 0, fmt.Errorf("error posting transfer: %w", err)
+	}
+
+	if transaction.Id == 0 {
+		return 0, fmt.Errorf("error: transaction ID is not set")
+	}
+
+	if key.Key != "" {
+		err = p.saveIdempotencyKey(ctx, tx, fromAccountId, key, transaction.Id)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return transaction.Id, nil
+}
+
+// newTransfer reads both accounts through tx, checks that amount can move
+// between them and returns the payment, converted if the receiving account
+// is held in another currency. A payment that would credit nothing is
+// refused with dbutil.ErrAmountTooSmall. Nothing is written.
+func (p *postgres) newTransfer(ctx context.Context, tx *sql.Tx, fromAccountId, toAccountId int, amount dbutil.Money) (*dbutil.Transaction, error) {
+	fromAccount, toAccount, err := transferAccounts(ctx, tx, fromAccountId, toAccountId)
+	if err != nil {
+		return nil, err
+	}
+
+	if amount.Currency != fromAccount.Currency() {
+		return nil, fmt.Errorf("paying %s from a %s account: %w", amount.Currency, fromAccount.Currency(), dbutil.ErrCurrencyMismatch)
+	}
+
+	transaction := dbutil.NewTransaction(fromAccount.Id, toAccount.Id, amount, "Transfer")
+
+	if toAccount.Currency() != amount.Currency {
+		rate, err := getExchangeRate(ctx, tx, amount.Currency, toAccount.Currency())
+		if err != nil {
+			return nil, err
+		}
+		err = transaction.Convert(rate)
+		if err != nil {
+			return nil, fmt.Errorf("error converting payment: %w", err)
+		}
+	}
+	if !transaction.DestinationAmount.IsPositive() {
+		return nil, fmt.Errorf("paying %s %s into a %s account: %w", amount, amount.Currency, toAccount.Currency(), dbutil.ErrAmountTooSmall)
+	}
+
+	return transaction, nil
+}
+
+// transferAccounts reads both sides of a payment through tx and checks that
+// they are different accounts and neither is frozen or closed.
+func transferAccounts(ctx context.Context, tx *sql.Tx, fromAccountId, toAccountId int) (*dbutil.Account, *dbutil.Account, error) {
+	if fromAccountId == toAccountId {
+		return nil, nil, fmt.Errorf("account %d: %w", fromAccountId, dbutil.ErrSameAccount)
+	}
+
+	fromAccount, err := getAccount(ctx, tx, fromAccountId)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error getting from account: %w", err)
+	}
+
+	toAccount, err := getAccount(ctx, tx, toAccountId)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error getting to account: %w", err)
+	}
+
+	err = fromAccount.CheckActive()
+	if err != nil {
+		return nil, nil, fmt.Errorf("paying account %d: %w", fromAccount.Id, err)
+	}
+	err = toAccount.CheckActive()
+	if err != nil {
+		return nil, nil, fmt.Errorf("receiving account %d: %w", toAccount.Id, err)
+	}
+	return fromAccount, toAccount, nil
+}
+
+func (p *postgres) UpdateAccountBalance(ctx context.Context, tx *sql.Tx, account *dbutil.Account) error {
+	_, err := tx.ExecContext(ctx, "UPDATE account SET balance = $1, updated_at = $2 WHERE id = $3", account.Balance, time.Now(), account.Id)
+	if err != nil {
+		return fmt.Errorf("error updating account balance: %w", err)
+	}
+
+	return nil
+}
+
+// Stimulus credits account with dbutil.StimulusAmount from the funding
+// account for its currency, through tx. Like any other payment it cannot go
+// to an account that is frozen or closed, which is read again through tx
+// rather than trusted from the caller's copy.
+func (p *postgres) Stimulus(ctx context.Context, tx *sql.Tx, account *dbutil.Account) error {
+	err := lockAccounts(ctx, tx, account.Id)
+	if err != nil {
+		return err
+	}
+	current, err := getAccount(ctx, tx, account.Id)
+	if err != nil {
+		return fmt.Errorf("error getting account: %w", err)
+	}
+	err = current.CheckActive()
+	if err != nil {
+		return fmt.Errorf("receiving account %d: %w", account.Id, err)
+	}
+
+	fundingId, err := p.fundingAccountId(ctx, tx, account.Currency())
+	if err != nil {
+		return err
+	}
+
+	amount := dbutil.StimulusAmount(account.Currency())
+	transaction := dbutil.NewTransaction(fundingId, account.Id, amount, "Stimulus")
+
+	err = p.post(ctx, tx, transaction, false)
+	if err != nil {
+		return err
+	}
+
+	// Keep the caller's copy in step with the row
+	account.Balance = account.Balance.Add(amount)
+	return nil
+}
@@ -0,0 +1,164 @@
+package dbutil
+
+import (
+	"errors"
+	"minibank/cron"
+	"time"
+)
+
+// How often a scheduled payment repeats. A cron payment follows the
+// five-field rule in Rule, evaluated in UTC.
+const (
+	FrequencyOnce    = "once"
+	FrequencyWeekly  = "weekly"
+	FrequencyMonthly = "monthly"
+	FrequencyCron    = "cron"
+)
+
+// Frequencies lists every valid frequency.
+var Frequencies = []string{FrequencyOnce, FrequencyWeekly, FrequencyMonthly, FrequencyCron}
+
+// ValidFrequency reports whether frequency is one of Frequencies.
+func ValidFrequency(frequency string) bool {
+	for _, f := range Frequencies {
+		if f == frequency {
+			return true
+		}
+	}
+	return false
+}
+
+// Scheduled payment statuses. Only active payments are run; the others are
+// kept for their history. A payment is completed once it has no occurrences
+// left, and failed if one of its accounts was closed under it or a one-off
+// payment ran out of attempts.
+const (
+	ScheduleActive    = "active"
+	ScheduleCompleted = "completed"
+	ScheduleCancelled = "cancelled"
+	ScheduleFailed    = "failed"
+)
+
+// Scheduled payment run statuses.
+const (
+	RunSucceeded = "succeeded"
+	RunFailed    = "failed"
+)
+
+// ErrScheduledPaymentNotFound is returned for a scheduled payment that does
+// not exist, belongs to someone else or, when changing it, is no longer
+// active or has already moved on.
+var ErrScheduledPaymentNotFound = errors.New("scheduled payment not found")
+
+// ScheduledPayment is a transfer of Amount from FromAccount to ToAccount that
+// the scheduler makes at DueAt, and then again at each later occurrence
+// until EndAt, if the payment repeats.
+//
+// A failed attempt is retried at AttemptAt, which is DueAt until the first
+// failure; Attempts counts the failures of the current occurrence.
+// Occurrences counts the ones that were paid.
+type ScheduledPayment struct {
+	Id          int        `json:"id"`
+	CustomerId  int        `json:"customer_id"`
+	FromAccount int        `json:"from_account"`
+	ToAccount   int        `json:"to_account"`
+	Amount      Money      `json:"amount"`
+	Frequency   string     `json:"frequency"`
+	Rule        string     `json:"rule,omitempty"`
+	StartAt     time.Time  `json:"start_at"`
+	EndAt       *time.Time `json:"end_at,omitempty"`
+	DueAt       time.Time  `json:"due_at"`
+	AttemptAt   time.Time  `json:"attempt_at"`
+	Attempts    int        `json:"attempts"`
+	Occurrences int        `json:"occurrences"`
+	Status      string     `json:"status"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+}
+
+// ScheduledPaymentRun records one attempt at an occurrence of a scheduled
+// payment: the transaction it made, or why it failed.
+type ScheduledPaymentRun struct {
+	Id                 int       `json:"id"`
+	ScheduledPaymentId int       `json:"scheduled_payment_id"`
+	DueAt              time.Time `json:"due_at"`
+	Attempt            int       `json:"attempt"`
+	Status             string    `json:"status"`
+	TransactionId      int       `json:"transaction_id,omitempty"`
+	Error              string    `json:"error,omitempty"`
+	RanAt              time.Time `json:"ran_at"`
+}
+
+// Active reports whether the scheduler still runs the payment.
+func (p *ScheduledPayment) Active() bool {
+	return p.Status == ScheduleActive
+}
+
+// FirstDue returns the first occurrence of the payment, at or after StartAt,
+// or false if it never falls due before EndAt.
+func (p *ScheduledPayment) FirstDue() (time.Time, bool) {
+	return p.NextDue(p.StartAt.Add(-time.Nanosecond))
+}
+
+// NextDue returns the first occurrence of the payment strictly after t, or
+// false if there is none before EndAt. Weekly payments fall due every seven
+// days from StartAt, and monthly ones on the day of the month of StartAt, or
+// the last day of shorter months.
+func (p *ScheduledPayment) NextDue(t time.Time) (time.Time, bool) {
+	var next time.Time
+	switch p.Frequency {
+	case FrequencyOnce:
+		if p.StartAt.After(t) {
+			next = p.StartAt
+		}
+	case FrequencyWeekly:
+		const week = 7 * 24 * time.Hour
+		next = p.StartAt
+		if !next.After(t) {
+			next = next.Add((t.Sub(p.StartAt)/week + 1) * week)
+		}
+	case FrequencyMonthly:
+		months := (t.Year()-p.StartAt.Year())*12 + int(t.Month()-p.StartAt.Month()) - 1
+		if months < 0 {
+			months = 0
+		}
+		for next = addMonths(p.StartAt, months); !next.After(t); months++ {
+			next = addMonths(p.StartAt, months+1)
+		}
+	case FrequencyCron:
+		schedule, err := cron.Parse(p.Rule)
+		if err == nil {
+			next = schedule.Next(t.UTC())
+		}
+	}
+
+	if next.IsZero() || (p.EndAt != nil && next.After(*p.EndAt)) {
+		return time.Time{}, false
+	}
+	return next, true
+}
+
+// addMonths adds n months to t, keeping its day of the month unless the
+// month is too short for it, in which case it is the last day.
+func addMonths(t time.Time, n int) time.Time {
+	year, month := t.Year(), t.Month()+time.Month(n)
+	lastDay := time.Date(year, month+1, 0, 0, 0, 0, 0, t.Location()).Day()
+	day := t.Day()
+	if day > lastDay {
+		day = lastDay
+	}
+	return time.Date(year, month, day, t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), t.Location())
+}
+
+// Advance moves the payment on to its next occurrence with a clean slate of
+// attempts, or completes it if there is none.
+func (p *ScheduledPayment) Advance() {
+	p.Attempts = 0
+	next, ok := p.NextDue(p.DueAt)
+	if !ok {
+		p.Status = ScheduleCompleted
+		return
+	}
+	p.DueAt = next
+	p.AttemptAt = next
+}
@@ -0,0 +1,22 @@
+package dbutil
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrSessionNotFound is returned for an unknown, revoked or expired session.
+var ErrSessionNotFound = errors.New("session not found")
+
+// Session is a server-side login session. Data holds the encoded session
+// values; the cookie only carries the signed Id.
+type Session struct {
+	Id         string    `json:"id"`
+	CustomerId int       `json:"customer_id,omitempty"`
+	Data       string    `json:"-"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
@@ -1,127 +1,138 @@
 package sqlite
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"log"
 	"minibank/dbutil"
-	"os"
+	"time"
 )
 
-func (s *sqlite) GetAccounts() []dbutil.Account {
-	sqlScript, err := os.ReadFile("./sql/queryUsers.sql")
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// accountColumns lists the columns scanAccount expects, in order.
+const accountColumns = "id, customer_id, type, nickname, balance, held, currency, created_at, updated_at, status, status_reason, status_changed_at"
+
+// scanAccount scans a full account row.
+func scanAccount(row scanner, account *dbutil.Account) error {
+	var statusChangedAt sql.NullTime
+	var currency string
+	err := row.Scan(&account.Id, &account.Customer_id, &account.Type, &account.Nickname, &account.Balance, &account.Held, &currency, &account.Created_at, &account.Updated_at, &account.Status, &account.Status_reason, &statusChangedAt)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	var accounts []dbutil.Account
-	rows, err := s.db.Query(string(sqlScript))
-	if err != nil {
-		panic(err)
+	account.Balance.Currency = currency
+	account.Held.Currency = currency
+	if statusChangedAt.Valid {
+		account.Status_changed_at = &statusChangedAt.Time
 	}
+	return nil
+}
+
+// scanAccounts collects every account in rows and closes it.
+func scanAccounts(rows *sql.Rows) ([]dbutil.Account, error) {
+	defer rows.Close()
+	var accounts []dbutil.Account
 	for rows.Next() {
 		var account dbutil.Account
-		var id sql.NullInt64
-		err := rows.Scan(
-			&id,
-			&account.First_name,
-			&account.Last_name,
-			&account.Email,
-			&account.Phone_number,
-			&account.Encrypted_password,
-			&account.Balance,
-			&account.Created_at,
-			&account.Updated_at,
-		)
+		err := scanAccount(rows, &account)
 		if err != nil {
-			return nil
-		}
-		if id.Valid {
-			account.Id = int(id.Int64)
+			return nil, fmt.Errorf("error scanning row: %w", err)
 		}
 		accounts = append(accounts, account)
 	}
-	return accounts
-}
-
-func (s *sqlite) CreateAccount(account *dbutil.Account) error {
-	stmt, err := s.db.Prepare("INSERT INTO account(first_name, last_name, email, phone_number, encrypted_password, balance, created_at, updated_at) values(?, ?, ?, ?, ?, ?, ?, ?)")
-	if err != nil {
-		log.Println("error preparing statement: ", err)
-		return fmt.Errorf("error preparing statement: %w", err)
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over rows: %w", err)
 	}
-	defer stmt.Close()
+	return accounts, nil
+}
 
-	res, err := stmt.Exec(account.First_name, account.Last_name, account.Email, account.Phone_number, account.Encrypted_password, account.Balance, account.Created_at, account.Updated_at)
+// GetAccounts returns every account except the funding account.
+func (s *sqlite) GetAccounts(ctx context.Context) []dbutil.Account {
+	rows, err := s.db.QueryContext(ctx, "SELECT "+accountColumns+" FROM account WHERE customer_id NOT IN (SELECT id FROM customers WHERE email = ?) ORDER BY id", dbutil.FundingAccountEmail)
 	if err != nil {
-		log.Println("error executing statement: ", err)
-		return fmt.Errorf("error executing statement: %w", err)
+		panic(err)
 	}
-
-	id, err := res.LastInsertId()
+	accounts, err := scanAccounts(rows)
 	if err != nil {
-		log.Println("error getting last inserted id: ", err)
-		return fmt.Errorf("error getting last inserted id: %w", err)
+		log.Println("Error listing accounts:", err)
+		return nil
 	}
-	account.Id = int(id)
-	return nil
+	return accounts
 }
 
-func (s *sqlite) GetAccount(id int) (*dbutil.Account, error) {
-	// Prepare the SQL statement
-	stmt, err := s.db.Prepare("SELECT * FROM account WHERE id = ?")
+// ListCustomerAccounts returns the customer's accounts, oldest first.
+func (s *sqlite) ListCustomerAccounts(ctx context.Context, customerId int) ([]dbutil.Account, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT "+accountColumns+" FROM account WHERE customer_id = ? ORDER BY id", customerId)
 	if err != nil {
-		return nil, fmt.Errorf("error preparing statement: %w", err)
+		return nil, fmt.Errorf("error listing accounts: %w", err)
 	}
-	defer stmt.Close()
+	return scanAccounts(rows)
+}
 
+// getAccount reads an account through an open transaction.
+func getAccount(ctx context.Context, tx *sql.Tx, id int) (*dbutil.Account, error) {
 	var account dbutil.Account
-	err = stmt.QueryRow(id).Scan(&account.Id, &account.First_name, &account.Last_name, &account.Email, &account.Phone_number, &account.Encrypted_password, &account.Balance, &account.Created_at, &account.Updated_at)
-
+	err := scanAccount(tx.QueryRowContext(ctx, "SELECT "+accountColumns+" FROM account WHERE id = ?", id), &account)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, fmt.Errorf("account not found: %w", err)
 		}
 		return nil, fmt.Errorf("error scanning row: %w", err)
 	}
-
 	return &account, nil
 }
 
-func (s *sqlite) GetAccountByEmail(email string) (*dbutil.Account, error) {
-	// Prepare the SQL statement
-	stmt, err := s.db.Prepare("SELECT * FROM account WHERE email = ?") // Use the correct table name "account"
+func (s *sqlite) CreateAccount(ctx context.Context, account *dbutil.Account) error {
+	tx, err := s.beginTx(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("error preparing statement: %w", err)
+		return fmt.Errorf("error starting transaction: %w", err)
 	}
-	defer stmt.Close()
+	defer tx.Rollback()
 
-	var account dbutil.Account
-	err = stmt.QueryRow(email).Scan(&account.Id, &account.First_name, &account.Last_name, &account.Email, &account.Phone_number, &account.Encrypted_password, &account.Balance, &account.Created_at, &account.Updated_at)
+	err = insertAccount(ctx, tx, account)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
 
+// insertAccount stores a new account through an open transaction and sets
+// its id.
+func insertAccount(ctx context.Context, tx *sql.Tx, account *dbutil.Account) error {
+	res, err := tx.ExecContext(ctx, "INSERT INTO account(customer_id, type, nickname, balance, currency, created_at, updated_at, status) values(?, ?, ?, ?, ?, ?, ?, ?)",
+		account.Customer_id, account.Type, account.Nickname, account.Balance, account.Currency(), account.Created_at, account.Updated_at, account.Status)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, fmt.Errorf("account not found: %w", err) // Or you can return nil, nil
-		}
-		return nil, fmt.Errorf("error scanning row: %w", err)
+		log.Println("error executing statement: ", err)
+		return fmt.Errorf("error executing statement: %w", err)
 	}
 
-	return &account, nil
+	id, err := res.LastInsertId()
+	if err != nil {
+		log.Println("error getting last inserted id: ", err)
+		return fmt.Errorf("error getting last inserted id: %w", err)
+	}
+	account.Id = int(id)
+	return nil
 }
 
-func (s *sqlite) GetAccountByPhoneNumber(number int) (*dbutil.Account, error) {
+func (s *sqlite) GetAccount(ctx context.Context, id int) (*dbutil.Account, error) {
 	// Prepare the SQL statement
-	stmt, err := s.db.Prepare("SELECT * FROM account WHERE phone_number = ?") // Use the correct table name "account"
+	stmt, err := s.db.PrepareContext(ctx, "SELECT "+accountColumns+" FROM account WHERE id = ?")
 	if err != nil {
 		return nil, fmt.Errorf("error preparing statement: %w", err)
 	}
 	defer stmt.Close()
 
 	var account dbutil.Account
-	err = stmt.QueryRow(number).Scan(&account.Id, &account.First_name, &account.Last_name, &account.Email, &account.Phone_number, &account.Encrypted_password, &account.Balance, &account.Created_at, &account.Updated_at)
+	err = scanAccount(stmt.QueryRowContext(ctx, id), &account)
 
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return nil, fmt.Errorf("account not found: %w", err) // Or you can return nil, nil
+			return nil, fmt.Errorf("account not found: %w", err)
 		}
 		return nil, fmt.Errorf("error scanning row: %w", err)
 	}
@@ -129,27 +140,37 @@ func (s *sqlite) GetAccountByPhoneNumber(number int) (*dbutil.Account, error) {
 	return &account, nil
 }
 
-func (s *sqlite) DeleteAccount(id int) error {
-	stmt, err := s.db.Prepare("DELETE FROM account WHERE id = ?") // Use correct table name "account"
+// SetAccountStatus moves an account to status, recording why. The change is
+// checked against the account's current status, and closing needs a zero
+// balance, in the same transaction as the update so that a payment cannot
+// land in between.
+func (s *sqlite) SetAccountStatus(ctx context.Context, id int, status, reason string, at time.Time) (err error) {
+	tx, err := s.beginTx(ctx)
 	if err != nil {
-		return fmt.Errorf("error preparing delete statement: %w", err)
+		return fmt.Errorf("error starting transaction: %w", err)
 	}
-	defer stmt.Close()
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		} else {
+			err = tx.Commit()
+		}
+	}()
 
-	// Execute the statement with the account ID
-	result, err := stmt.Exec(id)
+	account, err := getAccount(ctx, tx, id)
 	if err != nil {
-		return fmt.Errorf("error deleting account: %w", err)
+		return err
 	}
-
-	rowsAffected, err := result.RowsAffected()
-	if err != nil {
-		return fmt.Errorf("error getting rows affected: %w", err)
+	if !dbutil.CanChangeStatus(account.Status, status) {
+		return fmt.Errorf("account %d is %s, cannot become %s: %w", id, account.Status, status, dbutil.ErrInvalidStatusChange)
 	}
-
-	if rowsAffected == 0 {
-		return fmt.Errorf(`no account found with ID %d`, id)
+	if status == dbutil.StatusClosed && !account.Balance.IsZero() {
+		return dbutil.ErrBalanceNotZero
 	}
 
+	_, err = tx.ExecContext(ctx, "UPDATE account SET status = ?, status_reason = ?, status_changed_at = ?, updated_at = ? WHERE id = ?", status, reason, at, at, id)
+	if err != nil {
+		return fmt.Errorf("error updating account status: %w", err)
+	}
 	return nil
 }
@@ -0,0 +1,101 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"minibank/dbutil"
+	"time"
+)
+
+func (s *sqlite) CreateAPIKey(ctx context.Context, key *dbutil.APIKey) error {
+	result, err := s.db.ExecContext(ctx, "INSERT INTO api_keys (customer_id, name, prefix, token_hash, scopes, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+		key.CustomerId, key.Name, key.Prefix, key.TokenHash, dbutil.JoinScopes(key.Scopes), key.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("error inserting api key: %w", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("error getting last insert ID: %w", err)
+	}
+	key.Id = int(id)
+	return nil
+}
+
+// GetAPIKeyByHash returns the unrevoked key with the given token hash.
+func (s *sqlite) GetAPIKeyByHash(ctx context.Context, hash string) (*dbutil.APIKey, error) {
+	key, err := scanAPIKey(s.db.QueryRowContext(ctx, "SELECT "+apiKeyColumns+" FROM api_keys WHERE token_hash = ? AND revoked_at IS NULL", hash))
+	if err == sql.ErrNoRows {
+		return nil, dbutil.ErrAPIKeyNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error fetching api key: %w", err)
+	}
+	return key, nil
+}
+
+func (s *sqlite) ListAPIKeys(ctx context.Context, customerId int) ([]dbutil.APIKey, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT "+apiKeyColumns+" FROM api_keys WHERE customer_id = ? ORDER BY id", customerId)
+	if err != nil {
+		return nil, fmt.Errorf("error querying api keys: %w", err)
+	}
+	defer rows.Close()
+
+	var keys []dbutil.APIKey
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning api key: %w", err)
+		}
+		keys = append(keys, *key)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over rows: %w", err)
+	}
+	return keys, nil
+}
+
+// RevokeAPIKey revokes one of the customer's keys. Revoking an unknown or
+// already revoked key returns dbutil.ErrAPIKeyNotFound.
+func (s *sqlite) RevokeAPIKey(ctx context.Context, customerId, id int) error {
+	result, err := s.db.ExecContext(ctx, "UPDATE api_keys SET revoked_at = ? WHERE id = ? AND customer_id = ? AND revoked_at IS NULL", time.Now(), id, customerId)
+	if err != nil {
+		return fmt.Errorf("error revoking api key: %w", err)
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error getting rows affected: %w", err)
+	}
+	if rows == 0 {
+		return dbutil.ErrAPIKeyNotFound
+	}
+	return nil
+}
+
+func (s *sqlite) TouchAPIKey(ctx context.Context, id int, at time.Time) error {
+	_, err := s.db.ExecContext(ctx, "UPDATE api_keys SET last_used_at = ? WHERE id = ?", at, id)
+	if err != nil {
+		return fmt.Errorf("error updating api key: %w", err)
+	}
+	return nil
+}
+
+const apiKeyColumns = "id, customer_id, name, prefix, token_hash, scopes, created_at, last_used_at, revoked_at"
+
+func scanAPIKey(row scanner) (*dbutil.APIKey, error) {
+	var key dbutil.APIKey
+	var scopes string
+	var lastUsed, revoked sql.NullTime
+	err := row.Scan(&key.Id, &key.CustomerId, &key.Name, &key.Prefix, &key.TokenHash, &scopes, &key.CreatedAt, &lastUsed, &revoked)
+	if err != nil {
+		return nil, err
+	}
+	key.Scopes = dbutil.SplitScopes(scopes)
+	if lastUsed.Valid {
+		key.LastUsedAt = &lastUsed.Time
+	}
+	if revoked.Valid {
+		key.RevokedAt = &revoked.Time
+	}
+	return &key, nil
+}
@@ -0,0 +1,29 @@
+package sqlite
+
+import (
+	"context"
+	"fmt"
+	"minibank/dbutil"
+)
+
+func (s *sqlite) CreateAuditEvent(ctx context.Context, event *dbutil.AuditEvent) error {
+	result, err := s.db.ExecContext(ctx, "INSERT INTO audit_log (customer_id, account_id, actor_id, event, detail, ip, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		nullableId(event.CustomerId), nullableId(event.AccountId), nullableId(event.ActorId), event.Event, event.Detail, event.IP, event.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("error inserting audit event: %w", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("error getting last insert ID: %w", err)
+	}
+	event.Id = int(id)
+	return nil
+}
+
+// nullableId stores an unset (zero) id as NULL.
+func nullableId(id int) interface{} {
+	if id == 0 {
+		return nil
+	}
+	return id
+}
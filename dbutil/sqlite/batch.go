@@ -0,0 +1,51 @@
+package sqlite
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"minibank/dbutil"
+)
+
+// TransferBatch makes payments from one account in a single database
+// transaction: either every payment is made, or one fails and none is,
+// with a *dbutil.BatchError saying which. Each payment is made as Transfer
+// makes it, idempotency key included, so retrying a batch that went
+// through returns the same transactions.
+func (s *sqlite) TransferBatch(ctx context.Context, fromAccountId int, payments []dbutil.BatchPayment) (err error) {
+	tx, err := s.beginTx(ctx)
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			log.Printf("Rolling back batch due to error: %v", err)
+			tx.Rollback()
+		} else {
+			err = tx.Commit()
+			if err != nil {
+				log.Printf("Error committing batch: %v", err)
+				err = fmt.Errorf("error committing transaction: %w", err)
+			}
+		}
+		// Nothing was made, so no payment has a transaction
+		if err != nil {
+			for i := range payments {
+				payments[i].TransactionId = 0
+			}
+		}
+	}()
+
+	for i := range payments {
+		payment := payments[i]
+		id, err := s.transfer(ctx, tx, fromAccountId, payment.ToAccount, payment.Amount, payment.Reference, payment.Key)
+		if err != nil {
+			return &dbutil.BatchError{Index: i, Err: err}
+		}
+		payments[i].TransactionId = id
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"minibank/dbutil"
+	"time"
+)
+
+func (s *sqlite) CreateEmailToken(ctx context.Context, token *dbutil.EmailToken) error {
+	result, err := s.db.ExecContext(ctx, "INSERT INTO email_tokens (customer_id, purpose, token_hash, created_at, expires_at) VALUES (?, ?, ?, ?, ?)",
+		token.CustomerId, token.Purpose, token.TokenHash, token.CreatedAt.UTC(), token.ExpiresAt.UTC())
+	if err != nil {
+		return fmt.Errorf("error inserting email token: %w", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("error getting last insert ID: %w", err)
+	}
+	token.Id = int(id)
+	return nil
+}
+
+// UseEmailToken marks the unexpired, unused token with the given hash and
+// purpose as used and returns it. Marking and checking happen in one
+// statement, so a token cannot be used twice by racing requests.
+func (s *sqlite) UseEmailToken(ctx context.Context, purpose, hash string, at time.Time) (*dbutil.EmailToken, error) {
+	var token dbutil.EmailToken
+	var usedAt time.Time
+	err := s.db.QueryRowContext(ctx, `
+		UPDATE email_tokens SET used_at = ?
+		WHERE token_hash = ? AND purpose = ? AND used_at IS NULL AND expires_at > ?
+		RETURNING id, customer_id, purpose, token_hash, created_at, expires_at, used_at`,
+		at.UTC(), hash, purpose, at.UTC()).
+		Scan(&token.Id, &token.CustomerId, &token.Purpose, &token.TokenHash, &token.CreatedAt, &token.ExpiresAt, &usedAt)
+	if err == sql.ErrNoRows {
+		return nil, dbutil.ErrEmailTokenNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error using email token: %w", err)
+	}
+	token.UsedAt = &usedAt
+	return &token, nil
+}
+
+// DeleteEmailTokens discards the customer's outstanding tokens for purpose,
+// along with any expired or used tokens of any customer.
+func (s *sqlite) DeleteEmailTokens(ctx context.Context, customerId int, purpose string) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM email_tokens WHERE (customer_id = ? AND purpose = ?) OR used_at IS NOT NULL OR expires_at <= ?",
+		customerId, purpose, time.Now().UTC())
+	if err != nil {
+		return fmt.Errorf("error deleting email tokens: %w", err)
+	}
+	return nil
+}
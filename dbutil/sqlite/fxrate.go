@@ -0,0 +1,69 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"minibank/dbutil"
+)
+
+// queryRower is satisfied by both *sql.DB and *sql.Tx.
+type queryRower interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// getExchangeRate reads the rate from base to quote, or returns
+// dbutil.ErrNoExchangeRate.
+func getExchangeRate(ctx context.Context, q queryRower, base, quote string) (*dbutil.ExchangeRate, error) {
+	var rate dbutil.ExchangeRate
+	err := q.QueryRowContext(ctx, "SELECT base, quote, rate, fee_basis_points, updated_at FROM fx_rates WHERE base = ? AND quote = ?", base, quote).
+		Scan(&rate.Base, &rate.Quote, &rate.Rate, &rate.FeeBasisPoints, &rate.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%s to %s: %w", base, quote, dbutil.ErrNoExchangeRate)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error fetching exchange rate: %w", err)
+	}
+	return &rate, nil
+}
+
+func (s *sqlite) GetExchangeRate(ctx context.Context, base, quote string) (*dbutil.ExchangeRate, error) {
+	return getExchangeRate(ctx, s.db, base, quote)
+}
+
+// ListExchangeRates returns every rate, ordered by currency pair.
+func (s *sqlite) ListExchangeRates(ctx context.Context) ([]dbutil.ExchangeRate, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT base, quote, rate, fee_basis_points, updated_at FROM fx_rates ORDER BY base, quote")
+	if err != nil {
+		return nil, fmt.Errorf("error listing exchange rates: %w", err)
+	}
+	defer rows.Close()
+
+	var rates []dbutil.ExchangeRate
+	for rows.Next() {
+		var rate dbutil.ExchangeRate
+		err := rows.Scan(&rate.Base, &rate.Quote, &rate.Rate, &rate.FeeBasisPoints, &rate.UpdatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning exchange rate: %w", err)
+		}
+		rates = append(rates, rate)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over rows: %w", err)
+	}
+	return rates, nil
+}
+
+// SetExchangeRate adds the rate for its currency pair or replaces the
+// current one. Payments already made keep the rate they were converted at.
+func (s *sqlite) SetExchangeRate(ctx context.Context, rate *dbutil.ExchangeRate) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO fx_rates (base, quote, rate, fee_basis_points, updated_at) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (base, quote) DO UPDATE SET
+			rate = excluded.rate, fee_basis_points = excluded.fee_basis_points, updated_at = excluded.updated_at`,
+		rate.Base, rate.Quote, rate.Rate, rate.FeeBasisPoints, rate.UpdatedAt.UTC())
+	if err != nil {
+		return fmt.Errorf("error saving exchange rate: %w", err)
+	}
+	return nil
+}
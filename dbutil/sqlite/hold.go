@@ -0,0 +1,223 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"minibank/dbutil"
+	"time"
+)
+
+// Authorize places a hold for amount on the paying account. The payment is
+// checked and converted as by Transfer and recorded as a pending transaction
+// that lapses at expiresAt, but nothing is posted: the amount and any fee
+// are only set aside, out of the paying account's available balance, until
+// the hold is captured or voided. The rate is fixed when the hold is placed.
+//
+// The idempotency key works as it does for Transfer.
+func (s *sqlite) Authorize(ctx context.Context, fromAccountId, toAccountId int, amount dbutil.Money, key dbutil.IdempotencyKey, expiresAt time.Time) (id int, err error) {
+	tx, err := s.beginTx(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			log.Printf("Rolling back transaction due to error: %v", err)
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+		if err != nil {
+			id, err = 0, fmt.Errorf("error committing transaction: %w", err)
+		}
+	}()
+
+	if key.Key != "" {
+		id, err = s.replayTransfer(ctx, tx, fromAccountId, toAccountId, amount, key)
+		if err != nil {
+			return 0, err
+		}
+		if id != 0 {
+			return id, nil
+		}
+	}
+
+	transaction, err := s.newTransfer(ctx, tx, fromAccountId, toAccountId, amount)
+	if err != nil {
+		return 0, err
+	}
+	expiresAt = expiresAt.UTC()
+	transaction.Status = dbutil.TransactionPending
+	transaction.ExpiresAt = &expiresAt
+
+	err = s.MakeTransaction(ctx, tx, transaction)
+	if err != nil {
+		return 0, fmt.Errorf("error making transaction: %w", err)
+	}
+
+	// Checked by the UPDATE itself, as for a debit
+	result, err := tx.ExecContext(ctx, "UPDATE account SET held = held + ?, updated_at = ? WHERE id = ? AND balance - held >= ?",
+		transaction.Debit(), time.Now(), transaction.FromAccount, transaction.Debit())
+	if err != nil {
+		return 0, fmt.Errorf("error placing hold: %w", err)
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("error getting rows affected: %w", err)
+	}
+	if rows == 0 {
+		return 0, fmt.Errorf("account %d: %w", transaction.FromAccount, dbutil.ErrInsufficientFunds)
+	}
+
+	if key.Key != "" {
+		err = s.saveIdempotencyKey(ctx, tx, fromAccountId, key, transaction.Id)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return transaction.Id, nil
+}
+
+// CaptureHold posts a pending hold as of at: the hold is released and the
+// payment's entries are posted in its place. A hold that has expired, even
+// if it has not been voided yet, returns dbutil.ErrHoldExpired, and both
+// accounts must still be active.
+func (s *sqlite) CaptureHold(ctx context.Context, id int, at time.Time) (err error) {
+	tx, err := s.beginTx(ctx)
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+		if err != nil {
+			err = fmt.Errorf("error committing transaction: %w", err)
+		}
+	}()
+
+	transaction, err := getPendingHold(ctx, tx, id)
+	if err != nil {
+		return err
+	}
+	if !at.Before(*transaction.ExpiresAt) {
+		return fmt.Errorf("transaction %d: %w", id, dbutil.ErrHoldExpired)
+	}
+	_, _, err = transferAccounts(ctx, tx, transaction.FromAccount, transaction.ToAccount)
+	if err != nil {
+		return err
+	}
+
+	err = settleHold(ctx, tx, transaction, dbutil.TransactionPosted, at)
+	if err != nil {
+		return err
+	}
+	err = s.post(ctx, tx, transaction, true)
+	if err != nil {
+		return fmt.Errorf("error posting hold: %w", err)
+	}
+	return nil
+}
+
+// VoidHold cancels a pending hold as of at, releasing the money it set
+// aside. Nothing is posted.
+func (s *sqlite) VoidHold(ctx context.Context, id int, at time.Time) (err error) {
+	tx, err := s.beginTx(ctx)
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+		if err != nil {
+			err = fmt.Errorf("error committing transaction: %w", err)
+		}
+	}()
+
+	transaction, err := getPendingHold(ctx, tx, id)
+	if err != nil {
+		return err
+	}
+	return settleHold(ctx, tx, transaction, dbutil.TransactionVoided, at)
+}
+
+// ExpireHolds voids every pending hold that has expired by now, as of the
+// time it expired, and returns how many there were.
+func (s *sqlite) ExpireHolds(ctx context.Context, now time.Time) (n int, err error) {
+	tx, err := s.beginTx(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+		if err != nil {
+			n, err = 0, fmt.Errorf("error committing transaction: %w", err)
+		}
+	}()
+
+	now = now.UTC()
+	_, err = tx.ExecContext(ctx, `
+		UPDATE account SET held = held - (
+			SELECT SUM(t.amount + t.fee) FROM transactions t
+			WHERE t.from_account = account.id AND t.status = ? AND t.expires_at <= ?
+		), updated_at = ?
+		WHERE id IN (SELECT from_account FROM transactions WHERE status = ? AND expires_at <= ?)`,
+		dbutil.TransactionPending, now, now, dbutil.TransactionPending, now)
+	if err != nil {
+		return 0, fmt.Errorf("error releasing expired holds: %w", err)
+	}
+
+	result, err := tx.ExecContext(ctx, "UPDATE transactions SET status = ?, settled_at = expires_at WHERE status = ? AND expires_at <= ?",
+		dbutil.TransactionVoided, dbutil.TransactionPending, now)
+	if err != nil {
+		return 0, fmt.Errorf("error voiding expired holds: %w", err)
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("error getting rows affected: %w", err)
+	}
+	return int(rows), nil
+}
+
+// getPendingHold reads a transaction through tx and checks that it is a
+// pending hold.
+func getPendingHold(ctx context.Context, tx *sql.Tx, id int) (*dbutil.Transaction, error) {
+	transaction, err := getTransaction(ctx, tx, id)
+	if err != nil {
+		return nil, err
+	}
+	if !transaction.Pending() {
+		return nil, fmt.Errorf("transaction %d is %s: %w", id, transaction.Status, dbutil.ErrNotPending)
+	}
+	return transaction, nil
+}
+
+// settleHold releases the money a pending hold set aside and moves it to
+// status as of at.
+func settleHold(ctx context.Context, tx *sql.Tx, transaction *dbutil.Transaction, status string, at time.Time) error {
+	_, err := tx.ExecContext(ctx, "UPDATE account SET held = held - ?, updated_at = ? WHERE id = ?",
+		transaction.Debit(), at.UTC(), transaction.FromAccount)
+	if err != nil {
+		return fmt.Errorf("error releasing hold: %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE transactions SET status = ?, settled_at = ? WHERE id = ?", status, at.UTC(), transaction.Id)
+	if err != nil {
+		return fmt.Errorf("error settling transaction: %w", err)
+	}
+	at = at.UTC()
+	transaction.Status = status
+	transaction.SettledAt = &at
+	return nil
+}
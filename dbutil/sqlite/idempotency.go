@@ -0,0 +1,51 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"minibank/dbutil"
+	"time"
+)
+
+// replayTransfer looks up a live idempotency key for the paying account. It
+// returns the id of the transaction the key was first used for, or 0 when the
+// key is new. A live key that was used for a different payment is rejected
+// with dbutil.ErrIdempotencyKeyReused.
+func (s *sqlite) replayTransfer(ctx context.Context, tx *sql.Tx, fromAccountId, toAccountId int, amount dbutil.Money, key dbutil.IdempotencyKey) (int, error) {
+	var transactionId int
+	var previousTo int
+	var previousAmount dbutil.Money
+	err := tx.QueryRowContext(ctx, `
+		SELECT t.id, t.to_account, t.amount
+		FROM idempotency_keys k JOIN transactions t ON t.id = k.transaction_id
+		WHERE k.account_id = ? AND k.key = ? AND k.expires_at > ?`,
+		fromAccountId, key.Key, time.Now().UTC()).Scan(&transactionId, &previousTo, &previousAmount)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("error looking up idempotency key: %w", err)
+	}
+
+	if previousTo != toAccountId || previousAmount.Minor != amount.Minor {
+		return 0, dbutil.ErrIdempotencyKeyReused
+	}
+	return transactionId, nil
+}
+
+// saveIdempotencyKey records the transaction a key produced and drops keys
+// whose window has passed so they can be reused.
+func (s *sqlite) saveIdempotencyKey(ctx context.Context, tx *sql.Tx, fromAccountId int, key dbutil.IdempotencyKey, transactionId int) error {
+	_, err := tx.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE expires_at <= ?", time.Now().UTC())
+	if err != nil {
+		return fmt.Errorf("error deleting expired idempotency keys: %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx, "INSERT INTO idempotency_keys (account_id, key, transaction_id, expires_at) VALUES (?, ?, ?, ?)",
+		fromAccountId, key.Key, transactionId, key.ExpiresAt.UTC())
+	if err != nil {
+		return fmt.Errorf("error saving idempotency key: %w", err)
+	}
+	return nil
+}
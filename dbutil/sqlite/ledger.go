@@ -0,0 +1,249 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"minibank/dbutil"
+	"time"
+)
+
+// post records transaction, unless it is a hold that already has been, and
+// its ledger entries (see dbutil.Transaction.Entries), and applies the same
+// amounts to the cached account balances. When requireFunds is set the debit
+// from the paying account is conditional on it still having the amount
+// available, past any holds, at write time, and dbutil.ErrInsufficientFunds
+// is returned if it does not.
+func (s *sqlite) post(ctx context.Context, tx *sql.Tx, transaction *dbutil.Transaction, requireFunds bool) error {
+	// A conversion passes through the bank's accounts in both currencies
+	var bankSource, bankDestination int
+	if transaction.Converted() {
+		var err error
+		bankSource, err = s.fundingAccountId(ctx, tx, transaction.Amount.Currency)
+		if err != nil {
+			return err
+		}
+		bankDestination, err = s.fundingAccountId(ctx, tx, transaction.DestinationAmount.Currency)
+		if err != nil {
+			return err
+		}
+	}
+
+	if transaction.Id == 0 {
+		err := s.MakeTransaction(ctx, tx, transaction)
+		if err != nil {
+			return fmt.Errorf("error making transaction: %w", err)
+		}
+	}
+
+	stmt, err := tx.PrepareContext(ctx, "INSERT INTO ledger_entries (transaction_id, account_id, amount, currency, created_at) VALUES (?, ?, ?, ?, ?)")
+	if err != nil {
+		return fmt.Errorf("error preparing entry statement: %w", err)
+	}
+	defer stmt.Close()
+
+	now := time.Now()
+	for _, entry := range transaction.Entries(bankSource, bankDestination) {
+		query := "UPDATE account SET balance = balance + ?, updated_at = ? WHERE id = ? AND currency = ?"
+		args := []interface{}{entry.Amount, now, entry.AccountId, entry.Amount.Currency}
+		checkFunds := requireFunds && entry.AccountId == transaction.FromAccount && entry.Amount.IsNegative()
+		if checkFunds {
+			// Checked by the UPDATE itself so a concurrent debit cannot
+			// slip in between a read and the write.
+			query += " AND balance - held + ? >= 0"
+			args = append(args, entry.Amount)
+		}
+
+		result, err := tx.ExecContext(ctx, query, args...)
+		if err != nil {
+			return fmt.Errorf("error updating account balance: %w", err)
+		}
+		rows, err := result.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("error getting rows affected: %w", err)
+		}
+		if rows == 0 {
+			if checkFunds {
+				return fmt.Errorf("account %d: %w", entry.AccountId, dbutil.ErrInsufficientFunds)
+			}
+			return fmt.Errorf("no %s account found with ID %d", entry.Amount.Currency, entry.AccountId)
+		}
+
+		_, err = stmt.ExecContext(ctx, entry.TransactionId, entry.AccountId, entry.Amount, entry.Amount.Currency, now)
+		if err != nil {
+			return fmt.Errorf("error inserting ledger entry: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// fundingAccountId returns the id of the system funding account in currency,
+// creating it, and the funding customer, on first use.
+func (s *sqlite) fundingAccountId(ctx context.Context, tx *sql.Tx, currency string) (int, error) {
+	var id int
+	err := tx.QueryRowContext(ctx, "SELECT a.id FROM account a JOIN customers c ON c.id = a.customer_id WHERE c.email = ? AND a.currency = ?", dbutil.FundingAccountEmail, currency).Scan(&id)
+	if err == nil {
+		return id, nil
+	}
+	if err != sql.ErrNoRows {
+		return 0, fmt.Errorf("error fetching funding account: %w", err)
+	}
+
+	now := time.Now()
+	var customerId int
+	err = tx.QueryRowContext(ctx, "SELECT id FROM customers WHERE email = ?", dbutil.FundingAccountEmail).Scan(&customerId)
+	if err == sql.ErrNoRows {
+		result, err := tx.ExecContext(ctx, "INSERT INTO customers(first_name, last_name, email, phone_number, encrypted_password, created_at, updated_at) VALUES (?, ?, ?, NULL, '', ?, ?)",
+			"MiniBank", "Funding", dbutil.FundingAccountEmail, now, now)
+		if err != nil {
+			return 0, fmt.Errorf("error creating funding customer: %w", err)
+		}
+		id, err := result.LastInsertId()
+		if err != nil {
+			return 0, fmt.Errorf("error getting last inserted id: %w", err)
+		}
+		customerId = int(id)
+	} else if err != nil {
+		return 0, fmt.Errorf("error fetching funding customer: %w", err)
+	}
+
+	account := dbutil.Account{
+		Customer_id: customerId,
+		Type:        dbutil.AccountChecking,
+		Nickname:    currency,
+		Balance:     dbutil.NewMoney(0, currency),
+		Created_at:  now,
+		Updated_at:  now,
+		Status:      dbutil.StatusActive,
+	}
+	err = insertAccount(ctx, tx, &account)
+	if err != nil {
+		return 0, fmt.Errorf("error creating funding account: %w", err)
+	}
+	return account.Id, nil
+}
+
+// postOpeningBalances gives every account whose cached balance has no ledger
+// history an "Opening Balance" posting from the funding account in its
+// currency, so that
+// balances written outside the ledger (legacy rows, mock data) are backed by
+// entries.
+func (s *sqlite) postOpeningBalances(ctx context.Context, tx *sql.Tx) error {
+	rows, err := tx.QueryContext(ctx, `
+		SELECT a.id, a.balance - COALESCE((SELECT SUM(e.amount) FROM ledger_entries e WHERE e.account_id = a.id), 0), a.currency
+		FROM account a JOIN customers c ON c.id = a.customer_id
+		WHERE c.email IS NOT ?`, dbutil.FundingAccountEmail)
+	if err != nil {
+		return fmt.Errorf("error querying opening balances: %w", err)
+	}
+
+	var openings []dbutil.Transaction
+	for rows.Next() {
+		var accountId int
+		var unbacked dbutil.Money
+		var currency string
+		if err := rows.Scan(&accountId, &unbacked, &currency); err != nil {
+			rows.Close()
+			return fmt.Errorf("error scanning opening balance: %w", err)
+		}
+		unbacked.Currency = currency
+		if unbacked.Minor != 0 {
+			openings = append(openings, *dbutil.NewTransaction(0, accountId, unbacked, "Opening Balance"))
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating over rows: %w", err)
+	}
+
+	for i := range openings {
+		fundingId, err := s.fundingAccountId(ctx, tx, openings[i].Amount.Currency)
+		if err != nil {
+			return err
+		}
+		openings[i].FromAccount = fundingId
+		// The account already holds this money, so only the funding side
+		// moves when the entries are posted.
+		_, err = tx.ExecContext(ctx, "UPDATE account SET balance = balance - ? WHERE id = ?", openings[i].Amount, openings[i].ToAccount)
+		if err != nil {
+			return fmt.Errorf("error preparing opening balance: %w", err)
+		}
+		err = s.post(ctx, tx, &openings[i], false)
+		if err != nil {
+			return fmt.Errorf("error posting opening balance: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// CheckLedger verifies that every transaction's entries sum to zero in each
+// currency, that the whole journal does too, and that each account's balance
+// equals the sum of its entries, all of which are in its currency. It also
+// checks that what each account has held equals its pending holds.
+func (s *sqlite) CheckLedger(ctx context.Context) error {
+	var transactionId int
+	var sum dbutil.Money
+	var currency string
+	err := s.db.QueryRowContext(ctx, `
+		SELECT transaction_id, currency, SUM(amount) FROM ledger_entries
+		GROUP BY transaction_id, currency HAVING SUM(amount) != 0 LIMIT 1`).Scan(&transactionId, &currency, &sum)
+	if err == nil {
+		sum.Currency = currency
+		return fmt.Errorf("%w: entries of transaction %d sum to %s %s", dbutil.ErrLedgerUnbalanced, transactionId, sum, currency)
+	}
+	if err != sql.ErrNoRows {
+		return fmt.Errorf("error checking transactions: %w", err)
+	}
+
+	err = s.db.QueryRowContext(ctx, "SELECT currency, SUM(amount) FROM ledger_entries GROUP BY currency HAVING SUM(amount) != 0 LIMIT 1").Scan(&currency, &sum)
+	if err == nil {
+		sum.Currency = currency
+		return fmt.Errorf("%w: journal sums to %s %s", dbutil.ErrLedgerUnbalanced, sum, currency)
+	}
+	if err != sql.ErrNoRows {
+		return fmt.Errorf("error summing ledger: %w", err)
+	}
+
+	var entryId, accountId int
+	err = s.db.QueryRowContext(ctx, `
+		SELECT e.id, a.id FROM ledger_entries e JOIN account a ON a.id = e.account_id
+		WHERE e.currency != a.currency LIMIT 1`).Scan(&entryId, &accountId)
+	if err == nil {
+		return fmt.Errorf("%w: entry %d is not in the currency of account %d", dbutil.ErrLedgerUnbalanced, entryId, accountId)
+	}
+	if err != sql.ErrNoRows {
+		return fmt.Errorf("error checking entry currencies: %w", err)
+	}
+
+	var balance, entries dbutil.Money
+	err = s.db.QueryRowContext(ctx, `
+		SELECT a.id, a.currency, a.balance, COALESCE(SUM(e.amount), 0)
+		FROM account a LEFT JOIN ledger_entries e ON e.account_id = a.id
+		GROUP BY a.id, a.currency, a.balance
+		HAVING a.balance != COALESCE(SUM(e.amount), 0) LIMIT 1`).Scan(&accountId, &currency, &balance, &entries)
+	if err == nil {
+		balance.Currency, entries.Currency = currency, currency
+		return fmt.Errorf("%w: account %d has balance %s but entries sum to %s", dbutil.ErrLedgerUnbalanced, accountId, balance, entries)
+	}
+	if err != sql.ErrNoRows {
+		return fmt.Errorf("error checking account balances: %w", err)
+	}
+
+	var held, holds dbutil.Money
+	err = s.db.QueryRowContext(ctx, `
+		SELECT a.id, a.currency, a.held, COALESCE(SUM(t.amount + t.fee), 0)
+		FROM account a LEFT JOIN transactions t ON t.from_account = a.id AND t.status = ?
+		GROUP BY a.id, a.currency, a.held
+		HAVING a.held != COALESCE(SUM(t.amount + t.fee), 0) LIMIT 1`, dbutil.TransactionPending).Scan(&accountId, &currency, &held, &holds)
+	if err == nil {
+		held.Currency, holds.Currency = currency, currency
+		return fmt.Errorf("%w: account %d has %s held but pending holds sum to %s", dbutil.ErrLedgerUnbalanced, accountId, held, holds)
+	}
+	if err != sql.ErrNoRows {
+		return fmt.Errorf("error checking holds: %w", err)
+	}
+
+	return nil
+}
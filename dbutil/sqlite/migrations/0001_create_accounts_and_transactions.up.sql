@@ -0,0 +1,22 @@
+-- The original schema. IF NOT EXISTS lets databases created before
+-- migrations existed adopt this version without changes.
+CREATE TABLE IF NOT EXISTS account (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    first_name VARCHAR(50),
+    last_name VARCHAR(50),
+    email VARCHAR(50) UNIQUE,
+    phone_number INTEGER UNIQUE,
+    encrypted_password VARCHAR(100),
+    balance INTEGER,
+    created_at TIMESTAMP,
+    updated_at TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS transactions (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    from_account INTEGER,
+    to_account INTEGER,
+    amount REAL,
+    transaction_type TEXT,
+    created_at DATETIME
+);
@@ -0,0 +1,14 @@
+UPDATE account SET balance = balance / 100.0;
+
+CREATE TABLE transactions_major (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    from_account INTEGER,
+    to_account INTEGER,
+    amount REAL,
+    transaction_type TEXT,
+    created_at DATETIME
+);
+INSERT INTO transactions_major (id, from_account, to_account, amount, transaction_type, created_at)
+    SELECT id, from_account, to_account, amount / 100.0, transaction_type, created_at FROM transactions;
+DROP TABLE transactions;
+ALTER TABLE transactions_major RENAME TO transactions;
@@ -0,0 +1,15 @@
+-- Balances and amounts were written as dollars; store integer cents instead.
+UPDATE account SET balance = CAST(ROUND(COALESCE(balance, 0) * 100) AS INTEGER);
+
+CREATE TABLE transactions_minor (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    from_account INTEGER,
+    to_account INTEGER,
+    amount INTEGER,
+    transaction_type TEXT,
+    created_at DATETIME
+);
+INSERT INTO transactions_minor (id, from_account, to_account, amount, transaction_type, created_at)
+    SELECT id, from_account, to_account, CAST(ROUND(amount * 100) AS INTEGER), transaction_type, created_at FROM transactions;
+DROP TABLE transactions;
+ALTER TABLE transactions_minor RENAME TO transactions;
@@ -0,0 +1,4 @@
+UPDATE account SET balance = balance + (SELECT COALESCE(SUM(amount), 0) FROM transactions WHERE transaction_type = 'Opening Balance')
+    WHERE email = 'funding@minibank.internal';
+DELETE FROM transactions WHERE transaction_type = 'Opening Balance';
+DROP TABLE ledger_entries;
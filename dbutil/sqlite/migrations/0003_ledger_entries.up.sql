@@ -0,0 +1,29 @@
+CREATE TABLE ledger_entries (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    transaction_id INTEGER NOT NULL REFERENCES transactions(id),
+    account_id INTEGER NOT NULL,
+    amount INTEGER NOT NULL,
+    created_at DATETIME
+);
+CREATE INDEX ledger_entries_account_id ON ledger_entries(account_id);
+CREATE INDEX ledger_entries_transaction_id ON ledger_entries(transaction_id);
+
+-- Back every existing balance with an opening posting from the funding
+-- account, which is created only if there is money to back.
+INSERT INTO account (first_name, last_name, email, phone_number, encrypted_password, balance, created_at, updated_at)
+    SELECT 'MiniBank', 'Funding', 'funding@minibank.internal', NULL, '', 0, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP
+    WHERE EXISTS (SELECT 1 FROM account WHERE balance != 0)
+    AND NOT EXISTS (SELECT 1 FROM account WHERE email = 'funding@minibank.internal');
+
+INSERT INTO transactions (from_account, to_account, amount, transaction_type, created_at)
+    SELECT f.id, a.id, a.balance, 'Opening Balance', CURRENT_TIMESTAMP
+    FROM account a, account f
+    WHERE f.email = 'funding@minibank.internal' AND a.id != f.id AND a.balance != 0;
+
+INSERT INTO ledger_entries (transaction_id, account_id, amount, created_at)
+    SELECT id, from_account, -amount, created_at FROM transactions WHERE transaction_type = 'Opening Balance'
+    UNION ALL
+    SELECT id, to_account, amount, created_at FROM transactions WHERE transaction_type = 'Opening Balance';
+
+UPDATE account SET balance = balance - (SELECT COALESCE(SUM(amount), 0) FROM transactions WHERE transaction_type = 'Opening Balance')
+    WHERE email = 'funding@minibank.internal';
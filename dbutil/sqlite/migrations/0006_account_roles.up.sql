@@ -0,0 +1 @@
+ALTER TABLE account ADD COLUMN role TEXT NOT NULL DEFAULT 'customer';
@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS sessions (
+    id TEXT PRIMARY KEY,
+    account_id INTEGER REFERENCES account(id) ON DELETE CASCADE,
+    data TEXT NOT NULL,
+    user_agent TEXT NOT NULL DEFAULT '',
+    ip TEXT NOT NULL DEFAULT '',
+    created_at DATETIME NOT NULL,
+    last_seen_at DATETIME NOT NULL,
+    expires_at DATETIME NOT NULL
+);
+CREATE INDEX IF NOT EXISTS sessions_account_id ON sessions(account_id);
+CREATE INDEX IF NOT EXISTS sessions_expires_at ON sessions(expires_at);
@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS two_factor (
+    account_id INTEGER PRIMARY KEY REFERENCES account(id) ON DELETE CASCADE,
+    secret TEXT NOT NULL,
+    created_at DATETIME NOT NULL,
+    confirmed_at DATETIME,
+    last_used_step INTEGER NOT NULL DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS recovery_codes (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    account_id INTEGER NOT NULL REFERENCES account(id) ON DELETE CASCADE,
+    code_hash TEXT NOT NULL,
+    used_at DATETIME
+);
+CREATE INDEX IF NOT EXISTS recovery_codes_account_id ON recovery_codes(account_id);
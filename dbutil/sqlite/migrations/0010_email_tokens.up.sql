@@ -0,0 +1,15 @@
+ALTER TABLE account ADD COLUMN email_verified_at DATETIME;
+
+-- Accounts opened before email verification existed keep sending payments
+UPDATE account SET email_verified_at = CURRENT_TIMESTAMP;
+
+CREATE TABLE IF NOT EXISTS email_tokens (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    account_id INTEGER NOT NULL REFERENCES account(id) ON DELETE CASCADE,
+    purpose TEXT NOT NULL,
+    token_hash TEXT NOT NULL UNIQUE,
+    created_at DATETIME NOT NULL,
+    expires_at DATETIME NOT NULL,
+    used_at DATETIME
+);
+CREATE INDEX IF NOT EXISTS email_tokens_account_id ON email_tokens(account_id);
@@ -0,0 +1,3 @@
+ALTER TABLE account DROP COLUMN status_changed_at;
+ALTER TABLE account DROP COLUMN status_reason;
+ALTER TABLE account DROP COLUMN status;
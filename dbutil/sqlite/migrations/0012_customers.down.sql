@@ -0,0 +1,109 @@
+-- Each customer's details go back on their first account. Any further
+-- accounts lose them, and credentials move to that first account.
+DROP INDEX audit_log_customer_id;
+UPDATE audit_log SET account_id = (SELECT MIN(a.id) FROM account a WHERE a.customer_id = audit_log.customer_id)
+    WHERE account_id IS NULL AND customer_id IS NOT NULL;
+ALTER TABLE audit_log DROP COLUMN customer_id;
+
+CREATE TABLE email_tokens_old (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    account_id INTEGER NOT NULL REFERENCES account(id) ON DELETE CASCADE,
+    purpose TEXT NOT NULL,
+    token_hash TEXT NOT NULL UNIQUE,
+    created_at DATETIME NOT NULL,
+    expires_at DATETIME NOT NULL,
+    used_at DATETIME
+);
+INSERT INTO email_tokens_old (id, account_id, purpose, token_hash, created_at, expires_at, used_at)
+    SELECT t.id, (SELECT MIN(a.id) FROM account a WHERE a.customer_id = t.customer_id), t.purpose, t.token_hash, t.created_at, t.expires_at, t.used_at FROM email_tokens t;
+DROP TABLE email_tokens;
+ALTER TABLE email_tokens_old RENAME TO email_tokens;
+CREATE INDEX email_tokens_account_id ON email_tokens(account_id);
+
+CREATE TABLE recovery_codes_old (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    account_id INTEGER NOT NULL REFERENCES account(id) ON DELETE CASCADE,
+    code_hash TEXT NOT NULL,
+    used_at DATETIME
+);
+INSERT INTO recovery_codes_old (id, account_id, code_hash, used_at)
+    SELECT r.id, (SELECT MIN(a.id) FROM account a WHERE a.customer_id = r.customer_id), r.code_hash, r.used_at FROM recovery_codes r;
+DROP TABLE recovery_codes;
+ALTER TABLE recovery_codes_old RENAME TO recovery_codes;
+CREATE INDEX recovery_codes_account_id ON recovery_codes(account_id);
+
+CREATE TABLE two_factor_old (
+    account_id INTEGER PRIMARY KEY REFERENCES account(id) ON DELETE CASCADE,
+    secret TEXT NOT NULL,
+    created_at DATETIME NOT NULL,
+    confirmed_at DATETIME,
+    last_used_step INTEGER NOT NULL DEFAULT 0
+);
+INSERT INTO two_factor_old (account_id, secret, created_at, confirmed_at, last_used_step)
+    SELECT (SELECT MIN(a.id) FROM account a WHERE a.customer_id = t.customer_id), t.secret, t.created_at, t.confirmed_at, t.last_used_step FROM two_factor t;
+DROP TABLE two_factor;
+ALTER TABLE two_factor_old RENAME TO two_factor;
+
+CREATE TABLE sessions_old (
+    id TEXT PRIMARY KEY,
+    account_id INTEGER REFERENCES account(id) ON DELETE CASCADE,
+    data TEXT NOT NULL,
+    user_agent TEXT NOT NULL DEFAULT '',
+    ip TEXT NOT NULL DEFAULT '',
+    created_at DATETIME NOT NULL,
+    last_seen_at DATETIME NOT NULL,
+    expires_at DATETIME NOT NULL
+);
+-- Session data names the customer, so existing logins cannot be carried over
+DROP TABLE sessions;
+ALTER TABLE sessions_old RENAME TO sessions;
+CREATE INDEX sessions_account_id ON sessions(account_id);
+CREATE INDEX sessions_expires_at ON sessions(expires_at);
+
+CREATE TABLE api_keys_old (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    account_id INTEGER NOT NULL REFERENCES account(id) ON DELETE CASCADE,
+    name TEXT NOT NULL,
+    prefix TEXT NOT NULL,
+    token_hash TEXT NOT NULL UNIQUE,
+    scopes TEXT NOT NULL,
+    created_at DATETIME NOT NULL,
+    last_used_at DATETIME,
+    revoked_at DATETIME
+);
+INSERT INTO api_keys_old (id, account_id, name, prefix, token_hash, scopes, created_at, last_used_at, revoked_at)
+    SELECT k.id, (SELECT MIN(a.id) FROM account a WHERE a.customer_id = k.customer_id), k.name, k.prefix, k.token_hash, k.scopes, k.created_at, k.last_used_at, k.revoked_at FROM api_keys k;
+DROP TABLE api_keys;
+ALTER TABLE api_keys_old RENAME TO api_keys;
+CREATE INDEX api_keys_account_id ON api_keys(account_id);
+
+CREATE TABLE account_old (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    first_name VARCHAR(50),
+    last_name VARCHAR(50),
+    email VARCHAR(50) UNIQUE,
+    phone_number INTEGER UNIQUE,
+    encrypted_password VARCHAR(100),
+    balance INTEGER,
+    created_at TIMESTAMP,
+    updated_at TIMESTAMP,
+    role TEXT NOT NULL DEFAULT 'customer',
+    email_verified_at DATETIME,
+    status TEXT NOT NULL DEFAULT 'active',
+    status_reason TEXT NOT NULL DEFAULT '',
+    status_changed_at DATETIME
+);
+INSERT INTO account_old (id, first_name, last_name, email, phone_number, encrypted_password, balance, created_at, updated_at, role, email_verified_at, status, status_reason, status_changed_at)
+    SELECT a.id, c.first_name, c.last_name,
+        CASE WHEN first.id IS NOT NULL THEN c.email END,
+        CASE WHEN first.id IS NOT NULL THEN c.phone_number END,
+        CASE WHEN first.id IS NOT NULL THEN c.encrypted_password ELSE '' END,
+        a.balance, a.created_at, a.updated_at,
+        CASE WHEN first.id IS NOT NULL THEN c.role ELSE 'customer' END,
+        c.email_verified_at, a.status, a.status_reason, a.status_changed_at
+    FROM account a
+    JOIN customers c ON c.id = a.customer_id
+    LEFT JOIN (SELECT MIN(id) AS id FROM account GROUP BY customer_id) first ON first.id = a.id;
+DROP TABLE account;
+ALTER TABLE account_old RENAME TO account;
+DROP TABLE customers;
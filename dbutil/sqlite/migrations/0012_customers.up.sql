@@ -0,0 +1,110 @@
+-- Split the person who logs in from the accounts that hold their money. Each
+-- existing account becomes its own customer with the same id, so sessions,
+-- API keys and the rest keep pointing at the right person.
+CREATE TABLE customers (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    first_name VARCHAR(50),
+    last_name VARCHAR(50),
+    email VARCHAR(50) UNIQUE,
+    phone_number INTEGER UNIQUE,
+    encrypted_password VARCHAR(100),
+    role TEXT NOT NULL DEFAULT 'customer',
+    email_verified_at DATETIME,
+    created_at TIMESTAMP,
+    updated_at TIMESTAMP
+);
+INSERT INTO customers (id, first_name, last_name, email, phone_number, encrypted_password, role, email_verified_at, created_at, updated_at)
+    SELECT id, first_name, last_name, email, phone_number, encrypted_password, role, email_verified_at, created_at, updated_at FROM account;
+
+CREATE TABLE account_new (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    customer_id INTEGER NOT NULL REFERENCES customers(id),
+    type TEXT NOT NULL DEFAULT 'checking',
+    nickname TEXT NOT NULL DEFAULT '',
+    balance INTEGER,
+    created_at TIMESTAMP,
+    updated_at TIMESTAMP,
+    status TEXT NOT NULL DEFAULT 'active',
+    status_reason TEXT NOT NULL DEFAULT '',
+    status_changed_at DATETIME
+);
+INSERT INTO account_new (id, customer_id, type, nickname, balance, created_at, updated_at, status, status_reason, status_changed_at)
+    SELECT id, id, 'checking', '', balance, created_at, updated_at, status, status_reason, status_changed_at FROM account;
+DROP TABLE account;
+ALTER TABLE account_new RENAME TO account;
+CREATE INDEX account_customer_id ON account(customer_id);
+
+-- Logins and their credentials belong to the customer
+CREATE TABLE api_keys_new (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    customer_id INTEGER NOT NULL REFERENCES customers(id) ON DELETE CASCADE,
+    name TEXT NOT NULL,
+    prefix TEXT NOT NULL,
+    token_hash TEXT NOT NULL UNIQUE,
+    scopes TEXT NOT NULL,
+    created_at DATETIME NOT NULL,
+    last_used_at DATETIME,
+    revoked_at DATETIME
+);
+INSERT INTO api_keys_new SELECT * FROM api_keys;
+DROP TABLE api_keys;
+ALTER TABLE api_keys_new RENAME TO api_keys;
+CREATE INDEX api_keys_customer_id ON api_keys(customer_id);
+
+CREATE TABLE sessions_new (
+    id TEXT PRIMARY KEY,
+    customer_id INTEGER REFERENCES customers(id) ON DELETE CASCADE,
+    data TEXT NOT NULL,
+    user_agent TEXT NOT NULL DEFAULT '',
+    ip TEXT NOT NULL DEFAULT '',
+    created_at DATETIME NOT NULL,
+    last_seen_at DATETIME NOT NULL,
+    expires_at DATETIME NOT NULL
+);
+INSERT INTO sessions_new SELECT * FROM sessions;
+DROP TABLE sessions;
+ALTER TABLE sessions_new RENAME TO sessions;
+CREATE INDEX sessions_customer_id ON sessions(customer_id);
+CREATE INDEX sessions_expires_at ON sessions(expires_at);
+
+CREATE TABLE two_factor_new (
+    customer_id INTEGER PRIMARY KEY REFERENCES customers(id) ON DELETE CASCADE,
+    secret TEXT NOT NULL,
+    created_at DATETIME NOT NULL,
+    confirmed_at DATETIME,
+    last_used_step INTEGER NOT NULL DEFAULT 0
+);
+INSERT INTO two_factor_new SELECT * FROM two_factor;
+DROP TABLE two_factor;
+ALTER TABLE two_factor_new RENAME TO two_factor;
+
+CREATE TABLE recovery_codes_new (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    customer_id INTEGER NOT NULL REFERENCES customers(id) ON DELETE CASCADE,
+    code_hash TEXT NOT NULL,
+    used_at DATETIME
+);
+INSERT INTO recovery_codes_new SELECT * FROM recovery_codes;
+DROP TABLE recovery_codes;
+ALTER TABLE recovery_codes_new RENAME TO recovery_codes;
+CREATE INDEX recovery_codes_customer_id ON recovery_codes(customer_id);
+
+CREATE TABLE email_tokens_new (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    customer_id INTEGER NOT NULL REFERENCES customers(id) ON DELETE CASCADE,
+    purpose TEXT NOT NULL,
+    token_hash TEXT NOT NULL UNIQUE,
+    created_at DATETIME NOT NULL,
+    expires_at DATETIME NOT NULL,
+    used_at DATETIME
+);
+INSERT INTO email_tokens_new SELECT * FROM email_tokens;
+DROP TABLE email_tokens;
+ALTER TABLE email_tokens_new RENAME TO email_tokens;
+CREATE INDEX email_tokens_customer_id ON email_tokens(customer_id);
+
+-- Only status changes were about an account rather than its owner
+ALTER TABLE audit_log ADD COLUMN customer_id INTEGER;
+UPDATE audit_log SET customer_id = account_id;
+UPDATE audit_log SET account_id = NULL WHERE event != 'account_status_changed';
+CREATE INDEX audit_log_customer_id ON audit_log(customer_id);
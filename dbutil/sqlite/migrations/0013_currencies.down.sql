@@ -0,0 +1,12 @@
+-- Amounts in other currencies are left as they are and read back as
+-- Australian dollars, so only roll back before any have been used.
+DROP TABLE fx_rates;
+
+ALTER TABLE transactions DROP COLUMN fee;
+ALTER TABLE transactions DROP COLUMN fx_rate;
+ALTER TABLE transactions DROP COLUMN destination_currency;
+ALTER TABLE transactions DROP COLUMN destination_amount;
+ALTER TABLE transactions DROP COLUMN currency;
+
+ALTER TABLE ledger_entries DROP COLUMN currency;
+ALTER TABLE account DROP COLUMN currency;
@@ -0,0 +1,19 @@
+-- Every existing account, payment and entry was in Australian dollars.
+ALTER TABLE account ADD COLUMN currency TEXT NOT NULL DEFAULT 'AUD';
+ALTER TABLE ledger_entries ADD COLUMN currency TEXT NOT NULL DEFAULT 'AUD';
+
+ALTER TABLE transactions ADD COLUMN currency TEXT NOT NULL DEFAULT 'AUD';
+ALTER TABLE transactions ADD COLUMN destination_amount INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE transactions ADD COLUMN destination_currency TEXT NOT NULL DEFAULT 'AUD';
+ALTER TABLE transactions ADD COLUMN fx_rate TEXT NOT NULL DEFAULT '';
+ALTER TABLE transactions ADD COLUMN fee INTEGER NOT NULL DEFAULT 0;
+UPDATE transactions SET destination_amount = amount;
+
+CREATE TABLE fx_rates (
+    base TEXT NOT NULL,
+    quote TEXT NOT NULL,
+    rate TEXT NOT NULL,
+    fee_basis_points INTEGER NOT NULL DEFAULT 0,
+    updated_at DATETIME NOT NULL,
+    PRIMARY KEY (base, quote)
+);
@@ -0,0 +1,11 @@
+-- Money set aside by pending holds. It stays in the balance, which only
+-- moves when entries are posted, but cannot be spent.
+ALTER TABLE account ADD COLUMN held INTEGER NOT NULL DEFAULT 0;
+
+-- Every existing transaction was posted when it was made.
+ALTER TABLE transactions ADD COLUMN status TEXT NOT NULL DEFAULT 'posted';
+ALTER TABLE transactions ADD COLUMN expires_at DATETIME;
+ALTER TABLE transactions ADD COLUMN settled_at DATETIME;
+UPDATE transactions SET settled_at = created_at;
+
+CREATE INDEX transactions_status_expires_at ON transactions (status, expires_at);
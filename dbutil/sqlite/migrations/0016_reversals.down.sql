@@ -0,0 +1,4 @@
+-- Refunds stay, as ordinary transactions that no longer say what they
+-- reversed.
+DROP INDEX transactions_reverses;
+ALTER TABLE transactions DROP COLUMN reverses;
@@ -0,0 +1,4 @@
+-- A refund points at the transaction it reverses.
+ALTER TABLE transactions ADD COLUMN reverses INTEGER REFERENCES transactions(id);
+
+CREATE INDEX transactions_reverses ON transactions (reverses);
@@ -0,0 +1,3 @@
+-- The payer's note for the payee, such as an invoice number, given with
+-- each payment of a bulk payment file.
+ALTER TABLE transactions ADD COLUMN reference TEXT NOT NULL DEFAULT '';
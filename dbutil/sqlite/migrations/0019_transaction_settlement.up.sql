@@ -0,0 +1,5 @@
+-- Statements list an account's history, and find its balance at the start
+-- of a period, by when transactions settled rather than when they were
+-- made. The id breaks ties, as it does for the history.
+CREATE INDEX transactions_from_account_settled_at ON transactions (from_account, settled_at, id);
+CREATE INDEX transactions_to_account_settled_at ON transactions (to_account, settled_at, id);
@@ -0,0 +1,196 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"minibank/dbutil"
+	"time"
+)
+
+const scheduledPaymentColumns = "id, customer_id, from_account, to_account, amount, currency, frequency, rule, start_at, end_at, due_at, attempt_at, attempts, occurrences, status, created_at, updated_at"
+
+func scanScheduledPayment(row scanner) (*dbutil.ScheduledPayment, error) {
+	var p dbutil.ScheduledPayment
+	var currency string
+	var endAt sql.NullTime
+	err := row.Scan(&p.Id, &p.CustomerId, &p.FromAccount, &p.ToAccount, &p.Amount, &currency, &p.Frequency, &p.Rule,
+		&p.StartAt, &endAt, &p.DueAt, &p.AttemptAt, &p.Attempts, &p.Occurrences, &p.Status, &p.CreatedAt, &p.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	p.Amount.Currency = currency
+	if endAt.Valid {
+		p.EndAt = &endAt.Time
+	}
+	return &p, nil
+}
+
+// nullTime stores a missing time as NULL, in UTC like every other time.
+func nullTime(t *time.Time) interface{} {
+	if t == nil {
+		return nil
+	}
+	return t.UTC()
+}
+
+func (s *sqlite) CreateScheduledPayment(ctx context.Context, p *dbutil.ScheduledPayment) error {
+	result, err := s.db.ExecContext(ctx, `
+		INSERT INTO scheduled_payments (customer_id, from_account, to_account, amount, currency, frequency, rule, start_at, end_at, due_at, attempt_at, attempts, occurrences, status, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		p.CustomerId, p.FromAccount, p.ToAccount, p.Amount, p.Amount.Currency, p.Frequency, p.Rule, p.StartAt.UTC(), nullTime(p.EndAt),
+		p.DueAt.UTC(), p.AttemptAt.UTC(), p.Attempts, p.Occurrences, p.Status, p.CreatedAt.UTC(), p.UpdatedAt.UTC())
+	if err != nil {
+		return fmt.Errorf("error inserting scheduled payment: %w", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("error getting last insert ID: %w", err)
+	}
+	p.Id = int(id)
+	return nil
+}
+
+func (s *sqlite) GetScheduledPayment(ctx context.Context, id int) (*dbutil.ScheduledPayment, error) {
+	p, err := scanScheduledPayment(s.db.QueryRowContext(ctx, "SELECT "+scheduledPaymentColumns+" FROM scheduled_payments WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return nil, dbutil.ErrScheduledPaymentNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error fetching scheduled payment: %w", err)
+	}
+	return p, nil
+}
+
+// ListScheduledPayments returns the customer's scheduled payments, newest
+// first.
+func (s *sqlite) ListScheduledPayments(ctx context.Context, customerId int) ([]dbutil.ScheduledPayment, error) {
+	return s.queryScheduledPayments(ctx, "SELECT "+scheduledPaymentColumns+" FROM scheduled_payments WHERE customer_id = ? ORDER BY id DESC", customerId)
+}
+
+// ListDueScheduledPayments returns up to limit active payments whose next
+// attempt is at or before now, the longest overdue first.
+func (s *sqlite) ListDueScheduledPayments(ctx context.Context, now time.Time, limit int) ([]dbutil.ScheduledPayment, error) {
+	return s.queryScheduledPayments(ctx, "SELECT "+scheduledPaymentColumns+" FROM scheduled_payments WHERE status = ? AND attempt_at <= ? ORDER BY attempt_at, id LIMIT ?",
+		dbutil.ScheduleActive, now.UTC(), limit)
+}
+
+func (s *sqlite) queryScheduledPayments(ctx context.Context, query string, args ...interface{}) ([]dbutil.ScheduledPayment, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error querying scheduled payments: %w", err)
+	}
+	defer rows.Close()
+
+	var payments []dbutil.ScheduledPayment
+	for rows.Next() {
+		p, err := scanScheduledPayment(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning scheduled payment: %w", err)
+		}
+		payments = append(payments, *p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over rows: %w", err)
+	}
+	return payments, nil
+}
+
+// RecordScheduledPaymentRun saves run and the state p was left in by it in
+// one transaction. The update only applies if the payment is still active
+// and still at the occurrence and attempt the run was for, so a payment that
+// was cancelled or run by someone else meanwhile returns
+// dbutil.ErrScheduledPaymentNotFound and nothing is recorded.
+func (s *sqlite) RecordScheduledPaymentRun(ctx context.Context, p *dbutil.ScheduledPayment, run *dbutil.ScheduledPaymentRun) (err error) {
+	tx, err := s.beginTx(ctx)
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+		if err != nil {
+			err = fmt.Errorf("error committing transaction: %w", err)
+		}
+	}()
+
+	result, err := tx.ExecContext(ctx, `
+		UPDATE scheduled_payments SET due_at = ?, attempt_at = ?, attempts = ?, occurrences = ?, status = ?, updated_at = ?
+		WHERE id = ? AND status = ? AND due_at = ? AND attempts = ?`,
+		p.DueAt.UTC(), p.AttemptAt.UTC(), p.Attempts, p.Occurrences, p.Status, p.UpdatedAt.UTC(),
+		p.Id, dbutil.ScheduleActive, run.DueAt.UTC(), run.Attempt-1)
+	if err != nil {
+		return fmt.Errorf("error updating scheduled payment: %w", err)
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error getting rows affected: %w", err)
+	}
+	if rows == 0 {
+		return dbutil.ErrScheduledPaymentNotFound
+	}
+
+	var transactionId interface{}
+	if run.TransactionId != 0 {
+		transactionId = run.TransactionId
+	}
+	result, err = tx.ExecContext(ctx, "INSERT INTO scheduled_payment_runs (scheduled_payment_id, due_at, attempt, status, transaction_id, error, ran_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		run.ScheduledPaymentId, run.DueAt.UTC(), run.Attempt, run.Status, transactionId, run.Error, run.RanAt.UTC())
+	if err != nil {
+		return fmt.Errorf("error inserting scheduled payment run: %w", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("error getting last insert ID: %w", err)
+	}
+	run.Id = int(id)
+	return nil
+}
+
+// CancelScheduledPayment stops one of the customer's active scheduled
+// payments. Cancelling an unknown or inactive payment returns
+// dbutil.ErrScheduledPaymentNotFound.
+func (s *sqlite) CancelScheduledPayment(ctx context.Context, customerId, id int, at time.Time) error {
+	result, err := s.db.ExecContext(ctx, "UPDATE scheduled_payments SET status = ?, updated_at = ? WHERE id = ? AND customer_id = ? AND status = ?",
+		dbutil.ScheduleCancelled, at.UTC(), id, customerId, dbutil.ScheduleActive)
+	if err != nil {
+		return fmt.Errorf("error cancelling scheduled payment: %w", err)
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error getting rows affected: %w", err)
+	}
+	if rows == 0 {
+		return dbutil.ErrScheduledPaymentNotFound
+	}
+	return nil
+}
+
+// ListScheduledPaymentRuns returns the history of a scheduled payment, most
+// recent first.
+func (s *sqlite) ListScheduledPaymentRuns(ctx context.Context, scheduledPaymentId int) ([]dbutil.ScheduledPaymentRun, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, scheduled_payment_id, due_at, attempt, status, COALESCE(transaction_id, 0), error, ran_at
+		FROM scheduled_payment_runs WHERE scheduled_payment_id = ? ORDER BY id DESC`, scheduledPaymentId)
+	if err != nil {
+		return nil, fmt.Errorf("error querying scheduled payment runs: %w", err)
+	}
+	defer rows.Close()
+
+	var runs []dbutil.ScheduledPaymentRun
+	for rows.Next() {
+		var run dbutil.ScheduledPaymentRun
+		err := rows.Scan(&run.Id, &run.ScheduledPaymentId, &run.DueAt, &run.Attempt, &run.Status, &run.TransactionId, &run.Error, &run.RanAt)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning scheduled payment run: %w", err)
+		}
+		runs = append(runs, run)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over rows: %w", err)
+	}
+	return runs, nil
+}
@@ -0,0 +1,103 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"minibank/dbutil"
+	"time"
+)
+
+// SaveSession inserts or updates a session. The creation time of an existing
+// session is kept. Expired sessions are dropped on the way.
+func (s *sqlite) SaveSession(ctx context.Context, session *dbutil.Session) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM sessions WHERE expires_at <= ?", time.Now().UTC())
+	if err != nil {
+		return fmt.Errorf("error deleting expired sessions: %w", err)
+	}
+
+	var customerId interface{}
+	if session.CustomerId != 0 {
+		customerId = session.CustomerId
+	}
+	_, err = s.db.ExecContext(ctx, `
+		INSERT INTO sessions (id, customer_id, data, user_agent, ip, created_at, last_seen_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET
+			customer_id = excluded.customer_id, data = excluded.data, user_agent = excluded.user_agent,
+			ip = excluded.ip, last_seen_at = excluded.last_seen_at, expires_at = excluded.expires_at`,
+		session.Id, customerId, session.Data, session.UserAgent, session.IP,
+		session.CreatedAt.UTC(), session.LastSeenAt.UTC(), session.ExpiresAt.UTC())
+	if err != nil {
+		return fmt.Errorf("error saving session: %w", err)
+	}
+	return nil
+}
+
+func (s *sqlite) GetSession(ctx context.Context, id string) (*dbutil.Session, error) {
+	session, err := scanSession(s.db.QueryRowContext(ctx, "SELECT "+sessionColumns+" FROM sessions WHERE id = ? AND expires_at > ?", id, time.Now().UTC()))
+	if err == sql.ErrNoRows {
+		return nil, dbutil.ErrSessionNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error fetching session: %w", err)
+	}
+	return session, nil
+}
+
+// ListSessions returns the customer's live sessions, most recently used first.
+func (s *sqlite) ListSessions(ctx context.Context, customerId int) ([]dbutil.Session, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT "+sessionColumns+" FROM sessions WHERE customer_id = ? AND expires_at > ? ORDER BY last_seen_at DESC", customerId, time.Now().UTC())
+	if err != nil {
+		return nil, fmt.Errorf("error querying sessions: %w", err)
+	}
+	defer rows.Close()
+
+	var sessions []dbutil.Session
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning session: %w", err)
+		}
+		sessions = append(sessions, *session)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over rows: %w", err)
+	}
+	return sessions, nil
+}
+
+func (s *sqlite) DeleteSession(ctx context.Context, id string) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM sessions WHERE id = ?", id)
+	if err != nil {
+		return fmt.Errorf("error deleting session: %w", err)
+	}
+	return nil
+}
+
+// DeleteCustomerSessions revokes the customer's sessions, except the one with
+// id except if it is not empty, and returns how many were revoked.
+func (s *sqlite) DeleteCustomerSessions(ctx context.Context, customerId int, except string) (int, error) {
+	result, err := s.db.ExecContext(ctx, "DELETE FROM sessions WHERE customer_id = ? AND id != ?", customerId, except)
+	if err != nil {
+		return 0, fmt.Errorf("error deleting sessions: %w", err)
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("error getting rows affected: %w", err)
+	}
+	return int(rows), nil
+}
+
+const sessionColumns = "id, customer_id, data, user_agent, ip, created_at, last_seen_at, expires_at"
+
+func scanSession(row scanner) (*dbutil.Session, error) {
+	var session dbutil.Session
+	var customerId sql.NullInt64
+	err := row.Scan(&session.Id, &customerId, &session.Data, &session.UserAgent, &session.IP, &session.CreatedAt, &session.LastSeenAt, &session.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	session.CustomerId = int(customerId.Int64)
+	return &session, nil
+}
@@ -1,19 +1,38 @@
 package sqlite
 
 import (
+	"context"
 	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
 	"log"
+	"minibank/dbutil/migrate"
 	"os"
+	"time"
 
-	_ "modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite"
+	sqlite3lib "modernc.org/sqlite/lib"
 )
 
 type sqlite struct {
 	db *sql.DB
 }
 
+// New opens the minibank database file in the working directory.
 func New() sqlite {
-	db, err := sql.Open("sqlite", "file:minibank?cache=shared&mode=rwc")
+	return Open("minibank")
+}
+
+// Open opens the SQLite database file at path, creating it if needed.
+func Open(path string) sqlite {
+	// Transactions take the write lock up front (_txlock=immediate) so
+	// concurrent transfers queue up in beginTx instead of deadlocking when
+	// two readers try to upgrade to writers. The write-ahead log lets reads
+	// outside a transaction, which do not retry, go on while a writer
+	// commits. Times are written in a fixed sortable layout so they can be
+	// compared in SQL.
+	db, err := sql.Open("sqlite", "file:"+path+"?mode=rwc&_txlock=immediate&_pragma=busy_timeout(50)&_pragma=journal_mode(WAL)&_time_format=sqlite")
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -22,36 +41,39 @@ func New() sqlite {
 	}
 }
 
-func (s *sqlite) Init() {
-	sqlStmt := `
-    CREATE TABLE IF NOT EXISTS account (  -- Use the correct table name "account"
-        id INTEGER PRIMARY KEY AUTOINCREMENT,
-        first_name VARCHAR(50),
-        last_name VARCHAR(50),
-        email VARCHAR(50) UNIQUE,
-        phone_number INTEGER UNIQUE,
-        encrypted_password VARCHAR(100),
-        balance INTEGER,
-        created_at TIMESTAMP,
-        updated_at TIMESTAMP
-    );
-
-	CREATE TABLE IF NOT EXISTS transactions (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		from_account INTEGER,
-		to_account INTEGER,
-		amount REAL,
-		transaction_type TEXT,
-		created_at DATETIME
-	);
-
-    `
-	_, err := s.db.Exec(sqlStmt)
+//go:embed migrations/*.sql
+var migrations embed.FS
+
+// Migrator returns the schema migrations for this database.
+func (s *sqlite) Migrator(ctx context.Context) (*migrate.Migrator, error) {
+	m, err := migrate.New(s.db, migrate.SQLite, migrations, "migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.adoptLegacySchema(ctx, m)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Init applies any pending migrations.
+func (s *sqlite) Init(ctx context.Context) {
+	m, err := s.Migrator(ctx)
 	if err != nil {
-		log.Fatal("Error creating account table:", err) // Log with context
+		log.Fatal("Error loading migrations:", err)
 	}
 
-	err = s.db.Ping()
+	count, err := m.Up(ctx)
+	if err != nil {
+		log.Fatal("Error applying migrations:", err)
+	}
+	if count > 0 {
+		log.Printf("Applied %d migration(s)", count)
+	}
+
+	err = s.db.PingContext(ctx)
 	if err != nil {
 		log.Fatal("Database connection failed:", err)
 		return
@@ -60,12 +82,54 @@ func (s *sqlite) Init() {
 	log.Println("Database connection successful!")
 }
 
-func (s *sqlite) MockData() {
+// adoptLegacySchema records the migrations that databases created before
+// schema_migrations existed already have. Those tracked their progress in
+// PRAGMA user_version: 1 after the move to minor units, 2 after the ledger.
+func (s *sqlite) adoptLegacySchema(ctx context.Context, m *migrate.Migrator) error {
+	tracked, err := m.TableExists(ctx)
+	if err != nil || tracked {
+		return err
+	}
+
+	var accountTables int
+	err = s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'account'").Scan(&accountTables)
+	if err != nil {
+		return fmt.Errorf("error looking for account table: %w", err)
+	}
+	if accountTables == 0 {
+		return nil
+	}
+
+	var version int
+	err = s.db.QueryRowContext(ctx, "PRAGMA user_version").Scan(&version)
+	if err != nil {
+		return fmt.Errorf("error reading schema version: %w", err)
+	}
+	return m.Baseline(ctx, version+1)
+}
+
+func (s *sqlite) MockData(ctx context.Context) {
 	sqlScript, err := os.ReadFile("./sql/mock_data.sql")
 	if err != nil {
 		panic(err)
 	}
-	_, err = s.db.Exec(string(sqlScript))
+	tx, err := s.beginTx(ctx)
+	if err != nil {
+		panic(err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, string(sqlScript))
+	if err != nil {
+		panic(err)
+	}
+
+	err = s.postOpeningBalances(ctx, tx)
+	if err != nil {
+		panic(err)
+	}
+
+	err = tx.Commit()
 	if err != nil {
 		panic(err)
 	}
@@ -73,6 +137,25 @@ func (s *sqlite) MockData() {
 	log.Println("Data added")
 }
 
-func (s *sqlite) Begin() (*sql.Tx, error) {
-	return s.db.Begin()
+func (s *sqlite) Begin(ctx context.Context) (*sql.Tx, error) {
+	return s.beginTx(ctx)
+}
+
+// beginTx starts a transaction, waiting for the write lock for as long as ctx
+// allows. SQLite's own busy timeout sleeps without watching the context, so
+// it is kept short and the waiting happens here instead.
+func (s *sqlite) beginTx(ctx context.Context) (*sql.Tx, error) {
+	for {
+		tx, err := s.db.BeginTx(ctx, nil)
+		var sqliteErr *sqlite3.Error
+		if err == nil || !errors.As(err, &sqliteErr) || sqliteErr.Code() != sqlite3lib.SQLITE_BUSY {
+			return tx, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
 }
@@ -0,0 +1,18 @@
+package sqlite
+
+import (
+	"context"
+	"minibank/dbutil"
+	"minibank/dbutil/dbtest"
+	"path/filepath"
+	"testing"
+)
+
+func TestConformance(t *testing.T) {
+	dbtest.Run(t, func(t *testing.T) dbutil.Database {
+		s := Open(filepath.Join(t.TempDir(), "minibank"))
+		t.Cleanup(func() { s.db.Close() })
+		s.Init(context.Background())
+		return &s
+	})
+}
@@ -1,20 +1,66 @@
 package sqlite
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"minibank/dbutil"
+	"strings"
 	"time"
 )
 
-func (s *sqlite) MakeTransaction(tx *sql.Tx, transaction *dbutil.Transaction) error {
-	stmt, err := tx.Prepare("INSERT INTO transactions (from_account, to_account, amount, transaction_type, created_at) VALUES (?, ?, ?, ?, ?)")
+// transactionColumns lists the columns scanTransaction expects, in order.
+const transactionColumns = "id, from_account, to_account, amount, currency, destination_amount, destination_currency, fx_rate, fee, transaction_type, status, created_at, expires_at, settled_at, reverses, reference"
+
+// scanTransaction scans a full transaction row. The fee is in the same
+// currency as the amount.
+func scanTransaction(row scanner, transaction *dbutil.Transaction) error {
+	var currency, destinationCurrency string
+	var expiresAt, settledAt sql.NullTime
+	var reverses sql.NullInt64
+	err := row.Scan(&transaction.Id, &transaction.FromAccount, &transaction.ToAccount, &transaction.Amount, &currency,
+		&transaction.DestinationAmount, &destinationCurrency, &transaction.Rate, &transaction.Fee, &transaction.TransactionType,
+		&transaction.Status, &transaction.CreatedAt, &expiresAt, &settledAt, &reverses, &transaction.Reference)
+	if err != nil {
+		return err
+	}
+	transaction.Amount.Currency = currency
+	transaction.Fee.Currency = currency
+	transaction.DestinationAmount.Currency = destinationCurrency
+	if expiresAt.Valid {
+		transaction.ExpiresAt = &expiresAt.Time
+	}
+	if settledAt.Valid {
+		transaction.SettledAt = &settledAt.Time
+	}
+	transaction.Reverses = int(reverses.Int64)
+	return nil
+}
+
+// MakeTransaction inserts transaction and sets its id. A posted transaction
+// is settled as it is made; a pending one is not settled until it is
+// captured or voided.
+func (s *sqlite) MakeTransaction(ctx context.Context, tx *sql.Tx, transaction *dbutil.Transaction) error {
+	stmt, err := tx.PrepareContext(ctx, `
+		INSERT INTO transactions (from_account, to_account, amount, currency, destination_amount, destination_currency, fx_rate, fee, transaction_type, status, created_at, expires_at, settled_at, reverses, reference)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
 	if err != nil {
 		return fmt.Errorf("error preparing insert statement: %w", err)
 	}
 	defer stmt.Close()
 
-	result, err := stmt.Exec(transaction.FromAccount, transaction.ToAccount, transaction.Amount, transaction.TransactionType, time.Now())
+	now := time.Now().UTC()
+	var settledAt *time.Time
+	if transaction.Status == dbutil.TransactionPosted {
+		settledAt = &now
+	}
+	var reverses interface{}
+	if transaction.Reverses != 0 {
+		reverses = transaction.Reverses
+	}
+	result, err := stmt.ExecContext(ctx, transaction.FromAccount, transaction.ToAccount, transaction.Amount, transaction.Amount.Currency,
+		transaction.DestinationAmount, transaction.DestinationAmount.Currency, transaction.Rate, transaction.Fee, transaction.TransactionType,
+		transaction.Status, now, nullTime(transaction.ExpiresAt), nullTime(settledAt), reverses, transaction.Reference)
 	if err != nil {
 		return fmt.Errorf("error inserting transaction: %w", err)
 	}
@@ -28,19 +74,109 @@ func (s *sqlite) MakeTransaction(tx *sql.Tx, transaction *dbutil.Transaction) er
 	return nil
 }
 
-func (s *sqlite) ListTransactionsFromAccount(accountID int) ([]dbutil.Transaction, error) {
-	// Update the SQL to include both from_account and to_account, and use DISTINCT to avoid duplicates
-	stmt, err := s.db.Prepare(`
-		SELECT DISTINCT id, from_account, to_account, amount, transaction_type, created_at 
-		FROM transactions 
-		WHERE from_account = ? OR to_account = ?
-	`)
-	if err != nil {
-		return nil, fmt.Errorf("error preparing statement: %w", err)
+// ListTransactionsFromAccount returns the page of filter.AccountId's
+// history that filter picks.
+func (s *sqlite) ListTransactionsFromAccount(ctx context.Context, filter dbutil.TransactionFilter) (*dbutil.TransactionPage, error) {
+	account := filter.AccountId
+	query := `
+		SELECT ` + transactionColumns + `
+		FROM transactions
+		WHERE (from_account = ? OR to_account = ?)`
+	args := []interface{}{account, account}
+
+	// The amount as the account sees it, in its own currency
+	amount := "CASE WHEN to_account = ? THEN destination_amount ELSE amount END"
+
+	switch filter.Direction {
+	case dbutil.DirectionIn:
+		query += " AND to_account = ?"
+		args = append(args, account)
+	case dbutil.DirectionOut:
+		query += " AND from_account = ?"
+		args = append(args, account)
+	}
+	// When each transaction happened, for the dates and the date orders
+	at := "created_at"
+	if filter.Settled {
+		at = "settled_at"
+		query += " AND status = ?"
+		args = append(args, dbutil.TransactionPosted)
+	}
+	if filter.Since != nil {
+		query += " AND " + at + " >= ?"
+		args = append(args, filter.Since.UTC())
+	}
+	if filter.Until != nil {
+		query += " AND " + at + " < ?"
+		args = append(args, filter.Until.UTC())
+	}
+	if filter.MinAmount != nil {
+		query += " AND " + amount + " >= ?"
+		args = append(args, account, filter.MinAmount.Minor)
+	}
+	if filter.MaxAmount != nil {
+		query += " AND " + amount + " <= ?"
+		args = append(args, account, filter.MaxAmount.Minor)
+	}
+	if filter.Type != "" {
+		query += " AND transaction_type = ?"
+		args = append(args, filter.Type)
+	}
+	if filter.Status != "" {
+		query += " AND status = ?"
+		args = append(args, filter.Status)
+	}
+	if filter.Counterparty != "" {
+		counterpartyID, _ := filter.CounterpartyId()
+		like := "%" + strings.ToLower(filter.Counterparty) + "%"
+		query += `
+		AND CASE WHEN from_account = ? THEN to_account ELSE from_account END IN (
+			SELECT a.id FROM account a JOIN customers c ON c.id = a.customer_id
+			WHERE a.id = ? OR LOWER(a.nickname) LIKE ? OR LOWER(c.first_name || ' ' || c.last_name) LIKE ?
+				OR LOWER(c.email) LIKE ? OR CAST(c.phone_number AS TEXT) LIKE ?)`
+		args = append(args, account, counterpartyID, like, like, like, like)
+	}
+
+	sort := filter.SortOrder()
+	if filter.After != "" {
+		cursor, err := dbutil.ParseHistoryCursor(filter.After, sort)
+		if err != nil {
+			return nil, err
+		}
+		switch sort {
+		case dbutil.SortNewest:
+			query += " AND (" + at + " < ? OR (" + at + " = ? AND id < ?))"
+			args = append(args, cursor.CreatedAt.UTC(), cursor.CreatedAt.UTC(), cursor.Id)
+		case dbutil.SortOldest:
+			query += " AND (" + at + " > ? OR (" + at + " = ? AND id > ?))"
+			args = append(args, cursor.CreatedAt.UTC(), cursor.CreatedAt.UTC(), cursor.Id)
+		case dbutil.SortLargest:
+			query += " AND (" + amount + " < ? OR (" + amount + " = ? AND id < ?))"
+			args = append(args, account, cursor.Amount, account, cursor.Amount, cursor.Id)
+		case dbutil.SortSmallest:
+			query += " AND (" + amount + " > ? OR (" + amount + " = ? AND id > ?))"
+			args = append(args, account, cursor.Amount, account, cursor.Amount, cursor.Id)
+		}
 	}
-	defer stmt.Close()
 
-	rows, err := stmt.Query(accountID, accountID)
+	switch sort {
+	case dbutil.SortOldest:
+		query += " ORDER BY " + at + ", id"
+	case dbutil.SortLargest:
+		query += " ORDER BY " + amount + " DESC, id DESC"
+		args = append(args, account)
+	case dbutil.SortSmallest:
+		query += " ORDER BY " + amount + ", id"
+		args = append(args, account)
+	default:
+		query += " ORDER BY " + at + " DESC, id DESC"
+	}
+	if filter.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, filter.Limit+1)
+	}
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, fmt.Errorf("error executing query: %w", err)
 	}
@@ -49,15 +185,7 @@ func (s *sqlite) ListTransactionsFromAccount(accountID int) ([]dbutil.Transactio
 	var transactions []dbutil.Transaction
 	for rows.Next() {
 		var transaction dbutil.Transaction
-		// Scan the new fields
-		err := rows.Scan(
-			&transaction.Id,
-			&transaction.FromAccount,
-			&transaction.ToAccount,
-			&transaction.Amount,
-			&transaction.TransactionType,
-			&transaction.CreatedAt,
-		)
+		err := scanTransaction(rows, &transaction)
 		if err != nil {
 			return nil, fmt.Errorf("error scanning transaction: %w", err)
 		}
@@ -69,20 +197,47 @@ func (s *sqlite) ListTransactionsFromAccount(accountID int) ([]dbutil.Transactio
 		return nil, fmt.Errorf("error iterating over rows: %w", err)
 	}
 
-	return transactions, nil
+	return dbutil.NewTransactionPage(&filter, transactions), nil
+}
+
+// AccountBalanceAt returns what accountId's balance was at the given time,
+// counting the transactions settled before it, so a hold counts from when
+// it was captured. A payment from the account to itself counts for
+// nothing. Statements date transactions the same way, so one period's
+// closing balance is the next one's opening balance.
+func (s *sqlite) AccountBalanceAt(ctx context.Context, accountID int, at time.Time) (dbutil.Money, error) {
+	var balance dbutil.Money
+	var currency string
+	err := s.db.QueryRowContext(ctx, `
+		SELECT COALESCE(SUM(CASE
+			WHEN t.from_account = t.to_account THEN 0
+			WHEN t.to_account = a.id THEN t.destination_amount
+			ELSE -(t.amount + t.fee) END), 0), a.currency
+		FROM account a
+		LEFT JOIN transactions t ON (t.from_account = a.id OR t.to_account = a.id) AND t.status = ? AND t.settled_at < ?
+		WHERE a.id = ?
+		GROUP BY a.id, a.currency`, dbutil.TransactionPosted, at.UTC(), accountID).Scan(&balance, &currency)
+	if err != nil {
+		return balance, fmt.Errorf("error summing transactions of account %d: %w", accountID, err)
+	}
+	balance.Currency = currency
+	return balance, nil
+}
+
+func (s *sqlite) GetTransaction(ctx context.Context, transactionID int) (*dbutil.Transaction, error) {
+	return getTransaction(ctx, s.db, transactionID)
 }
 
-func (s *sqlite) GetTransaction(transactionID int) (*dbutil.Transaction, error) {
+// getTransaction reads a transaction through q, which may be an open
+// transaction.
+func getTransaction(ctx context.Context, q queryRower, transactionID int) (*dbutil.Transaction, error) {
 	var transaction dbutil.Transaction
-	// Update the query to fetch the new fields
-	query := "SELECT id, from_account, to_account, amount, transaction_type, created_at FROM transactions WHERE id = ?"
-	row := s.db.QueryRow(query, transactionID)
+	row := q.QueryRowContext(ctx, "SELECT "+transactionColumns+" FROM transactions WHERE id = ?", transactionID)
 
-	// Scan the new fields
-	err := row.Scan(&transaction.Id, &transaction.FromAccount, &transaction.ToAccount, &transaction.Amount, &transaction.TransactionType, &transaction.CreatedAt)
+	err := scanTransaction(row, &transaction)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return nil, fmt.Errorf("transaction not found")
+			return nil, fmt.Errorf("transaction not found: %w", err)
 		}
 		return nil, fmt.Errorf("error fetching transaction: %w", err)
 	}
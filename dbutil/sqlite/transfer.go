@@ -1,6 +1,7 @@
 package sqlite
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"log"
@@ -8,8 +9,21 @@ import (
 	"time"
 )
 
-func (s *sqlite) Transfer(fromAccountId, toAccountId int, amount float64) (int, error) {
-	tx, err := s.db.Begin()
+// Transfer moves amount between two accounts in a single database
+// transaction. The accounts are read through the open transaction and the
+// debit is conditional on the funds still being there, so concurrent
+// transfers from the same account can neither overdraw it nor lose an update.
+// Money set aside by pending holds is not available to pay with.
+//
+// amount must be in the paying account's currency. If the receiving account
+// is held in another currency the payment is converted at the current rate
+// from the exchange rate table, plus its fee, or fails with
+// dbutil.ErrNoExchangeRate if there is none.
+//
+// A non-empty idempotency key that is still live for the paying account
+// returns the transaction it was first used for without moving money again.
+func (s *sqlite) Transfer(ctx context.Context, fromAccountId, toAccountId int, amount dbutil.Money, key dbutil.IdempotencyKey) (id int, err error) {
+	tx, err := s.beginTx(ctx)
 	if err != nil {
 		return 0, fmt.Errorf("error starting transaction: %w", err)
 	}
@@ -24,65 +38,124 @@ func (s *sqlite) Transfer(fromAccountId, toAccountId int, amount float64) (int,
 			err = tx.Commit()
 			if err != nil {
 				log.Printf("Error committing transaction: %v", err)
+				id, err = 0, fmt.Errorf("error committing transaction: %w", err)
 			}
 		}
 	}()
 
-	// TODO: Dont leave the page
-	fromAccount, err := s.GetAccount(fromAccountId)
+	return s.transfer(ctx, tx, fromAccountId, toAccountId, amount, "", key)
+}
+
+// transfer makes one payment through tx, as Transfer describes, with the
+// payer's reference, and returns its transaction id. Transfer and
+// TransferBatch both make their payments here.
+func (s *sqlite) transfer(ctx context.Context, tx *sql.Tx, fromAccountId, toAccountId int, amount dbutil.Money, reference string, key dbutil.IdempotencyKey) (int, error) {
+	if key.Key != "" {
+		id, err := s.replayTransfer(ctx, tx, fromAccountId, toAccountId, amount, key)
+		if err != nil {
+			return 0, err
+		}
+		if id != 0 {
+			return id, nil
+		}
+	}
+
+	transaction, err := s.newTransfer(ctx, tx, fromAccountId, toAccountId, amount)
 	if err != nil {
-		return 0, fmt.Errorf("error getting from account: %w", err)
+		return 0, err
 	}
+	transaction.Reference = reference
 
-	// TODO: Dont leave the page
-	toAccount, err := s.GetAccount(toAccountId)
+	// Post the debit and credit entries, which also moves both balances
+	err = s.post(ctx, tx, transaction, true)
 	if err != nil {
-		return 0, fmt.Errorf("error getting to account: %w", err)
+		return 0, fmt.Errorf("error posting transfer: %w", err)
 	}
-	// TODO: Make an error page for this or just stay on the same page.
-	if fromAccount.Balance < amount {
-		return 0, fmt.Errorf("insufficient funds in the from account")
+
+	if transaction.Id == 0 {
+		return 0, fmt.Errorf("error: transaction ID is not set")
 	}
 
-	fromAccount.Balance -= amount
-	toAccount.Balance += amount
+	if key.Key != "" {
+		err = s.saveIdempotencyKey(ctx, tx, fromAccountId, key, transaction.Id)
+		if err != nil {
+			return 0, err
+		}
+	}
 
-	// TODO: Dont leave the page
-	err = s.UpdateAccountBalance(tx, fromAccount)
+	return transaction.Id, nil
+}
+
+// newTransfer reads both accounts through tx, checks that amount can move
+// between them and returns the payment, converted if the receiving account
+// is held in another currency. A payment that would credit nothing is
+// refused with dbutil.ErrAmountTooSmall. Nothing is written.
+func (s *sqlite) newTransfer(ctx context.Context, tx *sql.Tx, fromAccountId, toAccountId int, amount dbutil.Money) (*dbutil.Transaction, error) {
+	fromAccount, toAccount, err := transferAccounts(ctx, tx, fromAccountId, toAccountId)
 	if err != nil {
-		return 0, fmt.Errorf("error updating from account balance: %w", err)
+		return nil, err
 	}
 
-	// TODO: Dont leave the page
-	err = s.UpdateAccountBalance(tx, toAccount)
-	if err != nil {
-		return 0, fmt.Errorf("error updating to account balance: %w", err)
+	if amount.Currency != fromAccount.Currency() {
+		return nil, fmt.Errorf("paying %s from a %s account: %w", amount.Currency, fromAccount.Currency(), dbutil.ErrCurrencyMismatch)
 	}
 
 	// Create a new transaction using NewTransaction, which returns a pointer
-	transaction := dbutil.NewTransaction(fromAccountId, toAccountId, amount, "Transfer")
+	transaction := dbutil.NewTransaction(fromAccount.Id, toAccount.Id, amount, "Transfer")
+
+	if toAccount.Currency() != amount.Currency {
+		rate, err := getExchangeRate(ctx, tx, amount.Currency, toAccount.Currency())
+		if err != nil {
+			return nil, err
+		}
+		err = transaction.Convert(rate)
+		if err != nil {
+			return nil, fmt.Errorf("error converting payment: %w", err)
+		}
+	}
+	if !transaction.DestinationAmount.IsPositive() {
+		return nil, fmt.Errorf("paying %s %s into a %s account: %w", amount, amount.Currency, toAccount.Currency(), dbutil.ErrAmountTooSmall)
+	}
 
-	// Use the pointer when passing to MakeTransaction
-	err = s.MakeTransaction(tx, transaction)
+	return transaction, nil
+}
+
+// transferAccounts reads both sides of a payment through tx and checks that
+// they are different accounts and neither is frozen or closed.
+func transferAccounts(ctx context.Context, tx *sql.Tx, fromAccountId, toAccountId int) (*dbutil.Account, *dbutil.Account, error) {
+	if fromAccountId == toAccountId {
+		return nil, nil, fmt.Errorf("account %d: %w", fromAccountId, dbutil.ErrSameAccount)
+	}
+
+	fromAccount, err := getAccount(ctx, tx, fromAccountId)
 	if err != nil {
-		return 0, fmt.Errorf("error making transaction: %w", err)
+		return nil, nil, fmt.Errorf("error getting from account: %w", err)
 	}
 
-	if transaction.Id == 0 {
-		return 0, fmt.Errorf("error: transaction ID is not set")
+	toAccount, err := getAccount(ctx, tx, toAccountId)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error getting to account: %w", err)
 	}
 
-	return transaction.Id, nil
+	err = fromAccount.CheckActive()
+	if err != nil {
+		return nil, nil, fmt.Errorf("paying account %d: %w", fromAccount.Id, err)
+	}
+	err = toAccount.CheckActive()
+	if err != nil {
+		return nil, nil, fmt.Errorf("receiving account %d: %w", toAccount.Id, err)
+	}
+	return fromAccount, toAccount, nil
 }
 
-func (s *sqlite) UpdateAccountBalance(tx *sql.Tx, account *dbutil.Account) error {
-	stmt, err := tx.Prepare("UPDATE account SET balance = ?, updated_at = ? WHERE id = ?")
+func (s *sqlite) UpdateAccountBalance(ctx context.Context, tx *sql.Tx, account *dbutil.Account) error {
+	stmt, err := tx.PrepareContext(ctx, "UPDATE account SET balance = ?, updated_at = ? WHERE id = ?")
 	if err != nil {
 		return fmt.Errorf("error preparing update statement: %w", err)
 	}
 	defer stmt.Close()
 
-	_, err = stmt.Exec(account.Balance, time.Now(), account.Id)
+	_, err = stmt.ExecContext(ctx, account.Balance, time.Now(), account.Id)
 	if err != nil {
 		return fmt.Errorf("error updating account balance: %w", err)
 	}
@@ -90,16 +163,34 @@ func (s *sqlite) UpdateAccountBalance(tx *sql.Tx, account *dbutil.Account) error
 	return nil
 }
 
-func (s *sqlite) Stimulus(tx *sql.Tx, account *dbutil.Account) error {
-	// Update the account balance
-	account.Balance += 1000
+// Stimulus credits account with dbutil.StimulusAmount from the funding
+// account for its currency, through tx. Like any other payment it cannot go
+// to an account that is frozen or closed, which is read again through tx
+// rather than trusted from the caller's copy.
+func (s *sqlite) Stimulus(ctx context.Context, tx *sql.Tx, account *dbutil.Account) error {
+	current, err := getAccount(ctx, tx, account.Id)
+	if err != nil {
+		return fmt.Errorf("error getting account: %w", err)
+	}
+	err = current.CheckActive()
+	if err != nil {
+		return fmt.Errorf("receiving account %d: %w", account.Id, err)
+	}
+
+	fundingId, err := s.fundingAccountId(ctx, tx, account.Currency())
+	if err != nil {
+		return err
+	}
 
-	transaction := dbutil.NewTransaction(1, account.Id, 1000.0, "Stimulus")
+	amount := dbutil.StimulusAmount(account.Currency())
+	transaction := dbutil.NewTransaction(fundingId, account.Id, amount, "Stimulus")
 
-	err := s.MakeTransaction(tx, transaction)
+	err = s.post(ctx, tx, transaction, false)
 	if err != nil {
 		return err
 	}
 
-	return s.UpdateAccountBalance(tx, account)
+	// Keep the caller's copy in step with the row
+	account.Balance = account.Balance.Add(amount)
+	return nil
 }
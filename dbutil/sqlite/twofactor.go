@@ -0,0 +1,156 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"minibank/dbutil"
+	"time"
+)
+
+func (s *sqlite) GetTwoFactor(ctx context.Context, customerId int) (*dbutil.TwoFactor, error) {
+	var tf dbutil.TwoFactor
+	var confirmed sql.NullTime
+	err := s.db.QueryRowContext(ctx, "SELECT customer_id, secret, created_at, confirmed_at, last_used_step FROM two_factor WHERE customer_id = ?", customerId).
+		Scan(&tf.CustomerId, &tf.Secret, &tf.CreatedAt, &confirmed, &tf.LastUsedStep)
+	if err == sql.ErrNoRows {
+		return nil, dbutil.ErrTwoFactorNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error fetching two-factor secret: %w", err)
+	}
+	if confirmed.Valid {
+		tf.ConfirmedAt = &confirmed.Time
+	}
+	return &tf, nil
+}
+
+// SaveTwoFactor stores a new, unconfirmed secret for the customer, replacing
+// any earlier one.
+func (s *sqlite) SaveTwoFactor(ctx context.Context, tf *dbutil.TwoFactor) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO two_factor (customer_id, secret, created_at) VALUES (?, ?, ?)
+		ON CONFLICT (customer_id) DO UPDATE SET
+			secret = excluded.secret, created_at = excluded.created_at, confirmed_at = NULL, last_used_step = 0`,
+		tf.CustomerId, tf.Secret, tf.CreatedAt.UTC())
+	if err != nil {
+		return fmt.Errorf("error saving two-factor secret: %w", err)
+	}
+	return nil
+}
+
+// ConfirmTwoFactor turns on two-factor authentication for the customer, after
+// a code from step was accepted, and replaces its recovery codes.
+func (s *sqlite) ConfirmTwoFactor(ctx context.Context, customerId int, step int64, at time.Time, recoveryHashes []string) (err error) {
+	tx, err := s.beginTx(ctx)
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		} else {
+			err = tx.Commit()
+		}
+	}()
+
+	_, err = tx.ExecContext(ctx, "UPDATE two_factor SET confirmed_at = ?, last_used_step = ? WHERE customer_id = ?", at.UTC(), step, customerId)
+	if err != nil {
+		return fmt.Errorf("error confirming two-factor secret: %w", err)
+	}
+	err = replaceRecoveryCodes(ctx, tx, customerId, recoveryHashes)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// ReplaceRecoveryCodes invalidates the customer's recovery codes and stores
+// new ones.
+func (s *sqlite) ReplaceRecoveryCodes(ctx context.Context, customerId int, hashes []string) (err error) {
+	tx, err := s.beginTx(ctx)
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		} else {
+			err = tx.Commit()
+		}
+	}()
+
+	return replaceRecoveryCodes(ctx, tx, customerId, hashes)
+}
+
+func replaceRecoveryCodes(ctx context.Context, tx *sql.Tx, customerId int, hashes []string) error {
+	_, err := tx.ExecContext(ctx, "DELETE FROM recovery_codes WHERE customer_id = ?", customerId)
+	if err != nil {
+		return fmt.Errorf("error deleting recovery codes: %w", err)
+	}
+	for _, hash := range hashes {
+		_, err = tx.ExecContext(ctx, "INSERT INTO recovery_codes (customer_id, code_hash) VALUES (?, ?)", customerId, hash)
+		if err != nil {
+			return fmt.Errorf("error inserting recovery code: %w", err)
+		}
+	}
+	return nil
+}
+
+// UseTwoFactorStep records that a code from step was accepted. It fails with
+// dbutil.ErrTwoFactorCodeUsed if that step or a later one already was, which
+// also settles two requests racing with the same code.
+func (s *sqlite) UseTwoFactorStep(ctx context.Context, customerId int, step int64) error {
+	result, err := s.db.ExecContext(ctx, "UPDATE two_factor SET last_used_step = ? WHERE customer_id = ? AND last_used_step < ?", step, customerId, step)
+	if err != nil {
+		return fmt.Errorf("error recording two-factor code: %w", err)
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error getting rows affected: %w", err)
+	}
+	if rows == 0 {
+		return dbutil.ErrTwoFactorCodeUsed
+	}
+	return nil
+}
+
+// UseRecoveryCode marks one of the customer's unused recovery codes as used,
+// or returns dbutil.ErrRecoveryCodeNotFound.
+func (s *sqlite) UseRecoveryCode(ctx context.Context, customerId int, hash string, at time.Time) error {
+	result, err := s.db.ExecContext(ctx, "UPDATE recovery_codes SET used_at = ? WHERE customer_id = ? AND code_hash = ? AND used_at IS NULL", at.UTC(), customerId, hash)
+	if err != nil {
+		return fmt.Errorf("error using recovery code: %w", err)
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error getting rows affected: %w", err)
+	}
+	if rows == 0 {
+		return dbutil.ErrRecoveryCodeNotFound
+	}
+	return nil
+}
+
+func (s *sqlite) CountRecoveryCodes(ctx context.Context, customerId int) (int, error) {
+	var count int
+	err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM recovery_codes WHERE customer_id = ? AND used_at IS NULL", customerId).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("error counting recovery codes: %w", err)
+	}
+	return count, nil
+}
+
+// DeleteTwoFactor turns off two-factor authentication for the customer and
+// discards its recovery codes.
+func (s *sqlite) DeleteTwoFactor(ctx context.Context, customerId int) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM recovery_codes WHERE customer_id = ?", customerId)
+	if err != nil {
+		return fmt.Errorf("error deleting recovery codes: %w", err)
+	}
+	_, err = s.db.ExecContext(ctx, "DELETE FROM two_factor WHERE customer_id = ?", customerId)
+	if err != nil {
+		return fmt.Errorf("error deleting two-factor secret: %w", err)
+	}
+	return nil
+}
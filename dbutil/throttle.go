@@ -0,0 +1,12 @@
+package dbutil
+
+import "time"
+
+// LoginThrottle counts recent failed logins for a key, such as an email
+// address or a client IP. LockedUntil is zero unless the key is locked out.
+type LoginThrottle struct {
+	Key           string    `json:"key"`
+	Failures      int       `json:"failures"`
+	LastFailureAt time.Time `json:"last_failure_at"`
+	LockedUntil   time.Time `json:"locked_until"`
+}
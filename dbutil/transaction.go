@@ -1,24 +1,242 @@
 package dbutil
 
 import (
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
 	"time"
 )
 
+// StimulusUnits is how many whole units of its own currency an account is
+// credited each time the stimulus is claimed.
+const StimulusUnits = 1000
+
+// StimulusAmount returns the stimulus payment for an account held in
+// currency.
+func StimulusAmount(currency string) Money {
+	return NewMoney(StimulusUnits*pow10(Exponent(currency)), currency)
+}
+
+// Transaction statuses. A pending transaction is an authorization hold: the
+// money is set aside in the paying account, which lowers its available
+// balance, but nothing is posted to the ledger until the hold is captured
+// and the transaction becomes posted. A hold that is voided, or that
+// expires first, releases the money and is never posted. Transfers are
+// posted straight away.
+const (
+	TransactionPending = "pending"
+	TransactionPosted  = "posted"
+	TransactionVoided  = "voided"
+)
+
+var (
+	// ErrNotPending is returned when capturing or voiding a transaction
+	// that is not a pending hold.
+	ErrNotPending = errors.New("transaction is not a pending hold")
+
+	// ErrHoldExpired is returned when capturing a hold after it expired.
+	ErrHoldExpired = errors.New("hold has expired")
+
+	// ErrNotRefundable is returned when reversing anything but a posted
+	// transfer.
+	ErrNotRefundable = errors.New("transaction cannot be refunded")
+
+	// ErrRefundTooLarge is returned when a refund would take the total
+	// refunded past what was paid.
+	ErrRefundTooLarge = errors.New("refund exceeds the amount paid")
+)
+
+// ErrIdempotencyKeyReused is returned when an idempotency key that is still
+// live is presented again for a different payment.
+var ErrIdempotencyKeyReused = errors.New("idempotency key already used for a different payment")
+
+// IdempotencyKey lets a client retry a transfer safely. A transfer presented
+// with the same key by the same account before ExpiresAt returns the original
+// transaction instead of moving money again. ExpiresAt is compared with the
+// wall clock, time.Now, by every backend. The zero value means no key.
+type IdempotencyKey struct {
+	Key       string
+	ExpiresAt time.Time
+}
+
+// Transaction moves Amount out of FromAccount, in that account's currency,
+// and DestinationAmount into ToAccount, in its currency. The two are the same
+// unless the payment was converted at Rate, in which case Fee, also in the
+// paying account's currency, was debited on top of Amount.
+//
+// A pending transaction is a hold that lapses at ExpiresAt. SettledAt is
+// when the transaction was posted or voided. A refund has the id of the
+// transaction it reverses in Reverses. Reference is the payer's note for
+// the payee, such as an invoice number, if they gave one.
 type Transaction struct {
-	Id              int       `json:"id"`
-	FromAccount     int       `json:"from_account"`
-	ToAccount       int       `json:"to_account"`
-	Amount          float64   `json:"amount"`
-	TransactionType string    `json:"transaction_type"`
-	CreatedAt       time.Time `json:"created_at"`
+	Id                int        `json:"id"`
+	FromAccount       int        `json:"from_account"`
+	ToAccount         int        `json:"to_account"`
+	Amount            Money      `json:"amount"`
+	DestinationAmount Money      `json:"destination_amount"`
+	Rate              string     `json:"rate,omitempty"`
+	Fee               Money      `json:"fee"`
+	TransactionType   string     `json:"transaction_type"`
+	Status            string     `json:"status"`
+	CreatedAt         time.Time  `json:"created_at"`
+	ExpiresAt         *time.Time `json:"expires_at,omitempty"`
+	SettledAt         *time.Time `json:"settled_at,omitempty"`
+	Reverses          int        `json:"reverses,omitempty"`
+	Reference         string     `json:"reference,omitempty"`
 }
 
-func NewTransaction(fromAccount, toAccount int, amount float64, transactionType string) *Transaction {
+func NewTransaction(fromAccount, toAccount int, amount Money, transactionType string) *Transaction {
 	return &Transaction{
-		FromAccount:     fromAccount,
-		ToAccount:       toAccount,
-		Amount:          amount,
-		TransactionType: transactionType,
-		CreatedAt:       time.Now(),
+		FromAccount:       fromAccount,
+		ToAccount:         toAccount,
+		Amount:            amount,
+		DestinationAmount: amount,
+		Fee:               NewMoney(0, amount.Currency),
+		TransactionType:   transactionType,
+		Status:            TransactionPosted,
+		CreatedAt:         time.Now(),
+	}
+}
+
+// Pending reports whether the transaction is a hold that has been neither
+// captured nor voided.
+func (t *Transaction) Pending() bool {
+	return t.Status == TransactionPending
+}
+
+// Debit returns everything the transaction takes out of the paying account:
+// the amount and any conversion fee. It is also what a hold sets aside.
+func (t *Transaction) Debit() Money {
+	return t.Amount.Add(t.Fee)
+}
+
+// Convert makes the transaction pay out in rate's quote currency, setting
+// the destination amount, rate and fee.
+func (t *Transaction) Convert(rate *ExchangeRate) error {
+	converted, fee, err := rate.Convert(t.Amount)
+	if err != nil {
+		return err
+	}
+	t.DestinationAmount = converted
+	t.Rate = rate.Rate
+	t.Fee = fee
+	return nil
+}
+
+// Converted reports whether the payment changed currency.
+func (t *Transaction) Converted() bool {
+	return t.Rate != ""
+}
+
+// AmountFor returns the amount as seen from accountId: what was paid in for
+// the receiving account, and what was paid out for the paying one.
+func (t *Transaction) AmountFor(accountId int) Money {
+	if accountId == t.ToAccount && accountId != t.FromAccount {
+		return t.DestinationAmount
+	}
+	return t.Amount
+}
+
+// BalanceChange returns what posting the transaction does to accountId's
+// balance: plus what arrived for the receiving account, minus the debit for
+// the paying one. A payment from an account to itself changes nothing.
+func (t *Transaction) BalanceChange(accountId int) Money {
+	if t.FromAccount == t.ToAccount {
+		return NewMoney(0, t.Amount.Currency)
+	}
+	if accountId == t.ToAccount && accountId != t.FromAccount {
+		return t.DestinationAmount
+	}
+	debit := t.Debit()
+	return NewMoney(-debit.Minor, debit.Currency)
+}
+
+// Entries returns the ledger entries that post the transaction. A payment
+// within one currency is a debit and a matching credit. A converted payment
+// goes through the bank's own accounts: bankSource, in the paying account's
+// currency, receives the amount and fee, and bankDestination, in the
+// receiving account's currency, pays out the destination amount. Either
+// way the entries in each currency sum to zero.
+func (t *Transaction) Entries(bankSource, bankDestination int) []LedgerEntry {
+	if !t.Converted() {
+		return []LedgerEntry{
+			{TransactionId: t.Id, AccountId: t.FromAccount, Amount: NewMoney(-t.Amount.Minor, t.Amount.Currency)},
+			{TransactionId: t.Id, AccountId: t.ToAccount, Amount: t.Amount},
+		}
+	}
+
+	debit := t.Debit()
+	return []LedgerEntry{
+		{TransactionId: t.Id, AccountId: t.FromAccount, Amount: NewMoney(-debit.Minor, debit.Currency)},
+		{TransactionId: t.Id, AccountId: bankSource, Amount: debit},
+		{TransactionId: t.Id, AccountId: bankDestination, Amount: NewMoney(-t.DestinationAmount.Minor, t.DestinationAmount.Currency)},
+		{TransactionId: t.Id, AccountId: t.ToAccount, Amount: t.DestinationAmount},
+	}
+}
+
+// Refundable reports whether the transaction is a posted transfer, the only
+// kind that can be reversed.
+func (t *Transaction) Refundable() bool {
+	return t.Status == TransactionPosted && t.TransactionType == "Transfer"
+}
+
+// Reversal returns the refund of amount of t, given that refunded has been
+// refunded already. The refund comes back out of the receiving account, in
+// the currency t arrived in, and goes to the paying account; refunding all
+// of t's destination amount, at once or in parts, reverses it fully.
+//
+// A converted payment is refunded on its original terms rather than at the
+// current rate: the payer gets back the same share of what they were
+// debited, fee included, as the refund is of what arrived. The shares are
+// rounded cumulatively, so the refunds of a full reversal add up to the
+// debit exactly.
+func (t *Transaction) Reversal(amount, refunded Money) (*Transaction, error) {
+	if !t.Refundable() {
+		return nil, fmt.Errorf("transaction %d is a %s %s: %w", t.Id, t.Status, t.TransactionType, ErrNotRefundable)
+	}
+	if amount.Currency != t.DestinationAmount.Currency {
+		return nil, fmt.Errorf("refunding %s of a payment received in %s: %w", amount.Currency, t.DestinationAmount.Currency, ErrCurrencyMismatch)
+	}
+	if !amount.IsPositive() {
+		return nil, fmt.Errorf("refund amount must be positive")
+	}
+	total := refunded.Add(amount)
+	if t.DestinationAmount.LessThan(total) {
+		return nil, fmt.Errorf("refunding %s of %s %s with %s already refunded: %w", amount, t.DestinationAmount, t.DestinationAmount.Currency, refunded, ErrRefundTooLarge)
+	}
+
+	reversal := NewTransaction(t.ToAccount, t.FromAccount, amount, "Refund")
+	reversal.Reverses = t.Id
+	if !t.Converted() {
+		return reversal, nil
+	}
+
+	debit := t.Debit()
+	before, err := share(debit, refunded, t.DestinationAmount)
+	if err != nil {
+		return nil, err
+	}
+	after, err := share(debit, total, t.DestinationAmount)
+	if err != nil {
+		return nil, err
+	}
+	rate, err := ParseRate(t.Rate)
+	if err != nil {
+		return nil, err
+	}
+	reversal.DestinationAmount = NewMoney(after-before, debit.Currency)
+	reversal.Rate = strings.TrimRight(strings.TrimRight(new(big.Rat).Inv(rate).FloatString(12), "0"), ".")
+	return reversal, nil
+}
+
+// share returns the part of m that part is of whole, in whole minor units.
+func share(m, part, whole Money) (int64, error) {
+	exact := big.NewRat(part.Minor, whole.Minor)
+	exact.Mul(exact, new(big.Rat).SetInt64(m.Minor))
+	minor, err := roundMinor(exact)
+	if err != nil {
+		return 0, fmt.Errorf("error sharing %s %s: %w", m, m.Currency, err)
 	}
+	return minor, nil
 }
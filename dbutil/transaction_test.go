@@ -0,0 +1,30 @@
+package dbutil
+
+import "testing"
+
+func TestBalanceChange(t *testing.T) {
+	converted := &Transaction{
+		FromAccount: 1, ToAccount: 2,
+		Amount: NewMoney(1000, "AUD"), DestinationAmount: NewMoney(650, "USD"), Fee: NewMoney(10, "AUD"),
+		Rate: "0.65",
+	}
+	toSelf := NewTransaction(1, 1, NewMoney(1000, "AUD"), "Transfer")
+
+	tests := []struct {
+		name        string
+		transaction *Transaction
+		accountId   int
+		want        Money
+	}{
+		{"payer", NewTransaction(1, 2, NewMoney(1000, "AUD"), "Transfer"), 1, NewMoney(-1000, "AUD")},
+		{"payee", NewTransaction(1, 2, NewMoney(1000, "AUD"), "Transfer"), 2, NewMoney(1000, "AUD")},
+		{"converted payer", converted, 1, NewMoney(-1010, "AUD")},
+		{"converted payee", converted, 2, NewMoney(650, "USD")},
+		{"to itself", toSelf, 1, NewMoney(0, "AUD")},
+	}
+	for _, test := range tests {
+		if got := test.transaction.BalanceChange(test.accountId); got != test.want {
+			t.Errorf("%s: BalanceChange(%d) = %v, want %v", test.name, test.accountId, got, test.want)
+		}
+	}
+}
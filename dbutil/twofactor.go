@@ -0,0 +1,69 @@
+package dbutil
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrTwoFactorNotFound is returned for a customer that has not started
+	// enrolling in two-factor authentication.
+	ErrTwoFactorNotFound = errors.New("two-factor authentication not set up")
+
+	// ErrTwoFactorCodeUsed is returned when a code's time step is not
+	// after the last one accepted, so each code only works once.
+	ErrTwoFactorCodeUsed = errors.New("two-factor code already used")
+
+	// ErrRecoveryCodeNotFound is returned for an unknown or already used
+	// recovery code.
+	ErrRecoveryCodeNotFound = errors.New("recovery code not found")
+)
+
+// RecoveryCodeCount is how many recovery codes a customer is given.
+const RecoveryCodeCount = 10
+
+// TwoFactor is a customer's TOTP secret. It only guards logins once
+// ConfirmedAt is set, which happens when the customer proves they can generate
+// codes. LastUsedStep is the time step of the last accepted code.
+type TwoFactor struct {
+	CustomerId   int        `json:"customer_id"`
+	Secret       string     `json:"-"`
+	CreatedAt    time.Time  `json:"created_at"`
+	ConfirmedAt  *time.Time `json:"confirmed_at,omitempty"`
+	LastUsedStep int64      `json:"-"`
+}
+
+// Enabled reports whether the secret has been confirmed.
+func (t *TwoFactor) Enabled() bool {
+	return t != nil && t.ConfirmedAt != nil
+}
+
+// NewRecoveryCodes generates RecoveryCodeCount single-use codes and the
+// hashes to store for them. Like API tokens, each carries enough randomness
+// (80 bits) that a fast hash is enough.
+func NewRecoveryCodes() (codes, hashes []string, err error) {
+	for i := 0; i < RecoveryCodeCount; i++ {
+		secret := make([]byte, 10)
+		_, err := rand.Read(secret)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error generating recovery code: %w", err)
+		}
+		raw := strings.ToLower(base32.StdEncoding.EncodeToString(secret))
+		code := raw[0:4] + "-" + raw[4:8] + "-" + raw[8:12] + "-" + raw[12:16]
+		codes = append(codes, code)
+		hashes = append(hashes, HashRecoveryCode(code))
+	}
+	return codes, hashes, nil
+}
+
+// HashRecoveryCode returns the value stored for a recovery code. Case,
+// spaces and dashes are ignored so the code can be typed loosely.
+func HashRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	code = strings.NewReplacer("-", "", " ", "").Replace(code)
+	return HashAPIToken(code)
+}
@@ -0,0 +1,149 @@
+// Package mailer sends the emails the bank needs, such as password reset and
+// address verification links, through a pluggable Mailer.
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Message is a plain-text email.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers messages.
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// New returns the mailer described by spec: "log" or "" to write messages to
+// the log, "file:<path>" to append them to a file, or
+// "smtp://[user:password@]host:port" to send them through an SMTP server.
+// from is the sender address.
+func New(spec, from string) (Mailer, error) {
+	switch {
+	case spec == "" || spec == "log":
+		return &File{From: from}, nil
+	case strings.HasPrefix(spec, "file:"):
+		return &File{From: from, Path: strings.TrimPrefix(spec, "file:")}, nil
+	case strings.HasPrefix(spec, "smtp://"):
+		u, err := url.Parse(spec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid smtp url: %w", err)
+		}
+		m := &SMTP{Addr: u.Host, From: from}
+		if u.User != nil {
+			m.Username = u.User.Username()
+			m.Password, _ = u.User.Password()
+		}
+		return m, nil
+	}
+	return nil, fmt.Errorf("unsupported mailer %q", spec)
+}
+
+// format renders msg as an RFC 5322 message.
+func format(from string, msg Message, date time.Time) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", msg.Subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	return []byte(b.String())
+}
+
+// checkHeaders refuses header values that would start a new header.
+func checkHeaders(values ...string) error {
+	for _, v := range values {
+		if strings.ContainsAny(v, "\r\n") {
+			return fmt.Errorf("invalid mail header %q", v)
+		}
+	}
+	return nil
+}
+
+// SMTP sends mail through an SMTP server, using STARTTLS when the server
+// offers it and PLAIN authentication when a username is set.
+type SMTP struct {
+	Addr     string // host:port
+	From     string
+	Username string
+	Password string
+}
+
+func (m *SMTP) Send(ctx context.Context, msg Message) error {
+	err := checkHeaders(m.From, msg.To, msg.Subject)
+	if err != nil {
+		return err
+	}
+
+	var auth smtp.Auth
+	if m.Username != "" {
+		host, _, _ := net.SplitHostPort(m.Addr)
+		auth = smtp.PlainAuth("", m.Username, m.Password, host)
+	}
+
+	// net/smtp takes no context, so give up waiting for it instead
+	done := make(chan error, 1)
+	go func() {
+		done <- smtp.SendMail(m.Addr, auth, m.From, []string{msg.To}, format(m.From, msg, time.Now()))
+	}()
+	select {
+	case err = <-done:
+		if err != nil {
+			return fmt.Errorf("error sending mail: %w", err)
+		}
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// File appends messages to a file, or writes them to the log when Path is
+// empty, so that links can be followed locally without a mail server.
+type File struct {
+	From string
+	Path string
+
+	mu sync.Mutex
+}
+
+func (m *File) Send(ctx context.Context, msg Message) error {
+	err := checkHeaders(m.From, msg.To, msg.Subject)
+	if err != nil {
+		return err
+	}
+	data := format(m.From, msg, time.Now())
+
+	if m.Path == "" {
+		log.Printf("Mail to %s:\n%s", msg.To, data)
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, err := os.OpenFile(m.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("error opening mail file: %w", err)
+	}
+	defer f.Close()
+	_, err = f.Write(append(data, "\r\n\r\n"...))
+	if err != nil {
+		return fmt.Errorf("error writing mail file: %w", err)
+	}
+	return nil
+}
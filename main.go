@@ -1,7 +1,53 @@
 package main
 
-import "minibank/server"
+import (
+	"context"
+	"fmt"
+	"log"
+	"minibank/server"
+	"os"
+	"os/signal"
+)
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if len(os.Args) != 3 {
+			fmt.Fprintln(os.Stderr, "usage: minibank migrate up|down|status")
+			os.Exit(2)
+		}
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+		if err := server.Migrate(ctx, os.Args[2], os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "role" {
+		if len(os.Args) != 4 {
+			fmt.Fprintln(os.Stderr, "usage: minibank role <email> customer|teller|admin")
+			os.Exit(2)
+		}
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+		if err := server.SetRole(ctx, os.Args[2], os.Args[3]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "rates" {
+		if len(os.Args) != 3 {
+			fmt.Fprintln(os.Stderr, "usage: minibank rates <file.csv>")
+			os.Exit(2)
+		}
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+		if err := server.LoadExchangeRates(ctx, os.Args[2], os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	server.Run()
 }
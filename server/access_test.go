@@ -0,0 +1,282 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"minibank/dbutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// Who may use a web route.
+const (
+	public = "public"
+	login  = "login"
+	staff  = "staff"
+)
+
+// webRoutes lists every page and form of the site with who may use it.
+// logsOut marks the routes that end the session.
+var webRoutes = []struct {
+	method, path string
+	access       string
+	logsOut      bool
+}{
+	{method: http.MethodGet, path: "/", access: login},
+	{method: http.MethodPost, path: "/account", access: login},
+	{method: http.MethodPost, path: "/open-account", access: login},
+	{method: http.MethodGet, path: "/payment", access: login},
+	{method: http.MethodPost, path: "/payment", access: login},
+	{method: http.MethodGet, path: "/scheduled-payments", access: login},
+	{method: http.MethodPost, path: "/scheduled-payments", access: login},
+	{method: http.MethodPost, path: "/scheduled-payments/999999/cancel", access: login},
+	{method: http.MethodGet, path: "/bulk-payments", access: login},
+	{method: http.MethodPost, path: "/bulk-payments/preview", access: login},
+	{method: http.MethodPost, path: "/bulk-payments", access: login},
+	{method: http.MethodGet, path: "/all-accounts", access: staff},
+	{method: http.MethodGet, path: "/create-account", access: public},
+	{method: http.MethodPost, path: "/create-account", access: public},
+	{method: http.MethodGet, path: "/delete-account", access: login},
+	{method: http.MethodPost, path: "/delete-account", access: login},
+	{method: http.MethodGet, path: "/transactions", access: login},
+	{method: http.MethodGet, path: "/statement", access: login},
+	{method: http.MethodGet, path: "/single-transaction/999999", access: login},
+	{method: http.MethodPost, path: "/single-transaction/999999/refund", access: login},
+	{method: http.MethodGet, path: "/login", access: public},
+	{method: http.MethodGet, path: "/forgot-password", access: public},
+	{method: http.MethodPost, path: "/forgot-password", access: public},
+	{method: http.MethodGet, path: "/reset-password", access: public},
+	{method: http.MethodPost, path: "/reset-password", access: public},
+	{method: http.MethodGet, path: "/verify-email", access: public},
+	{method: http.MethodPost, path: "/verify-email/resend", access: login},
+	{method: http.MethodGet, path: "/two-factor", access: login},
+	{method: http.MethodPost, path: "/two-factor/enroll", access: login},
+	{method: http.MethodPost, path: "/two-factor/confirm", access: login},
+	{method: http.MethodPost, path: "/two-factor/recovery-codes", access: login},
+	{method: http.MethodPost, path: "/two-factor/disable", access: login},
+	{method: http.MethodPost, path: "/logout", access: public, logsOut: true},
+	{method: http.MethodPost, path: "/logout-all", access: login, logsOut: true},
+}
+
+// roles are the signed-in roles the access tests try, with "" for a
+// visitor who has not logged in.
+var roles = []string{"", dbutil.RoleCustomer, dbutil.RoleTeller, dbutil.RoleAdmin}
+
+func TestWebAccess(t *testing.T) {
+	ts := newTestServer(t, nil)
+	for _, role := range roles {
+		email := "anonymous"
+		if role != "" {
+			email = role + "@example.com"
+			ts.customer(t, email, role, "AUD")
+		}
+
+		t.Run(email, func(t *testing.T) {
+			open := func() *testClient {
+				if role == "" {
+					return ts.client(t)
+				}
+				return ts.login(t, email)
+			}
+			tc := open()
+			for _, route := range webRoutes {
+				resp := tc.do(t, route.method, route.path, "application/x-www-form-urlencoded", strings.NewReader(""))
+				body := readBody(t, resp)
+				toLogin := resp.StatusCode == http.StatusSeeOther && resp.Header.Get("Location") == "/login"
+
+				switch {
+				case route.access != public && role == "":
+					if !toLogin {
+						t.Errorf("%s %s: status %d, want a redirect to /login", route.method, route.path, resp.StatusCode)
+					}
+				case route.access == staff && role == dbutil.RoleCustomer:
+					if resp.StatusCode != http.StatusForbidden {
+						t.Errorf("%s %s: status %d, want %d", route.method, route.path, resp.StatusCode, http.StatusForbidden)
+					}
+				case resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusUnauthorized:
+					t.Errorf("%s %s: status %d, want access: %s", route.method, route.path, resp.StatusCode, body)
+				case toLogin && route.access != public:
+					t.Errorf("%s %s: redirected to /login, want access", route.method, route.path)
+				}
+
+				if route.logsOut {
+					tc = open()
+				}
+			}
+		})
+	}
+}
+
+func TestWebOwnership(t *testing.T) {
+	ts := newTestServer(t, nil)
+	_, bobAccount := ts.customer(t, "bob@example.com", dbutil.RoleCustomer, "AUD")
+	_, carolAccount := ts.customer(t, "carol@example.com", dbutil.RoleCustomer, "AUD")
+	ts.customer(t, "alice@example.com", dbutil.RoleCustomer, "AUD")
+	ts.customer(t, "teller@example.com", dbutil.RoleTeller, "AUD")
+	ts.customer(t, "admin@example.com", dbutil.RoleAdmin, "AUD")
+
+	// Bob pays Carol; Alice and the staff have nothing to do with it
+	id, err := ts.db.Transfer(context.Background(), bobAccount.Id, carolAccount.Id, dbutil.NewMoney(1000, "AUD"), dbutil.IdempotencyKey{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	refund := url.Values{"amount": {"1.00"}}.Encode()
+	closeAccount := url.Values{"account_id": {fmt.Sprint(bobAccount.Id)}}.Encode()
+
+	tests := []struct {
+		method, path, form string
+		// want is the status for each of bob, carol, alice, teller and
+		// admin
+		want [5]int
+	}{
+		{http.MethodGet, fmt.Sprintf("/transactions?account_id=%d", bobAccount.Id), "",
+			[5]int{200, 403, 403, 200, 200}},
+		{http.MethodGet, fmt.Sprintf("/statement?account_id=%d", bobAccount.Id), "",
+			[5]int{200, 403, 403, 200, 200}},
+		{http.MethodGet, fmt.Sprintf("/single-transaction/%d", id), "",
+			[5]int{200, 200, 404, 200, 200}},
+		// Only the payee or an admin may refund, and each refunds 1.00
+		{http.MethodPost, fmt.Sprintf("/single-transaction/%d/refund", id), refund,
+			[5]int{403, 303, 404, 403, 303}},
+		// Bob's account still has money in it, which stops even the admin
+		{http.MethodPost, "/delete-account", closeAccount,
+			[5]int{409, 403, 403, 403, 409}},
+	}
+	actors := []string{"bob", "carol", "alice", "teller", "admin"}
+	for i, actor := range actors {
+		tc := ts.login(t, actor+"@example.com")
+		for _, tt := range tests {
+			resp := tc.do(t, tt.method, tt.path, "application/x-www-form-urlencoded", strings.NewReader(tt.form))
+			body := readBody(t, resp)
+			if resp.StatusCode != tt.want[i] {
+				t.Errorf("%s: %s %s: status %d, want %d: %s", actor, tt.method, tt.path, resp.StatusCode, tt.want[i], body)
+			}
+		}
+	}
+}
+
+// apiPath fills in the parameters of an API route path with resources of
+// the customer making the request, or ones that do not exist.
+func apiPath(path string, customer *dbutil.Customer, account *dbutil.Account) string {
+	path = strings.NewReplacer(
+		"/customers/:id", fmt.Sprintf("/customers/%d", customer.Id),
+		"/accounts/:id", fmt.Sprintf("/accounts/%d", account.Id),
+		":base", "AUD",
+		":quote", "XXX",
+		":id", "999999",
+	).Replace(path)
+	return apiPrefix + path
+}
+
+// apiRejection returns the error code of a 401 or 403 response, or "" for
+// any other status.
+func apiRejection(t *testing.T, resp *http.Response) string {
+	t.Helper()
+	body := readBody(t, resp)
+	if resp.StatusCode != http.StatusUnauthorized && resp.StatusCode != http.StatusForbidden {
+		return ""
+	}
+	var e apiError
+	if err := json.Unmarshal([]byte(body), &e); err != nil {
+		t.Fatalf("%s %s: status %d with body %q", resp.Request.Method, resp.Request.URL.Path, resp.StatusCode, body)
+	}
+	return e.Error.Code
+}
+
+func TestAPIRoleAccess(t *testing.T) {
+	ts := newTestServer(t, nil)
+	routes := apiRoutes(ts.db, ts.cfg)
+	for _, role := range roles {
+		email := "anonymous"
+		var customer *dbutil.Customer
+		var account *dbutil.Account
+		if role != "" {
+			email = role + "@example.com"
+			customer, account = ts.customer(t, email, role, "AUD")
+		}
+
+		t.Run(email, func(t *testing.T) {
+			open := func() *testClient {
+				if role == "" {
+					return ts.client(t)
+				}
+				return ts.login(t, email)
+			}
+			tc := open()
+			for _, route := range routes {
+				path := apiPrefix + route.Path
+				if customer != nil {
+					path = apiPath(route.Path, customer, account)
+				}
+				resp := tc.do(t, route.Method, path, "application/json", strings.NewReader("{}"))
+				got := apiRejection(t, resp)
+
+				allowed := route.Roles == nil
+				for _, r := range route.Roles {
+					allowed = allowed || r == role
+				}
+				switch {
+				case route.Scope == "":
+					if got != "" {
+						t.Errorf("%s %s: %s, want access to a public route", route.Method, path, got)
+					}
+				case role == "":
+					if got != "unauthenticated" {
+						t.Errorf("%s %s: %q, want unauthenticated", route.Method, path, got)
+					}
+				case !allowed:
+					if got != "forbidden" {
+						t.Errorf("%s %s: %q, want forbidden", route.Method, path, got)
+					}
+				case got != "":
+					t.Errorf("%s %s: %s, want access", route.Method, path, got)
+				}
+
+				if route.Method == http.MethodDelete && route.Path == "/sessions/current" {
+					tc = open()
+				}
+			}
+		})
+	}
+}
+
+func TestAPIKeyScopes(t *testing.T) {
+	ts := newTestServer(t, nil)
+	// An admin, so that only the scopes of the key limit it
+	customer, account := ts.customer(t, "admin@example.com", dbutil.RoleAdmin, "AUD")
+	routes := apiRoutes(ts.db, ts.cfg)
+
+	for _, scope := range dbutil.Scopes {
+		t.Run(scope, func(t *testing.T) {
+			key, token, err := dbutil.NewAPIKey(customer.Id, scope, []string{scope})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := ts.db.CreateAPIKey(context.Background(), key); err != nil {
+				t.Fatal(err)
+			}
+
+			tc := ts.client(t)
+			for _, route := range routes {
+				if route.Scope == "" {
+					continue
+				}
+				path := apiPath(route.Path, customer, account)
+				resp := tc.do(t, route.Method, path, "application/json", strings.NewReader("{}"),
+					"Authorization", "Bearer "+token, "X-CSRF-Token", "")
+				got := apiRejection(t, resp)
+
+				if !key.HasScope(route.Scope) {
+					if got != "insufficient_scope" {
+						t.Errorf("%s %s: %q, want insufficient_scope", route.Method, path, got)
+					}
+				} else if got != "" {
+					t.Errorf("%s %s: %s, want access", route.Method, path, got)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,199 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"minibank/dbutil"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	errMissingFields      = errors.New("Please fill in all required fields.")
+	errInvalidPhoneNumber = errors.New("Invalid phone number. Only digits are allowed.")
+	errInvalidAccountType = errors.New("Account type must be one of: " + strings.Join(dbutil.AccountTypes, ", "))
+	errNicknameTooLong    = errors.New("Nicknames can be at most 50 characters long.")
+	errInvalidCurrency    = errors.New("Currency must be one of: " + strings.Join(dbutil.Currencies(), ", "))
+)
+
+// newCustomer validates sign-up details and returns a customer ready to be
+// stored, with the first name capitalised and the password hashed, together
+// with the checking account every customer starts with.
+func newCustomer(firstName, lastName, email, phoneNumber, password string) (*dbutil.Customer, *dbutil.Account, error) {
+	if firstName == "" || lastName == "" || email == "" || password == "" {
+		return nil, nil, errMissingFields
+	}
+
+	number, err := strconv.Atoi(phoneNumber)
+	if err != nil {
+		return nil, nil, errInvalidPhoneNumber
+	}
+
+	firstName = strings.ToUpper(firstName[:1]) + firstName[1:]
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), 10)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	customer := &dbutil.Customer{
+		First_name:         firstName,
+		Last_name:          lastName,
+		Email:              email,
+		Phone_number:       number,
+		Encrypted_password: string(hashedPassword),
+		Created_at:         now,
+		Updated_at:         now,
+		Role:               dbutil.RoleCustomer,
+	}
+	account, err := newAccount(customer.Id, dbutil.AccountChecking, "", dbutil.DefaultCurrency)
+	if err != nil {
+		return nil, nil, err
+	}
+	return customer, account, nil
+}
+
+// newAccount validates the details of an account customerID wants to open and
+// returns it ready to be stored, empty and active. An empty currency means
+// dbutil.DefaultCurrency.
+func newAccount(customerID int, accountType, nickname, currency string) (*dbutil.Account, error) {
+	if !dbutil.ValidAccountType(accountType) {
+		return nil, errInvalidAccountType
+	}
+	if currency == "" {
+		currency = dbutil.DefaultCurrency
+	}
+	if !dbutil.ValidCurrency(currency) {
+		return nil, errInvalidCurrency
+	}
+	nickname = strings.TrimSpace(nickname)
+	if len(nickname) > 50 {
+		return nil, errNicknameTooLong
+	}
+
+	now := time.Now()
+	return &dbutil.Account{
+		Customer_id: customerID,
+		Type:        accountType,
+		Nickname:    nickname,
+		Balance:     dbutil.NewMoney(0, currency),
+		Created_at:  now,
+		Updated_at:  now,
+		Status:      dbutil.StatusActive,
+	}, nil
+}
+
+// hasOpenAccount reports whether any of accounts is not closed. A customer
+// whose accounts are all closed has left the bank and cannot log in.
+func hasOpenAccount(accounts []dbutil.Account) bool {
+	for i := range accounts {
+		if !accounts[i].Closed() {
+			return true
+		}
+	}
+	return false
+}
+
+// primaryAccount returns the account that payments to a customer land in and
+// that is used when a customer does not pick one: their oldest open checking
+// account, or failing that their oldest open account. It returns nil if every
+// account is closed.
+func primaryAccount(accounts []dbutil.Account) *dbutil.Account {
+	var primary *dbutil.Account
+	for i := range accounts {
+		if accounts[i].Closed() {
+			continue
+		}
+		if accounts[i].Type == dbutil.AccountChecking {
+			return &accounts[i]
+		}
+		if primary == nil {
+			primary = &accounts[i]
+		}
+	}
+	return primary
+}
+
+// findAccount returns the account in accounts with id, or nil.
+func findAccount(accounts []dbutil.Account, id int) *dbutil.Account {
+	for i := range accounts {
+		if accounts[i].Id == id {
+			return &accounts[i]
+		}
+	}
+	return nil
+}
+
+// ownAccount picks one of the logged-in customer's accounts by the id in
+// value, or their primary account if value is empty. It returns nil for an
+// id that is not theirs or not a number.
+func ownAccount(c echo.Context, value string) *dbutil.Account {
+	if value == "" {
+		return primaryAccount(currentAccounts(c))
+	}
+	id, err := strconv.Atoi(value)
+	if err != nil {
+		return nil
+	}
+	return findAccount(currentAccounts(c), id)
+}
+
+// findRecipient resolves a payment recipient given as an email address or a
+// phone number to the customer and the primary account payments to them land
+// in. A customer without an open account is not found.
+func findRecipient(ctx context.Context, db dbutil.Database, recipient string) (*dbutil.Customer, *dbutil.Account, error) {
+	var customer *dbutil.Customer
+	var err error
+	if strings.Contains(recipient, "@") {
+		customer, err = db.GetCustomerByEmail(ctx, recipient)
+	} else {
+		phoneNumber, convErr := strconv.Atoi(recipient)
+		if convErr != nil {
+			return nil, nil, errInvalidPhoneNumber
+		}
+		customer, err = db.GetCustomerByPhoneNumber(ctx, phoneNumber)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	accounts, err := db.ListCustomerAccounts(ctx, customer.Id)
+	if err != nil {
+		return nil, nil, err
+	}
+	account := primaryAccount(accounts)
+	if account == nil {
+		return nil, nil, fmt.Errorf("customer %d has no open account: %w", customer.Id, sql.ErrNoRows)
+	}
+	return customer, account, nil
+}
+
+// customerAccounts is a customer together with their accounts, for pages
+// that list accounts by who owns them.
+type customerAccounts struct {
+	Customer dbutil.Customer
+	Accounts []dbutil.Account
+}
+
+// groupAccounts sorts accounts under the customers that own them, in the
+// order of customers. Customers without any of accounts are left out.
+func groupAccounts(customers []dbutil.Customer, accounts []dbutil.Account) []customerAccounts {
+	byCustomer := make(map[int][]dbutil.Account)
+	for _, account := range accounts {
+		byCustomer[account.Customer_id] = append(byCustomer[account.Customer_id], account)
+	}
+
+	var groups []customerAccounts
+	for _, customer := range customers {
+		if owned := byCustomer[customer.Id]; len(owned) > 0 {
+			groups = append(groups, customerAccounts{Customer: customer, Accounts: owned})
+		}
+	}
+	return groups
+}
@@ -0,0 +1,1236 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"minibank/dbutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// apiPrefix is where the versioned JSON API is mounted.
+const apiPrefix = "/api/v1"
+
+// apiError is the body of every error response from the JSON API.
+type apiError struct {
+	Error apiErrorDetail `json:"error"`
+}
+
+type apiErrorDetail struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// apiFail writes an error envelope. code is a stable machine-readable string;
+// message is for humans and may change.
+func apiFail(c echo.Context, status int, code, message string) error {
+	return c.JSON(status, apiError{Error: apiErrorDetail{Code: code, Message: message}})
+}
+
+// requestError is a reason a request is refused, with the status and API
+// error code it is reported with. Work shared by the web pages and the API
+// returns it, so each can report the refusal in its own way.
+type requestError struct {
+	status  int
+	code    string
+	message string
+}
+
+func (e *requestError) Error() string {
+	return e.message
+}
+
+func badRequest(code, message string) error {
+	return &requestError{status: http.StatusBadRequest, code: code, message: message}
+}
+
+type customerResponse struct {
+	ID            int               `json:"id"`
+	FirstName     string            `json:"first_name"`
+	LastName      string            `json:"last_name"`
+	Email         string            `json:"email"`
+	PhoneNumber   int               `json:"phone_number,omitempty"`
+	Role          string            `json:"role"`
+	EmailVerified bool              `json:"email_verified"`
+	CreatedAt     time.Time         `json:"created_at"`
+	UpdatedAt     time.Time         `json:"updated_at"`
+	Accounts      []accountResponse `json:"accounts"`
+}
+
+func newCustomerResponse(customer *dbutil.Customer, accounts []dbutil.Account) customerResponse {
+	res := customerResponse{
+		ID:            customer.Id,
+		FirstName:     customer.First_name,
+		LastName:      customer.Last_name,
+		Email:         customer.Email,
+		PhoneNumber:   customer.Phone_number,
+		Role:          customer.Role,
+		EmailVerified: customer.EmailVerified(),
+		CreatedAt:     customer.Created_at,
+		UpdatedAt:     customer.Updated_at,
+		Accounts:      make([]accountResponse, 0, len(accounts)),
+	}
+	for i := range accounts {
+		res.Accounts = append(res.Accounts, newAccountResponse(&accounts[i]))
+	}
+	return res
+}
+
+type accountResponse struct {
+	ID            int          `json:"id"`
+	CustomerID    int          `json:"customer_id"`
+	Type          string       `json:"type"`
+	Nickname      string       `json:"nickname,omitempty"`
+	Balance       dbutil.Money `json:"balance"`
+	Held          dbutil.Money `json:"held"`
+	Available     dbutil.Money `json:"available"`
+	CreatedAt     time.Time    `json:"created_at"`
+	UpdatedAt     time.Time    `json:"updated_at"`
+	Status        string       `json:"status"`
+	StatusReason  string       `json:"status_reason,omitempty"`
+	StatusChanged *time.Time   `json:"status_changed_at,omitempty"`
+}
+
+func newAccountResponse(account *dbutil.Account) accountResponse {
+	return accountResponse{
+		ID:            account.Id,
+		CustomerID:    account.Customer_id,
+		Type:          account.Type,
+		Nickname:      account.Nickname,
+		Balance:       account.Balance,
+		Held:          account.Held,
+		Available:     account.Available(),
+		CreatedAt:     account.Created_at,
+		UpdatedAt:     account.Updated_at,
+		Status:        account.Status,
+		StatusReason:  account.Status_reason,
+		StatusChanged: account.Status_changed_at,
+	}
+}
+
+type accountListResponse struct {
+	Accounts []accountResponse `json:"accounts"`
+}
+
+// transactionResponse is a payment of Amount, in the paying account's
+// currency, that arrived as DestinationAmount. For a payment between
+// currencies Rate is the exchange rate it was converted at and Fee what the
+// payer was charged on top of Amount. Status is "pending" for a hold that
+// lapses at ExpiresAt, then "posted" or "voided" as of SettledAt. A refund
+// gives the transaction it reverses in Reverses. Reference is the payer's
+// note, if any.
+type transactionResponse struct {
+	ID                int          `json:"id"`
+	FromAccount       int          `json:"from_account"`
+	ToAccount         int          `json:"to_account"`
+	Amount            dbutil.Money `json:"amount"`
+	DestinationAmount dbutil.Money `json:"destination_amount"`
+	Rate              string       `json:"rate,omitempty"`
+	Fee               dbutil.Money `json:"fee"`
+	Type              string       `json:"type"`
+	Status            string       `json:"status"`
+	CreatedAt         time.Time    `json:"created_at"`
+	ExpiresAt         *time.Time   `json:"expires_at,omitempty"`
+	SettledAt         *time.Time   `json:"settled_at,omitempty"`
+	Reverses          int          `json:"reverses,omitempty"`
+	Reference         string       `json:"reference,omitempty"`
+}
+
+func newTransactionResponse(transaction *dbutil.Transaction) transactionResponse {
+	return transactionResponse{
+		ID:                transaction.Id,
+		FromAccount:       transaction.FromAccount,
+		ToAccount:         transaction.ToAccount,
+		Amount:            transaction.Amount,
+		DestinationAmount: transaction.DestinationAmount,
+		Rate:              transaction.Rate,
+		Fee:               transaction.Fee,
+		Type:              transaction.TransactionType,
+		Status:            transaction.Status,
+		CreatedAt:         transaction.CreatedAt,
+		ExpiresAt:         transaction.ExpiresAt,
+		SettledAt:         transaction.SettledAt,
+		Reverses:          transaction.Reverses,
+		Reference:         transaction.Reference,
+	}
+}
+
+// transactionListResponse is a list of transactions. A paged list has the
+// cursor of the next page in NextCursor, unless this is the last.
+type transactionListResponse struct {
+	Transactions []transactionResponse `json:"transactions"`
+	NextCursor   string                `json:"next_cursor,omitempty"`
+}
+
+type exchangeRateListResponse struct {
+	Rates []dbutil.ExchangeRate `json:"rates"`
+}
+
+type sessionResponse struct {
+	CustomerID int `json:"customer_id"`
+}
+
+// setRoleRequest gives a customer one of the roles "customer", "teller" or
+// "admin".
+type setRoleRequest struct {
+	Role string `json:"role"`
+}
+
+// setStatusRequest moves an account to the status "active", "frozen" or
+// "closed", giving the reason for the change.
+type setStatusRequest struct {
+	Status string `json:"status"`
+	Reason string `json:"reason"`
+}
+
+// createSessionRequest logs in with an email and password. Customers with
+// two-factor authentication must also send TOTPCode, a code from their
+// authenticator app or one of their recovery codes.
+type createSessionRequest struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+	TOTPCode string `json:"totp_code,omitempty"`
+}
+
+// createCustomerRequest signs up a new customer, who starts with a checking
+// account.
+type createCustomerRequest struct {
+	FirstName   string `json:"first_name"`
+	LastName    string `json:"last_name"`
+	Email       string `json:"email"`
+	PhoneNumber string `json:"phone_number"`
+	Password    string `json:"password"`
+}
+
+// openAccountRequest opens another account of Type "checking" or "savings"
+// for the logged-in customer, with an optional Nickname. Currency is an ISO
+// 4217 code and defaults to AUD.
+type openAccountRequest struct {
+	Type     string `json:"type"`
+	Nickname string `json:"nickname,omitempty"`
+	Currency string `json:"currency,omitempty"`
+}
+
+// createPasswordResetRequest asks for a password reset link to be mailed to
+// Email. The response is the same whether or not a customer has it.
+type createPasswordResetRequest struct {
+	Email string `json:"email"`
+}
+
+// confirmPasswordResetRequest sets a new password with the token from a
+// reset link.
+type confirmPasswordResetRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+// confirmEmailRequest confirms an email address with the token from a
+// verification link.
+type confirmEmailRequest struct {
+	Token string `json:"token"`
+}
+
+// createTransferRequest pays Amount, a decimal string such as "12.50" in the
+// paying account's currency, from FromAccount, or the customer's primary
+// account if it is 0. The money goes to the customer with Recipient as their
+// email address or phone number, or to ToAccount, another of the customer's
+// own accounts; exactly one of the two must be given. Payments into an
+// account in another currency are converted at the current exchange rate,
+// and its fee is charged on top. Retries should send the same Idempotency-Key header.
+// Payments to other customers above the step-up threshold made with a
+// session, rather than an API key, must send StepUp: a two-factor code, or
+// the password for customers without two-factor authentication. Keys that
+// can pay were confirmed that way when they were created.
+//
+// With Authorize set the payment is only authorized: the money is held in
+// the paying account and the transaction stays pending until the payee
+// captures it or either side voids it, or until the hold expires.
+type createTransferRequest struct {
+	FromAccount int    `json:"from_account,omitempty"`
+	Recipient   string `json:"recipient,omitempty"`
+	ToAccount   int    `json:"to_account,omitempty"`
+	Amount      string `json:"amount"`
+	StepUp      string `json:"step_up,omitempty"`
+	Authorize   bool   `json:"authorize,omitempty"`
+}
+
+// setExchangeRateRequest sets how many units of the quote currency one unit
+// of the base currency buys, as a decimal string such as "0.6512", and the
+// fee in hundredths of a percent charged on each conversion.
+type setExchangeRateRequest struct {
+	Rate           string `json:"rate"`
+	FeeBasisPoints int    `json:"fee_basis_points"`
+}
+
+// apiRoute describes one endpoint of the JSON API. The same table mounts the
+// handlers and generates the OpenAPI document, so the two cannot disagree
+// about which routes exist or what they accept and return.
+type apiRoute struct {
+	Method  string
+	Path    string // relative to apiPrefix, in Echo syntax
+	Summary string
+	// Scope is the API key scope the route needs, or "" for a public
+	// route. A logged-in session passes any scope.
+	Scope string
+	// Roles, when set, limits the route to customers with one of these
+	// roles.
+	Roles   []string
+	Query   interface{} // query string type, tagged like transactionQuery, or nil
+	Header  string      // optional request header, such as Idempotency-Key
+	Request interface{} // JSON body type, or nil
+	Status  int         // success status
+	// Response is the JSON body type on success, or nil for no body.
+	Response interface{}
+	// Produces lists the media types of a success body that is a file
+	// rather than JSON, such as a statement download.
+	Produces []string
+	// Errors lists the error statuses the handler returns itself; 401 and
+	// 403 for authenticated routes and 500 are implied.
+	Errors  []int
+	Handler echo.HandlerFunc
+}
+
+// apiRoutes lists every route of the JSON API.
+func apiRoutes(db dbutil.Database, cfg Config) []apiRoute {
+	return []apiRoute{
+		{
+			Method: http.MethodPost, Path: "/sessions", Summary: "Log in",
+			Request: createSessionRequest{}, Status: http.StatusCreated, Response: sessionResponse{},
+			Errors: []int{http.StatusBadRequest, http.StatusUnauthorized, http.StatusLocked, http.StatusTooManyRequests},
+			Handler: func(c echo.Context) error {
+				return apiCreateSessionHandler(db, cfg, c)
+			},
+		},
+		{
+			Method: http.MethodGet, Path: "/sessions/current", Summary: "Show the current session", Scope: dbutil.ScopeRead,
+			Status: http.StatusOK, Response: sessionResponse{},
+			Handler: func(c echo.Context) error {
+				return apiCurrentSessionHandler(c)
+			},
+		},
+		{
+			Method: http.MethodDelete, Path: "/sessions/current", Summary: "Log out", Scope: dbutil.ScopeRead,
+			Status: http.StatusNoContent,
+			Handler: func(c echo.Context) error {
+				return apiDeleteSessionHandler(c)
+			},
+		},
+		{
+			Method: http.MethodGet, Path: "/sessions", Summary: "List the customer's sessions", Scope: dbutil.ScopeRead,
+			Status: http.StatusOK, Response: sessionListResponse{},
+			Errors: []int{http.StatusNotImplemented},
+			Handler: func(c echo.Context) error {
+				return apiSessionsHandler(db, cfg, c)
+			},
+		},
+		{
+			Method: http.MethodDelete, Path: "/sessions", Summary: "Log out every other session", Scope: dbutil.ScopeAdmin,
+			Status: http.StatusNoContent,
+			Errors: []int{http.StatusNotImplemented},
+			Handler: func(c echo.Context) error {
+				return apiRevokeOtherSessionsHandler(db, cfg, c)
+			},
+		},
+		{
+			Method: http.MethodDelete, Path: "/sessions/:id", Summary: "Revoke a session", Scope: dbutil.ScopeAdmin,
+			Status: http.StatusNoContent,
+			Errors: []int{http.StatusNotFound, http.StatusNotImplemented},
+			Handler: func(c echo.Context) error {
+				return apiRevokeSessionHandler(db, cfg, c)
+			},
+		},
+		{
+			Method: http.MethodPost, Path: "/customers", Summary: "Sign up and log in",
+			Request: createCustomerRequest{}, Status: http.StatusCreated, Response: customerResponse{},
+			Errors: []int{http.StatusBadRequest, http.StatusConflict},
+			Handler: func(c echo.Context) error {
+				return apiCreateCustomerHandler(db, cfg, c)
+			},
+		},
+		{
+			Method: http.MethodPost, Path: "/customers/me/verification-email", Summary: "Send a new email address confirmation link", Scope: dbutil.ScopeRead,
+			Status: http.StatusAccepted,
+			Errors: []int{http.StatusConflict},
+			Handler: func(c echo.Context) error {
+				return apiResendVerificationHandler(db, cfg, c)
+			},
+		},
+		{
+			Method: http.MethodPost, Path: "/email-verifications", Summary: "Confirm an email address",
+			Request: confirmEmailRequest{}, Status: http.StatusNoContent,
+			Errors: []int{http.StatusBadRequest},
+			Handler: func(c echo.Context) error {
+				return apiConfirmEmailHandler(db, cfg, c)
+			},
+		},
+		{
+			Method: http.MethodPost, Path: "/password-resets", Summary: "Email a password reset link",
+			Request: createPasswordResetRequest{}, Status: http.StatusAccepted,
+			Errors: []int{http.StatusBadRequest},
+			Handler: func(c echo.Context) error {
+				return apiCreatePasswordResetHandler(db, cfg, c)
+			},
+		},
+		{
+			Method: http.MethodPost, Path: "/password-resets/confirm", Summary: "Set a new password from a reset link",
+			Request: confirmPasswordResetRequest{}, Status: http.StatusNoContent,
+			Errors: []int{http.StatusBadRequest},
+			Handler: func(c echo.Context) error {
+				return apiConfirmPasswordResetHandler(db, cfg, c)
+			},
+		},
+		{
+			Method: http.MethodGet, Path: "/customers/me", Summary: "Show the logged-in customer and their accounts", Scope: dbutil.ScopeRead,
+			Status: http.StatusOK, Response: customerResponse{},
+			Errors: []int{http.StatusNotFound},
+			Handler: func(c echo.Context) error {
+				return apiCustomerHandler(db, c, apiCustomerID(c))
+			},
+		},
+		{
+			Method: http.MethodGet, Path: "/customers/:id", Summary: "Show a customer and their accounts", Scope: dbutil.ScopeRead,
+			Status: http.StatusOK, Response: customerResponse{},
+			Errors: []int{http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound},
+			Handler: func(c echo.Context) error {
+				id, err := strconv.Atoi(c.Param("id"))
+				if err != nil {
+					return apiFail(c, http.StatusBadRequest, "invalid_id", "Customer ID must be a number")
+				}
+				return apiCustomerHandler(db, c, id)
+			},
+		},
+		{
+			Method: http.MethodPut, Path: "/customers/:id/role", Summary: "Change a customer's role", Scope: dbutil.ScopeAdmin,
+			Roles:   []string{dbutil.RoleAdmin},
+			Request: setRoleRequest{}, Status: http.StatusOK, Response: customerResponse{},
+			Errors: []int{http.StatusBadRequest, http.StatusNotFound},
+			Handler: func(c echo.Context) error {
+				return apiSetRoleHandler(db, c)
+			},
+		},
+		{
+			Method: http.MethodPost, Path: "/customers/:id/unlock", Summary: "Lift a lockout after failed logins", Scope: dbutil.ScopeAdmin,
+			Roles:  []string{dbutil.RoleAdmin},
+			Status: http.StatusNoContent,
+			Errors: []int{http.StatusBadRequest, http.StatusNotFound},
+			Handler: func(c echo.Context) error {
+				return apiUnlockCustomerHandler(db, c)
+			},
+		},
+		{
+			Method: http.MethodGet, Path: "/accounts", Summary: "List every account", Scope: dbutil.ScopeRead,
+			Roles:  []string{dbutil.RoleTeller, dbutil.RoleAdmin},
+			Status: http.StatusOK, Response: accountListResponse{},
+			Handler: func(c echo.Context) error {
+				return apiAccountsHandler(db, c)
+			},
+		},
+		{
+			Method: http.MethodPost, Path: "/accounts", Summary: "Open another account", Scope: dbutil.ScopeAdmin,
+			Request: openAccountRequest{}, Status: http.StatusCreated, Response: accountResponse{},
+			Errors: []int{http.StatusBadRequest},
+			Handler: func(c echo.Context) error {
+				return apiOpenAccountHandler(db, c)
+			},
+		},
+		{
+			Method: http.MethodGet, Path: "/accounts/:id", Summary: "Show an account", Scope: dbutil.ScopeRead,
+			Status: http.StatusOK, Response: accountResponse{},
+			Errors: []int{http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound},
+			Handler: func(c echo.Context) error {
+				return apiAccountHandler(db, c)
+			},
+		},
+		{
+			Method: http.MethodGet, Path: "/accounts/:id/statement", Summary: "Download an account statement for a period", Scope: dbutil.ScopeRead,
+			Query:  statementQuery{},
+			Status: http.StatusOK, Produces: statementContentTypes(),
+			Errors: []int{http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound},
+			Handler: func(c echo.Context) error {
+				return apiStatementHandler(db, cfg, c)
+			},
+		},
+		{
+			Method: http.MethodPut, Path: "/accounts/:id/status", Summary: "Freeze, unfreeze or close an account", Scope: dbutil.ScopeAdmin,
+			Roles:   []string{dbutil.RoleAdmin},
+			Request: setStatusRequest{}, Status: http.StatusOK, Response: accountResponse{},
+			Errors: []int{http.StatusBadRequest, http.StatusNotFound, http.StatusConflict},
+			Handler: func(c echo.Context) error {
+				return apiSetStatusHandler(db, c)
+			},
+		},
+		{
+			Method: http.MethodPost, Path: "/transfers", Summary: "Pay another customer or move money between own accounts, or authorize a hold", Scope: dbutil.ScopePayments,
+			Header: "Idempotency-Key", Request: createTransferRequest{}, Status: http.StatusCreated, Response: transactionResponse{},
+			Errors: []int{http.StatusBadRequest, http.StatusUnprocessableEntity, http.StatusTooManyRequests},
+			Handler: func(c echo.Context) error {
+				return apiCreateTransferHandler(db, cfg, c)
+			},
+		},
+		{
+			Method: http.MethodPost, Path: "/bulk-payments", Summary: "Preview a CSV file of payments, or with execute pay it all or nothing or best effort", Scope: dbutil.ScopePayments,
+			Request: bulkPaymentRequest{}, Status: http.StatusOK, Response: bulkPaymentReport{},
+			Errors: []int{http.StatusBadRequest, http.StatusUnprocessableEntity, http.StatusTooManyRequests},
+			Handler: func(c echo.Context) error {
+				return apiBulkPaymentsHandler(db, cfg, c)
+			},
+		},
+		{
+			Method: http.MethodGet, Path: "/scheduled-payments", Summary: "List the customer's scheduled payments", Scope: dbutil.ScopeRead,
+			Status: http.StatusOK, Response: scheduledPaymentListResponse{},
+			Handler: func(c echo.Context) error {
+				return apiScheduledPaymentsHandler(db, c)
+			},
+		},
+		{
+			Method: http.MethodPost, Path: "/scheduled-payments", Summary: "Schedule a one-off or repeating payment", Scope: dbutil.ScopePayments,
+			Request: createScheduledPaymentRequest{}, Status: http.StatusCreated, Response: scheduledPaymentResponse{},
+			Errors: []int{http.StatusBadRequest, http.StatusUnprocessableEntity, http.StatusTooManyRequests},
+			Handler: func(c echo.Context) error {
+				return apiCreateScheduledPaymentHandler(db, cfg, c)
+			},
+		},
+		{
+			Method: http.MethodGet, Path: "/scheduled-payments/:id", Summary: "Show a scheduled payment and its runs", Scope: dbutil.ScopeRead,
+			Status: http.StatusOK, Response: scheduledPaymentResponse{},
+			Errors: []int{http.StatusBadRequest, http.StatusNotFound},
+			Handler: func(c echo.Context) error {
+				return apiScheduledPaymentHandler(db, c)
+			},
+		},
+		{
+			Method: http.MethodDelete, Path: "/scheduled-payments/:id", Summary: "Cancel a scheduled payment", Scope: dbutil.ScopePayments,
+			Status: http.StatusNoContent,
+			Errors: []int{http.StatusBadRequest, http.StatusNotFound},
+			Handler: func(c echo.Context) error {
+				return apiCancelScheduledPaymentHandler(db, cfg, c)
+			},
+		},
+		{
+			Method: http.MethodGet, Path: "/transactions", Summary: "Search an account's transactions, by default the primary account's, a page at a time", Scope: dbutil.ScopeRead,
+			Query:  transactionQuery{},
+			Status: http.StatusOK, Response: transactionListResponse{},
+			Errors: []int{http.StatusBadRequest, http.StatusNotFound},
+			Handler: func(c echo.Context) error {
+				return apiTransactionsHandler(db, c)
+			},
+		},
+		{
+			Method: http.MethodGet, Path: "/fx-rates", Summary: "List exchange rates", Scope: dbutil.ScopeRead,
+			Status: http.StatusOK, Response: exchangeRateListResponse{},
+			Handler: func(c echo.Context) error {
+				return apiExchangeRatesHandler(db, c)
+			},
+		},
+		{
+			Method: http.MethodPut, Path: "/fx-rates/:base/:quote", Summary: "Set the exchange rate from one currency to another", Scope: dbutil.ScopeAdmin,
+			Roles:   []string{dbutil.RoleAdmin},
+			Request: setExchangeRateRequest{}, Status: http.StatusOK, Response: dbutil.ExchangeRate{},
+			Errors: []int{http.StatusBadRequest},
+			Handler: func(c echo.Context) error {
+				return apiSetExchangeRateHandler(db, c)
+			},
+		},
+		{
+			Method: http.MethodGet, Path: "/api-keys", Summary: "List the customer's API keys", Scope: dbutil.ScopeAdmin,
+			Status: http.StatusOK, Response: apiKeyListResponse{},
+			Handler: func(c echo.Context) error {
+				return apiKeysHandler(db, c)
+			},
+		},
+		{
+			Method: http.MethodPost, Path: "/api-keys", Summary: "Create an API key; the token is only returned here", Scope: dbutil.ScopeAdmin,
+			Request: createAPIKeyRequest{}, Status: http.StatusCreated, Response: apiKeyResponse{},
+			Errors: []int{http.StatusBadRequest, http.StatusTooManyRequests},
+			Handler: func(c echo.Context) error {
+				return apiCreateAPIKeyHandler(db, cfg, c)
+			},
+		},
+		{
+			Method: http.MethodDelete, Path: "/api-keys/:id", Summary: "Revoke an API key", Scope: dbutil.ScopeAdmin,
+			Status: http.StatusNoContent,
+			Errors: []int{http.StatusBadRequest, http.StatusNotFound},
+			Handler: func(c echo.Context) error {
+				return apiRevokeAPIKeyHandler(db, c)
+			},
+		},
+		{
+			Method: http.MethodGet, Path: "/transactions/:id", Summary: "Show a transaction", Scope: dbutil.ScopeRead,
+			Status: http.StatusOK, Response: transactionResponse{},
+			Errors: []int{http.StatusBadRequest, http.StatusNotFound},
+			Handler: func(c echo.Context) error {
+				return apiTransactionHandler(db, c)
+			},
+		},
+		{
+			Method: http.MethodPost, Path: "/transactions/:id/capture", Summary: "Capture a pending hold, posting the payment", Scope: dbutil.ScopePayments,
+			Status: http.StatusOK, Response: transactionResponse{},
+			Errors: []int{http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound, http.StatusConflict, http.StatusUnprocessableEntity},
+			Handler: func(c echo.Context) error {
+				return apiCaptureHoldHandler(db, cfg, c)
+			},
+		},
+		{
+			Method: http.MethodPost, Path: "/transactions/:id/void", Summary: "Void a pending hold, releasing the money", Scope: dbutil.ScopePayments,
+			Status: http.StatusOK, Response: transactionResponse{},
+			Errors: []int{http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound, http.StatusConflict},
+			Handler: func(c echo.Context) error {
+				return apiVoidHoldHandler(db, cfg, c)
+			},
+		},
+		{
+			Method: http.MethodGet, Path: "/transactions/:id/refunds", Summary: "List the refunds of a transaction", Scope: dbutil.ScopeRead,
+			Status: http.StatusOK, Response: transactionListResponse{},
+			Errors: []int{http.StatusBadRequest, http.StatusNotFound},
+			Handler: func(c echo.Context) error {
+				return apiTransactionRefundsHandler(db, c)
+			},
+		},
+		{
+			Method: http.MethodPost, Path: "/transactions/:id/refunds", Summary: "Refund all or part of a transfer; payee or admin only", Scope: dbutil.ScopePayments,
+			Header: "Idempotency-Key", Request: createRefundRequest{}, Status: http.StatusCreated, Response: transactionResponse{},
+			Errors: []int{http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound, http.StatusConflict, http.StatusUnprocessableEntity},
+			Handler: func(c echo.Context) error {
+				return apiRefundTransactionHandler(db, cfg, c)
+			},
+		},
+	}
+}
+
+// registerAPI mounts the JSON API under apiPrefix and its OpenAPI document at
+// /api/openapi.json.
+func registerAPI(e *echo.Echo, db dbutil.Database, cfg Config) {
+	routes := apiRoutes(db, cfg)
+
+	api := e.Group(apiPrefix)
+	for _, route := range routes {
+		var middleware []echo.MiddlewareFunc
+		if route.Scope != "" {
+			middleware = append(middleware, requireAPIAuth(db, route.Scope))
+		}
+		if route.Roles != nil {
+			middleware = append(middleware, requireRole(route.Roles...))
+		}
+		api.Add(route.Method, route.Path, route.Handler, middleware...)
+	}
+
+	spec, err := json.Marshal(openAPISpec(routes))
+	if err != nil {
+		log.Fatal("Error generating OpenAPI document: ", err)
+	}
+	e.GET("/api/openapi.json", func(c echo.Context) error {
+		return c.JSONBlob(http.StatusOK, spec)
+	})
+
+	// Errors raised outside the API handlers, such as unknown routes and
+	// request timeouts, still get the error envelope under apiPrefix.
+	fallback := e.HTTPErrorHandler
+	e.HTTPErrorHandler = func(err error, c echo.Context) {
+		if !strings.HasPrefix(c.Request().URL.Path, apiPrefix+"/") || c.Response().Committed {
+			fallback(err, c)
+			return
+		}
+		status := http.StatusInternalServerError
+		message := http.StatusText(status)
+		var he *echo.HTTPError
+		if errors.As(err, &he) {
+			status = he.Code
+			message = http.StatusText(status)
+			if m, ok := he.Message.(string); ok {
+				message = m
+			}
+		} else {
+			log.Printf("API error on %s: %v", c.Path(), err)
+		}
+		code := strings.ReplaceAll(strings.ToLower(http.StatusText(status)), " ", "_")
+		apiFail(c, status, code, message)
+	}
+}
+
+// requireAPIAuth authenticates a request by its bearer API key or, failing
+// that, its session cookie, and rejects keys without scope. The customer and
+// their accounts are then available through currentCustomer and
+// currentAccounts.
+func requireAPIAuth(db dbutil.Database, scope string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			ctx := c.Request().Context()
+
+			var customerID int
+			token, ok := strings.CutPrefix(c.Request().Header.Get("Authorization"), "Bearer ")
+			if ok {
+				key, err := db.GetAPIKeyByHash(ctx, dbutil.HashAPIToken(token))
+				if errors.Is(err, dbutil.ErrAPIKeyNotFound) {
+					return apiFail(c, http.StatusUnauthorized, "invalid_api_key", "API key is invalid or revoked")
+				}
+				if err != nil {
+					log.Println("Error fetching API key:", err)
+					return apiFail(c, http.StatusInternalServerError, "internal_error", "Error checking API key")
+				}
+				if !key.HasScope(scope) {
+					return apiFail(c, http.StatusForbidden, "insufficient_scope", "API key lacks the "+scope+" scope")
+				}
+
+				err = db.TouchAPIKey(ctx, key.Id, time.Now())
+				if err != nil {
+					log.Printf("Error updating last use of API key %d: %v", key.Id, err)
+				}
+				customerID = key.CustomerId
+				c.Set("apiKey", key)
+			} else {
+				customerID, ok = currentUserID(c)
+				if !ok {
+					return apiFail(c, http.StatusUnauthorized, "unauthenticated", "Log in or send an API key")
+				}
+			}
+
+			customer, err := db.GetCustomer(ctx, customerID)
+			if errors.Is(err, sql.ErrNoRows) {
+				return apiFail(c, http.StatusUnauthorized, "unauthenticated", "Customer no longer exists")
+			}
+			if err != nil {
+				log.Printf("Error fetching customer %d: %v", customerID, err)
+				return apiFail(c, http.StatusInternalServerError, "internal_error", "Error fetching customer")
+			}
+			accounts, err := db.ListCustomerAccounts(ctx, customerID)
+			if err != nil {
+				log.Printf("Error fetching accounts of customer %d: %v", customerID, err)
+				return apiFail(c, http.StatusInternalServerError, "internal_error", "Error fetching accounts")
+			}
+			if !hasOpenAccount(accounts) {
+				return apiFail(c, http.StatusUnauthorized, "account_closed", "Every account of this customer is closed")
+			}
+			c.Set("customer", customer)
+			c.Set("accounts", accounts)
+			return next(c)
+		}
+	}
+}
+
+// apiCustomerID returns the ID of the customer authenticated by
+// requireAPIAuth.
+func apiCustomerID(c echo.Context) int {
+	return currentCustomer(c).Id
+}
+
+func apiCreateSessionHandler(db dbutil.Database, cfg Config, c echo.Context) error {
+	ctx := c.Request().Context()
+
+	var req createSessionRequest
+	if err := c.Bind(&req); err != nil {
+		return apiFail(c, http.StatusBadRequest, "invalid_request", "Request body is not valid JSON")
+	}
+	if req.Email == "" || req.Password == "" {
+		return apiFail(c, http.StatusBadRequest, "missing_fields", "Please enter both email and password.")
+	}
+
+	customer, err := authenticate(ctx, db, cfg, req.Email, req.Password, c.RealIP())
+	if errors.Is(err, errTwoFactorRequired) {
+		if req.TOTPCode == "" {
+			return apiFail(c, http.StatusUnauthorized, "two_factor_required", "This account needs a two-factor code.")
+		}
+		err = authenticateSecondFactor(ctx, db, cfg, customer, req.TOTPCode, c.RealIP())
+	}
+	if errors.Is(err, errInvalidCredentials) {
+		return apiFail(c, http.StatusUnauthorized, "invalid_credentials", "Invalid email or password.")
+	}
+	if errors.Is(err, errInvalidTwoFactorCode) {
+		return apiFail(c, http.StatusUnauthorized, "invalid_two_factor_code", "Invalid two-factor code.")
+	}
+	if errors.Is(err, errAccountLocked) {
+		return apiFail(c, http.StatusLocked, "account_locked", "Too many failed logins. Please try again later.")
+	}
+	var delay *loginDelayError
+	if errors.As(err, &delay) {
+		setRetryAfter(c, delay.Wait)
+		return apiFail(c, http.StatusTooManyRequests, "too_many_attempts", "Too many failed logins. Please wait a moment and try again.")
+	}
+	if err != nil {
+		log.Println("Error authenticating:", err)
+		return apiFail(c, http.StatusInternalServerError, "internal_error", "An error occurred. Please try again.")
+	}
+
+	err = logIn(c, db, customer.Id)
+	if err != nil {
+		log.Println("Error saving session:", err)
+		return apiFail(c, http.StatusInternalServerError, "internal_error", "Error saving session")
+	}
+	return c.JSON(http.StatusCreated, sessionResponse{CustomerID: customer.Id})
+}
+
+func apiCurrentSessionHandler(c echo.Context) error {
+	return c.JSON(http.StatusOK, sessionResponse{CustomerID: apiCustomerID(c)})
+}
+
+func apiDeleteSessionHandler(c echo.Context) error {
+	err := logOut(c)
+	if err != nil {
+		log.Println("Error saving session:", err)
+		return apiFail(c, http.StatusInternalServerError, "internal_error", "Error saving session")
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+func apiCreateCustomerHandler(db dbutil.Database, cfg Config, c echo.Context) error {
+	ctx := c.Request().Context()
+
+	var req createCustomerRequest
+	if err := c.Bind(&req); err != nil {
+		return apiFail(c, http.StatusBadRequest, "invalid_request", "Request body is not valid JSON")
+	}
+
+	customer, account, err := newCustomer(req.FirstName, req.LastName, req.Email, req.PhoneNumber, req.Password)
+	if errors.Is(err, errMissingFields) {
+		return apiFail(c, http.StatusBadRequest, "missing_fields", err.Error())
+	}
+	if errors.Is(err, errInvalidPhoneNumber) {
+		return apiFail(c, http.StatusBadRequest, "invalid_phone_number", err.Error())
+	}
+	if err != nil {
+		log.Println("Error preparing customer:", err)
+		return apiFail(c, http.StatusInternalServerError, "internal_error", "Error creating account")
+	}
+
+	_, err = db.GetCustomerByEmail(ctx, customer.Email)
+	if err == nil {
+		return apiFail(c, http.StatusConflict, "email_taken", "An account with that email already exists")
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		log.Println("Error checking email:", err)
+		return apiFail(c, http.StatusInternalServerError, "internal_error", "Error creating account")
+	}
+
+	err = db.CreateCustomer(ctx, customer, account)
+	if err != nil {
+		return apiFail(c, http.StatusInternalServerError, "internal_error", "Error creating account. Please try again.")
+	}
+
+	err = sendVerificationEmail(ctx, db, cfg, customer)
+	if err != nil {
+		log.Println("Error sending verification email:", err)
+	}
+
+	// Like the sign-up form, a new customer starts logged in
+	err = logIn(c, db, customer.Id)
+	if err != nil {
+		log.Println("Error saving session:", err)
+	}
+	return c.JSON(http.StatusCreated, newCustomerResponse(customer, []dbutil.Account{*account}))
+}
+
+func apiCustomerHandler(db dbutil.Database, c echo.Context, id int) error {
+	ctx := c.Request().Context()
+
+	if !canViewCustomer(currentCustomer(c), id) {
+		return apiFail(c, http.StatusForbidden, "forbidden", "You can only view yourself")
+	}
+
+	customer, err := db.GetCustomer(ctx, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return apiFail(c, http.StatusNotFound, "customer_not_found", "Customer not found")
+	}
+	if err != nil {
+		log.Printf("Error fetching customer %d: %v", id, err)
+		return apiFail(c, http.StatusInternalServerError, "internal_error", "Error fetching customer")
+	}
+	accounts, err := db.ListCustomerAccounts(ctx, id)
+	if err != nil {
+		log.Printf("Error fetching accounts of customer %d: %v", id, err)
+		return apiFail(c, http.StatusInternalServerError, "internal_error", "Error fetching accounts")
+	}
+	return c.JSON(http.StatusOK, newCustomerResponse(customer, accounts))
+}
+
+func apiOpenAccountHandler(db dbutil.Database, c echo.Context) error {
+	ctx := c.Request().Context()
+
+	var req openAccountRequest
+	if err := c.Bind(&req); err != nil {
+		return apiFail(c, http.StatusBadRequest, "invalid_request", "Request body is not valid JSON")
+	}
+
+	account, err := newAccount(apiCustomerID(c), req.Type, req.Nickname, req.Currency)
+	if errors.Is(err, errInvalidAccountType) {
+		return apiFail(c, http.StatusBadRequest, "invalid_account_type", err.Error())
+	}
+	if errors.Is(err, errInvalidCurrency) {
+		return apiFail(c, http.StatusBadRequest, "invalid_currency", err.Error())
+	}
+	if errors.Is(err, errNicknameTooLong) {
+		return apiFail(c, http.StatusBadRequest, "invalid_nickname", err.Error())
+	}
+	if err != nil {
+		log.Println("Error preparing account:", err)
+		return apiFail(c, http.StatusInternalServerError, "internal_error", "Error opening account")
+	}
+
+	err = db.CreateAccount(ctx, account)
+	if err != nil {
+		log.Println("Error opening account:", err)
+		return apiFail(c, http.StatusInternalServerError, "internal_error", "Error opening account")
+	}
+	c.Response().Header().Set("Location", apiPrefix+"/accounts/"+strconv.Itoa(account.Id))
+	return c.JSON(http.StatusCreated, newAccountResponse(account))
+}
+
+func apiAccountHandler(db dbutil.Database, c echo.Context) error {
+	ctx := c.Request().Context()
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return apiFail(c, http.StatusBadRequest, "invalid_id", "Account ID must be a number")
+	}
+
+	account, err := db.GetAccount(ctx, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return apiFail(c, http.StatusNotFound, "account_not_found", "Account not found")
+	}
+	if err != nil {
+		log.Printf("Error fetching account %d: %v", id, err)
+		return apiFail(c, http.StatusInternalServerError, "internal_error", "Error fetching account")
+	}
+	if !canViewAccount(currentCustomer(c), account) {
+		return apiFail(c, http.StatusForbidden, "forbidden", "You can only view your own accounts")
+	}
+	return c.JSON(http.StatusOK, newAccountResponse(account))
+}
+
+func apiAccountsHandler(db dbutil.Database, c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if !canListAccounts(currentCustomer(c)) {
+		return apiFail(c, http.StatusForbidden, "forbidden", "Your role does not allow this")
+	}
+
+	accounts := db.GetAccounts(ctx)
+	res := accountListResponse{Accounts: make([]accountResponse, 0, len(accounts))}
+	for i := range accounts {
+		res.Accounts = append(res.Accounts, newAccountResponse(&accounts[i]))
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+func apiSetRoleHandler(db dbutil.Database, c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if !canSetRole(currentCustomer(c)) {
+		return apiFail(c, http.StatusForbidden, "forbidden", "Your role does not allow this")
+	}
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return apiFail(c, http.StatusBadRequest, "invalid_id", "Customer ID must be a number")
+	}
+	var req setRoleRequest
+	if err := c.Bind(&req); err != nil {
+		return apiFail(c, http.StatusBadRequest, "invalid_request", "Request body is not valid JSON")
+	}
+	if !dbutil.ValidRole(req.Role) {
+		return apiFail(c, http.StatusBadRequest, "invalid_role", "Role must be one of: "+strings.Join(dbutil.Roles, ", "))
+	}
+
+	err = db.SetCustomerRole(ctx, id, req.Role)
+	if errors.Is(err, sql.ErrNoRows) {
+		return apiFail(c, http.StatusNotFound, "customer_not_found", "Customer not found")
+	}
+	if err != nil {
+		log.Printf("Error setting role of customer %d: %v", id, err)
+		return apiFail(c, http.StatusInternalServerError, "internal_error", "Error updating customer")
+	}
+
+	return apiCustomerHandler(db, c, id)
+}
+
+func apiSetStatusHandler(db dbutil.Database, c echo.Context) error {
+	ctx := c.Request().Context()
+
+	actor := currentCustomer(c)
+	if !canChangeStatus(actor) {
+		return apiFail(c, http.StatusForbidden, "forbidden", "Your role does not allow this")
+	}
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return apiFail(c, http.StatusBadRequest, "invalid_id", "Account ID must be a number")
+	}
+	var req setStatusRequest
+	if err := c.Bind(&req); err != nil {
+		return apiFail(c, http.StatusBadRequest, "invalid_request", "Request body is not valid JSON")
+	}
+	if !dbutil.ValidStatus(req.Status) {
+		return apiFail(c, http.StatusBadRequest, "invalid_status", "Status must be one of: "+strings.Join(dbutil.Statuses, ", "))
+	}
+	if strings.TrimSpace(req.Reason) == "" {
+		return apiFail(c, http.StatusBadRequest, "missing_reason", "Please give a reason for the change")
+	}
+
+	account, err := db.GetAccount(ctx, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return apiFail(c, http.StatusNotFound, "account_not_found", "Account not found")
+	}
+	if err != nil {
+		log.Printf("Error fetching account %d: %v", id, err)
+		return apiFail(c, http.StatusInternalServerError, "internal_error", "Error fetching account")
+	}
+
+	err = changeAccountStatus(ctx, db, actor, account, req.Status, req.Reason, c.RealIP())
+	if errors.Is(err, errFundingAccount) {
+		return apiFail(c, http.StatusForbidden, "forbidden", "The funding account cannot change status")
+	}
+	if errors.Is(err, dbutil.ErrInvalidStatusChange) {
+		return apiFail(c, http.StatusConflict, "invalid_status_change", "A "+account.Status+" account cannot become "+req.Status)
+	}
+	if errors.Is(err, dbutil.ErrBalanceNotZero) {
+		return apiFail(c, http.StatusConflict, "balance_not_zero", "Only an account with a zero balance can be closed")
+	}
+	if err != nil {
+		log.Printf("Error changing status of account %d: %v", id, err)
+		return apiFail(c, http.StatusInternalServerError, "internal_error", "Error updating account")
+	}
+
+	account, err = db.GetAccount(ctx, id)
+	if err != nil {
+		log.Printf("Error fetching account %d: %v", id, err)
+		return apiFail(c, http.StatusInternalServerError, "internal_error", "Error fetching account")
+	}
+	return c.JSON(http.StatusOK, newAccountResponse(account))
+}
+
+func apiUnlockCustomerHandler(db dbutil.Database, c echo.Context) error {
+	ctx := c.Request().Context()
+
+	actor := currentCustomer(c)
+	if !canUnlockCustomer(actor) {
+		return apiFail(c, http.StatusForbidden, "forbidden", "Your role does not allow this")
+	}
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return apiFail(c, http.StatusBadRequest, "invalid_id", "Customer ID must be a number")
+	}
+	customer, err := db.GetCustomer(ctx, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return apiFail(c, http.StatusNotFound, "customer_not_found", "Customer not found")
+	}
+	if err != nil {
+		log.Printf("Error fetching customer %d: %v", id, err)
+		return apiFail(c, http.StatusInternalServerError, "internal_error", "Error fetching customer")
+	}
+
+	err = db.ClearLoginThrottle(ctx, emailThrottleKey(customer.Email))
+	if err != nil {
+		log.Printf("Error unlocking customer %d: %v", id, err)
+		return apiFail(c, http.StatusInternalServerError, "internal_error", "Error unlocking customer")
+	}
+
+	err = db.CreateAuditEvent(ctx, &dbutil.AuditEvent{
+		CustomerId: customer.Id,
+		ActorId:    actor.Id,
+		Event:      dbutil.AuditAccountUnlocked,
+		IP:         c.RealIP(),
+		CreatedAt:  time.Now(),
+	})
+	if err != nil {
+		log.Println("Error writing audit event:", err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+func apiCreateTransferHandler(db dbutil.Database, cfg Config, c echo.Context) error {
+	ctx := c.Request().Context()
+
+	var req createTransferRequest
+	if err := c.Bind(&req); err != nil {
+		return apiFail(c, http.StatusBadRequest, "invalid_request", "Request body is not valid JSON")
+	}
+	if (req.Recipient == "" && req.ToAccount == 0) || req.Amount == "" {
+		return apiFail(c, http.StatusBadRequest, "missing_fields", "Please provide recipient or to_account, and amount")
+	}
+	if req.Recipient != "" && req.ToAccount != 0 {
+		return apiFail(c, http.StatusBadRequest, "invalid_recipient", "Give either recipient or to_account, not both")
+	}
+
+	sender := currentCustomer(c)
+	from := primaryAccount(currentAccounts(c))
+	if req.FromAccount != 0 {
+		from = findAccount(currentAccounts(c), req.FromAccount)
+	}
+	if from == nil {
+		return apiFail(c, http.StatusBadRequest, "invalid_from_account", "from_account must be one of your accounts")
+	}
+	if from.CheckActive() != nil {
+		return apiFail(c, http.StatusForbidden, "account_frozen", "This account is frozen or closed and cannot send payments")
+	}
+	amount, err := dbutil.ParseMoney(req.Amount, from.Currency())
+	if err != nil || !amount.IsPositive() {
+		return apiFail(c, http.StatusBadRequest, "invalid_amount", fmt.Sprintf("Amount must be a positive number with at most %d decimal places", dbutil.Exponent(from.Currency())))
+	}
+
+	var to *dbutil.Account
+	if req.ToAccount != 0 {
+		to = findAccount(currentAccounts(c), req.ToAccount)
+		if to == nil || to.Id == from.Id {
+			return apiFail(c, http.StatusBadRequest, "invalid_to_account", "to_account must be another of your accounts")
+		}
+	} else {
+		_, to, err = findRecipient(ctx, db, req.Recipient)
+		if errors.Is(err, errInvalidPhoneNumber) {
+			return apiFail(c, http.StatusBadRequest, "invalid_recipient", "Recipient must be an email address or phone number")
+		}
+		if errors.Is(err, sql.ErrNoRows) {
+			return apiFail(c, http.StatusUnprocessableEntity, "recipient_not_found", "Recipient account not found")
+		}
+		if err != nil {
+			log.Println("Error finding recipient:", err)
+			return apiFail(c, http.StatusInternalServerError, "internal_error", "Error finding recipient account")
+		}
+		// Paying one's own email address or phone number from the primary
+		// account would pay the account itself
+		if to.Id == from.Id {
+			return apiFail(c, http.StatusBadRequest, "same_account", "A payment cannot go to the account it is paid from")
+		}
+	}
+	checks := needsPaymentChecks(sender, to)
+	if checks && !canSendPayments(sender) {
+		return apiFail(c, http.StatusForbidden, "email_not_verified", "Confirm your email address before sending payments")
+	}
+
+	// API keys are for unattended use, so only sessions are asked to
+	// confirm large payments
+	if c.Get("apiKey") == nil && checks && needsStepUp(ctx, db, cfg, amount) {
+		err = confirmStepUp(ctx, db, cfg, sender, req.StepUp, c.RealIP())
+		if refused := stepUpRefusal(c, err, "Payments over "+cfg.StepUpThreshold.String()+" "+cfg.StepUpThreshold.Currency); refused != nil {
+			return apiFail(c, refused.status, refused.code, refused.message)
+		}
+		if err != nil {
+			log.Println("Error confirming payment:", err)
+			return apiFail(c, http.StatusInternalServerError, "internal_error", "Error processing payment")
+		}
+	}
+
+	key := dbutil.IdempotencyKey{
+		Key:       c.Request().Header.Get("Idempotency-Key"),
+		ExpiresAt: time.Now().Add(cfg.IdempotencyWindow),
+	}
+
+	var transactionID int
+	if req.Authorize {
+		transactionID, err = db.Authorize(ctx, from.Id, to.Id, amount, key, cfg.now().Add(cfg.HoldDuration))
+	} else {
+		transactionID, err = db.Transfer(ctx, from.Id, to.Id, amount, key)
+	}
+	if errors.Is(err, dbutil.ErrInsufficientFunds) {
+		return apiFail(c, http.StatusUnprocessableEntity, "insufficient_funds", "Insufficient balance")
+	}
+	if errors.Is(err, dbutil.ErrSameAccount) {
+		return apiFail(c, http.StatusBadRequest, "same_account", "A payment cannot go to the account it is paid from")
+	}
+	if errors.Is(err, dbutil.ErrIdempotencyKeyReused) {
+		return apiFail(c, http.StatusUnprocessableEntity, "idempotency_key_reused", "Idempotency key already used for a different payment")
+	}
+	if errors.Is(err, dbutil.ErrAccountFrozen) || errors.Is(err, dbutil.ErrAccountClosed) {
+		return apiFail(c, http.StatusUnprocessableEntity, "recipient_unavailable", "Recipient account cannot receive payments")
+	}
+	if errors.Is(err, dbutil.ErrNoExchangeRate) {
+		return apiFail(c, http.StatusUnprocessableEntity, "no_exchange_rate", "Payments from "+from.Currency()+" to "+to.Currency()+" are not available")
+	}
+	if errors.Is(err, dbutil.ErrAmountTooSmall) {
+		return apiFail(c, http.StatusUnprocessableEntity, "amount_too_small", "The amount is too small to pay into a "+to.Currency()+" account")
+	}
+	if err != nil {
+		log.Printf("Error during transfer: %v", err)
+		return apiFail(c, http.StatusInternalServerError, "internal_error", "Error processing payment")
+	}
+
+	transaction, err := db.GetTransaction(ctx, transactionID)
+	if err != nil {
+		log.Printf("Error fetching transaction %d: %v", transactionID, err)
+		return apiFail(c, http.StatusInternalServerError, "internal_error", "Error fetching transaction")
+	}
+	c.Response().Header().Set("Location", apiPrefix+"/transactions/"+strconv.Itoa(transactionID))
+	return c.JSON(http.StatusCreated, newTransactionResponse(transaction))
+}
+
+func apiTransactionsHandler(db dbutil.Database, c echo.Context) error {
+	ctx := c.Request().Context()
+
+	q, err := bindTransactionQuery(c)
+	if err != nil {
+		return apiFail(c, http.StatusBadRequest, "invalid_query", err.Error())
+	}
+	account := primaryAccount(currentAccounts(c))
+	if q.AccountId != 0 {
+		account, err = db.GetAccount(ctx, q.AccountId)
+		// Someone else's account is reported as missing, as for
+		// transactions
+		if errors.Is(err, sql.ErrNoRows) || (err == nil && !canViewAccount(currentCustomer(c), account)) {
+			return apiFail(c, http.StatusNotFound, "account_not_found", "Account not found")
+		}
+		if err != nil {
+			log.Printf("Error fetching account %d: %v", q.AccountId, err)
+			return apiFail(c, http.StatusInternalServerError, "internal_error", "Error fetching account")
+		}
+	}
+	filter, err := q.filter(account)
+	if err != nil {
+		return apiFail(c, http.StatusBadRequest, "invalid_query", err.Error())
+	}
+
+	page, err := db.ListTransactionsFromAccount(ctx, filter)
+	if err != nil {
+		log.Printf("Error fetching transactions for account %d: %v", account.Id, err)
+		return apiFail(c, http.StatusInternalServerError, "internal_error", "Error fetching transactions")
+	}
+
+	res := transactionListResponse{
+		Transactions: make([]transactionResponse, 0, len(page.Transactions)),
+		NextCursor:   page.NextCursor,
+	}
+	for i := range page.Transactions {
+		res.Transactions = append(res.Transactions, newTransactionResponse(&page.Transactions[i]))
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+func apiTransactionHandler(db dbutil.Database, c echo.Context) error {
+	ctx := c.Request().Context()
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return apiFail(c, http.StatusBadRequest, "invalid_id", "Transaction ID must be a number")
+	}
+
+	transaction, err := db.GetTransaction(ctx, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return apiFail(c, http.StatusNotFound, "transaction_not_found", "Transaction not found")
+	}
+	if err != nil {
+		log.Printf("Error fetching transaction %d: %v", id, err)
+		return apiFail(c, http.StatusInternalServerError, "internal_error", "Error fetching transaction")
+	}
+
+	from, err := db.GetAccount(ctx, transaction.FromAccount)
+	if err != nil {
+		log.Printf("Error fetching account %d: %v", transaction.FromAccount, err)
+		return apiFail(c, http.StatusInternalServerError, "internal_error", "Error fetching transaction")
+	}
+	to, err := db.GetAccount(ctx, transaction.ToAccount)
+	if err != nil {
+		log.Printf("Error fetching account %d: %v", transaction.ToAccount, err)
+		return apiFail(c, http.StatusInternalServerError, "internal_error", "Error fetching transaction")
+	}
+
+	// Someone else's transaction is reported as missing rather than forbidden
+	// so that IDs cannot be probed.
+	if !canViewTransaction(currentCustomer(c), from, to) {
+		return apiFail(c, http.StatusNotFound, "transaction_not_found", "Transaction not found")
+	}
+	return c.JSON(http.StatusOK, newTransactionResponse(transaction))
+}
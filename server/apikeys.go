@@ -0,0 +1,143 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"minibank/dbutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+type apiKeyResponse struct {
+	ID         int        `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+	// Token is only set in the response that creates the key.
+	Token string `json:"token,omitempty"`
+}
+
+func newAPIKeyResponse(key *dbutil.APIKey) apiKeyResponse {
+	return apiKeyResponse{
+		ID:         key.Id,
+		Name:       key.Name,
+		Prefix:     key.Prefix,
+		Scopes:     key.Scopes,
+		CreatedAt:  key.CreatedAt,
+		LastUsedAt: key.LastUsedAt,
+		RevokedAt:  key.RevokedAt,
+	}
+}
+
+type apiKeyListResponse struct {
+	Keys []apiKeyResponse `json:"keys"`
+}
+
+// createAPIKeyRequest names a new key and lists its scopes, each one of
+// "read", "payments" or "admin". Payments made with a key are never asked
+// for step-up confirmation, so a key with more than the read scope must be
+// confirmed with StepUp instead: a two-factor code, or the password for
+// customers without two-factor authentication.
+type createAPIKeyRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	StepUp string   `json:"step_up,omitempty"`
+}
+
+func apiKeysHandler(db dbutil.Database, c echo.Context) error {
+	ctx := c.Request().Context()
+
+	keys, err := db.ListAPIKeys(ctx, apiCustomerID(c))
+	if err != nil {
+		log.Println("Error listing API keys:", err)
+		return apiFail(c, http.StatusInternalServerError, "internal_error", "Error listing API keys")
+	}
+
+	res := apiKeyListResponse{Keys: make([]apiKeyResponse, 0, len(keys))}
+	for i := range keys {
+		res.Keys = append(res.Keys, newAPIKeyResponse(&keys[i]))
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+func apiCreateAPIKeyHandler(db dbutil.Database, cfg Config, c echo.Context) error {
+	ctx := c.Request().Context()
+
+	var req createAPIKeyRequest
+	if err := c.Bind(&req); err != nil {
+		return apiFail(c, http.StatusBadRequest, "invalid_request", "Request body is not valid JSON")
+	}
+	if req.Name == "" || len(req.Scopes) == 0 {
+		return apiFail(c, http.StatusBadRequest, "missing_fields", "Please provide a name and at least one scope")
+	}
+	for _, scope := range req.Scopes {
+		if !dbutil.ValidScope(scope) {
+			return apiFail(c, http.StatusBadRequest, "invalid_scope", "Scopes must be among: "+strings.Join(dbutil.Scopes, ", "))
+		}
+	}
+
+	// A key cannot be given more than the credential creating it holds
+	if caller, ok := c.Get("apiKey").(*dbutil.APIKey); ok {
+		for _, scope := range req.Scopes {
+			if !caller.HasScope(scope) {
+				return apiFail(c, http.StatusForbidden, "insufficient_scope", "API key lacks the "+scope+" scope")
+			}
+		}
+	}
+
+	readOnly := true
+	for _, scope := range req.Scopes {
+		readOnly = readOnly && scope == dbutil.ScopeRead
+	}
+	if !readOnly {
+		err := confirmStepUp(ctx, db, cfg, currentCustomer(c), req.StepUp, c.RealIP())
+		if refused := stepUpRefusal(c, err, "Keys with more than the read scope"); refused != nil {
+			return apiFail(c, refused.status, refused.code, refused.message)
+		}
+		if err != nil {
+			log.Println("Error confirming API key:", err)
+			return apiFail(c, http.StatusInternalServerError, "internal_error", "Error creating API key")
+		}
+	}
+
+	key, token, err := dbutil.NewAPIKey(apiCustomerID(c), req.Name, req.Scopes)
+	if err != nil {
+		log.Println("Error generating API key:", err)
+		return apiFail(c, http.StatusInternalServerError, "internal_error", "Error creating API key")
+	}
+	err = db.CreateAPIKey(ctx, key)
+	if err != nil {
+		log.Println("Error creating API key:", err)
+		return apiFail(c, http.StatusInternalServerError, "internal_error", "Error creating API key")
+	}
+
+	res := newAPIKeyResponse(key)
+	res.Token = token
+	return c.JSON(http.StatusCreated, res)
+}
+
+func apiRevokeAPIKeyHandler(db dbutil.Database, c echo.Context) error {
+	ctx := c.Request().Context()
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return apiFail(c, http.StatusBadRequest, "invalid_id", "API key ID must be a number")
+	}
+
+	err = db.RevokeAPIKey(ctx, apiCustomerID(c), id)
+	if errors.Is(err, dbutil.ErrAPIKeyNotFound) {
+		return apiFail(c, http.StatusNotFound, "api_key_not_found", "API key not found")
+	}
+	if err != nil {
+		log.Println("Error revoking API key:", err)
+		return apiFail(c, http.StatusInternalServerError, "internal_error", "Error revoking API key")
+	}
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"encoding/json"
+	"minibank/dbutil"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCreateAPIKeyStepUp(t *testing.T) {
+	now := time.Date(2026, 3, 2, 9, 0, 0, 0, time.UTC)
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.Clock = func() time.Time { return now }
+	})
+	alice, _ := ts.customer(t, "alice@example.com", dbutil.RoleCustomer, "AUD")
+	session := ts.login(t, alice.Email)
+
+	// create asks for a key with scopes, using tc and any header pairs, and
+	// returns the error code or the token
+	create := func(tc *testClient, want int, stepUp string, scopes []string, header ...string) string {
+		t.Helper()
+		resp := tc.doJSON(t, http.MethodPost, apiPrefix+"/api-keys", createAPIKeyRequest{Name: "script", Scopes: scopes, StepUp: stepUp}, header...)
+		body := expectStatus(t, resp, want)
+		var res struct {
+			apiKeyResponse
+			apiError
+		}
+		json.Unmarshal([]byte(body), &res)
+		// Failed confirmations slow down the next ones
+		now = now.Add(time.Hour)
+		if res.Error.Code != "" {
+			return res.Error.Code
+		}
+		return res.Token
+	}
+	read := []string{dbutil.ScopeRead}
+	payments := []string{dbutil.ScopeRead, dbutil.ScopePayments}
+	admin := []string{dbutil.ScopeAdmin}
+
+	create(session, http.StatusCreated, "", read)
+	if code := create(session, http.StatusForbidden, "", payments); code != "step_up_required" {
+		t.Errorf("payments key without step_up: %s, want step_up_required", code)
+	}
+	if code := create(session, http.StatusForbidden, "wrong", admin); code != "step_up_failed" {
+		t.Errorf("admin key with the wrong password: %s, want step_up_failed", code)
+	}
+	token := create(session, http.StatusCreated, testPassword, admin)
+
+	// Nor can a key make one that pays without confirmation
+	bearer := ts.client(t)
+	auth := "Bearer " + token
+	if code := create(bearer, http.StatusForbidden, "", payments, "Authorization", auth); code != "step_up_required" {
+		t.Errorf("payments key from an admin key: %s, want step_up_required", code)
+	}
+	create(bearer, http.StatusCreated, testPassword, payments, "Authorization", auth)
+
+	// With two-factor authentication the code is needed, not the password
+	ts.enableTwoFactor(t, alice, now)
+	if code := create(session, http.StatusForbidden, testPassword, payments); code != "step_up_failed" {
+		t.Errorf("payments key with the password: %s, want step_up_failed", code)
+	}
+	create(session, http.StatusCreated, totpCode(t, now), payments)
+}
@@ -0,0 +1,175 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"minibank/dbutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// errInvalidCredentials is returned by authenticate for an unknown email or a
+// wrong password, which callers must not tell apart.
+var errInvalidCredentials = errors.New("invalid email or password")
+
+// authenticate checks an email and password against the stored bcrypt hash,
+// from a client at ip. Repeated failures slow down and then lock out further
+// attempts; see checkLoginThrottle. For a customer with two-factor
+// authentication the password alone is not enough: the customer comes back
+// with errTwoFactorRequired and the login is finished by
+// authenticateSecondFactor.
+func authenticate(ctx context.Context, db dbutil.Database, cfg Config, email, password, ip string) (*dbutil.Customer, error) {
+	now := cfg.now()
+	err := checkLoginThrottle(ctx, db, cfg, email, ip, now)
+	if err != nil {
+		return nil, err
+	}
+
+	customer, err := db.GetCustomerByEmail(ctx, email)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	if err == nil {
+		err = bcrypt.CompareHashAndPassword([]byte(customer.Encrypted_password), []byte(password))
+	}
+	if err == nil {
+		accounts, err := db.ListCustomerAccounts(ctx, customer.Id)
+		if err != nil {
+			return nil, err
+		}
+		// A customer whose accounts are all closed fails like an
+		// unknown email
+		if hasOpenAccount(accounts) {
+			tf, err := loadTwoFactor(ctx, db, customer.Id)
+			if err != nil {
+				return nil, err
+			}
+			if tf.Enabled() {
+				// The failures are only forgotten once the code is
+				// right too, or a stolen password would allow unlimited
+				// guesses at the code
+				return customer, errTwoFactorRequired
+			}
+			// Only the email's count is cleared, so an attacker cannot
+			// reset their IP's count by logging in to their own account
+			return customer, db.ClearLoginThrottle(ctx, emailThrottleKey(email))
+		}
+	}
+
+	err = recordLoginFailure(ctx, db, cfg, email, ip, now)
+	if err != nil {
+		return nil, err
+	}
+	return nil, errInvalidCredentials
+}
+
+// currentUserID returns the id of the logged-in customer, if any.
+func currentUserID(c echo.Context) (int, bool) {
+	sess, _ := session.Get("session", c)
+	userID, ok := sess.Values["userID"].(int)
+	return userID, ok
+}
+
+// requireLogin loads the logged-in customer and their accounts for the HTML
+// routes, sending visitors without one, or whose accounts have all been
+// closed, to the login page. Handlers read them back with currentCustomer
+// and currentAccounts.
+func requireLogin(db dbutil.Database) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			ctx := c.Request().Context()
+
+			userID, ok := currentUserID(c)
+			if !ok {
+				return c.Redirect(http.StatusSeeOther, "/login")
+			}
+
+			customer, err := db.GetCustomer(ctx, userID)
+			if err != nil {
+				log.Println("Error fetching customer details:", err)
+				return c.Redirect(http.StatusSeeOther, "/login")
+			}
+			accounts, err := db.ListCustomerAccounts(ctx, customer.Id)
+			if err != nil {
+				log.Println("Error fetching account details:", err)
+				return c.Redirect(http.StatusSeeOther, "/login")
+			}
+			if !hasOpenAccount(accounts) {
+				logOut(c)
+				return c.Redirect(http.StatusSeeOther, "/login")
+			}
+			c.Set("customer", customer)
+			c.Set("accounts", accounts)
+			return next(c)
+		}
+	}
+}
+
+// requireRole rejects logged-in customers whose role is not one of roles. It
+// must run after requireLogin or requireAPIAuth.
+func requireRole(roles ...string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			customer := currentCustomer(c)
+			for _, role := range roles {
+				if customer != nil && customer.Role == role {
+					return next(c)
+				}
+			}
+			if strings.HasPrefix(c.Request().URL.Path, apiPrefix+"/") {
+				return apiFail(c, http.StatusForbidden, "forbidden", "Your role does not allow this")
+			}
+			return c.String(http.StatusForbidden, "Forbidden")
+		}
+	}
+}
+
+// currentCustomer returns the customer loaded by requireLogin or
+// requireAPIAuth, or nil on public routes.
+func currentCustomer(c echo.Context) *dbutil.Customer {
+	customer, _ := c.Get("customer").(*dbutil.Customer)
+	return customer
+}
+
+// currentAccounts returns the accounts of the customer loaded by
+// requireLogin or requireAPIAuth, oldest first, closed ones included.
+func currentAccounts(c echo.Context) []dbutil.Account {
+	accounts, _ := c.Get("accounts").([]dbutil.Account)
+	return accounts
+}
+
+// logIn starts a session for customerID. A server-side session gets a fresh
+// ID so that one planted before login cannot be reused, and the row under
+// the old ID, which may hold a pending two-factor login, is deleted.
+func logIn(c echo.Context, db dbutil.Database, customerID int) error {
+	sess, _ := session.Get("session", c)
+	if sess.ID != "" {
+		err := db.DeleteSession(c.Request().Context(), sess.ID)
+		if err != nil {
+			return err
+		}
+		sess.ID = ""
+	}
+	now := time.Now().Unix()
+	sess.Values["userID"] = customerID
+	sess.Values["createdAt"] = now
+	sess.Values["lastSeen"] = now
+	delete(sess.Values, "pendingUserID")
+	delete(sess.Values, "pendingAt")
+	return sess.Save(c.Request(), c.Response())
+}
+
+// logOut clears the session and expires its cookie.
+func logOut(c echo.Context) error {
+	sess, _ := session.Get("session", c)
+	sess.Options.MaxAge = -1 // Expire the session cookie
+	sess.Values["userID"] = nil
+	return sess.Save(c.Request(), c.Response())
+}
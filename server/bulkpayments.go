@@ -0,0 +1,544 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"minibank/dbutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+)
+
+// Limits on bulk payment files.
+const (
+	maxBulkPayments    = 500
+	maxBulkFileSize    = 1 << 20
+	maxReferenceLength = 140
+)
+
+// bulkIdempotencyKey is the idempotency key of each row of a bulk payment
+// file, from the batch id and the row's line.
+const bulkIdempotencyKey = "bulk:%s:%d"
+
+// How a bulk payment file is carried out: either every valid row is paid or
+// none is, or each row is paid if it can be.
+const (
+	bulkAllOrNothing = "all_or_nothing"
+	bulkBestEffort   = "best_effort"
+)
+
+// Statuses of the rows of a bulk payment report. Rows are valid or invalid
+// in a preview; once the file is carried out a valid row is paid, failed
+// when its payment was refused, or not paid when another row's failure
+// stopped an all-or-nothing batch.
+const (
+	bulkRowValid   = "valid"
+	bulkRowInvalid = "invalid"
+	bulkRowPaid    = "paid"
+	bulkRowFailed  = "failed"
+	bulkRowNotPaid = "not_paid"
+)
+
+// bulkPaymentRequest previews, or with Execute carries out, the payments in
+// CSV from FromAccount, or the primary account if it is 0.
+//
+// Each line of CSV is a recipient, given by email address or phone number
+// as for a single payment, an amount in the paying account's currency and
+// an optional reference for the recipient. A first line starting with
+// "recipient" is a header and is skipped.
+//
+// Mode is "all_or_nothing", the default, or "best_effort". BatchId, which a
+// preview returns, makes carrying out the file safe to retry: a row already
+// paid under the same BatchId is not paid again. StepUp confirms the file
+// when its payments to others add up to more than the step-up threshold.
+type bulkPaymentRequest struct {
+	FromAccount int    `json:"from_account,omitempty"`
+	CSV         string `json:"csv"`
+	Mode        string `json:"mode,omitempty"`
+	Execute     bool   `json:"execute,omitempty"`
+	BatchId     string `json:"batch_id,omitempty"`
+	StepUp      string `json:"step_up,omitempty"`
+}
+
+// bulkPaymentRow is one line of a bulk payment file as entered, with the
+// account it pays and what became of it. Error says why the row is invalid
+// or its payment failed.
+type bulkPaymentRow struct {
+	Line          int    `json:"line"`
+	Recipient     string `json:"recipient"`
+	Amount        string `json:"amount"`
+	Reference     string `json:"reference,omitempty"`
+	ToAccount     int    `json:"to_account,omitempty"`
+	RecipientName string `json:"recipient_name,omitempty"`
+	Status        string `json:"status"`
+	Error         string `json:"error,omitempty"`
+	TransactionId int    `json:"transaction_id,omitempty"`
+
+	amount dbutil.Money
+	to     *dbutil.Account
+}
+
+// bulkPaymentReport is the preview of a bulk payment file or, once
+// Executed, the result of carrying it out. Total is what the valid rows
+// add up to in a preview and what was paid afterwards, in the paying
+// account's currency. Error says why an all-or-nothing batch was not paid.
+type bulkPaymentReport struct {
+	FromAccount int              `json:"from_account"`
+	Mode        string           `json:"mode"`
+	BatchId     string           `json:"batch_id"`
+	Executed    bool             `json:"executed"`
+	Rows        []bulkPaymentRow `json:"rows"`
+	Total       dbutil.Money     `json:"total"`
+	Available   dbutil.Money     `json:"available"`
+	Valid       int              `json:"valid"`
+	Invalid     int              `json:"invalid"`
+	Paid        int              `json:"paid"`
+	Failed      int              `json:"failed"`
+	Error       string           `json:"error,omitempty"`
+}
+
+// parseBulkPaymentCSV reads the rows of a bulk payment file. Rows are
+// numbered by their line in the file, counting the header. A byte order
+// mark, which spreadsheets often write, is ignored.
+func parseBulkPaymentCSV(data string) ([]bulkPaymentRow, error) {
+	r := csv.NewReader(strings.NewReader(strings.TrimPrefix(data, "\ufeff")))
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+
+	var rows []bulkPaymentRow
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			return nil, badRequest("invalid_csv", fmt.Sprintf("The file is not valid CSV: line %d: %v", parseErr.Line, parseErr.Err))
+		}
+		if err != nil {
+			return nil, badRequest("invalid_csv", "The file is not valid CSV")
+		}
+		line, _ := r.FieldPos(0)
+		if len(rows) == 0 && line == 1 && strings.EqualFold(strings.TrimSpace(record[0]), "recipient") {
+			continue
+		}
+		if len(record) == 1 && strings.TrimSpace(record[0]) == "" {
+			continue
+		}
+
+		row := bulkPaymentRow{Line: line, Status: bulkRowValid}
+		for i := range record {
+			record[i] = strings.TrimSpace(record[i])
+		}
+		row.Recipient = record[0]
+		if len(record) > 1 {
+			row.Amount = record[1]
+		}
+		if len(record) > 2 {
+			row.Reference = record[2]
+		}
+		if len(record) < 2 || len(record) > 3 {
+			row.Status, row.Error = bulkRowInvalid, "Each line needs a recipient, an amount and optionally a reference"
+		}
+		rows = append(rows, row)
+		if len(rows) > maxBulkPayments {
+			return nil, badRequest("too_many_payments", fmt.Sprintf("A file can have at most %d payments", maxBulkPayments))
+		}
+	}
+	if len(rows) == 0 {
+		return nil, badRequest("no_payments", "The file has no payments")
+	}
+	return rows, nil
+}
+
+// checkBulkPaymentRow resolves the recipient of row and checks that from
+// can pay it, marking the row invalid if not. Only unexpected errors are
+// returned.
+func checkBulkPaymentRow(ctx context.Context, db dbutil.Database, from *dbutil.Account, row *bulkPaymentRow) error {
+	invalid := func(message string) error {
+		row.Status, row.Error = bulkRowInvalid, message
+		return nil
+	}
+
+	amount, err := dbutil.ParseMoney(row.Amount, from.Currency())
+	if err != nil || !amount.IsPositive() {
+		return invalid(fmt.Sprintf("Amount must be a positive number with at most %d decimal places", dbutil.Exponent(from.Currency())))
+	}
+	row.amount = amount
+	if utf8.RuneCountInString(row.Reference) > maxReferenceLength {
+		return invalid(fmt.Sprintf("Reference must be at most %d characters", maxReferenceLength))
+	}
+
+	// Recipients are found as for a single payment, so a row pays whichever
+	// account a payment to the same recipient would
+	if row.Recipient == "" {
+		return invalid("Recipient is missing")
+	}
+	customer, to, err := findRecipient(ctx, db, row.Recipient)
+	if errors.Is(err, errInvalidPhoneNumber) {
+		return invalid("Invalid recipient phone number")
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return invalid("Recipient account not found")
+	}
+	if err != nil {
+		return fmt.Errorf("error finding recipient on line %d: %w", row.Line, err)
+	}
+	row.ToAccount = to.Id
+	row.RecipientName = customer.First_name + " " + customer.Last_name
+	row.to = to
+
+	if to.Id == from.Id {
+		return invalid("A payment cannot go to the account it is paid from")
+	}
+	if to.CheckActive() != nil {
+		return invalid("The recipient's account cannot receive payments")
+	}
+	if to.Currency() != from.Currency() {
+		rate, err := db.GetExchangeRate(ctx, from.Currency(), to.Currency())
+		if errors.Is(err, dbutil.ErrNoExchangeRate) {
+			return invalid("Payments from " + from.Currency() + " to " + to.Currency() + " are not available")
+		}
+		if err != nil {
+			return fmt.Errorf("error fetching exchange rate: %w", err)
+		}
+		converted, _, err := rate.Convert(amount)
+		if err != nil {
+			return fmt.Errorf("error converting line %d: %w", row.Line, err)
+		}
+		if !converted.IsPositive() {
+			return invalid("The amount is too small to pay into a " + to.Currency() + " account")
+		}
+	}
+	return nil
+}
+
+// bulkTransferError returns the reason to give for a payment of a bulk file
+// that was refused, or "" if err is not one the customer can act on.
+func bulkTransferError(err error, from, to *dbutil.Account) string {
+	switch {
+	case errors.Is(err, dbutil.ErrInsufficientFunds):
+		return "Insufficient balance"
+	case errors.Is(err, dbutil.ErrSameAccount):
+		return "A payment cannot go to the account it is paid from"
+	case errors.Is(err, dbutil.ErrIdempotencyKeyReused):
+		return "This line was already paid differently in this batch"
+	case errors.Is(err, dbutil.ErrAccountFrozen) || errors.Is(err, dbutil.ErrAccountClosed):
+		return "The recipient's account cannot receive payments"
+	case errors.Is(err, dbutil.ErrNoExchangeRate):
+		return "Payments from " + from.Currency() + " to " + to.Currency() + " are not available"
+	case errors.Is(err, dbutil.ErrAmountTooSmall):
+		return "The amount is too small to pay into a " + to.Currency() + " account"
+	}
+	return ""
+}
+
+// runBulkPayments previews or carries out the bulk payment file in req for
+// the logged-in customer. Reasons to refuse the file as a whole are
+// returned as a *requestError; problems with single rows are in the report.
+func runBulkPayments(ctx context.Context, db dbutil.Database, cfg Config, c echo.Context, req bulkPaymentRequest) (*bulkPaymentReport, error) {
+	customer := currentCustomer(c)
+
+	mode := req.Mode
+	if mode == "" {
+		mode = bulkAllOrNothing
+	}
+	if mode != bulkAllOrNothing && mode != bulkBestEffort {
+		return nil, badRequest("invalid_mode", "mode must be all_or_nothing or best_effort")
+	}
+	from := primaryAccount(currentAccounts(c))
+	if req.FromAccount != 0 {
+		from = findAccount(currentAccounts(c), req.FromAccount)
+	}
+	if from == nil {
+		return nil, badRequest("invalid_from_account", "from_account must be one of your accounts")
+	}
+	if from.CheckActive() != nil {
+		return nil, &requestError{status: http.StatusForbidden, code: "account_frozen", message: "This account is frozen or closed and cannot send payments"}
+	}
+	if !canSendPayments(customer) {
+		return nil, &requestError{status: http.StatusForbidden, code: "email_not_verified", message: "Confirm your email address before sending payments"}
+	}
+
+	rows, err := parseBulkPaymentCSV(req.CSV)
+	if err != nil {
+		return nil, err
+	}
+	report := &bulkPaymentReport{
+		FromAccount: from.Id,
+		Mode:        mode,
+		BatchId:     req.BatchId,
+		Rows:        rows,
+		Total:       dbutil.NewMoney(0, from.Currency()),
+		Available:   from.Available(),
+	}
+	if report.BatchId == "" {
+		report.BatchId = uuid.NewString()
+	}
+
+	// What the valid rows pay to other customers decides whether the file
+	// needs step-up, so splitting a large payment into lines gains nothing
+	toOthers := dbutil.NewMoney(0, from.Currency())
+	for i := range rows {
+		row := &rows[i]
+		if row.Status == bulkRowValid {
+			if err := checkBulkPaymentRow(ctx, db, from, row); err != nil {
+				return nil, err
+			}
+		}
+		if row.Status != bulkRowValid {
+			report.Invalid++
+			continue
+		}
+		report.Valid++
+		report.Total = report.Total.Add(row.amount)
+		if needsPaymentChecks(customer, row.to) {
+			toOthers = toOthers.Add(row.amount)
+		}
+	}
+	if report.Available.LessThan(report.Total) {
+		report.Error = "The valid payments add up to more than the available balance"
+	}
+	if !req.Execute {
+		return report, nil
+	}
+
+	if report.Valid == 0 {
+		return nil, &requestError{status: http.StatusUnprocessableEntity, code: "no_valid_payments", message: "None of the payments in the file are valid"}
+	}
+	if mode == bulkAllOrNothing && report.Invalid > 0 {
+		return nil, &requestError{status: http.StatusUnprocessableEntity, code: "invalid_payments",
+			message: "Some payments are invalid; fix them or pay the valid ones on a best-effort basis"}
+	}
+	if c.Get("apiKey") == nil && needsStepUp(ctx, db, cfg, toOthers) {
+		err = confirmStepUp(ctx, db, cfg, customer, req.StepUp, c.RealIP())
+		if refused := stepUpRefusal(c, err, "Payments over "+cfg.StepUpThreshold.String()+" "+cfg.StepUpThreshold.Currency+" in total"); refused != nil {
+			return nil, refused
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error confirming payments: %w", err)
+		}
+	}
+
+	err = executeBulkPayments(ctx, db, cfg, from, report)
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// executeBulkPayments pays the valid rows of report from from, in one batch
+// or one by one according to its mode, and records the outcome of each.
+func executeBulkPayments(ctx context.Context, db dbutil.Database, cfg Config, from *dbutil.Account, report *bulkPaymentReport) error {
+	report.Executed = true
+	report.Total = dbutil.NewMoney(0, from.Currency())
+	report.Error = ""
+
+	// Each row keeps its own idempotency key, so retrying the file pays only
+	// the rows that were not paid the first time
+	var payments []dbutil.BatchPayment
+	var paying []*bulkPaymentRow
+	for i := range report.Rows {
+		row := &report.Rows[i]
+		if row.Status != bulkRowValid {
+			continue
+		}
+		payments = append(payments, dbutil.BatchPayment{
+			ToAccount: row.ToAccount,
+			Amount:    row.amount,
+			Reference: row.Reference,
+			Key:       dbutil.IdempotencyKey{Key: fmt.Sprintf(bulkIdempotencyKey, report.BatchId, row.Line), ExpiresAt: time.Now().Add(cfg.IdempotencyWindow)},
+		})
+		paying = append(paying, row)
+	}
+
+	if report.Mode == bulkAllOrNothing {
+		err := db.TransferBatch(ctx, from.Id, payments)
+		var failed *dbutil.BatchError
+		if errors.As(err, &failed) {
+			row := paying[failed.Index]
+			reason := bulkTransferError(failed.Err, from, row.to)
+			if reason == "" {
+				return err
+			}
+			for _, other := range paying {
+				other.Status = bulkRowNotPaid
+			}
+			row.Status, row.Error = bulkRowFailed, reason
+			report.Failed = 1
+			report.Error = fmt.Sprintf("No payments were made, because the payment on line %d failed", row.Line)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for i, row := range paying {
+			row.Status, row.TransactionId = bulkRowPaid, payments[i].TransactionId
+			report.Paid++
+			report.Total = report.Total.Add(row.amount)
+		}
+		return nil
+	}
+
+	for i, row := range paying {
+		err := db.TransferBatch(ctx, from.Id, payments[i:i+1])
+		var failed *dbutil.BatchError
+		if errors.As(err, &failed) {
+			reason := bulkTransferError(failed.Err, from, row.to)
+			if reason == "" {
+				log.Printf("Error paying line %d of bulk payment %s: %v", row.Line, report.BatchId, err)
+				reason = "Error processing payment"
+			}
+			row.Status, row.Error = bulkRowFailed, reason
+			report.Failed++
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		row.Status, row.TransactionId = bulkRowPaid, payments[i].TransactionId
+		report.Paid++
+		report.Total = report.Total.Add(row.amount)
+	}
+	return nil
+}
+
+func renderBulkPayments(db dbutil.Database, c echo.Context, status int, data map[string]interface{}) error {
+	ctx := c.Request().Context()
+
+	method, err := stepUpMethod(ctx, db, currentCustomer(c).Id)
+	if err != nil {
+		log.Println("Error fetching two-factor settings:", err)
+		return c.String(http.StatusInternalServerError, "Error loading bulk payments")
+	}
+	var accounts []dbutil.Account
+	for _, account := range currentAccounts(c) {
+		if !account.Closed() {
+			accounts = append(accounts, account)
+		}
+	}
+
+	if data == nil {
+		data = map[string]interface{}{}
+	}
+	data["Accounts"] = accounts
+	data["StepUpMethod"] = method
+	data["MaxPayments"] = maxBulkPayments
+	// A preview leads on to paying the file; otherwise another can be sent
+	report, _ := data["Report"].(*bulkPaymentReport)
+	data["ShowUpload"] = report == nil || report.Executed
+	return c.Render(status, "bulk-payments", data)
+}
+
+func bulkPaymentsHandler(db dbutil.Database, c echo.Context) error {
+	return renderBulkPayments(db, c, http.StatusOK, nil)
+}
+
+// bulkPaymentFormRequest reads a bulk payment request from the form on the
+// bulk payments page. The file comes as an upload or, once previewed, in
+// the csv field.
+func bulkPaymentFormRequest(c echo.Context) (bulkPaymentRequest, error) {
+	req := bulkPaymentRequest{
+		CSV:     c.FormValue("csv"),
+		Mode:    c.FormValue("mode"),
+		BatchId: c.FormValue("batch_id"),
+		StepUp:  c.FormValue("step_up"),
+	}
+	if value := c.FormValue("from_account"); value != "" {
+		id, err := strconv.Atoi(value)
+		if err != nil {
+			return req, badRequest("invalid_from_account", "Invalid source account")
+		}
+		req.FromAccount = id
+	}
+	if header, err := c.FormFile("file"); err == nil && header.Size > 0 {
+		if header.Size > maxBulkFileSize {
+			return req, badRequest("file_too_large", "The file is too large")
+		}
+		file, err := header.Open()
+		if err != nil {
+			return req, fmt.Errorf("error opening upload: %w", err)
+		}
+		defer file.Close()
+		data, err := io.ReadAll(io.LimitReader(file, maxBulkFileSize))
+		if err != nil {
+			return req, fmt.Errorf("error reading upload: %w", err)
+		}
+		req.CSV = string(data)
+	}
+	if !utf8.ValidString(req.CSV) {
+		return req, badRequest("invalid_csv", "The file must be UTF-8 text")
+	}
+	return req, nil
+}
+
+// previewBulkPaymentsHandler checks an uploaded file and shows what paying
+// it would do, with a form to go ahead.
+func previewBulkPaymentsHandler(db dbutil.Database, cfg Config, c echo.Context) error {
+	return bulkPaymentsFormHandler(db, cfg, c, false)
+}
+
+// executeBulkPaymentsHandler pays a previewed file and shows the report.
+func executeBulkPaymentsHandler(db dbutil.Database, cfg Config, c echo.Context) error {
+	return bulkPaymentsFormHandler(db, cfg, c, true)
+}
+
+func bulkPaymentsFormHandler(db dbutil.Database, cfg Config, c echo.Context, execute bool) error {
+	ctx := c.Request().Context()
+
+	req, err := bulkPaymentFormRequest(c)
+	var refused *requestError
+	if err == nil {
+		req.Execute = execute
+		var report *bulkPaymentReport
+		report, err = runBulkPayments(ctx, db, cfg, c, req)
+		if err == nil {
+			return renderBulkPayments(db, c, http.StatusOK, map[string]interface{}{"Report": report, "CSV": req.CSV})
+		}
+	}
+	if errors.As(err, &refused) {
+		data := map[string]interface{}{"Error": refused.message}
+		// Show the preview again, so the customer can see what to fix or
+		// confirm the payments
+		if execute {
+			req.Execute = false
+			if report, err := runBulkPayments(ctx, db, cfg, c, req); err == nil {
+				data["Report"] = report
+				data["CSV"] = req.CSV
+			}
+		}
+		return renderBulkPayments(db, c, refused.status, data)
+	}
+	log.Println("Error processing bulk payments:", err)
+	return c.String(http.StatusInternalServerError, "Error processing bulk payments")
+}
+
+func apiBulkPaymentsHandler(db dbutil.Database, cfg Config, c echo.Context) error {
+	ctx := c.Request().Context()
+
+	var req bulkPaymentRequest
+	if err := c.Bind(&req); err != nil {
+		return apiFail(c, http.StatusBadRequest, "invalid_request", "Request body is not valid JSON")
+	}
+
+	report, err := runBulkPayments(ctx, db, cfg, c, req)
+	var refused *requestError
+	if errors.As(err, &refused) {
+		return apiFail(c, refused.status, refused.code, refused.message)
+	}
+	if err != nil {
+		log.Println("Error processing bulk payments:", err)
+		return apiFail(c, http.StatusInternalServerError, "internal_error", "Error processing bulk payments")
+	}
+	return c.JSON(http.StatusOK, report)
+}
@@ -0,0 +1,41 @@
+package server
+
+import (
+	"minibank/dbutil"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestBulkPaymentsRetry(t *testing.T) {
+	now := time.Date(2026, 3, 2, 9, 0, 0, 0, time.UTC)
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.Clock = func() time.Time { return now }
+	})
+	ts.customer(t, "alice@example.com", dbutil.RoleCustomer, "AUD")
+	_, bobAccount := ts.customer(t, "bob@example.com", dbutil.RoleCustomer, "AUD")
+	_, carolAccount := ts.customer(t, "carol@example.com", dbutil.RoleCustomer, "AUD")
+	session := ts.login(t, "alice@example.com")
+
+	for _, mode := range []string{bulkAllOrNothing, bulkBestEffort} {
+		bob, carol := ts.balance(t, bobAccount.Id), ts.balance(t, carolAccount.Id)
+		req := bulkPaymentRequest{
+			CSV:     "bob@example.com,1.00\ncarol@example.com,2.00\n",
+			Mode:    mode,
+			Execute: true,
+			BatchId: "batch-" + mode,
+		}
+		// The response to the first attempt is lost, and the file is sent
+		// again
+		for i := 0; i < 2; i++ {
+			expectStatus(t, session.doJSON(t, http.MethodPost, apiPrefix+"/bulk-payments", req), http.StatusOK)
+		}
+
+		if got, want := ts.balance(t, bobAccount.Id), bob.Add(dbutil.NewMoney(100, "AUD")); got != want {
+			t.Errorf("%s: Bob has %s, want %s", mode, got, want)
+		}
+		if got, want := ts.balance(t, carolAccount.Id), carol.Add(dbutil.NewMoney(200, "AUD")); got != want {
+			t.Errorf("%s: Carol has %s, want %s", mode, got, want)
+		}
+	}
+}
@@ -0,0 +1,298 @@
+package server
+
+import (
+	"encoding/base64"
+	"log"
+	"minibank/dbutil"
+	"minibank/dbutil/postgres"
+	"minibank/dbutil/sqlite"
+	"minibank/mailer"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds the server settings that can be changed through environment
+// variables.
+type Config struct {
+	// DatabaseURL selects the backend (DATABASE_URL). A postgres:// or
+	// postgresql:// URL uses PostgreSQL; sqlite:<path> or an empty value
+	// uses the SQLite file ("minibank" by default).
+	DatabaseURL string
+
+	// RequestTimeout bounds how long a request, including its database
+	// work, may run (REQUEST_TIMEOUT, default 10s).
+	RequestTimeout time.Duration
+
+	// IdempotencyWindow is how long an Idempotency-Key on POST /payment is
+	// remembered (IDEMPOTENCY_WINDOW, default 24h).
+	IdempotencyWindow time.Duration
+
+	// SessionKeys are the key pairs session cookies are signed and
+	// encrypted with (SESSION_KEYS). Pairs are comma separated, each a
+	// base64 hash key and an optional base64 encryption key of 16, 24 or
+	// 32 bytes joined by ":". New cookies use the first pair; the rest
+	// still decode, so a key is rotated by putting a new pair in front and
+	// dropping the old one after the absolute timeout. When unset, random
+	// keys are generated and sessions do not survive a restart.
+	SessionKeys [][]byte
+
+	// SessionStore is "cookie" to keep session data in the cookie itself or
+	// "database" to keep it server-side, which allows sessions to be listed
+	// and revoked (SESSION_STORE, default cookie).
+	SessionStore string
+
+	// SessionSecure, SessionSameSite set the Secure and SameSite cookie
+	// flags (SESSION_SECURE, default false; SESSION_SAMESITE lax, strict or
+	// none, default lax). Cookies are always HttpOnly.
+	SessionSecure   bool
+	SessionSameSite http.SameSite
+
+	// SessionIdleTimeout ends a session after a period without requests
+	// (SESSION_IDLE_TIMEOUT, default 30m), and SessionAbsoluteTimeout ends
+	// it a fixed time after login however active it is
+	// (SESSION_ABSOLUTE_TIMEOUT, default 12h).
+	SessionIdleTimeout     time.Duration
+	SessionAbsoluteTimeout time.Duration
+
+	// TrustedProxies are the reverse proxies whose X-Forwarded-For header
+	// gives the client address (TRUSTED_PROXIES, comma separated addresses
+	// or CIDR ranges). When empty the address of the connection is used, as
+	// any client can send X-Forwarded-For or X-Real-IP. Login throttling
+	// and the audit log rely on the client address.
+	TrustedProxies []*net.IPNet
+
+	// LoginMaxFailures is how many failed logins lock an email address
+	// (LOGIN_MAX_FAILURES, default 5), and LoginLockout how long the lock
+	// lasts and how long failures are remembered (LOGIN_LOCKOUT, default
+	// 15m).
+	LoginMaxFailures int
+	LoginLockout     time.Duration
+
+	// StepUpThreshold is the largest payment that can be made without
+	// confirming it again with a two-factor code, or the password for
+	// accounts without two-factor authentication (STEP_UP_THRESHOLD, a
+	// decimal amount, default 1000).
+	StepUpThreshold dbutil.Money
+
+	// Mailer delivers password reset and email verification links
+	// (MAILER: log, file:<path> or smtp://[user:password@]host:port,
+	// default log), sent from MAIL_FROM.
+	Mailer mailer.Mailer
+
+	// BaseURL is where the site is reached, for links in emails (BASE_URL,
+	// default http://localhost:3000).
+	BaseURL string
+
+	// SchedulerInterval is how often the scheduler looks for scheduled
+	// payments that are due (SCHEDULER_INTERVAL, default 1m).
+	SchedulerInterval time.Duration
+
+	// ScheduleMaxAttempts is how many times a scheduled payment is tried
+	// before the customer is told it failed (SCHEDULE_MAX_ATTEMPTS, default
+	// 3). The n-th retry waits n times ScheduleRetryDelay
+	// (SCHEDULE_RETRY_DELAY, default 15m).
+	ScheduleMaxAttempts int
+	ScheduleRetryDelay  time.Duration
+
+	// HoldDuration is how long a hold placed by authorizing a payment lasts
+	// before it expires and the money is released (HOLD_DURATION, default
+	// 168h).
+	HoldDuration time.Duration
+
+	// Clock returns the current time for two-factor codes, login
+	// throttling, holds and the payment scheduler. It is nil, meaning time.Now,
+	// except where a fake clock is needed. Idempotency keys are not timed by
+	// it: the database checks their ExpiresAt against the wall clock.
+	Clock func() time.Time
+}
+
+// now reads cfg.Clock.
+func (cfg Config) now() time.Time {
+	if cfg.Clock != nil {
+		return cfg.Clock()
+	}
+	return time.Now()
+}
+
+func LoadConfig() Config {
+	return Config{
+		DatabaseURL:       os.Getenv("DATABASE_URL"),
+		RequestTimeout:    durationEnv("REQUEST_TIMEOUT", 10*time.Second),
+		IdempotencyWindow: durationEnv("IDEMPOTENCY_WINDOW", 24*time.Hour),
+
+		SessionKeys:            sessionKeysEnv("SESSION_KEYS"),
+		SessionStore:           sessionStoreEnv("SESSION_STORE"),
+		SessionSecure:          os.Getenv("SESSION_SECURE") == "true",
+		SessionSameSite:        sameSiteEnv("SESSION_SAMESITE"),
+		SessionIdleTimeout:     durationEnv("SESSION_IDLE_TIMEOUT", 30*time.Minute),
+		SessionAbsoluteTimeout: durationEnv("SESSION_ABSOLUTE_TIMEOUT", 12*time.Hour),
+
+		TrustedProxies: ipRangesEnv("TRUSTED_PROXIES"),
+
+		LoginMaxFailures: intEnv("LOGIN_MAX_FAILURES", 5),
+		LoginLockout:     durationEnv("LOGIN_LOCKOUT", 15*time.Minute),
+
+		StepUpThreshold: moneyEnv("STEP_UP_THRESHOLD", dbutil.NewMoney(100000, dbutil.DefaultCurrency)),
+
+		Mailer:  mailerEnv("MAILER", "MAIL_FROM"),
+		BaseURL: strings.TrimRight(stringEnv("BASE_URL", "http://localhost:3000"), "/"),
+
+		SchedulerInterval:   durationEnv("SCHEDULER_INTERVAL", time.Minute),
+		ScheduleMaxAttempts: intEnv("SCHEDULE_MAX_ATTEMPTS", 3),
+		ScheduleRetryDelay:  durationEnv("SCHEDULE_RETRY_DELAY", 15*time.Minute),
+
+		HoldDuration: durationEnv("HOLD_DURATION", 7*24*time.Hour),
+	}
+}
+
+func stringEnv(name, fallback string) string {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	return value
+}
+
+func durationEnv(name string, fallback time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		log.Printf("Invalid %s %q, using %s", name, value, fallback)
+		return fallback
+	}
+	return d
+}
+
+func intEnv(name string, fallback int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		log.Printf("Invalid %s %q, using %d", name, value, fallback)
+		return fallback
+	}
+	return n
+}
+
+func moneyEnv(name string, fallback dbutil.Money) dbutil.Money {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	m, err := dbutil.ParseMoney(value, fallback.Currency)
+	if err != nil || m.IsNegative() {
+		log.Printf("Invalid %s %q, using %s", name, value, fallback)
+		return fallback
+	}
+	return m
+}
+
+func sessionKeysEnv(name string) [][]byte {
+	value := os.Getenv(name)
+	if value == "" {
+		return nil
+	}
+
+	var keys [][]byte
+	for _, pair := range strings.Split(value, ",") {
+		hashKey, blockKey, _ := strings.Cut(strings.TrimSpace(pair), ":")
+		hash, err := base64.StdEncoding.DecodeString(hashKey)
+		if err != nil || len(hash) < 32 {
+			log.Fatalf("Invalid %s: hash keys must be base64 and at least 32 bytes", name)
+		}
+		var block []byte
+		if blockKey != "" {
+			block, err = base64.StdEncoding.DecodeString(blockKey)
+			if err != nil || (len(block) != 16 && len(block) != 24 && len(block) != 32) {
+				log.Fatalf("Invalid %s: encryption keys must be base64 and 16, 24 or 32 bytes", name)
+			}
+		}
+		keys = append(keys, hash, block)
+	}
+	return keys
+}
+
+func ipRangesEnv(name string) []*net.IPNet {
+	value := os.Getenv(name)
+	if value == "" {
+		return nil
+	}
+
+	var ranges []*net.IPNet
+	for _, s := range strings.Split(value, ",") {
+		s = strings.TrimSpace(s)
+		if !strings.Contains(s, "/") {
+			if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+		_, ipRange, err := net.ParseCIDR(s)
+		if err != nil {
+			log.Fatalf("Invalid %s %q, expected addresses or CIDR ranges", name, value)
+		}
+		ranges = append(ranges, ipRange)
+	}
+	return ranges
+}
+
+func sessionStoreEnv(name string) string {
+	switch value := os.Getenv(name); value {
+	case "", "cookie":
+		return "cookie"
+	case "database":
+		return value
+	default:
+		log.Fatalf("Invalid %s %q, expected cookie or database", name, value)
+		return ""
+	}
+}
+
+func mailerEnv(name, fromName string) mailer.Mailer {
+	m, err := mailer.New(os.Getenv(name), stringEnv(fromName, "MiniBank <no-reply@minibank.local>"))
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", name, err)
+	}
+	return m
+}
+
+func sameSiteEnv(name string) http.SameSite {
+	switch value := strings.ToLower(os.Getenv(name)); value {
+	case "", "lax":
+		return http.SameSiteLaxMode
+	case "strict":
+		return http.SameSiteStrictMode
+	case "none":
+		return http.SameSiteNoneMode
+	default:
+		log.Printf("Invalid %s %q, using lax", name, value)
+		return http.SameSiteLaxMode
+	}
+}
+
+// openDatabase connects to the backend named by url; see Config.DatabaseURL.
+func openDatabase(url string) dbutil.Database {
+	switch {
+	case url == "":
+		db := sqlite.New()
+		return &db
+	case strings.HasPrefix(url, "postgres://"), strings.HasPrefix(url, "postgresql://"):
+		db := postgres.New(url)
+		return &db
+	case strings.HasPrefix(url, "sqlite:"):
+		db := sqlite.Open(strings.TrimPrefix(url, "sqlite:"))
+		return &db
+	}
+	log.Fatalf("Unsupported DATABASE_URL %q", url)
+	return nil
+}
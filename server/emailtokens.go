@@ -0,0 +1,323 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"minibank/dbutil"
+	"minibank/mailer"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// How long emailed links work for.
+const (
+	passwordResetTTL     = time.Hour
+	emailVerificationTTL = 48 * time.Hour
+)
+
+// issueEmailToken creates a token for purpose and returns a link to path on
+// the site that carries it.
+func issueEmailToken(ctx context.Context, db dbutil.Database, cfg Config, customerID int, purpose string, ttl time.Duration, path string) (string, error) {
+	token, raw, err := dbutil.NewEmailToken(customerID, purpose, cfg.now(), ttl)
+	if err != nil {
+		return "", err
+	}
+	err = db.CreateEmailToken(ctx, token)
+	if err != nil {
+		return "", err
+	}
+	return cfg.BaseURL + path + "?token=" + url.QueryEscape(raw), nil
+}
+
+// sendVerificationEmail mails the customer a link that confirms their email
+// address.
+func sendVerificationEmail(ctx context.Context, db dbutil.Database, cfg Config, customer *dbutil.Customer) error {
+	link, err := issueEmailToken(ctx, db, cfg, customer.Id, dbutil.TokenEmailVerification, emailVerificationTTL, "/verify-email")
+	if err != nil {
+		return err
+	}
+	return cfg.Mailer.Send(ctx, mailer.Message{
+		To:      customer.Email,
+		Subject: "Confirm your MiniBank email address",
+		Body: fmt.Sprintf("Hi %s,\n\nPlease confirm your email address by opening this link:\n\n%s\n\n"+
+			"You can send payments once it is confirmed. The link expires in %d hours.\n",
+			customer.First_name, link, int(emailVerificationTTL.Hours())),
+	})
+}
+
+// requestPasswordReset mails a reset link to email if a customer has it.
+// Unknown addresses are not an error, so callers cannot use this to find out
+// who banks here.
+func requestPasswordReset(ctx context.Context, db dbutil.Database, cfg Config, email string) error {
+	customer, err := db.GetCustomerByEmail(ctx, email)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && customer.Email == dbutil.FundingAccountEmail) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	accounts, err := db.ListCustomerAccounts(ctx, customer.Id)
+	if err != nil {
+		return err
+	}
+	if !hasOpenAccount(accounts) {
+		return nil
+	}
+
+	link, err := issueEmailToken(ctx, db, cfg, customer.Id, dbutil.TokenPasswordReset, passwordResetTTL, "/reset-password")
+	if err != nil {
+		return err
+	}
+	return cfg.Mailer.Send(ctx, mailer.Message{
+		To:      customer.Email,
+		Subject: "Reset your MiniBank password",
+		Body: fmt.Sprintf("Hi %s,\n\nSomeone asked to reset the password for this account. If it was you, open this link to choose a new one:\n\n%s\n\n"+
+			"The link expires in %d minutes. If you did not ask for this, you can ignore this email.\n",
+			customer.First_name, link, int(passwordResetTTL.Minutes())),
+	})
+}
+
+// verifyEmail uses a verification token and marks its customer's email
+// address as confirmed.
+func verifyEmail(ctx context.Context, db dbutil.Database, cfg Config, token, ip string) error {
+	now := cfg.now()
+	used, err := db.UseEmailToken(ctx, dbutil.TokenEmailVerification, dbutil.HashAPIToken(token), now)
+	if err != nil {
+		return err
+	}
+	err = db.SetEmailVerified(ctx, used.CustomerId, now)
+	if err != nil {
+		return err
+	}
+
+	err = db.CreateAuditEvent(ctx, &dbutil.AuditEvent{
+		CustomerId: used.CustomerId,
+		ActorId:    used.CustomerId,
+		Event:      dbutil.AuditEmailVerified,
+		IP:         ip,
+		CreatedAt:  now,
+	})
+	if err != nil {
+		log.Println("Error writing audit event:", err)
+	}
+	return nil
+}
+
+// resetPassword uses a reset token to give its customer a new password. Other
+// reset links stop working, any lockout is lifted, and with server-side
+// sessions every existing login is ended. Since the link arrived by email,
+// the address counts as verified too.
+func resetPassword(ctx context.Context, db dbutil.Database, cfg Config, token, password, ip string) error {
+	if password == "" {
+		return errMissingFields
+	}
+
+	now := cfg.now()
+	used, err := db.UseEmailToken(ctx, dbutil.TokenPasswordReset, dbutil.HashAPIToken(token), now)
+	if err != nil {
+		return err
+	}
+	customer, err := db.GetCustomer(ctx, used.CustomerId)
+	if err != nil {
+		return err
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), 10)
+	if err != nil {
+		return err
+	}
+	err = db.SetCustomerPassword(ctx, customer.Id, string(hashedPassword))
+	if err != nil {
+		return err
+	}
+	err = db.SetEmailVerified(ctx, customer.Id, now)
+	if err != nil {
+		return err
+	}
+	err = db.DeleteEmailTokens(ctx, customer.Id, dbutil.TokenPasswordReset)
+	if err != nil {
+		return err
+	}
+	err = db.ClearLoginThrottle(ctx, emailThrottleKey(customer.Email))
+	if err != nil {
+		return err
+	}
+	if cfg.SessionStore == "database" {
+		_, err = db.DeleteCustomerSessions(ctx, customer.Id, "")
+		if err != nil {
+			return err
+		}
+	}
+
+	err = db.CreateAuditEvent(ctx, &dbutil.AuditEvent{
+		CustomerId: customer.Id,
+		ActorId:    customer.Id,
+		Event:      dbutil.AuditPasswordReset,
+		IP:         ip,
+		CreatedAt:  now,
+	})
+	if err != nil {
+		log.Println("Error writing audit event:", err)
+	}
+	return nil
+}
+
+func forgotPasswordHandler(db dbutil.Database, cfg Config, c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if c.Request().Method == http.MethodPost {
+		email := c.FormValue("email")
+		if email == "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Please enter your email address."})
+		}
+
+		err := requestPasswordReset(ctx, db, cfg, email)
+		if err != nil {
+			log.Println("Error sending password reset:", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "An error occurred. Please try again."})
+		}
+		return c.JSON(http.StatusOK, map[string]string{"status": "sent"})
+	}
+
+	return c.Render(http.StatusOK, "forgot-password", nil)
+}
+
+func resetPasswordHandler(db dbutil.Database, cfg Config, c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if c.Request().Method == http.MethodPost {
+		err := resetPassword(ctx, db, cfg, c.FormValue("token"), c.FormValue("password"), c.RealIP())
+		if errors.Is(err, errMissingFields) {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Please enter a new password."})
+		}
+		if errors.Is(err, dbutil.ErrEmailTokenNotFound) {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "This reset link is invalid or has expired. Please ask for a new one."})
+		}
+		if err != nil {
+			log.Println("Error resetting password:", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "An error occurred. Please try again."})
+		}
+
+		// The old password may be what got someone else in
+		logOut(c)
+		return c.JSON(http.StatusOK, map[string]string{"status": "success"})
+	}
+
+	return c.Render(http.StatusOK, "reset-password", map[string]interface{}{
+		"Token": c.QueryParam("token"),
+	})
+}
+
+func verifyEmailHandler(db dbutil.Database, cfg Config, c echo.Context) error {
+	ctx := c.Request().Context()
+
+	err := verifyEmail(ctx, db, cfg, c.QueryParam("token"), c.RealIP())
+	if errors.Is(err, dbutil.ErrEmailTokenNotFound) {
+		return c.Render(http.StatusBadRequest, "verify-email", map[string]interface{}{
+			"Error": "This confirmation link is invalid or has expired. Log in to ask for a new one.",
+		})
+	}
+	if err != nil {
+		log.Println("Error verifying email:", err)
+		return c.String(http.StatusInternalServerError, "Error confirming email address")
+	}
+	return c.Render(http.StatusOK, "verify-email", nil)
+}
+
+// resendVerificationHandler mails the logged-in customer a new confirmation
+// link.
+func resendVerificationHandler(db dbutil.Database, cfg Config, c echo.Context) error {
+	ctx := c.Request().Context()
+
+	customer := currentCustomer(c)
+	if !customer.EmailVerified() {
+		err := sendVerificationEmail(ctx, db, cfg, customer)
+		if err != nil {
+			log.Println("Error sending verification email:", err)
+			return c.String(http.StatusInternalServerError, "Error sending confirmation email")
+		}
+	}
+	return c.Redirect(http.StatusSeeOther, "/?verification=sent")
+}
+
+func apiResendVerificationHandler(db dbutil.Database, cfg Config, c echo.Context) error {
+	ctx := c.Request().Context()
+
+	customer := currentCustomer(c)
+	if customer.EmailVerified() {
+		return apiFail(c, http.StatusConflict, "already_verified", "Your email address is already confirmed")
+	}
+	err := sendVerificationEmail(ctx, db, cfg, customer)
+	if err != nil {
+		log.Println("Error sending verification email:", err)
+		return apiFail(c, http.StatusInternalServerError, "internal_error", "Error sending confirmation email")
+	}
+	return c.NoContent(http.StatusAccepted)
+}
+
+func apiConfirmEmailHandler(db dbutil.Database, cfg Config, c echo.Context) error {
+	ctx := c.Request().Context()
+
+	var req confirmEmailRequest
+	if err := c.Bind(&req); err != nil {
+		return apiFail(c, http.StatusBadRequest, "invalid_request", "Request body is not valid JSON")
+	}
+
+	err := verifyEmail(ctx, db, cfg, req.Token, c.RealIP())
+	if errors.Is(err, dbutil.ErrEmailTokenNotFound) {
+		return apiFail(c, http.StatusBadRequest, "invalid_token", "The token is invalid or has expired")
+	}
+	if err != nil {
+		log.Println("Error verifying email:", err)
+		return apiFail(c, http.StatusInternalServerError, "internal_error", "Error confirming email address")
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+func apiCreatePasswordResetHandler(db dbutil.Database, cfg Config, c echo.Context) error {
+	ctx := c.Request().Context()
+
+	var req createPasswordResetRequest
+	if err := c.Bind(&req); err != nil {
+		return apiFail(c, http.StatusBadRequest, "invalid_request", "Request body is not valid JSON")
+	}
+	if req.Email == "" {
+		return apiFail(c, http.StatusBadRequest, "missing_fields", "Please enter your email address.")
+	}
+
+	err := requestPasswordReset(ctx, db, cfg, req.Email)
+	if err != nil {
+		log.Println("Error sending password reset:", err)
+		return apiFail(c, http.StatusInternalServerError, "internal_error", "Error sending password reset")
+	}
+	return c.NoContent(http.StatusAccepted)
+}
+
+func apiConfirmPasswordResetHandler(db dbutil.Database, cfg Config, c echo.Context) error {
+	ctx := c.Request().Context()
+
+	var req confirmPasswordResetRequest
+	if err := c.Bind(&req); err != nil {
+		return apiFail(c, http.StatusBadRequest, "invalid_request", "Request body is not valid JSON")
+	}
+
+	err := resetPassword(ctx, db, cfg, req.Token, req.Password, c.RealIP())
+	if errors.Is(err, errMissingFields) {
+		return apiFail(c, http.StatusBadRequest, "missing_fields", "Please enter a new password.")
+	}
+	if errors.Is(err, dbutil.ErrEmailTokenNotFound) {
+		return apiFail(c, http.StatusBadRequest, "invalid_token", "The token is invalid or has expired")
+	}
+	if err != nil {
+		log.Println("Error resetting password:", err)
+		return apiFail(c, http.StatusInternalServerError, "internal_error", "Error resetting password")
+	}
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"minibank/dbutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// LoadExchangeRates runs the "rates" command, which sets every exchange rate
+// listed in the file at path. Rates already in the table but not in the file
+// are kept.
+func LoadExchangeRates(ctx context.Context, path string, out io.Writer) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	rates, err := parseExchangeRates(f, time.Now())
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	cfg := LoadConfig()
+	db := openDatabase(cfg.DatabaseURL)
+	for i := range rates {
+		err = db.SetExchangeRate(ctx, &rates[i])
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "%s/%s %s (fee %d bp)\n", rates[i].Base, rates[i].Quote, rates[i].Rate, rates[i].FeeBasisPoints)
+	}
+	return nil
+}
+
+// parseExchangeRates reads exchange rates as CSV lines of base currency,
+// quote currency, rate and an optional fee in basis points, such as
+// "AUD,USD,0.6512,25". Blank lines and lines starting with # are skipped.
+func parseExchangeRates(r io.Reader, now time.Time) ([]dbutil.ExchangeRate, error) {
+	reader := csv.NewReader(r)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	var rates []dbutil.ExchangeRate
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return rates, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		line, _ := reader.FieldPos(0)
+		if len(record) != 3 && len(record) != 4 {
+			return nil, fmt.Errorf("line %d: expected base,quote,rate[,fee_basis_points]", line)
+		}
+
+		rate := dbutil.ExchangeRate{
+			Base:      strings.ToUpper(strings.TrimSpace(record[0])),
+			Quote:     strings.ToUpper(strings.TrimSpace(record[1])),
+			Rate:      strings.TrimSpace(record[2]),
+			UpdatedAt: now,
+		}
+		if len(record) == 4 {
+			rate.FeeBasisPoints, err = strconv.Atoi(strings.TrimSpace(record[3]))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid fee %q", line, record[3])
+			}
+		}
+		if err := rate.Validate(); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		rates = append(rates, rate)
+	}
+}
+
+func apiExchangeRatesHandler(db dbutil.Database, c echo.Context) error {
+	ctx := c.Request().Context()
+
+	rates, err := db.ListExchangeRates(ctx)
+	if err != nil {
+		log.Println("Error listing exchange rates:", err)
+		return apiFail(c, http.StatusInternalServerError, "internal_error", "Error listing exchange rates")
+	}
+	if rates == nil {
+		rates = []dbutil.ExchangeRate{}
+	}
+	return c.JSON(http.StatusOK, exchangeRateListResponse{Rates: rates})
+}
+
+func apiSetExchangeRateHandler(db dbutil.Database, c echo.Context) error {
+	ctx := c.Request().Context()
+
+	actor := currentCustomer(c)
+	if !canSetExchangeRates(actor) {
+		return apiFail(c, http.StatusForbidden, "forbidden", "Your role does not allow this")
+	}
+
+	var req setExchangeRateRequest
+	if err := c.Bind(&req); err != nil {
+		return apiFail(c, http.StatusBadRequest, "invalid_request", "Request body is not valid JSON")
+	}
+	rate := dbutil.ExchangeRate{
+		Base:           strings.ToUpper(c.Param("base")),
+		Quote:          strings.ToUpper(c.Param("quote")),
+		Rate:           req.Rate,
+		FeeBasisPoints: req.FeeBasisPoints,
+		UpdatedAt:      time.Now(),
+	}
+	if err := rate.Validate(); err != nil {
+		return apiFail(c, http.StatusBadRequest, "invalid_exchange_rate", err.Error())
+	}
+
+	previous, err := db.GetExchangeRate(ctx, rate.Base, rate.Quote)
+	if err != nil && !errors.Is(err, dbutil.ErrNoExchangeRate) {
+		log.Println("Error fetching exchange rate:", err)
+		return apiFail(c, http.StatusInternalServerError, "internal_error", "Error setting exchange rate")
+	}
+
+	err = db.SetExchangeRate(ctx, &rate)
+	if err != nil {
+		log.Println("Error setting exchange rate:", err)
+		return apiFail(c, http.StatusInternalServerError, "internal_error", "Error setting exchange rate")
+	}
+
+	detail := fmt.Sprintf("%s/%s %s, fee %d bp", rate.Base, rate.Quote, rate.Rate, rate.FeeBasisPoints)
+	if previous != nil {
+		detail += fmt.Sprintf(" (was %s, fee %d bp)", previous.Rate, previous.FeeBasisPoints)
+	}
+	err = db.CreateAuditEvent(ctx, &dbutil.AuditEvent{
+		ActorId:   actor.Id,
+		Event:     dbutil.AuditExchangeRateChanged,
+		Detail:    detail,
+		IP:        c.RealIP(),
+		CreatedAt: rate.UpdatedAt,
+	})
+	if err != nil {
+		log.Println("Error writing audit event:", err)
+	}
+
+	return c.JSON(http.StatusOK, rate)
+}
@@ -2,36 +2,34 @@ package server
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"log"
 	"minibank/dbutil"
+	"minibank/statement"
 	"net/http"
 	"strconv"
-	"strings"
 	"time"
 
-	"github.com/labstack/echo-contrib/session"
+	"github.com/google/uuid"
 	"github.com/labstack/echo/v4"
-	"golang.org/x/crypto/bcrypt"
 )
 
 func accountHandler(db dbutil.Database, c echo.Context) error {
+	ctx := c.Request().Context()
 
-	// Get the user ID from the session
-	sess, _ := session.Get("session", c)
-	userID, ok := sess.Values["userID"]
-	if !ok {
-		return c.Redirect(http.StatusSeeOther, "/login") // Redirect to login if not logged in
-	}
-
-	// Fetch the account details from the database
-	account, err := db.GetAccount(userID.(int))
-	if err != nil {
-		log.Println("Error fetching account details:", err) // Log the error for debugging
-		return c.Redirect(http.StatusSeeOther, "/login")
-	}
+	// Loaded by requireLogin
+	customer := currentCustomer(c)
 	if c.Request().Method == http.MethodPost {
-		tx, err := db.Begin() // Assuming your dbutil.Database has a Begin() method
+		account := ownAccount(c, c.FormValue("account_id"))
+		if account == nil {
+			return c.String(http.StatusBadRequest, "Invalid account ID")
+		}
+		if account.CheckActive() != nil {
+			return c.String(http.StatusForbidden, "This account is frozen or closed and cannot receive payments")
+		}
+
+		tx, err := db.Begin(ctx) // Assuming your dbutil.Database has a Begin() method
 		if err != nil {
 			return c.String(http.StatusInternalServerError, "Error starting transaction")
 		}
@@ -44,75 +42,95 @@ func accountHandler(db dbutil.Database, c echo.Context) error {
 		}()
 
 		// Apply the stimulus
-		err = db.Stimulus(tx, account)
+		err = db.Stimulus(ctx, tx, account)
+		if errors.Is(err, dbutil.ErrAccountFrozen) || errors.Is(err, dbutil.ErrAccountClosed) {
+			return c.String(http.StatusForbidden, "This account is frozen or closed and cannot receive payments")
+		}
 		if err != nil {
 			return c.String(http.StatusInternalServerError, err.Error())
 		}
 		return c.Redirect(http.StatusSeeOther, "/")
 	}
 
-	// Render the account.html template with the account data
+	// Render the account.html template with the customer's accounts
 	return c.Render(http.StatusOK, "account", map[string]interface{}{
-		"Account": account,
+		"Customer":         customer,
+		"Accounts":         currentAccounts(c),
+		"AccountTypes":     dbutil.AccountTypes,
+		"Currencies":       dbutil.Currencies(),
+		"DefaultCurrency":  dbutil.DefaultCurrency,
+		"VerificationSent": c.QueryParam("verification") == "sent",
 	})
 }
 
+// openAccountHandler opens another account for the logged-in customer.
+func openAccountHandler(db dbutil.Database, c echo.Context) error {
+	ctx := c.Request().Context()
+
+	account, err := newAccount(currentCustomer(c).Id, c.FormValue("type"), c.FormValue("nickname"), c.FormValue("currency"))
+	if errors.Is(err, errInvalidAccountType) || errors.Is(err, errNicknameTooLong) || errors.Is(err, errInvalidCurrency) {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+	if err != nil {
+		return c.String(http.StatusInternalServerError, "Error opening account")
+	}
+
+	err = db.CreateAccount(ctx, account)
+	if err != nil {
+		log.Println("Error opening account:", err)
+		return c.String(http.StatusInternalServerError, "Error opening account")
+	}
+	return c.Redirect(http.StatusSeeOther, "/")
+}
+
 func allAccountsHandler(db dbutil.Database, c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if !canListAccounts(currentCustomer(c)) {
+		return c.String(http.StatusForbidden, "Forbidden")
+	}
+
 	return c.Render(http.StatusOK, "all-accounts", map[string]interface{}{
-		"Accounts": db.GetAccounts(),
+		"Customers": groupAccounts(db.GetCustomers(ctx), db.GetAccounts(ctx)),
 	})
 }
 
-func createAccountHandler(db dbutil.Database, c echo.Context) error {
+func createAccountHandler(db dbutil.Database, cfg Config, c echo.Context) error {
+	ctx := c.Request().Context()
+
 	if c.Request().Method == http.MethodGet {
 		return c.Render(http.StatusOK, "create-account", nil)
 	}
 
 	if c.Request().Method == http.MethodPost {
-		firstName := c.FormValue("first_name")
-		lastName := c.FormValue("last_name")
-		email := c.FormValue("email")
-		phoneNumberStr := c.FormValue("phone_number")
-		password := c.FormValue("password")
-
-		// Validate required fields
-		if firstName == "" || lastName == "" || email == "" || password == "" {
-			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Please fill in all required fields."})
+		customer, account, err := newCustomer(
+			c.FormValue("first_name"),
+			c.FormValue("last_name"),
+			c.FormValue("email"),
+			c.FormValue("phone_number"),
+			c.FormValue("password"),
+		)
+		if errors.Is(err, errMissingFields) || errors.Is(err, errInvalidPhoneNumber) {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
 		}
-
-		// Validate phone number
-		number, err := strconv.Atoi(phoneNumberStr)
 		if err != nil {
-			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid phone number. Only digits are allowed."})
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Error hashing password."})
 		}
 
-		// Format the first name and hash the password
-		firstName = strings.Replace(firstName, string(firstName[0]), strings.ToUpper(string(firstName[0])), 1)
-		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), 10)
+		// Create the new customer and their account in the database
+		err = db.CreateCustomer(ctx, customer, account)
 		if err != nil {
-			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Error hashing password."})
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Error creating account. Please try again."})
 		}
 
-		// Create the new account in the database
-		newAccount := &dbutil.Account{
-			First_name:         firstName,
-			Last_name:          lastName,
-			Email:              email,
-			Phone_number:       number,
-			Encrypted_password: string(hashedPassword),
-			Balance:            0,
-			Created_at:         time.Now(),
-			Updated_at:         time.Now(),
-		}
-		err = db.CreateAccount(newAccount)
+		// The customer can ask for another link if this one goes astray
+		err = sendVerificationEmail(ctx, db, cfg, customer)
 		if err != nil {
-			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Error creating account. Please try again."})
+			log.Println("Error sending verification email:", err)
 		}
 
 		// Automatically log in the user by creating a session
-		sess, _ := session.Get("session", c)
-		sess.Values["userID"] = newAccount.Id
-		sess.Save(c.Request(), c.Response())
+		logIn(c, db, customer.Id)
 
 		// Return success response
 		return c.JSON(http.StatusOK, map[string]string{"status": "success"})
@@ -121,7 +139,9 @@ func createAccountHandler(db dbutil.Database, c echo.Context) error {
 	return nil
 }
 
-func loginHandler(db dbutil.Database, c echo.Context) error {
+func loginHandler(db dbutil.Database, cfg Config, c echo.Context) error {
+	ctx := c.Request().Context()
+
 	if c.Request().Method == http.MethodPost {
 		email := c.FormValue("email")
 		password := c.FormValue("password")
@@ -131,28 +151,35 @@ func loginHandler(db dbutil.Database, c echo.Context) error {
 			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Please enter both email and password."})
 		}
 
-		// Fetch account by email
-		account, err := db.GetAccountByEmail(email)
-		if err != nil {
-			// Check if the error is "no rows found," meaning the account doesn't exist
-			if err == sql.ErrNoRows {
-				return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid email or password."})
+		customer, err := authenticate(ctx, db, cfg, email, password, c.RealIP())
+		if errors.Is(err, errTwoFactorRequired) {
+			// The login page asks for the code and posts it to
+			// /login/two-factor
+			err = startTwoFactorLogin(c, customer.Id, cfg.now())
+			if err != nil {
+				log.Println("Error saving session:", err)
+				return c.JSON(http.StatusInternalServerError, map[string]string{"error": "An error occurred. Please try again."})
 			}
-			// Unexpected database error
-			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "An error occurred. Please try again."})
+			return c.JSON(http.StatusOK, map[string]string{"status": "two_factor_required"})
 		}
-
-		// Check password
-		err = bcrypt.CompareHashAndPassword([]byte(account.Encrypted_password), []byte(password))
-		if err != nil {
-			// Incorrect password
+		if errors.Is(err, errInvalidCredentials) {
 			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid email or password."})
 		}
+		if errors.Is(err, errAccountLocked) {
+			return c.JSON(http.StatusLocked, map[string]string{"error": "Too many failed logins. Please try again later."})
+		}
+		var delay *loginDelayError
+		if errors.As(err, &delay) {
+			setRetryAfter(c, delay.Wait)
+			return c.JSON(http.StatusTooManyRequests, map[string]string{"error": "Too many failed logins. Please wait a moment and try again."})
+		}
+		if err != nil {
+			// Unexpected database error
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "An error occurred. Please try again."})
+		}
 
 		// Successful login: create session
-		sess, _ := session.Get("session", c)
-		sess.Values["userID"] = account.Id
-		sess.Save(c.Request(), c.Response())
+		logIn(c, db, customer.Id)
 
 		// Return success response
 		return c.JSON(http.StatusOK, map[string]string{"status": "success"})
@@ -162,24 +189,36 @@ func loginHandler(db dbutil.Database, c echo.Context) error {
 }
 
 func logoutHandler(c echo.Context) error {
-	sess, _ := session.Get("session", c)
-	sess.Options.MaxAge = -1 // Set the MaxAge option to -1 to expire the cookie immediately
-	sess.Values["userID"] = nil
-	sess.Save(c.Request(), c.Response())
+	logOut(c)
 	return c.Redirect(http.StatusSeeOther, "/")
 }
 
+// deleteAccountHandler closes an account. Its row and transactions are kept,
+// so the other side of each payment can still see who it was with.
 func deleteAccountHandler(db dbutil.Database, c echo.Context) error {
-	sess, _ := session.Get("session", c)
-	userID, ok := sess.Values["userID"]
-	if !ok {
+	ctx := c.Request().Context()
+
+	actor := currentCustomer(c)
+	if actor == nil {
 		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "not_logged_in"})
 	}
 
 	if c.Request().Method == http.MethodGet {
-		accounts := db.GetAccounts()
+		// Only admins may pick someone else's account
+		customers := []dbutil.Customer{*actor}
+		accounts := currentAccounts(c)
+		if actor.Role == dbutil.RoleAdmin {
+			customers = db.GetCustomers(ctx)
+			accounts = db.GetAccounts(ctx)
+		}
+		var open []dbutil.Account
+		for _, account := range accounts {
+			if !account.Closed() {
+				open = append(open, account)
+			}
+		}
 		return c.Render(http.StatusOK, "delete-account", map[string]interface{}{
-			"Accounts": accounts,
+			"Customers": groupAccounts(customers, open),
 		})
 	}
 
@@ -191,81 +230,164 @@ func deleteAccountHandler(db dbutil.Database, c echo.Context) error {
 		}
 
 		// Fetch the account details
-		account, err := db.GetAccount(accountID)
+		account, err := db.GetAccount(ctx, accountID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return c.JSON(http.StatusForbidden, map[string]string{"error": "unauthorized"})
+		}
 		if err != nil {
 			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "fetch_error"})
 		}
 
-		// Check if the account is restricted and not owned by the user
-		if accountID <= 5 && account.Id != userID.(int) {
+		if !canCloseAccount(actor, account) {
 			return c.JSON(http.StatusForbidden, map[string]string{"error": "unauthorized"})
 		}
 
-		// Delete the account
-		err = db.DeleteAccount(accountID)
+		reason := "Closed by the account holder"
+		if account.Customer_id != actor.Id {
+			reason = "Closed by an administrator"
+		}
+
+		// Close the account
+		err = changeAccountStatus(ctx, db, actor, account, dbutil.StatusClosed, reason, c.RealIP())
+		if errors.Is(err, errFundingAccount) {
+			return c.JSON(http.StatusForbidden, map[string]string{"error": "unauthorized"})
+		}
+		if errors.Is(err, dbutil.ErrBalanceNotZero) {
+			return c.JSON(http.StatusConflict, map[string]string{"error": "balance_not_zero"})
+		}
+		if errors.Is(err, dbutil.ErrInvalidStatusChange) {
+			return c.JSON(http.StatusConflict, map[string]string{"error": "already_closed"})
+		}
 		if err != nil {
+			log.Printf("Error closing account %d: %v", accountID, err)
 			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "delete_error"})
 		}
 
-		// If the user deleted their own account, clear the session and log them out
-		if accountID == userID.(int) {
-			sess.Options.MaxAge = -1 // Expire the session cookie
-			sess.Values["userID"] = nil
-			sess.Save(c.Request(), c.Response()) // Ensure session is saved as expired
-			return c.JSON(http.StatusOK, map[string]string{"status": "logged_out"})
+		// If the user closed their last open account, clear the session and
+		// log them out
+		if account.Customer_id == actor.Id {
+			remaining := 0
+			for _, own := range currentAccounts(c) {
+				if !own.Closed() && own.Id != account.Id {
+					remaining++
+				}
+			}
+			if remaining == 0 {
+				logOut(c) // Ensure session is saved as expired
+				return c.JSON(http.StatusOK, map[string]string{"status": "logged_out"})
+			}
 		}
 
-		// Otherwise, deletion was successful but no logout needed
+		// Otherwise, closing was successful but no logout needed
 		return c.JSON(http.StatusOK, map[string]string{"status": "success"})
 	}
 
 	return nil
 }
 
-func paymentHandler(db dbutil.Database, c echo.Context) error {
+func paymentHandler(db dbutil.Database, cfg Config, c echo.Context) error {
+	ctx := c.Request().Context()
+
 	if c.Request().Method == http.MethodPost {
 		c.Response().Header().Set("Content-Type", "application/json")
 		recipient := c.FormValue("recipient")
+		toAccountStr := c.FormValue("to_account")
 		amountStr := c.FormValue("amount")
 
-		if recipient == "" || amountStr == "" {
+		if (recipient == "" && toAccountStr == "") || amountStr == "" {
 			return c.JSON(http.StatusBadRequest, map[string]interface{}{"Error": "Please provide recipient and amount"})
 		}
-		amount, err := strconv.ParseFloat(amountStr, 64)
-		if err != nil {
-			return c.JSON(http.StatusBadRequest, map[string]interface{}{"Error": "Invalid amount"})
+
+		// Loaded by requireLogin
+		sender := currentCustomer(c)
+		senderAccount := ownAccount(c, c.FormValue("from_account"))
+		if senderAccount == nil {
+			return c.JSON(http.StatusBadRequest, map[string]interface{}{"Error": "Invalid source account"})
+		}
+		if senderAccount.CheckActive() != nil {
+			return c.JSON(http.StatusForbidden, map[string]interface{}{"Error": "This account is frozen or closed and cannot send payments"})
 		}
 
-		sess, _ := session.Get("session", c)
-		userID, ok := sess.Values["userID"]
-		if !ok {
-			return c.Redirect(http.StatusSeeOther, "/login")
+		// The amount is in the paying account's currency
+		amount, err := dbutil.ParseMoney(amountStr, senderAccount.Currency())
+		if err != nil || !amount.IsPositive() {
+			return c.JSON(http.StatusBadRequest, map[string]interface{}{"Error": "Invalid amount"})
 		}
 
 		var recipientAccount *dbutil.Account
-		if strings.Contains(recipient, "@") {
-			recipientAccount, err = db.GetAccountByEmail(recipient)
+		if toAccountStr != "" {
+			recipientAccount = ownAccount(c, toAccountStr)
+			if recipientAccount == nil || recipientAccount.Id == senderAccount.Id {
+				return c.JSON(http.StatusBadRequest, map[string]interface{}{"Error": "Invalid destination account"})
+			}
 		} else {
-			phoneNumber, err := strconv.Atoi(recipient)
-			if err != nil {
+			_, recipientAccount, err = findRecipient(ctx, db, recipient)
+			if errors.Is(err, errInvalidPhoneNumber) {
 				return c.JSON(http.StatusBadRequest, map[string]interface{}{"Error": "Invalid recipient phone number"})
 			}
-			recipientAccount, err = db.GetAccountByPhoneNumber(phoneNumber)
+			if errors.Is(err, sql.ErrNoRows) {
+				return c.JSON(http.StatusNotFound, map[string]interface{}{"Error": "Recipient account not found"})
+			}
+			if err != nil {
+				log.Println("Error finding recipient:", err)
+				return c.JSON(http.StatusInternalServerError, map[string]interface{}{"Error": "Error finding recipient account"})
+			}
+			// Paying one's own email address or phone number from the
+			// primary account would pay the account itself
+			if recipientAccount.Id == senderAccount.Id {
+				return c.JSON(http.StatusBadRequest, map[string]interface{}{"Error": "A payment cannot go to the account it is paid from"})
+			}
 		}
-		if err != nil {
-			return c.JSON(http.StatusInternalServerError, map[string]interface{}{"Error": "Error finding recipient account"})
+		checks := needsPaymentChecks(sender, recipientAccount)
+		if checks && !canSendPayments(sender) {
+			return c.JSON(http.StatusForbidden, map[string]interface{}{"Error": "Please confirm your email address before sending payments"})
 		}
 
-		senderAccount, err := db.GetAccount(userID.(int))
-		if err != nil {
-			return c.JSON(http.StatusInternalServerError, map[string]interface{}{"Error": "Error fetching sender account details"})
+		if senderAccount.Available().LessThan(amount) {
+			return c.JSON(http.StatusBadRequest, map[string]interface{}{"Error": "Insufficient balance"})
 		}
 
-		if senderAccount.Balance < amount {
-			return c.JSON(http.StatusBadRequest, map[string]interface{}{"Error": "Insufficient balance"})
+		// Large payments need the two-factor code, or the password, again
+		if checks && needsStepUp(ctx, db, cfg, amount) {
+			err = confirmStepUp(ctx, db, cfg, sender, c.FormValue("step_up"), c.RealIP())
+			if refused := stepUpRefusal(c, err, "Payments over "+cfg.StepUpThreshold.String()+" "+cfg.StepUpThreshold.Currency); refused != nil {
+				return c.JSON(refused.status, map[string]interface{}{"Error": refused.message})
+			}
+			if err != nil {
+				log.Println("Error confirming payment:", err)
+				return c.JSON(http.StatusInternalServerError, map[string]interface{}{"Error": "Error processing payment"})
+			}
+		}
+
+		// A retried request carries the same key, from the header or the
+		// hidden form field, and gets the original transaction back.
+		key := dbutil.IdempotencyKey{Key: c.Request().Header.Get("Idempotency-Key")}
+		if key.Key == "" {
+			key.Key = c.FormValue("idempotency_key")
 		}
+		key.ExpiresAt = time.Now().Add(cfg.IdempotencyWindow)
 
-		transactionID, err := db.Transfer(userID.(int), recipientAccount.Id, amount)
+		// The balance check above is only a fast path; Transfer re-checks the
+		// funds atomically in case another payment got there first.
+		transactionID, err := db.Transfer(ctx, senderAccount.Id, recipientAccount.Id, amount, key)
+		if errors.Is(err, dbutil.ErrInsufficientFunds) {
+			return c.JSON(http.StatusBadRequest, map[string]interface{}{"Error": "Insufficient balance"})
+		}
+		if errors.Is(err, dbutil.ErrSameAccount) {
+			return c.JSON(http.StatusBadRequest, map[string]interface{}{"Error": "A payment cannot go to the account it is paid from"})
+		}
+		if errors.Is(err, dbutil.ErrIdempotencyKeyReused) {
+			return c.JSON(http.StatusUnprocessableEntity, map[string]interface{}{"Error": "Idempotency key already used for a different payment"})
+		}
+		if errors.Is(err, dbutil.ErrAccountFrozen) || errors.Is(err, dbutil.ErrAccountClosed) {
+			return c.JSON(http.StatusUnprocessableEntity, map[string]interface{}{"Error": "The recipient's account cannot receive payments"})
+		}
+		if errors.Is(err, dbutil.ErrNoExchangeRate) {
+			return c.JSON(http.StatusUnprocessableEntity, map[string]interface{}{"Error": "Payments from " + senderAccount.Currency() + " to " + recipientAccount.Currency() + " are not available"})
+		}
+		if errors.Is(err, dbutil.ErrAmountTooSmall) {
+			return c.JSON(http.StatusBadRequest, map[string]interface{}{"Error": "The amount is too small to pay into a " + recipientAccount.Currency() + " account"})
+		}
 		if err != nil {
 			log.Printf("Error during transfer: %v", err)
 			return c.JSON(http.StatusInternalServerError, map[string]interface{}{"Error": "Error processing payment"})
@@ -276,88 +398,113 @@ func paymentHandler(db dbutil.Database, c echo.Context) error {
 			return c.JSON(http.StatusInternalServerError, map[string]interface{}{"Error": "Error finalizing transaction"})
 		}
 
-		tx, err := db.Begin()
-		if err != nil {
-			return c.JSON(http.StatusInternalServerError, "Error starting transaction")
-		}
-
-		err = tx.Commit()
-		if err != nil {
-			return c.JSON(http.StatusInternalServerError, "Error committing transaction")
-		}
 		// Redirect to the transaction details page
 		return c.Redirect(http.StatusSeeOther, fmt.Sprintf("/single-transaction/%d", transactionID))
 	}
 
 	recipient := c.QueryParam("recipient")
 	if recipient == "" {
-		return c.Render(http.StatusOK, "payment", nil)
+		method, err := stepUpMethod(ctx, db, currentCustomer(c).Id)
+		if err != nil {
+			log.Println("Error fetching two-factor settings:", err)
+			return c.String(http.StatusInternalServerError, "Error loading payment page")
+		}
+		var accounts []dbutil.Account
+		// Keyed by account, in the account's currency
+		thresholds := make(map[int]string)
+		for _, account := range currentAccounts(c) {
+			if !account.Closed() {
+				accounts = append(accounts, account)
+				thresholds[account.Id] = stepUpThreshold(ctx, db, cfg, account.Currency()).String()
+			}
+		}
+		return c.Render(http.StatusOK, "payment", map[string]interface{}{
+			"Accounts":         accounts,
+			"IdempotencyKey":   uuid.NewString(),
+			"StepUpThresholds": thresholds,
+			"StepUpMethod":     method,
+		})
 	}
 
 	c.Response().Header().Set("Content-Type", "application/json")
 
-	var recipientAccount *dbutil.Account
-	var err error
-	if strings.Contains(recipient, "@") {
-		recipientAccount, err = db.GetAccountByEmail(recipient)
-	} else {
-		phoneNumber, err := strconv.Atoi(recipient)
-		if err != nil {
-			return c.JSON(http.StatusBadRequest, map[string]interface{}{"Error": "Invalid recipient phone number"})
-		}
-		recipientAccount, err = db.GetAccountByPhoneNumber(phoneNumber)
+	recipientCustomer, recipientAccount, err := findRecipient(ctx, db, recipient)
+	if errors.Is(err, errInvalidPhoneNumber) {
+		return c.JSON(http.StatusBadRequest, map[string]interface{}{"Error": "Invalid recipient phone number"})
 	}
-
 	if err != nil {
-		if err == sql.ErrNoRows {
+		if errors.Is(err, sql.ErrNoRows) {
 			return c.JSON(http.StatusNotFound, map[string]interface{}{"Error": "Account not found"})
 		}
 		return c.JSON(http.StatusInternalServerError, map[string]interface{}{"Error": err.Error()})
 	}
 
-	if recipientAccount == nil {
-		return c.JSON(http.StatusNotFound, map[string]interface{}{"Error": "Account not found"})
-	}
-
-	return c.JSON(http.StatusOK, map[string]interface{}{"Account": recipientAccount})
+	// Just enough for the payer to confirm who they are paying
+	return c.JSON(http.StatusOK, map[string]interface{}{"Account": map[string]interface{}{
+		"id":         recipientAccount.Id,
+		"first_name": recipientCustomer.First_name,
+		"last_name":  recipientCustomer.Last_name,
+	}})
 }
 
 func transactionsHandler(db dbutil.Database, c echo.Context) error {
-	// Step 1: Get the account ID from the URL parameters or session
-	accountIDStr := c.QueryParam("account_id")
-	if accountIDStr == "" {
-		sess, _ := session.Get("session", c)
-		userID, ok := sess.Values["userID"]
-		if !ok {
-			log.Println("User is not logged in. Redirecting to login.")
-			return c.Redirect(http.StatusSeeOther, "/login")
-		}
-		accountIDStr = strconv.Itoa(userID.(int))
-	}
-	// Step 2: Convert account ID to integer
-	accountID, err := strconv.Atoi(accountIDStr)
+	ctx := c.Request().Context()
+
+	// Step 1: Read the filters, and the account ID from the URL parameters,
+	// defaulting to the customer's primary account
+	actor := currentCustomer(c)
+	q, err := bindTransactionQuery(c)
 	if err != nil {
-		log.Printf("Invalid account ID: %s. Error: %v", accountIDStr, err)
 		return c.String(http.StatusBadRequest, "Invalid account ID")
 	}
-	// Step 3: Fetch account details
-	account, err := db.GetAccount(accountID)
+	accountID := q.AccountId
+	if accountID == 0 {
+		accountID = primaryAccount(currentAccounts(c)).Id
+	}
+	// Step 2: Fetch account details
+	account, err := db.GetAccount(ctx, accountID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return c.String(http.StatusForbidden, "Forbidden")
+	}
 	if err != nil {
 		log.Printf("Error fetching account details for ID %d: %v", accountID, err)
 		return c.String(http.StatusInternalServerError, "Error fetching account details")
 	}
-	// Step 4: Fetch transactions
-	transactions, err := db.ListTransactionsFromAccount(accountID)
+	if !canViewAccount(actor, account) {
+		return c.String(http.StatusForbidden, "Forbidden")
+	}
+	owner, err := db.GetCustomer(ctx, account.Customer_id)
+	if err != nil {
+		log.Printf("Error fetching owner of account %d: %v", accountID, err)
+		return c.String(http.StatusInternalServerError, "Error fetching account details")
+	}
+	data := map[string]interface{}{
+		"Account":    account,
+		"Owner":      owner,
+		"Accounts":   currentAccounts(c),
+		"Query":      q,
+		"Sorts":      dbutil.Sorts,
+		"Formats":    statement.Formats,
+		"IsLoggedIn": true,
+	}
+	// Step 3: Check the filters, showing the form again if they are wrong
+	filter, err := q.filter(account)
+	if err != nil {
+		data["Error"] = err.Error()
+		return c.Render(http.StatusBadRequest, "transactions", data)
+	}
+	// Step 4: Fetch a page of transactions
+	page, err := db.ListTransactionsFromAccount(ctx, filter)
 	if err != nil {
 		log.Printf("Error fetching transactions for account %d: %v", accountID, err)
 		return c.String(http.StatusInternalServerError, "Error fetching transactions")
 	}
 	// Step 5: Render the template
-	return c.Render(http.StatusOK, "transactions", map[string]interface{}{
-		"Transactions": transactions,
-		"Account":      account,
-		"IsLoggedIn":   true,
-	})
+	data["Transactions"] = page.Transactions
+	if page.NextCursor != "" {
+		data["NextPage"] = nextPageURL(c, page.NextCursor)
+	}
+	return c.Render(http.StatusOK, "transactions", data)
 }
 
 func singleTransactionHandler(db dbutil.Database, c echo.Context) error {
@@ -375,32 +522,83 @@ func singleTransactionHandler(db dbutil.Database, c echo.Context) error {
 		return c.String(http.StatusBadRequest, "Invalid transaction ID")
 	}
 
+	return renderSingleTransaction(db, c, transactionID, http.StatusOK, "")
+}
+
+// renderSingleTransaction shows a transaction with the given status and
+// error message, if any, above it.
+func renderSingleTransaction(db dbutil.Database, c echo.Context, transactionID int, status int, errorMessage string) error {
+	ctx := c.Request().Context()
+
 	// Step 3: Fetch the transaction details from the database
-	transaction, err := db.GetTransaction(transactionID)
+	transaction, err := db.GetTransaction(ctx, transactionID)
 	if err != nil {
 		log.Printf("Error fetching transaction details for ID %d: %v", transactionID, err)
 		return c.String(http.StatusNotFound, "Transaction not found")
 	}
 
 	// Step 4: Fetch associated account details using FromAccount and ToAccount
-	fromAccount, err := db.GetAccount(transaction.FromAccount)
+	fromAccount, err := db.GetAccount(ctx, transaction.FromAccount)
 	if err != nil {
 		log.Printf("Error fetching from account details for ID %d: %v", transaction.FromAccount, err)
 		return c.String(http.StatusInternalServerError, "Error fetching from account details")
 	}
 
-	toAccount, err := db.GetAccount(transaction.ToAccount)
+	toAccount, err := db.GetAccount(ctx, transaction.ToAccount)
 	if err != nil {
 		log.Printf("Error fetching to account details for ID %d: %v", transaction.ToAccount, err)
 		return c.String(http.StatusInternalServerError, "Error fetching to account details")
 	}
 
+	if !canViewTransaction(currentCustomer(c), fromAccount, toAccount) {
+		return c.String(http.StatusNotFound, "Transaction not found")
+	}
+
+	// And the customers who own them, for their names
+	fromOwner, err := db.GetCustomer(ctx, fromAccount.Customer_id)
+	if err != nil {
+		log.Printf("Error fetching owner of account %d: %v", fromAccount.Id, err)
+		return c.String(http.StatusInternalServerError, "Error fetching from account details")
+	}
+
+	toOwner, err := db.GetCustomer(ctx, toAccount.Customer_id)
+	if err != nil {
+		log.Printf("Error fetching owner of account %d: %v", toAccount.Id, err)
+		return c.String(http.StatusInternalServerError, "Error fetching to account details")
+	}
+
+	// And the reversal chain: the payment this one refunds, and the
+	// refunds of this one
+	var original *dbutil.Transaction
+	if transaction.Reverses != 0 {
+		original, err = db.GetTransaction(ctx, transaction.Reverses)
+		if err != nil {
+			log.Printf("Error fetching transaction %d reversed by %d: %v", transaction.Reverses, transaction.Id, err)
+			return c.String(http.StatusInternalServerError, "Error fetching transaction details")
+		}
+	}
+	refunds, refunded, err := refundedSoFar(ctx, db, transaction)
+	if err != nil {
+		log.Printf("Error fetching refunds of transaction %d: %v", transaction.Id, err)
+		return c.String(http.StatusInternalServerError, "Error fetching transaction details")
+	}
+	remaining := transaction.DestinationAmount.Sub(refunded)
+
 	// Step 5: Render the template
-	err = c.Render(http.StatusOK, "single-transaction", map[string]interface{}{
-		"Transaction": transaction,
-		"FromAccount": fromAccount,
-		"ToAccount":   toAccount,
-		"IsLoggedIn":  true,
+	err = c.Render(status, "single-transaction", map[string]interface{}{
+		"Transaction":    transaction,
+		"FromAccount":    fromAccount,
+		"ToAccount":      toAccount,
+		"FromOwner":      fromOwner,
+		"ToOwner":        toOwner,
+		"Original":       original,
+		"Refunds":        refunds,
+		"Refunded":       refunded,
+		"Remaining":      remaining,
+		"CanRefund":      transaction.Refundable() && remaining.IsPositive() && canReverseTransaction(currentCustomer(c), fromAccount, toAccount),
+		"IdempotencyKey": uuid.NewString(),
+		"Error":          errorMessage,
+		"IsLoggedIn":     true,
 	})
 
 	if err != nil {
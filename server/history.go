@@ -0,0 +1,142 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"minibank/dbutil"
+	"net/url"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Page sizes for transaction histories, on the web page and through the API.
+const (
+	defaultHistoryLimit = 50
+	maxHistoryLimit     = 200
+)
+
+// transactionQuery is the query string of a transaction history, on
+// /transactions and GET /api/v1/transactions alike. Dates are YYYY-MM-DD,
+// taken as UTC, or RFC 3339 times; until is exclusive for a time and takes
+// in the whole day for a date. Amounts are decimal strings in the account's
+// currency. Cursor is the next_cursor of the previous page.
+type transactionQuery struct {
+	AccountId    int    `query:"account_id"`
+	Since        string `query:"since"`
+	Until        string `query:"until"`
+	MinAmount    string `query:"min_amount"`
+	MaxAmount    string `query:"max_amount"`
+	Counterparty string `query:"counterparty"`
+	Direction    string `query:"direction"`
+	Type         string `query:"type"`
+	Sort         string `query:"sort"`
+	Cursor       string `query:"cursor"`
+	Limit        int    `query:"limit"`
+}
+
+// bindTransactionQuery reads the history query from c's query string.
+func bindTransactionQuery(c echo.Context) (transactionQuery, error) {
+	var q transactionQuery
+	if err := (&echo.DefaultBinder{}).BindQueryParams(c, &q); err != nil {
+		return q, errors.New("account_id and limit must be numbers")
+	}
+	return q, nil
+}
+
+// filter checks q and returns the filter it makes for account's history.
+// The error, if any, is fit to show the customer.
+func (q *transactionQuery) filter(account *dbutil.Account) (dbutil.TransactionFilter, error) {
+	filter := dbutil.TransactionFilter{
+		AccountId:    account.Id,
+		Counterparty: q.Counterparty,
+		Type:         q.Type,
+		Sort:         q.Sort,
+		After:        q.Cursor,
+		Limit:        q.Limit,
+	}
+
+	var err error
+	if filter.Since, err = parseHistoryTime(q.Since, false); err != nil {
+		return filter, errors.New("since must be a date (YYYY-MM-DD) or an RFC 3339 time")
+	}
+	if filter.Until, err = parseHistoryTime(q.Until, true); err != nil {
+		return filter, errors.New("until must be a date (YYYY-MM-DD) or an RFC 3339 time")
+	}
+
+	currency := account.Currency()
+	if filter.MinAmount, err = parseHistoryAmount(q.MinAmount, currency); err != nil {
+		return filter, fmt.Errorf("min_amount %w", err)
+	}
+	if filter.MaxAmount, err = parseHistoryAmount(q.MaxAmount, currency); err != nil {
+		return filter, fmt.Errorf("max_amount %w", err)
+	}
+
+	switch q.Direction {
+	case "", dbutil.DirectionIn, dbutil.DirectionOut:
+		filter.Direction = q.Direction
+	default:
+		return filter, errors.New("direction must be in or out")
+	}
+
+	if filter.Sort != "" && !dbutil.ValidSort(filter.Sort) {
+		return filter, fmt.Errorf("sort must be one of %v", dbutil.Sorts)
+	}
+	if filter.After != "" {
+		if _, err := dbutil.ParseHistoryCursor(filter.After, filter.SortOrder()); err != nil {
+			return filter, errors.New("cursor is not valid for this sort order")
+		}
+	}
+
+	switch {
+	case filter.Limit == 0:
+		filter.Limit = defaultHistoryLimit
+	case filter.Limit < 0 || filter.Limit > maxHistoryLimit:
+		return filter, fmt.Errorf("limit must be between 1 and %d", maxHistoryLimit)
+	}
+	return filter, nil
+}
+
+// parseHistoryTime parses a since or until bound, "" being none. A bare
+// date is the start of that day in UTC, or, with endOfDay, the start of the
+// next so that the whole day is included.
+func parseHistoryTime(s string, endOfDay bool) (*time.Time, error) {
+	if s == "" {
+		return nil, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return &t, nil
+	}
+	t, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		return nil, err
+	}
+	if endOfDay {
+		t = t.AddDate(0, 0, 1)
+	}
+	return &t, nil
+}
+
+// parseHistoryAmount parses a min_amount or max_amount bound, "" being
+// none.
+func parseHistoryAmount(s, currency string) (*dbutil.Money, error) {
+	if s == "" {
+		return nil, nil
+	}
+	amount, err := dbutil.ParseMoney(s, currency)
+	if err != nil || amount.Minor < 0 {
+		return nil, fmt.Errorf("must be a non-negative number of %s with at most %d decimal places", currency, dbutil.Exponent(currency))
+	}
+	return &amount, nil
+}
+
+// nextPageURL returns the URL of the page after the current one: the same
+// path and query with the cursor set.
+func nextPageURL(c echo.Context, cursor string) string {
+	query := url.Values{}
+	for name, values := range c.QueryParams() {
+		query[name] = values
+	}
+	query.Set("cursor", cursor)
+	return c.Request().URL.Path + "?" + query.Encode()
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"minibank/dbutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// A hold is placed by POST /transfers with "authorize" set. These handlers
+// settle it: the payee captures it, posting the payment, or either side voids
+// it. Holds nobody settles are voided by the scheduler once they expire.
+
+func apiCaptureHoldHandler(db dbutil.Database, cfg Config, c echo.Context) error {
+	return settleHoldHandler(db, cfg, c, canCaptureHold, db.CaptureHold)
+}
+
+func apiVoidHoldHandler(db dbutil.Database, cfg Config, c echo.Context) error {
+	return settleHoldHandler(db, cfg, c, canVoidHold, db.VoidHold)
+}
+
+// settleHoldHandler captures or voids the hold named by the id parameter
+// with settle, if allowed lets the customer, and returns the transaction as
+// it now stands.
+func settleHoldHandler(db dbutil.Database, cfg Config, c echo.Context,
+	allowed func(actor *dbutil.Customer, from, to *dbutil.Account) bool,
+	settle func(ctx context.Context, id int, at time.Time) error) error {
+	ctx := c.Request().Context()
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return apiFail(c, http.StatusBadRequest, "invalid_id", "Transaction ID must be a number")
+	}
+
+	transaction, err := db.GetTransaction(ctx, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return apiFail(c, http.StatusNotFound, "transaction_not_found", "Transaction not found")
+	}
+	if err != nil {
+		log.Printf("Error fetching transaction %d: %v", id, err)
+		return apiFail(c, http.StatusInternalServerError, "internal_error", "Error fetching transaction")
+	}
+	from, err := db.GetAccount(ctx, transaction.FromAccount)
+	if err != nil {
+		log.Printf("Error fetching account %d: %v", transaction.FromAccount, err)
+		return apiFail(c, http.StatusInternalServerError, "internal_error", "Error fetching transaction")
+	}
+	to, err := db.GetAccount(ctx, transaction.ToAccount)
+	if err != nil {
+		log.Printf("Error fetching account %d: %v", transaction.ToAccount, err)
+		return apiFail(c, http.StatusInternalServerError, "internal_error", "Error fetching transaction")
+	}
+
+	actor := currentCustomer(c)
+	if !canViewTransaction(actor, from, to) {
+		return apiFail(c, http.StatusNotFound, "transaction_not_found", "Transaction not found")
+	}
+	if !allowed(actor, from, to) {
+		return apiFail(c, http.StatusForbidden, "forbidden", "You cannot settle this hold")
+	}
+
+	err = settle(ctx, id, cfg.now())
+	if errors.Is(err, dbutil.ErrNotPending) {
+		return apiFail(c, http.StatusConflict, "not_pending", "This transaction is not a pending hold")
+	}
+	if errors.Is(err, dbutil.ErrHoldExpired) {
+		return apiFail(c, http.StatusConflict, "hold_expired", "This hold has expired")
+	}
+	if errors.Is(err, dbutil.ErrAccountFrozen) || errors.Is(err, dbutil.ErrAccountClosed) {
+		return apiFail(c, http.StatusUnprocessableEntity, "account_unavailable", "One of the accounts is frozen or closed")
+	}
+	if errors.Is(err, dbutil.ErrInsufficientFunds) {
+		return apiFail(c, http.StatusUnprocessableEntity, "insufficient_funds", "Insufficient balance")
+	}
+	if err != nil {
+		log.Printf("Error settling hold %d: %v", id, err)
+		return apiFail(c, http.StatusInternalServerError, "internal_error", "Error settling hold")
+	}
+
+	transaction, err = db.GetTransaction(ctx, id)
+	if err != nil {
+		log.Printf("Error fetching transaction %d: %v", id, err)
+		return apiFail(c, http.StatusInternalServerError, "internal_error", "Error fetching transaction")
+	}
+	return c.JSON(http.StatusOK, newTransactionResponse(transaction))
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+// Migrate runs the "migrate" command against the database selected by
+// DATABASE_URL. command is one of up, down or status.
+func Migrate(ctx context.Context, command string, out io.Writer) error {
+	cfg := LoadConfig()
+	db := openDatabase(cfg.DatabaseURL)
+
+	m, err := db.Migrator(ctx)
+	if err != nil {
+		return err
+	}
+
+	switch command {
+	case "up":
+		count, err := m.Up(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "applied %d migration(s)\n", count)
+	case "down":
+		reverted, err := m.Down(ctx)
+		if err != nil {
+			return err
+		}
+		if !reverted {
+			fmt.Fprintln(out, "no migrations to revert")
+		} else {
+			fmt.Fprintln(out, "reverted 1 migration")
+		}
+	case "status":
+		statuses, err := m.Status(ctx)
+		if err != nil {
+			return err
+		}
+		for _, status := range statuses {
+			state := "pending"
+			if status.Applied {
+				state = "applied " + status.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Fprintf(out, "%04d %-40s %s\n", status.Version, status.Name, state)
+		}
+	default:
+		return fmt.Errorf("unknown migrate command %q, expected up, down or status", command)
+	}
+	return nil
+}
@@ -0,0 +1,228 @@
+package server
+
+import (
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// openAPISpec builds an OpenAPI 3 document for routes. Schemas are derived
+// from the request and response types by reflection, following their json
+// tags, so changing a struct changes the document with it.
+func openAPISpec(routes []apiRoute) map[string]interface{} {
+	schemas := map[string]interface{}{}
+	errorRef := schemaRef(reflect.TypeOf(apiError{}), schemas)
+
+	paths := map[string]interface{}{}
+	for _, route := range routes {
+		path := apiPrefix + echoParam.ReplaceAllString(route.Path, "{$1}")
+		item, ok := paths[path].(map[string]interface{})
+		if !ok {
+			item = map[string]interface{}{}
+			paths[path] = item
+		}
+
+		var params []interface{}
+		for _, name := range echoParam.FindAllStringSubmatch(route.Path, -1) {
+			// Path parameters are ids, apart from currency codes
+			paramType := "integer"
+			if name[1] != "id" {
+				paramType = "string"
+			}
+			params = append(params, map[string]interface{}{
+				"name": name[1], "in": "path", "required": true,
+				"schema": map[string]interface{}{"type": paramType},
+			})
+		}
+		if route.Query != nil {
+			// Query parameters are optional and named by query tags
+			t := reflect.TypeOf(route.Query)
+			for i := 0; i < t.NumField(); i++ {
+				name := t.Field(i).Tag.Get("query")
+				if name == "" {
+					continue
+				}
+				params = append(params, map[string]interface{}{
+					"name": name, "in": "query",
+					"schema": schemaRef(t.Field(i).Type, schemas),
+				})
+			}
+		}
+		if route.Header != "" {
+			params = append(params, map[string]interface{}{
+				"name": route.Header, "in": "header",
+				"schema": map[string]interface{}{"type": "string"},
+			})
+		}
+		// csrfProtection checks every request but a GET that comes without
+		// an API key
+		unsafe := route.Method != http.MethodGet
+		if unsafe {
+			params = append(params, map[string]interface{}{
+				"name": "X-CSRF-Token", "in": "header",
+				"description": "The value of the _csrf cookie. Needed with the session cookie, but not with an API key.",
+				"schema":      map[string]interface{}{"type": "string"},
+			})
+		}
+
+		success := map[string]interface{}{"description": http.StatusText(route.Status)}
+		if route.Response != nil {
+			success["content"] = jsonContent(schemaRef(reflect.TypeOf(route.Response), schemas))
+		}
+		if route.Produces != nil {
+			content := map[string]interface{}{}
+			for _, mediaType := range route.Produces {
+				content[mediaType] = map[string]interface{}{
+					"schema": map[string]interface{}{"type": "string", "format": "binary"},
+				}
+			}
+			success["content"] = content
+		}
+		responses := map[string]interface{}{strconv.Itoa(route.Status): success}
+		failures := append([]int{http.StatusInternalServerError}, route.Errors...)
+		if route.Scope != "" {
+			failures = append(failures, http.StatusUnauthorized, http.StatusForbidden)
+		}
+		if unsafe {
+			failures = append(failures, http.StatusForbidden)
+		}
+		for _, status := range failures {
+			description := http.StatusText(status)
+			if unsafe && status == http.StatusForbidden {
+				description += `, or "invalid or missing CSRF token" if X-CSRF-Token is missing or wrong`
+			}
+			responses[strconv.Itoa(status)] = map[string]interface{}{
+				"description": description,
+				"content":     jsonContent(errorRef),
+			}
+		}
+
+		operation := map[string]interface{}{
+			"summary":   route.Summary,
+			"responses": responses,
+		}
+		if params != nil {
+			operation["parameters"] = params
+		}
+		if route.Request != nil {
+			operation["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content":  jsonContent(schemaRef(reflect.TypeOf(route.Request), schemas)),
+			}
+		}
+		if route.Scope != "" {
+			operation["security"] = []interface{}{
+				map[string]interface{}{"session": []string{}},
+				map[string]interface{}{"bearer": []string{}},
+			}
+			description := "API keys need the " + route.Scope + " scope."
+			if route.Roles != nil {
+				description += " Only for roles: " + strings.Join(route.Roles, ", ") + "."
+			}
+			operation["description"] = description
+		}
+		item[strings.ToLower(route.Method)] = operation
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "MiniBank API",
+			"version": "1",
+			"description": "Requests are authenticated with an API key, sent as a bearer token, or the session cookie set by " +
+				"logging in. Requests that use the session cookie with any method but GET must also send the value of " +
+				"the _csrf cookie in the X-CSRF-Token header, or they fail with 403 and the message " +
+				`"invalid or missing CSRF token". Requests with an API key do not.`,
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"securitySchemes": map[string]interface{}{
+				"session": map[string]interface{}{
+					"type": "apiKey", "in": "cookie", "name": "session",
+					"description": "Unsafe requests also need the X-CSRF-Token header.",
+				},
+				"bearer": map[string]interface{}{"type": "http", "scheme": "bearer"},
+			},
+		},
+	}
+}
+
+// echoParam matches a path parameter such as ":id".
+var echoParam = regexp.MustCompile(`:(\w+)`)
+
+func jsonContent(schema interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"application/json": map[string]interface{}{"schema": schema},
+	}
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// schemaRef returns the schema for t, adding named structs to schemas and
+// referring to them by name.
+func schemaRef(t reflect.Type, schemas map[string]interface{}) interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch {
+	case t == timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t.Kind() == reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case t.Kind() == reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case t.Kind() == reflect.Int64:
+		return map[string]interface{}{"type": "integer", "format": "int64"}
+	case t.Kind() >= reflect.Int && t.Kind() <= reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case t.Kind() == reflect.Float32 || t.Kind() == reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case t.Kind() == reflect.Slice || t.Kind() == reflect.Array:
+		return map[string]interface{}{"type": "array", "items": schemaRef(t.Elem(), schemas)}
+	case t.Kind() == reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemaRef(t.Elem(), schemas)}
+	case t.Kind() != reflect.Struct:
+		return map[string]interface{}{}
+	}
+
+	name := strings.ToUpper(t.Name()[:1]) + t.Name()[1:]
+	ref := map[string]interface{}{"$ref": "#/components/schemas/" + name}
+	if _, ok := schemas[name]; ok {
+		return ref
+	}
+	// Reserve the name first so recursive types terminate
+	schemas[name] = nil
+
+	properties := map[string]interface{}{}
+	var required []string
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		fieldName, options, _ := strings.Cut(tag, ",")
+		if fieldName == "" {
+			fieldName = field.Name
+		}
+		properties[fieldName] = schemaRef(field.Type, schemas)
+		if !strings.Contains(options, "omitempty") {
+			required = append(required, fieldName)
+		}
+	}
+
+	schema := map[string]interface{}{"type": "object", "properties": properties}
+	if required != nil {
+		schema["required"] = required
+	}
+	schemas[name] = schema
+	return ref
+}
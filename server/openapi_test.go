@@ -0,0 +1,351 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"minibank/dbutil"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// specChecker checks responses against the server's own OpenAPI document
+// and remembers which operations it has seen.
+type specChecker struct {
+	spec    map[string]interface{}
+	paths   []specPath
+	covered map[string]bool
+}
+
+// specPath is a path of the document with a pattern matching the URL paths
+// it stands for.
+type specPath struct {
+	template string
+	params   int
+	pattern  *regexp.Regexp
+}
+
+var specParam = regexp.MustCompile(`\{\w+\}`)
+
+func newSpecChecker(t *testing.T, tc *testClient) *specChecker {
+	t.Helper()
+	resp := tc.get(t, "/api/openapi.json")
+	body := expectStatus(t, resp, http.StatusOK)
+	sc := &specChecker{covered: make(map[string]bool)}
+	if err := json.Unmarshal([]byte(body), &sc.spec); err != nil {
+		t.Fatalf("decoding OpenAPI document: %v", err)
+	}
+	for template := range sc.spec["paths"].(map[string]interface{}) {
+		// QuoteMeta escapes the braces around parameters
+		pattern := regexp.MustCompile(`\\\{\w+\\\}`).ReplaceAllString(regexp.QuoteMeta(template), `[^/]+`)
+		sc.paths = append(sc.paths, specPath{
+			template: template,
+			params:   len(specParam.FindAllString(template, -1)),
+			pattern:  regexp.MustCompile("^" + pattern + "$"),
+		})
+	}
+	// A literal segment beats a parameter, as in Echo's router
+	sort.Slice(sc.paths, func(i, j int) bool { return sc.paths[i].params < sc.paths[j].params })
+	return sc
+}
+
+// operation returns the operation of the document that serves method and
+// path, and its key for the coverage check.
+func (sc *specChecker) operation(method, path string) (map[string]interface{}, string) {
+	for _, p := range sc.paths {
+		if !p.pattern.MatchString(path) {
+			continue
+		}
+		item := sc.spec["paths"].(map[string]interface{})[p.template].(map[string]interface{})
+		op, _ := item[strings.ToLower(method)].(map[string]interface{})
+		if op != nil {
+			return op, method + " " + p.template
+		}
+	}
+	return nil, ""
+}
+
+// check fails t unless the document lists resp's status for its operation
+// and body, which was read from resp, matches the schema given for it.
+func (sc *specChecker) check(t *testing.T, resp *http.Response, body string) {
+	t.Helper()
+	method, path := resp.Request.Method, resp.Request.URL.Path
+	op, key := sc.operation(method, path)
+	if op == nil {
+		t.Errorf("%s %s is not in the OpenAPI document", method, path)
+		return
+	}
+	sc.covered[key] = true
+
+	responses := op["responses"].(map[string]interface{})
+	documented, ok := responses[fmt.Sprint(resp.StatusCode)].(map[string]interface{})
+	if !ok {
+		t.Errorf("%s: status %d is not documented: %s", key, resp.StatusCode, body)
+		return
+	}
+	content, ok := documented["content"].(map[string]interface{})
+	if !ok {
+		if body != "" {
+			t.Errorf("%s: status %d is documented without a body but has %q", key, resp.StatusCode, body)
+		}
+		return
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	var media map[string]interface{}
+	for documentedType, v := range content {
+		if t, _, _ := mime.ParseMediaType(documentedType); t == mediaType {
+			media, _ = v.(map[string]interface{})
+		}
+	}
+	if media == nil {
+		t.Errorf("%s: status %d has undocumented content type %q", key, resp.StatusCode, mediaType)
+		return
+	}
+	if mediaType != "application/json" {
+		return
+	}
+
+	decoder := json.NewDecoder(strings.NewReader(body))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		t.Errorf("%s: status %d body is not JSON: %v", key, resp.StatusCode, err)
+		return
+	}
+	for _, err := range sc.validate(media["schema"], value, "body") {
+		t.Errorf("%s: status %d: %v", key, resp.StatusCode, err)
+	}
+}
+
+// validate returns how value, found at where, breaks schema. Properties the
+// schema does not list count, so an undocumented field is caught too.
+func (sc *specChecker) validate(schema, value interface{}, where string) []error {
+	s := schema.(map[string]interface{})
+	if ref, ok := s["$ref"].(string); ok {
+		name := strings.TrimPrefix(ref, "#/components/schemas/")
+		s = sc.spec["components"].(map[string]interface{})["schemas"].(map[string]interface{})[name].(map[string]interface{})
+	}
+	wrong := func(want string) []error {
+		return []error{fmt.Errorf("%s is %#v, want %s", where, value, want)}
+	}
+
+	switch s["type"] {
+	case nil:
+		return nil
+	case "object":
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return wrong("an object")
+		}
+		var errs []error
+		required, _ := s["required"].([]interface{})
+		for _, name := range required {
+			if _, ok := object[name.(string)]; !ok {
+				errs = append(errs, fmt.Errorf("%s lacks required %s", where, name))
+			}
+		}
+		properties, _ := s["properties"].(map[string]interface{})
+		for name, v := range object {
+			if property, ok := properties[name]; ok {
+				errs = append(errs, sc.validate(property, v, where+"."+name)...)
+			} else if additional, ok := s["additionalProperties"]; ok {
+				errs = append(errs, sc.validate(additional, v, where+"."+name)...)
+			} else {
+				errs = append(errs, fmt.Errorf("%s has undocumented property %s", where, name))
+			}
+		}
+		return errs
+	case "array":
+		array, ok := value.([]interface{})
+		if !ok {
+			return wrong("an array")
+		}
+		var errs []error
+		for i, v := range array {
+			errs = append(errs, sc.validate(s["items"], v, fmt.Sprintf("%s[%d]", where, i))...)
+		}
+		return errs
+	case "string":
+		str, ok := value.(string)
+		if !ok {
+			return wrong("a string")
+		}
+		if s["format"] == "date-time" {
+			if _, err := time.Parse(time.RFC3339Nano, str); err != nil {
+				return wrong("a date-time")
+			}
+		}
+	case "integer":
+		n, ok := value.(json.Number)
+		if _, err := n.Int64(); !ok || err != nil {
+			return wrong("an integer")
+		}
+	case "number":
+		if _, ok := value.(json.Number); !ok {
+			return wrong("a number")
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return wrong("a boolean")
+		}
+	}
+	return nil
+}
+
+// TestOpenAPIResponses calls every operation of the API, through sessions
+// and API keys, on success and failure, and checks each response against
+// the OpenAPI document.
+func TestOpenAPIResponses(t *testing.T) {
+	ts := newTestServer(t, nil)
+	alice, aliceAccount := ts.customer(t, "alice@example.com", dbutil.RoleCustomer, "AUD")
+	bob, bobAccount := ts.customer(t, "bob@example.com", dbutil.RoleCustomer, "AUD")
+	ts.customer(t, "admin@example.com", dbutil.RoleAdmin, "AUD")
+
+	anonymous := ts.client(t)
+	sc := newSpecChecker(t, anonymous)
+
+	// call sends body, if not nil, as JSON and checks the response against
+	// want and the document. It returns the decoded JSON body, if any.
+	call := func(tc *testClient, method, path string, body interface{}, want int, header ...string) map[string]interface{} {
+		t.Helper()
+		var resp *http.Response
+		if body != nil {
+			resp = tc.doJSON(t, method, path, body, header...)
+		} else {
+			resp = tc.do(t, method, path, "", nil, header...)
+		}
+		data := expectStatus(t, resp, want)
+		sc.check(t, resp, data)
+		var decoded map[string]interface{}
+		json.Unmarshal([]byte(data), &decoded)
+		return decoded
+	}
+	id := func(v interface{}) int {
+		n, _ := v.(float64)
+		return int(n)
+	}
+	v1 := func(format string, args ...interface{}) string {
+		return apiPrefix + fmt.Sprintf(format, args...)
+	}
+
+	// Public routes
+	call(anonymous, http.MethodGet, v1("/sessions/current"), nil, http.StatusUnauthorized)
+	call(anonymous, http.MethodPost, v1("/customers"), createCustomerRequest{
+		FirstName: "Carol", LastName: "Example", Email: "carol@example.com", PhoneNumber: "0412345678", Password: testPassword,
+	}, http.StatusForbidden, "X-CSRF-Token", "")
+	call(ts.client(t), http.MethodPost, v1("/customers"), createCustomerRequest{
+		FirstName: "Carol", LastName: "Example", Email: "carol@example.com", PhoneNumber: "0412345678", Password: testPassword,
+	}, http.StatusCreated)
+	call(ts.client(t), http.MethodPost, v1("/customers"), createCustomerRequest{
+		FirstName: "Carol", LastName: "Example", Email: "carol@example.com", PhoneNumber: "0412345679", Password: testPassword,
+	}, http.StatusConflict)
+	call(anonymous, http.MethodPost, v1("/email-verifications"), confirmEmailRequest{Token: "wrong"}, http.StatusBadRequest)
+	call(anonymous, http.MethodPost, v1("/password-resets"), createPasswordResetRequest{Email: bob.Email}, http.StatusAccepted)
+	call(anonymous, http.MethodPost, v1("/password-resets/confirm"), confirmPasswordResetRequest{Token: "wrong", Password: testPassword}, http.StatusBadRequest)
+
+	// A customer's own session
+	session := ts.client(t)
+	call(session, http.MethodPost, v1("/sessions"), createSessionRequest{Email: alice.Email, Password: testPassword}, http.StatusCreated)
+	call(session, http.MethodGet, v1("/sessions/current"), nil, http.StatusOK)
+	call(session, http.MethodGet, v1("/sessions"), nil, http.StatusNotImplemented)
+	call(session, http.MethodDelete, v1("/sessions/abc"), nil, http.StatusNotImplemented)
+	call(session, http.MethodGet, v1("/customers/me"), nil, http.StatusOK)
+	call(session, http.MethodGet, v1("/customers/%d", alice.Id), nil, http.StatusOK)
+	call(session, http.MethodGet, v1("/customers/%d", bob.Id), nil, http.StatusForbidden)
+	call(session, http.MethodPost, v1("/customers/me/verification-email"), struct{}{}, http.StatusConflict)
+	call(session, http.MethodPut, v1("/customers/%d/role", bob.Id), setRoleRequest{Role: dbutil.RoleAdmin}, http.StatusForbidden)
+	call(session, http.MethodGet, v1("/accounts"), nil, http.StatusForbidden)
+	call(session, http.MethodPost, v1("/accounts"), openAccountRequest{Type: dbutil.AccountSavings, Currency: "AUD"}, http.StatusCreated)
+	call(session, http.MethodGet, v1("/accounts/%d", aliceAccount.Id), nil, http.StatusOK)
+	call(session, http.MethodGet, v1("/accounts/%d", bobAccount.Id), nil, http.StatusForbidden)
+	call(session, http.MethodGet, v1("/accounts/999999"), nil, http.StatusNotFound)
+	call(session, http.MethodGet, v1("/accounts/%d/statement?format=csv", aliceAccount.Id), nil, http.StatusOK)
+	call(session, http.MethodGet, v1("/accounts/%d/statement?format=doc", aliceAccount.Id), nil, http.StatusBadRequest)
+
+	transfer := call(session, http.MethodPost, v1("/transfers"), createTransferRequest{Recipient: bob.Email, Amount: "25.00"}, http.StatusCreated)
+	call(session, http.MethodPost, v1("/transfers"), createTransferRequest{Recipient: alice.Email, Amount: "25.00"}, http.StatusBadRequest)
+	call(session, http.MethodPost, v1("/transfers"), createTransferRequest{Recipient: bob.Email, Amount: "100000.00"}, http.StatusForbidden)
+	call(session, http.MethodPost, v1("/transfers"), createTransferRequest{Recipient: bob.Email, Amount: "100000.00", StepUp: testPassword}, http.StatusUnprocessableEntity)
+	captured := call(session, http.MethodPost, v1("/transfers"), createTransferRequest{Recipient: bob.Email, Amount: "5.00", Authorize: true}, http.StatusCreated)
+	voided := call(session, http.MethodPost, v1("/transfers"), createTransferRequest{Recipient: bob.Email, Amount: "6.00", Authorize: true}, http.StatusCreated)
+	call(session, http.MethodPost, v1("/transactions/%d/void", id(voided["id"])), struct{}{}, http.StatusOK)
+	call(session, http.MethodPost, v1("/transactions/%d/void", id(voided["id"])), struct{}{}, http.StatusConflict)
+	call(session, http.MethodGet, v1("/transactions"), nil, http.StatusOK)
+	call(session, http.MethodGet, v1("/transactions?sort=sideways"), nil, http.StatusBadRequest)
+	call(session, http.MethodGet, v1("/transactions/%d", id(transfer["id"])), nil, http.StatusOK)
+	call(session, http.MethodGet, v1("/transactions/999999"), nil, http.StatusNotFound)
+	call(session, http.MethodGet, v1("/transactions/%d/refunds", id(transfer["id"])), nil, http.StatusOK)
+	call(session, http.MethodPost, v1("/transactions/%d/refunds", id(transfer["id"])), createRefundRequest{Amount: "5.00"}, http.StatusForbidden)
+
+	call(session, http.MethodPost, v1("/bulk-payments"), bulkPaymentRequest{CSV: "bob@example.com,1.00\nnobody@example.com,2.00\n"}, http.StatusOK)
+	call(session, http.MethodPost, v1("/bulk-payments"), bulkPaymentRequest{CSV: ""}, http.StatusBadRequest)
+
+	start := time.Now().Add(24 * time.Hour).UTC()
+	schedule := call(session, http.MethodPost, v1("/scheduled-payments"), createScheduledPaymentRequest{
+		Recipient: bob.Email, Amount: "3.00", Frequency: dbutil.FrequencyWeekly, StartAt: &start,
+	}, http.StatusCreated)
+	call(session, http.MethodPost, v1("/scheduled-payments"), createScheduledPaymentRequest{
+		Recipient: bob.Email, Amount: "3.00", Frequency: "fortnightly",
+	}, http.StatusBadRequest)
+	call(session, http.MethodGet, v1("/scheduled-payments"), nil, http.StatusOK)
+	call(session, http.MethodGet, v1("/scheduled-payments/%d", id(schedule["id"])), nil, http.StatusOK)
+	call(session, http.MethodDelete, v1("/scheduled-payments/%d", id(schedule["id"])), nil, http.StatusNoContent)
+	call(session, http.MethodGet, v1("/scheduled-payments/999999"), nil, http.StatusNotFound)
+
+	call(session, http.MethodGet, v1("/fx-rates"), nil, http.StatusOK)
+	call(session, http.MethodPut, v1("/fx-rates/AUD/USD"), setExchangeRateRequest{Rate: "0.65", FeeBasisPoints: 50}, http.StatusForbidden)
+
+	key := call(session, http.MethodPost, v1("/api-keys"), createAPIKeyRequest{Name: "reports", Scopes: []string{dbutil.ScopeRead}}, http.StatusCreated)
+	call(session, http.MethodPost, v1("/api-keys"), createAPIKeyRequest{Name: "bad", Scopes: []string{"everything"}}, http.StatusBadRequest)
+	call(session, http.MethodGet, v1("/api-keys"), nil, http.StatusOK)
+
+	// The key reads but cannot pay, and needs no CSRF token
+	bearer := ts.client(t)
+	auth := "Bearer " + key["token"].(string)
+	call(bearer, http.MethodGet, v1("/customers/me"), nil, http.StatusOK, "Authorization", auth)
+	call(bearer, http.MethodPost, v1("/transfers"), createTransferRequest{Recipient: bob.Email, Amount: "1.00"}, http.StatusForbidden,
+		"Authorization", auth, "X-CSRF-Token", "")
+	call(bearer, http.MethodGet, v1("/customers/me"), nil, http.StatusUnauthorized, "Authorization", "Bearer wrong")
+	call(session, http.MethodDelete, v1("/api-keys/%d", id(key["id"])), nil, http.StatusNoContent)
+	call(session, http.MethodDelete, v1("/api-keys/%d", id(key["id"])), nil, http.StatusNotFound)
+
+	// The payee captures the hold and refunds
+	payee := ts.client(t)
+	call(payee, http.MethodPost, v1("/sessions"), createSessionRequest{Email: bob.Email, Password: testPassword}, http.StatusCreated)
+	call(payee, http.MethodPost, v1("/transactions/%d/capture", id(captured["id"])), struct{}{}, http.StatusOK)
+	call(payee, http.MethodPost, v1("/transactions/%d/refunds", id(transfer["id"])), createRefundRequest{Amount: "5.00"}, http.StatusCreated)
+	call(payee, http.MethodPost, v1("/transactions/%d/refunds", id(transfer["id"])), createRefundRequest{Amount: "50.00"}, http.StatusUnprocessableEntity)
+
+	// Staff routes
+	admin := ts.client(t)
+	call(admin, http.MethodPost, v1("/sessions"), createSessionRequest{Email: "admin@example.com", Password: testPassword}, http.StatusCreated)
+	call(admin, http.MethodGet, v1("/accounts"), nil, http.StatusOK)
+	call(admin, http.MethodGet, v1("/customers/%d", bob.Id), nil, http.StatusOK)
+	call(admin, http.MethodPut, v1("/customers/%d/role", bob.Id), setRoleRequest{Role: dbutil.RoleTeller}, http.StatusOK)
+	call(admin, http.MethodPut, v1("/customers/%d/role", bob.Id), setRoleRequest{Role: "owner"}, http.StatusBadRequest)
+	call(admin, http.MethodPost, v1("/customers/%d/unlock", bob.Id), struct{}{}, http.StatusNoContent)
+	call(admin, http.MethodPut, v1("/accounts/%d/status", bobAccount.Id), setStatusRequest{Status: dbutil.StatusFrozen, Reason: "test"}, http.StatusOK)
+	call(admin, http.MethodPut, v1("/accounts/%d/status", bobAccount.Id), setStatusRequest{Status: "gone"}, http.StatusBadRequest)
+	call(admin, http.MethodPut, v1("/fx-rates/AUD/USD"), setExchangeRateRequest{Rate: "0.65", FeeBasisPoints: 50}, http.StatusOK)
+	call(admin, http.MethodPut, v1("/fx-rates/AUD/XXX"), setExchangeRateRequest{Rate: "0.65"}, http.StatusBadRequest)
+
+	// Logging out, and a failed login last of all, since it slows down
+	// logins from the same address
+	call(admin, http.MethodDelete, v1("/sessions"), nil, http.StatusNotImplemented)
+	call(session, http.MethodDelete, v1("/sessions/current"), nil, http.StatusNoContent)
+	call(session, http.MethodGet, v1("/accounts"), nil, http.StatusUnauthorized)
+	call(anonymous, http.MethodPost, v1("/sessions"), createSessionRequest{Email: alice.Email, Password: "wrong"}, http.StatusUnauthorized)
+
+	for _, p := range sc.paths {
+		item := sc.spec["paths"].(map[string]interface{})[p.template].(map[string]interface{})
+		for method := range item {
+			if key := strings.ToUpper(method) + " " + p.template; !sc.covered[key] {
+				t.Errorf("%s was not called", key)
+			}
+		}
+	}
+}
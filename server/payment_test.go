@@ -0,0 +1,86 @@
+package server
+
+import (
+	"fmt"
+	"math/rand"
+	"minibank/dbutil"
+	"minibank/dbutil/dbtest"
+	"net/http"
+	"net/url"
+	"sync"
+	"testing"
+)
+
+// TestPaymentsConcurrent has customers pay each other through POST /payment
+// from many sessions at once, spending more than they have between them.
+// Whatever order the payments land in, no money may appear or disappear,
+// no balance may go negative and the ledger must balance.
+func TestPaymentsConcurrent(t *testing.T) {
+	ts := newTestServer(t, nil)
+
+	const customers, sessions, payments = 4, 3, 15
+	var emails []string
+	var accounts []*dbutil.Account
+	for i := 0; i < customers; i++ {
+		email := fmt.Sprintf("customer%d@example.com", i)
+		_, account := ts.customer(t, email, dbutil.RoleCustomer, "AUD")
+		emails = append(emails, email)
+		accounts = append(accounts, account)
+	}
+	total := dbtest.Total(t, ts.db, "AUD")
+
+	var clients [][]*testClient
+	for i := range emails {
+		var own []*testClient
+		for j := 0; j < sessions; j++ {
+			own = append(own, ts.login(t, emails[i]))
+		}
+		clients = append(clients, own)
+	}
+
+	// Payments of 150.00 to 450.00 from a 1000.00 balance, paid from several
+	// sessions at once, soon run some customers out of money while more
+	// is coming in
+	var mu sync.Mutex
+	statuses := make(map[int]int)
+	var wg sync.WaitGroup
+	for i := range clients {
+		for j, tc := range clients[i] {
+			wg.Add(1)
+			go func(i, j int, tc *testClient) {
+				defer wg.Done()
+				r := rand.New(rand.NewSource(int64(i*sessions + j)))
+				for k := 0; k < payments; k++ {
+					to := (i + 1 + r.Intn(customers-1)) % customers
+					amount := fmt.Sprintf("%d.%02d", 150+r.Intn(300), r.Intn(100))
+					resp := tc.postForm(t, "/payment", url.Values{
+						"from_account": {fmt.Sprint(accounts[i].Id)},
+						"recipient":    {emails[to]},
+						"amount":       {amount},
+					})
+					body := readBody(t, resp)
+					if resp.StatusCode != http.StatusSeeOther && resp.StatusCode != http.StatusBadRequest {
+						t.Errorf("payment of %s: status %d: %s", amount, resp.StatusCode, body)
+					}
+					mu.Lock()
+					statuses[resp.StatusCode]++
+					mu.Unlock()
+				}
+			}(i, j, tc)
+		}
+	}
+	wg.Wait()
+
+	if statuses[http.StatusSeeOther] == 0 || statuses[http.StatusBadRequest] == 0 {
+		t.Errorf("statuses = %v, want both payments made and payments refused", statuses)
+	}
+	if got := dbtest.Total(t, ts.db, "AUD"); got != total {
+		t.Errorf("total = %v, want %v", got, total)
+	}
+	for _, account := range accounts {
+		if balance := ts.balance(t, account.Id); balance.IsNegative() {
+			t.Errorf("account %d balance = %v", account.Id, balance)
+		}
+	}
+	dbtest.CheckLedger(t, ts.db)
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"minibank/dbutil"
+)
+
+// The policy functions decide what the logged-in customer may see or do.
+// Every handler that touches another customer's data must ask one of them.
+
+// isStaff reports whether customer works for the bank.
+func isStaff(customer *dbutil.Customer) bool {
+	return customer.Role == dbutil.RoleTeller || customer.Role == dbutil.RoleAdmin
+}
+
+func canListAccounts(actor *dbutil.Customer) bool {
+	return isStaff(actor)
+}
+
+func canViewCustomer(actor *dbutil.Customer, customerID int) bool {
+	return actor.Id == customerID || isStaff(actor)
+}
+
+func canViewAccount(actor *dbutil.Customer, account *dbutil.Account) bool {
+	return canViewCustomer(actor, account.Customer_id)
+}
+
+func canViewTransaction(actor *dbutil.Customer, from, to *dbutil.Account) bool {
+	return canViewAccount(actor, from) || canViewAccount(actor, to)
+}
+
+// canCaptureHold reports whether actor may capture a pending hold from one
+// account to another, which is for the payee to do.
+func canCaptureHold(actor *dbutil.Customer, from, to *dbutil.Account) bool {
+	return actor.Id == to.Customer_id
+}
+
+// canVoidHold reports whether actor may void a pending hold, which either
+// side may do.
+func canVoidHold(actor *dbutil.Customer, from, to *dbutil.Account) bool {
+	return actor.Id == from.Customer_id || actor.Id == to.Customer_id
+}
+
+// canReverseTransaction reports whether actor may refund a payment from one
+// account to another: the payee may give money back, and an admin may undo
+// any payment.
+func canReverseTransaction(actor *dbutil.Customer, from, to *dbutil.Account) bool {
+	return actor.Id == to.Customer_id || actor.Role == dbutil.RoleAdmin
+}
+
+// canUseAccount reports whether actor may move money out of account, which
+// only its owner may do.
+func canUseAccount(actor *dbutil.Customer, account *dbutil.Account) bool {
+	return actor.Id == account.Customer_id
+}
+
+func canCloseAccount(actor *dbutil.Customer, account *dbutil.Account) bool {
+	return actor.Id == account.Customer_id || actor.Role == dbutil.RoleAdmin
+}
+
+// canChangeStatus reports whether actor may freeze, unfreeze or close any
+// account.
+func canChangeStatus(actor *dbutil.Customer) bool {
+	return actor.Role == dbutil.RoleAdmin
+}
+
+func canSetRole(actor *dbutil.Customer) bool {
+	return actor.Role == dbutil.RoleAdmin
+}
+
+func canUnlockCustomer(actor *dbutil.Customer) bool {
+	return actor.Role == dbutil.RoleAdmin
+}
+
+func canSetExchangeRates(actor *dbutil.Customer) bool {
+	return actor.Role == dbutil.RoleAdmin
+}
+
+// canSendPayments reports whether actor may move money out of their
+// accounts, which needs a confirmed email address.
+func canSendPayments(actor *dbutil.Customer) bool {
+	return actor.EmailVerified()
+}
+
+// needsPaymentChecks reports whether a payment from sender to the account to
+// needs a confirmed email address and, if it is large, step-up. Moving
+// money between one's own accounts needs neither, since none of it leaves
+// the customer.
+func needsPaymentChecks(sender *dbutil.Customer, to *dbutil.Account) bool {
+	return to.Customer_id != sender.Id
+}
@@ -0,0 +1,214 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"minibank/dbutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// createRefundRequest refunds Amount, a decimal string in the currency the
+// payment was received in, of a transfer. Refunding everything that was
+// received reverses the payment, and a converted payment's fee is refunded
+// in proportion. Retries should send the same Idempotency-Key header.
+type createRefundRequest struct {
+	Amount string `json:"amount"`
+}
+
+// refundTransaction refunds amount, as entered, of the transaction with the
+// given id on behalf of actor and returns the refund. Reasons the refund
+// cannot be made are returned as a *requestError.
+func refundTransaction(ctx context.Context, db dbutil.Database, actor *dbutil.Customer, id int, amount string, key dbutil.IdempotencyKey, ip string) (*dbutil.Transaction, error) {
+	original, err := db.GetTransaction(ctx, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, &requestError{http.StatusNotFound, "transaction_not_found", "Transaction not found"}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error fetching transaction: %w", err)
+	}
+	from, err := db.GetAccount(ctx, original.FromAccount)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching paying account: %w", err)
+	}
+	to, err := db.GetAccount(ctx, original.ToAccount)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching receiving account: %w", err)
+	}
+
+	if !canViewTransaction(actor, from, to) {
+		return nil, &requestError{http.StatusNotFound, "transaction_not_found", "Transaction not found"}
+	}
+	if !canReverseTransaction(actor, from, to) {
+		return nil, &requestError{http.StatusForbidden, "forbidden", "Only the payee or an administrator can refund a payment"}
+	}
+	if !original.Refundable() {
+		return nil, &requestError{http.StatusConflict, "not_refundable", "Only completed transfers can be refunded"}
+	}
+
+	currency := original.DestinationAmount.Currency
+	refundAmount, err := dbutil.ParseMoney(amount, currency)
+	if err != nil || !refundAmount.IsPositive() {
+		return nil, &requestError{http.StatusBadRequest, "invalid_amount", fmt.Sprintf("Amount must be a positive number of %s with at most %d decimal places", currency, dbutil.Exponent(currency))}
+	}
+
+	refundID, err := db.Reverse(ctx, id, refundAmount, key)
+	if errors.Is(err, dbutil.ErrRefundTooLarge) {
+		return nil, &requestError{http.StatusUnprocessableEntity, "refund_too_large", "The refunds would add up to more than was paid"}
+	}
+	if errors.Is(err, dbutil.ErrInsufficientFunds) {
+		return nil, &requestError{http.StatusUnprocessableEntity, "insufficient_funds", "The receiving account does not have enough available to refund"}
+	}
+	if errors.Is(err, dbutil.ErrAccountFrozen) || errors.Is(err, dbutil.ErrAccountClosed) {
+		return nil, &requestError{http.StatusUnprocessableEntity, "account_unavailable", "One of the accounts is frozen or closed"}
+	}
+	if errors.Is(err, dbutil.ErrIdempotencyKeyReused) {
+		return nil, &requestError{http.StatusUnprocessableEntity, "idempotency_key_reused", "Idempotency key already used for a different payment"}
+	}
+	if errors.Is(err, dbutil.ErrNotRefundable) {
+		return nil, &requestError{http.StatusConflict, "not_refundable", "Only completed transfers can be refunded"}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error refunding transaction %d: %w", id, err)
+	}
+
+	refund, err := db.GetTransaction(ctx, refundID)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching refund: %w", err)
+	}
+
+	err = db.CreateAuditEvent(ctx, &dbutil.AuditEvent{
+		CustomerId: to.Customer_id,
+		AccountId:  to.Id,
+		ActorId:    actor.Id,
+		Event:      dbutil.AuditTransactionReversed,
+		Detail:     fmt.Sprintf("refunded %s %s of transaction %d as transaction %d", refund.Amount, refund.Amount.Currency, id, refund.Id),
+		IP:         ip,
+		CreatedAt:  time.Now(),
+	})
+	if err != nil {
+		log.Println("Error writing audit event:", err)
+	}
+	return refund, nil
+}
+
+// refundedSoFar returns the refunds of transaction and what they add up to,
+// in the currency it was received in.
+func refundedSoFar(ctx context.Context, db dbutil.Database, transaction *dbutil.Transaction) ([]dbutil.Transaction, dbutil.Money, error) {
+	refunded := dbutil.NewMoney(0, transaction.DestinationAmount.Currency)
+	refunds, err := db.ListReversals(ctx, transaction.Id)
+	if err != nil {
+		return nil, refunded, err
+	}
+	for _, refund := range refunds {
+		refunded = refunded.Add(refund.Amount)
+	}
+	return refunds, refunded, nil
+}
+
+func refundTransactionHandler(db dbutil.Database, cfg Config, c echo.Context) error {
+	ctx := c.Request().Context()
+
+	id, err := strconv.Atoi(c.Param("transaction_id"))
+	if err != nil {
+		return c.String(http.StatusBadRequest, "Invalid transaction ID")
+	}
+
+	key := dbutil.IdempotencyKey{
+		Key:       c.FormValue("idempotency_key"),
+		ExpiresAt: time.Now().Add(cfg.IdempotencyWindow),
+	}
+	_, err = refundTransaction(ctx, db, currentCustomer(c), id, c.FormValue("amount"), key, c.RealIP())
+	var refundErr *requestError
+	if errors.As(err, &refundErr) {
+		if refundErr.status == http.StatusNotFound {
+			return c.String(http.StatusNotFound, "Transaction not found")
+		}
+		return renderSingleTransaction(db, c, id, refundErr.status, refundErr.message)
+	}
+	if err != nil {
+		log.Println("Error refunding transaction:", err)
+		return c.String(http.StatusInternalServerError, "Error refunding transaction")
+	}
+	return c.Redirect(http.StatusSeeOther, "/single-transaction/"+strconv.Itoa(id))
+}
+
+func apiRefundTransactionHandler(db dbutil.Database, cfg Config, c echo.Context) error {
+	ctx := c.Request().Context()
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return apiFail(c, http.StatusBadRequest, "invalid_id", "Transaction ID must be a number")
+	}
+	var req createRefundRequest
+	if err := c.Bind(&req); err != nil {
+		return apiFail(c, http.StatusBadRequest, "invalid_request", "Request body is not valid JSON")
+	}
+	if req.Amount == "" {
+		return apiFail(c, http.StatusBadRequest, "missing_fields", "Please provide amount")
+	}
+
+	key := dbutil.IdempotencyKey{
+		Key:       c.Request().Header.Get("Idempotency-Key"),
+		ExpiresAt: time.Now().Add(cfg.IdempotencyWindow),
+	}
+	refund, err := refundTransaction(ctx, db, currentCustomer(c), id, req.Amount, key, c.RealIP())
+	var refundErr *requestError
+	if errors.As(err, &refundErr) {
+		return apiFail(c, refundErr.status, refundErr.code, refundErr.message)
+	}
+	if err != nil {
+		log.Println("Error refunding transaction:", err)
+		return apiFail(c, http.StatusInternalServerError, "internal_error", "Error refunding transaction")
+	}
+	c.Response().Header().Set("Location", apiPrefix+"/transactions/"+strconv.Itoa(refund.Id))
+	return c.JSON(http.StatusCreated, newTransactionResponse(refund))
+}
+
+func apiTransactionRefundsHandler(db dbutil.Database, c echo.Context) error {
+	ctx := c.Request().Context()
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return apiFail(c, http.StatusBadRequest, "invalid_id", "Transaction ID must be a number")
+	}
+
+	transaction, err := db.GetTransaction(ctx, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return apiFail(c, http.StatusNotFound, "transaction_not_found", "Transaction not found")
+	}
+	if err != nil {
+		log.Printf("Error fetching transaction %d: %v", id, err)
+		return apiFail(c, http.StatusInternalServerError, "internal_error", "Error fetching transaction")
+	}
+	from, err := db.GetAccount(ctx, transaction.FromAccount)
+	if err != nil {
+		log.Printf("Error fetching account %d: %v", transaction.FromAccount, err)
+		return apiFail(c, http.StatusInternalServerError, "internal_error", "Error fetching transaction")
+	}
+	to, err := db.GetAccount(ctx, transaction.ToAccount)
+	if err != nil {
+		log.Printf("Error fetching account %d: %v", transaction.ToAccount, err)
+		return apiFail(c, http.StatusInternalServerError, "internal_error", "Error fetching transaction")
+	}
+	if !canViewTransaction(currentCustomer(c), from, to) {
+		return apiFail(c, http.StatusNotFound, "transaction_not_found", "Transaction not found")
+	}
+
+	refunds, err := db.ListReversals(ctx, id)
+	if err != nil {
+		log.Printf("Error listing refunds of transaction %d: %v", id, err)
+		return apiFail(c, http.StatusInternalServerError, "internal_error", "Error listing refunds")
+	}
+	res := transactionListResponse{Transactions: make([]transactionResponse, 0, len(refunds))}
+	for i := range refunds {
+		res.Transactions = append(res.Transactions, newTransactionResponse(&refunds[i]))
+	}
+	return c.JSON(http.StatusOK, res)
+}
@@ -0,0 +1,26 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"minibank/dbutil"
+	"strings"
+)
+
+// SetRole runs the "role" command, which gives the customer with email one of
+// the customer roles. It is how the first admin is appointed; after that
+// admins can change roles through the API.
+func SetRole(ctx context.Context, email, role string) error {
+	if !dbutil.ValidRole(role) {
+		return fmt.Errorf("unknown role %q, expected one of %s", role, strings.Join(dbutil.Roles, ", "))
+	}
+
+	cfg := LoadConfig()
+	db := openDatabase(cfg.DatabaseURL)
+
+	customer, err := db.GetCustomerByEmail(ctx, email)
+	if err != nil {
+		return err
+	}
+	return db.SetCustomerRole(ctx, customer.Id, role)
+}
@@ -0,0 +1,456 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"minibank/cron"
+	"minibank/dbutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// scheduleFormTime is the format of the date and time inputs on the
+// scheduled payments page, which are in UTC.
+const scheduleFormTime = "2006-01-02T15:04"
+
+// createScheduledPaymentRequest schedules a payment of Amount, a decimal
+// string in the paying account's currency, from FromAccount, or the
+// primary account if it is 0, to Recipient or ToAccount as for a transfer.
+//
+// Frequency is "once", "weekly", "monthly" or "cron". The first payment is
+// made at StartAt, or straight away if it is not given. Weekly payments then
+// repeat every seven days and monthly ones on the same day of each month, or
+// its last day if shorter. A cron payment is made whenever Rule, a
+// five-field cron expression such as "0 9 1 * *" evaluated in UTC, fires
+// from StartAt on. Repeating payments stop after EndAt, if given.
+//
+// StepUp confirms, as for a transfer, a schedule paying another customer
+// more than the step-up threshold each time.
+type createScheduledPaymentRequest struct {
+	FromAccount int        `json:"from_account,omitempty"`
+	Recipient   string     `json:"recipient,omitempty"`
+	ToAccount   int        `json:"to_account,omitempty"`
+	Amount      string     `json:"amount"`
+	Frequency   string     `json:"frequency"`
+	Rule        string     `json:"rule,omitempty"`
+	StartAt     *time.Time `json:"start_at,omitempty"`
+	EndAt       *time.Time `json:"end_at,omitempty"`
+	StepUp      string     `json:"step_up,omitempty"`
+}
+
+type scheduledPaymentResponse struct {
+	ID          int          `json:"id"`
+	FromAccount int          `json:"from_account"`
+	ToAccount   int          `json:"to_account"`
+	Amount      dbutil.Money `json:"amount"`
+	Frequency   string       `json:"frequency"`
+	Rule        string       `json:"rule,omitempty"`
+	StartAt     time.Time    `json:"start_at"`
+	EndAt       *time.Time   `json:"end_at,omitempty"`
+	Status      string       `json:"status"`
+	// NextRunAt is when the payment will next be tried, for active
+	// payments: its next due date or, after a failed attempt, the retry.
+	NextRunAt   *time.Time `json:"next_run_at,omitempty"`
+	Occurrences int        `json:"occurrences"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	// Runs is the payment's history, most recent first. It is only
+	// included when a single payment is fetched.
+	Runs []scheduledPaymentRunResponse `json:"runs,omitempty"`
+}
+
+type scheduledPaymentRunResponse struct {
+	DueAt         time.Time `json:"due_at"`
+	Attempt       int       `json:"attempt"`
+	Status        string    `json:"status"`
+	TransactionID int       `json:"transaction_id,omitempty"`
+	Error         string    `json:"error,omitempty"`
+	RanAt         time.Time `json:"ran_at"`
+}
+
+func newScheduledPaymentResponse(p *dbutil.ScheduledPayment, runs []dbutil.ScheduledPaymentRun) scheduledPaymentResponse {
+	res := scheduledPaymentResponse{
+		ID:          p.Id,
+		FromAccount: p.FromAccount,
+		ToAccount:   p.ToAccount,
+		Amount:      p.Amount,
+		Frequency:   p.Frequency,
+		Rule:        p.Rule,
+		StartAt:     p.StartAt,
+		EndAt:       p.EndAt,
+		Status:      p.Status,
+		Occurrences: p.Occurrences,
+		CreatedAt:   p.CreatedAt,
+		UpdatedAt:   p.UpdatedAt,
+	}
+	if p.Active() {
+		res.NextRunAt = &p.AttemptAt
+	}
+	for _, run := range runs {
+		res.Runs = append(res.Runs, scheduledPaymentRunResponse{
+			DueAt:         run.DueAt,
+			Attempt:       run.Attempt,
+			Status:        run.Status,
+			TransactionID: run.TransactionId,
+			Error:         run.Error,
+			RanAt:         run.RanAt,
+		})
+	}
+	return res
+}
+
+type scheduledPaymentListResponse struct {
+	ScheduledPayments []scheduledPaymentResponse `json:"scheduled_payments"`
+}
+
+// newScheduledPayment validates the timing of a payment from one account to
+// another and returns it ready to be stored, active and due at its first
+// occurrence. A missing start means now.
+func newScheduledPayment(customerID int, from, to *dbutil.Account, amount dbutil.Money, frequency, rule string, startAt, endAt *time.Time, now time.Time) (*dbutil.ScheduledPayment, error) {
+	if !dbutil.ValidFrequency(frequency) {
+		return nil, badRequest("invalid_frequency", "Frequency must be one of: "+strings.Join(dbutil.Frequencies, ", "))
+	}
+	rule = strings.TrimSpace(rule)
+	if frequency == dbutil.FrequencyCron {
+		if _, err := cron.Parse(rule); err != nil {
+			return nil, badRequest("invalid_rule", "Rule must be a cron expression with five fields, such as \"0 9 1 * *\"")
+		}
+	} else {
+		rule = ""
+	}
+
+	start := now
+	if startAt != nil {
+		start = *startAt
+	}
+	// Leave a minute's grace for forms filled in to the minute
+	if start.Before(now.Add(-time.Minute)) {
+		return nil, badRequest("invalid_start", "The first payment cannot be in the past")
+	}
+	if frequency == dbutil.FrequencyOnce {
+		endAt = nil
+	}
+	if endAt != nil && endAt.Before(start) {
+		return nil, badRequest("invalid_end", "The end date must be after the first payment")
+	}
+
+	p := &dbutil.ScheduledPayment{
+		CustomerId:  customerID,
+		FromAccount: from.Id,
+		ToAccount:   to.Id,
+		Amount:      amount,
+		Frequency:   frequency,
+		Rule:        rule,
+		StartAt:     start.UTC(),
+		Status:      dbutil.ScheduleActive,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	if endAt != nil {
+		end := endAt.UTC()
+		p.EndAt = &end
+	}
+	first, ok := p.FirstDue()
+	if !ok {
+		return nil, badRequest("never_due", "This schedule would never make a payment")
+	}
+	p.DueAt = first
+	p.AttemptAt = first
+	return p, nil
+}
+
+// schedulePayment checks and stores a payment the logged-in customer wants
+// to schedule. The recipient is resolved now, so later payments go to the
+// same account even if the recipient's primary account changes. Reasons to
+// refuse the payment are returned as a *requestError.
+func schedulePayment(ctx context.Context, db dbutil.Database, cfg Config, c echo.Context, req createScheduledPaymentRequest) (*dbutil.ScheduledPayment, error) {
+	if (req.Recipient == "" && req.ToAccount == 0) || req.Amount == "" || req.Frequency == "" {
+		return nil, badRequest("missing_fields", "Please provide recipient or to_account, amount and frequency")
+	}
+	if req.Recipient != "" && req.ToAccount != 0 {
+		return nil, badRequest("invalid_recipient", "Give either recipient or to_account, not both")
+	}
+
+	customer := currentCustomer(c)
+	from := primaryAccount(currentAccounts(c))
+	if req.FromAccount != 0 {
+		from = findAccount(currentAccounts(c), req.FromAccount)
+	}
+	if from == nil {
+		return nil, badRequest("invalid_from_account", "from_account must be one of your accounts")
+	}
+	if from.CheckActive() != nil {
+		return nil, &requestError{status: http.StatusForbidden, code: "account_frozen", message: "This account is frozen or closed and cannot send payments"}
+	}
+	amount, err := dbutil.ParseMoney(req.Amount, from.Currency())
+	if err != nil || !amount.IsPositive() {
+		return nil, badRequest("invalid_amount", fmt.Sprintf("Amount must be a positive number with at most %d decimal places", dbutil.Exponent(from.Currency())))
+	}
+
+	var to *dbutil.Account
+	if req.ToAccount != 0 {
+		to = findAccount(currentAccounts(c), req.ToAccount)
+		if to == nil || to.Id == from.Id || to.Closed() {
+			return nil, badRequest("invalid_to_account", "to_account must be another of your open accounts")
+		}
+	} else {
+		_, to, err = findRecipient(ctx, db, req.Recipient)
+		if errors.Is(err, errInvalidPhoneNumber) {
+			return nil, badRequest("invalid_recipient", "Recipient must be an email address or phone number")
+		}
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, &requestError{status: http.StatusUnprocessableEntity, code: "recipient_not_found", message: "Recipient account not found"}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error finding recipient: %w", err)
+		}
+		if to.Id == from.Id {
+			return nil, badRequest("same_account", "A payment cannot go to the account it is paid from")
+		}
+	}
+	checks := needsPaymentChecks(customer, to)
+	if checks && !canSendPayments(customer) {
+		return nil, &requestError{status: http.StatusForbidden, code: "email_not_verified", message: "Confirm your email address before sending payments"}
+	}
+
+	payment, err := newScheduledPayment(customer.Id, from, to, amount, req.Frequency, req.Rule, req.StartAt, req.EndAt, cfg.now())
+	if err != nil {
+		return nil, err
+	}
+
+	if c.Get("apiKey") == nil && checks && needsStepUp(ctx, db, cfg, amount) {
+		err = confirmStepUp(ctx, db, cfg, customer, req.StepUp, c.RealIP())
+		if refused := stepUpRefusal(c, err, "Payments over "+cfg.StepUpThreshold.String()+" "+cfg.StepUpThreshold.Currency); refused != nil {
+			return nil, refused
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error confirming payment: %w", err)
+		}
+	}
+
+	err = db.CreateScheduledPayment(ctx, payment)
+	if err != nil {
+		return nil, err
+	}
+	return payment, nil
+}
+
+// scheduledPaymentView is a scheduled payment with its latest runs, for the
+// scheduled payments page.
+type scheduledPaymentView struct {
+	dbutil.ScheduledPayment
+	Runs []dbutil.ScheduledPaymentRun
+}
+
+// scheduledPaymentPageRuns is how many runs of each payment the page shows.
+const scheduledPaymentPageRuns = 5
+
+func renderScheduledPayments(db dbutil.Database, cfg Config, c echo.Context, status int, data map[string]interface{}) error {
+	ctx := c.Request().Context()
+	customer := currentCustomer(c)
+
+	payments, err := db.ListScheduledPayments(ctx, customer.Id)
+	if err != nil {
+		log.Println("Error listing scheduled payments:", err)
+		return c.String(http.StatusInternalServerError, "Error loading scheduled payments")
+	}
+	views := make([]scheduledPaymentView, 0, len(payments))
+	for _, payment := range payments {
+		runs, err := db.ListScheduledPaymentRuns(ctx, payment.Id)
+		if err != nil {
+			log.Println("Error listing scheduled payment runs:", err)
+			return c.String(http.StatusInternalServerError, "Error loading scheduled payments")
+		}
+		if len(runs) > scheduledPaymentPageRuns {
+			runs = runs[:scheduledPaymentPageRuns]
+		}
+		views = append(views, scheduledPaymentView{ScheduledPayment: payment, Runs: runs})
+	}
+
+	method, err := stepUpMethod(ctx, db, customer.Id)
+	if err != nil {
+		log.Println("Error fetching two-factor settings:", err)
+		return c.String(http.StatusInternalServerError, "Error loading scheduled payments")
+	}
+	var accounts []dbutil.Account
+	for _, account := range currentAccounts(c) {
+		if !account.Closed() {
+			accounts = append(accounts, account)
+		}
+	}
+
+	if data == nil {
+		data = map[string]interface{}{}
+	}
+	data["ScheduledPayments"] = views
+	data["Accounts"] = accounts
+	data["Frequencies"] = dbutil.Frequencies
+	data["StepUpMethod"] = method
+	data["Now"] = cfg.now().UTC().Format(scheduleFormTime)
+	return c.Render(status, "scheduled-payments", data)
+}
+
+func scheduledPaymentsHandler(db dbutil.Database, cfg Config, c echo.Context) error {
+	return renderScheduledPayments(db, cfg, c, http.StatusOK, nil)
+}
+
+// createScheduledPaymentHandler schedules a payment from the form on the
+// scheduled payments page, whose times are in UTC.
+func createScheduledPaymentHandler(db dbutil.Database, cfg Config, c echo.Context) error {
+	ctx := c.Request().Context()
+
+	req := createScheduledPaymentRequest{
+		Recipient: strings.TrimSpace(c.FormValue("recipient")),
+		Amount:    c.FormValue("amount"),
+		Frequency: c.FormValue("frequency"),
+		Rule:      c.FormValue("rule"),
+		StepUp:    c.FormValue("step_up"),
+	}
+	var err error
+	if value := c.FormValue("from_account"); value != "" {
+		req.FromAccount, err = strconv.Atoi(value)
+	}
+	if value := c.FormValue("to_account"); err == nil && value != "" {
+		// The recipient field is hidden, not cleared, for own accounts
+		req.ToAccount, err = strconv.Atoi(value)
+		req.Recipient = ""
+	}
+	if err == nil {
+		req.StartAt, err = parseFormTime(c.FormValue("start_at"))
+	}
+	if err == nil {
+		req.EndAt, err = parseFormTime(c.FormValue("end_at"))
+	}
+	if err != nil {
+		return renderScheduledPayments(db, cfg, c, http.StatusBadRequest, map[string]interface{}{"Error": "Invalid account or date"})
+	}
+
+	_, err = schedulePayment(ctx, db, cfg, c, req)
+	var refused *requestError
+	if errors.As(err, &refused) {
+		return renderScheduledPayments(db, cfg, c, refused.status, map[string]interface{}{"Error": refused.message})
+	}
+	if err != nil {
+		log.Println("Error scheduling payment:", err)
+		return c.String(http.StatusInternalServerError, "Error scheduling payment")
+	}
+	return c.Redirect(http.StatusSeeOther, "/scheduled-payments")
+}
+
+// parseFormTime reads a date and time input, in UTC, or nil if it is empty.
+func parseFormTime(value string) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(scheduleFormTime, value)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func cancelScheduledPaymentHandler(db dbutil.Database, cfg Config, c echo.Context) error {
+	ctx := c.Request().Context()
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.String(http.StatusBadRequest, "Invalid scheduled payment ID")
+	}
+	err = db.CancelScheduledPayment(ctx, currentCustomer(c).Id, id, cfg.now())
+	if errors.Is(err, dbutil.ErrScheduledPaymentNotFound) {
+		return renderScheduledPayments(db, cfg, c, http.StatusNotFound, map[string]interface{}{"Error": "That scheduled payment is not active."})
+	}
+	if err != nil {
+		log.Println("Error cancelling scheduled payment:", err)
+		return c.String(http.StatusInternalServerError, "Error cancelling scheduled payment")
+	}
+	return c.Redirect(http.StatusSeeOther, "/scheduled-payments")
+}
+
+func apiScheduledPaymentsHandler(db dbutil.Database, c echo.Context) error {
+	ctx := c.Request().Context()
+
+	payments, err := db.ListScheduledPayments(ctx, apiCustomerID(c))
+	if err != nil {
+		log.Println("Error listing scheduled payments:", err)
+		return apiFail(c, http.StatusInternalServerError, "internal_error", "Error listing scheduled payments")
+	}
+
+	res := scheduledPaymentListResponse{ScheduledPayments: make([]scheduledPaymentResponse, 0, len(payments))}
+	for i := range payments {
+		res.ScheduledPayments = append(res.ScheduledPayments, newScheduledPaymentResponse(&payments[i], nil))
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+func apiCreateScheduledPaymentHandler(db dbutil.Database, cfg Config, c echo.Context) error {
+	ctx := c.Request().Context()
+
+	var req createScheduledPaymentRequest
+	if err := c.Bind(&req); err != nil {
+		return apiFail(c, http.StatusBadRequest, "invalid_request", "Request body is not valid JSON")
+	}
+
+	payment, err := schedulePayment(ctx, db, cfg, c, req)
+	var refused *requestError
+	if errors.As(err, &refused) {
+		return apiFail(c, refused.status, refused.code, refused.message)
+	}
+	if err != nil {
+		log.Println("Error scheduling payment:", err)
+		return apiFail(c, http.StatusInternalServerError, "internal_error", "Error scheduling payment")
+	}
+
+	c.Response().Header().Set("Location", apiPrefix+"/scheduled-payments/"+strconv.Itoa(payment.Id))
+	return c.JSON(http.StatusCreated, newScheduledPaymentResponse(payment, nil))
+}
+
+func apiScheduledPaymentHandler(db dbutil.Database, c echo.Context) error {
+	ctx := c.Request().Context()
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return apiFail(c, http.StatusBadRequest, "invalid_id", "Scheduled payment ID must be a number")
+	}
+	payment, err := db.GetScheduledPayment(ctx, id)
+	// Someone else's payment is reported as missing, as for transactions
+	if errors.Is(err, dbutil.ErrScheduledPaymentNotFound) || (err == nil && !canViewCustomer(currentCustomer(c), payment.CustomerId)) {
+		return apiFail(c, http.StatusNotFound, "scheduled_payment_not_found", "Scheduled payment not found")
+	}
+	if err != nil {
+		log.Printf("Error fetching scheduled payment %d: %v", id, err)
+		return apiFail(c, http.StatusInternalServerError, "internal_error", "Error fetching scheduled payment")
+	}
+
+	runs, err := db.ListScheduledPaymentRuns(ctx, payment.Id)
+	if err != nil {
+		log.Printf("Error fetching runs of scheduled payment %d: %v", id, err)
+		return apiFail(c, http.StatusInternalServerError, "internal_error", "Error fetching scheduled payment")
+	}
+	return c.JSON(http.StatusOK, newScheduledPaymentResponse(payment, runs))
+}
+
+func apiCancelScheduledPaymentHandler(db dbutil.Database, cfg Config, c echo.Context) error {
+	ctx := c.Request().Context()
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return apiFail(c, http.StatusBadRequest, "invalid_id", "Scheduled payment ID must be a number")
+	}
+	err = db.CancelScheduledPayment(ctx, apiCustomerID(c), id, cfg.now())
+	if errors.Is(err, dbutil.ErrScheduledPaymentNotFound) {
+		return apiFail(c, http.StatusNotFound, "scheduled_payment_not_found", "No active scheduled payment with that ID")
+	}
+	if err != nil {
+		log.Printf("Error cancelling scheduled payment %d: %v", id, err)
+		return apiFail(c, http.StatusInternalServerError, "internal_error", "Error cancelling scheduled payment")
+	}
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,174 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"minibank/dbutil"
+	"minibank/mailer"
+	"time"
+)
+
+// scheduledPaymentBatch bounds how many due payments one pass of the
+// scheduler makes. Anything left over is picked up by the next pass.
+const scheduledPaymentBatch = 100
+
+// startScheduler makes scheduled payments and voids expired holds in the
+// background, every cfg.SchedulerInterval, until ctx is done.
+func startScheduler(ctx context.Context, db dbutil.Database, cfg Config) {
+	go func() {
+		ticker := time.NewTicker(cfg.SchedulerInterval)
+		defer ticker.Stop()
+		for {
+			_, err := runScheduledPayments(ctx, db, cfg)
+			if err != nil {
+				log.Println("Error running scheduled payments:", err)
+			}
+			expired, err := db.ExpireHolds(ctx, cfg.now())
+			if err != nil {
+				log.Println("Error expiring holds:", err)
+			} else if expired > 0 {
+				log.Printf("Voided %d expired hold(s)", expired)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// runScheduledPayments tries every scheduled payment that is due at
+// cfg.now() once and returns how many it tried. A payment that is several
+// occurrences behind, say after downtime, catches up by one occurrence per
+// call.
+func runScheduledPayments(ctx context.Context, db dbutil.Database, cfg Config) (int, error) {
+	now := cfg.now()
+	due, err := db.ListDueScheduledPayments(ctx, now, scheduledPaymentBatch)
+	if err != nil {
+		return 0, err
+	}
+
+	for i := range due {
+		// Each payment gets as long as a request would
+		paymentCtx, cancel := context.WithTimeout(ctx, cfg.RequestTimeout)
+		runScheduledPayment(paymentCtx, db, cfg, &due[i], now)
+		cancel()
+	}
+	return len(due), nil
+}
+
+// runScheduledPayment makes the current occurrence of p through Transfer and
+// records the attempt. A failed attempt is retried after a growing delay; the
+// last one tells the customer and moves on to the next occurrence. A closed
+// account stops the schedule altogether.
+//
+// The idempotency key names the occurrence, so an attempt whose outcome was
+// lost, or that another server also made, does not pay twice.
+func runScheduledPayment(ctx context.Context, db dbutil.Database, cfg Config, p *dbutil.ScheduledPayment, now time.Time) {
+	run := &dbutil.ScheduledPaymentRun{
+		ScheduledPaymentId: p.Id,
+		DueAt:              p.DueAt,
+		Attempt:            p.Attempts + 1,
+		RanAt:              now,
+	}
+	key := dbutil.IdempotencyKey{
+		Key:       fmt.Sprintf("scheduled-%d-%d", p.Id, p.DueAt.Unix()),
+		ExpiresAt: time.Now().Add(cfg.IdempotencyWindow),
+	}
+
+	transactionID, err := db.Transfer(ctx, p.FromAccount, p.ToAccount, p.Amount, key)
+	p.UpdatedAt = now
+	notify := false
+	switch {
+	case err == nil:
+		run.Status = dbutil.RunSucceeded
+		run.TransactionId = transactionID
+		p.Occurrences++
+		p.Advance()
+	case errors.Is(err, dbutil.ErrAccountClosed):
+		run.Status = dbutil.RunFailed
+		run.Error = scheduleErrorMessage(err)
+		p.Status = dbutil.ScheduleFailed
+		notify = true
+	default:
+		run.Status = dbutil.RunFailed
+		run.Error = scheduleErrorMessage(err)
+		p.Attempts++
+		if p.Attempts < cfg.ScheduleMaxAttempts {
+			p.AttemptAt = now.Add(time.Duration(p.Attempts) * cfg.ScheduleRetryDelay)
+		} else {
+			notify = true
+			if p.Frequency == dbutil.FrequencyOnce {
+				p.Status = dbutil.ScheduleFailed
+			} else {
+				p.Advance()
+			}
+		}
+	}
+	if err != nil {
+		log.Printf("Scheduled payment %d, attempt %d: %v", p.Id, run.Attempt, err)
+	}
+
+	err = db.RecordScheduledPaymentRun(ctx, p, run)
+	if errors.Is(err, dbutil.ErrScheduledPaymentNotFound) {
+		// Cancelled while it ran, or run by another server
+		return
+	}
+	if err != nil {
+		log.Printf("Error recording run of scheduled payment %d: %v", p.Id, err)
+		return
+	}
+
+	if notify {
+		err = sendScheduleFailureEmail(ctx, db, cfg, p, run)
+		if err != nil {
+			log.Printf("Error sending failure email for scheduled payment %d: %v", p.Id, err)
+		}
+	}
+}
+
+// scheduleErrorMessage explains to the customer why a scheduled payment
+// failed, without the internal details that go to the log.
+func scheduleErrorMessage(err error) string {
+	switch {
+	case errors.Is(err, dbutil.ErrInsufficientFunds):
+		return "Insufficient balance"
+	case errors.Is(err, dbutil.ErrAccountFrozen):
+		return "An account is frozen"
+	case errors.Is(err, dbutil.ErrAccountClosed):
+		return "An account is closed"
+	case errors.Is(err, dbutil.ErrSameAccount):
+		return "The payment would go to the account it is paid from"
+	case errors.Is(err, dbutil.ErrNoExchangeRate):
+		return "No exchange rate is available between the two currencies"
+	case errors.Is(err, dbutil.ErrAmountTooSmall):
+		return "The amount is too small to pay into the receiving account's currency"
+	default:
+		return "The payment could not be processed"
+	}
+}
+
+// sendScheduleFailureEmail tells the customer that an occurrence of p was
+// not paid, and whether the schedule goes on.
+func sendScheduleFailureEmail(ctx context.Context, db dbutil.Database, cfg Config, p *dbutil.ScheduledPayment, run *dbutil.ScheduledPaymentRun) error {
+	customer, err := db.GetCustomer(ctx, p.CustomerId)
+	if err != nil {
+		return fmt.Errorf("error fetching customer: %w", err)
+	}
+
+	next := "The schedule has been stopped."
+	if p.Active() {
+		next = "The next payment is due on " + p.DueAt.UTC().Format("2 January 2006 at 15:04 UTC") + "."
+	}
+	return cfg.Mailer.Send(ctx, mailer.Message{
+		To:      customer.Email,
+		Subject: "Your scheduled payment could not be made",
+		Body: fmt.Sprintf("Hi %s,\n\nYour scheduled payment of %s %s from account %d, due on %s, could not be made "+
+			"after %d attempt(s): %s.\n\n%s You can review your scheduled payments at:\n\n%s\n",
+			customer.First_name, p.Amount, p.Amount.Currency, p.FromAccount, run.DueAt.UTC().Format("2 January 2006 at 15:04 UTC"),
+			run.Attempt, run.Error, next, cfg.BaseURL+"/scheduled-payments"),
+	})
+}
@@ -0,0 +1,216 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"minibank/dbutil"
+	"minibank/mailer"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testMailer keeps the messages it is given.
+type testMailer struct {
+	mu       sync.Mutex
+	messages []mailer.Message
+}
+
+func (m *testMailer) Send(ctx context.Context, msg mailer.Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.messages = append(m.messages, msg)
+	return nil
+}
+
+// schedulerTest runs the scheduler by hand against a fake clock.
+type schedulerTest struct {
+	*testServer
+	now    time.Time
+	mailer *testMailer
+}
+
+func newSchedulerTest(t *testing.T) *schedulerTest {
+	st := &schedulerTest{
+		now:    time.Date(2026, 3, 2, 9, 0, 0, 0, time.UTC),
+		mailer: &testMailer{},
+	}
+	st.testServer = newTestServer(t, func(cfg *Config) {
+		cfg.Clock = func() time.Time { return st.now }
+		cfg.Mailer = st.mailer
+		cfg.ScheduleMaxAttempts = 3
+		cfg.ScheduleRetryDelay = 15 * time.Minute
+	})
+	return st
+}
+
+// schedule stores a payment of amount cents from one account to another
+// that first falls due after wait.
+func (st *schedulerTest) schedule(t *testing.T, customer *dbutil.Customer, from, to *dbutil.Account, amount int64, frequency, rule string, wait time.Duration) int {
+	t.Helper()
+	start := st.now.Add(wait)
+	p, err := newScheduledPayment(customer.Id, from, to, dbutil.NewMoney(amount, "AUD"), frequency, rule, &start, nil, st.now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.db.CreateScheduledPayment(context.Background(), p); err != nil {
+		t.Fatal(err)
+	}
+	return p.Id
+}
+
+// run moves the clock on by d and runs the scheduler once, expecting it to
+// try want payments.
+func (st *schedulerTest) run(t *testing.T, d time.Duration, want int) {
+	t.Helper()
+	st.runWith(t, st.db, d, want)
+}
+
+// runWith is run with the scheduler using db.
+func (st *schedulerTest) runWith(t *testing.T, db dbutil.Database, d time.Duration, want int) {
+	t.Helper()
+	st.now = st.now.Add(d)
+	got, err := runScheduledPayments(context.Background(), db, st.cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("at %s: tried %d payments, want %d", st.now, got, want)
+	}
+}
+
+func (st *schedulerTest) payment(t *testing.T, id int) (*dbutil.ScheduledPayment, []dbutil.ScheduledPaymentRun) {
+	t.Helper()
+	ctx := context.Background()
+	p, err := st.db.GetScheduledPayment(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runs, err := st.db.ListScheduledPaymentRuns(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p, runs
+}
+
+func TestSchedulerWeekly(t *testing.T) {
+	st := newSchedulerTest(t)
+	alice, aliceAccount := st.customer(t, "alice@example.com", dbutil.RoleCustomer, "AUD")
+	_, bobAccount := st.customer(t, "bob@example.com", dbutil.RoleCustomer, "AUD")
+	before := st.balance(t, bobAccount.Id)
+	id := st.schedule(t, alice, aliceAccount, bobAccount, 1000, dbutil.FrequencyWeekly, "", time.Hour)
+
+	st.run(t, 0, 0)
+	st.run(t, time.Hour, 1)
+	// Running again at the same time does not pay twice
+	st.run(t, 0, 0)
+	st.run(t, 6*24*time.Hour, 0)
+	st.run(t, 24*time.Hour, 1)
+
+	if got, want := st.balance(t, bobAccount.Id), before.Add(dbutil.NewMoney(2000, "AUD")); got != want {
+		t.Errorf("Bob has %s, want %s", got, want)
+	}
+	p, runs := st.payment(t, id)
+	if want := st.now.Add(7 * 24 * time.Hour); !p.DueAt.Equal(want) || p.Status != dbutil.ScheduleActive || p.Occurrences != 2 {
+		t.Errorf("payment is %s with %d occurrences, due %s, want active with 2, due %s", p.Status, p.Occurrences, p.DueAt, want)
+	}
+	if len(runs) != 2 || runs[0].Status != dbutil.RunSucceeded || runs[1].Status != dbutil.RunSucceeded {
+		t.Errorf("runs: %+v, want two that succeeded", runs)
+	}
+	if len(st.mailer.messages) != 0 {
+		t.Errorf("sent %d emails, want none", len(st.mailer.messages))
+	}
+}
+
+// lostRunDB fails to record the next lose runs, as if the connection
+// dropped after the payment was made.
+type lostRunDB struct {
+	dbutil.Database
+	lose int
+}
+
+func (db *lostRunDB) RecordScheduledPaymentRun(ctx context.Context, p *dbutil.ScheduledPayment, run *dbutil.ScheduledPaymentRun) error {
+	if db.lose > 0 {
+		db.lose--
+		return errors.New("connection lost")
+	}
+	return db.Database.RecordScheduledPaymentRun(ctx, p, run)
+}
+
+func TestSchedulerLostRun(t *testing.T) {
+	st := newSchedulerTest(t)
+	alice, aliceAccount := st.customer(t, "alice@example.com", dbutil.RoleCustomer, "AUD")
+	_, bobAccount := st.customer(t, "bob@example.com", dbutil.RoleCustomer, "AUD")
+	before := st.balance(t, bobAccount.Id)
+	id := st.schedule(t, alice, aliceAccount, bobAccount, 1000, dbutil.FrequencyOnce, "", 0)
+
+	// The payment is made but not recorded, so it is still due and is
+	// tried again
+	db := &lostRunDB{Database: st.db, lose: 1}
+	st.runWith(t, db, 0, 1)
+	st.runWith(t, db, time.Minute, 1)
+	st.runWith(t, db, time.Minute, 0)
+
+	if got, want := st.balance(t, bobAccount.Id), before.Add(dbutil.NewMoney(1000, "AUD")); got != want {
+		t.Errorf("Bob has %s, want %s", got, want)
+	}
+	p, runs := st.payment(t, id)
+	if p.Status != dbutil.ScheduleCompleted || len(runs) != 1 || runs[0].Status != dbutil.RunSucceeded {
+		t.Errorf("payment is %s with runs %+v, want completed with one that succeeded", p.Status, runs)
+	}
+}
+
+func TestSchedulerRetries(t *testing.T) {
+	st := newSchedulerTest(t)
+	alice, aliceAccount := st.customer(t, "alice@example.com", dbutil.RoleCustomer, "AUD")
+	_, bobAccount := st.customer(t, "bob@example.com", dbutil.RoleCustomer, "AUD")
+	// More than Alice has
+	id := st.schedule(t, alice, aliceAccount, bobAccount, 100000000, dbutil.FrequencyOnce, "", 0)
+
+	st.run(t, 0, 1)
+	// The n-th retry waits n times the retry delay
+	st.run(t, 14*time.Minute, 0)
+	st.run(t, time.Minute, 1)
+	st.run(t, 29*time.Minute, 0)
+	st.run(t, time.Minute, 1)
+	st.run(t, 24*time.Hour, 0)
+
+	p, runs := st.payment(t, id)
+	if p.Status != dbutil.ScheduleFailed {
+		t.Errorf("payment is %s, want %s", p.Status, dbutil.ScheduleFailed)
+	}
+	if len(runs) != 3 {
+		t.Fatalf("%d runs, want 3", len(runs))
+	}
+	// Newest first
+	for i, run := range runs {
+		if attempt := len(runs) - i; run.Attempt != attempt || run.Status != dbutil.RunFailed || run.Error != "Insufficient balance" {
+			t.Errorf("run %d: %+v, want failed attempt %d for insufficient balance", i, run, attempt)
+		}
+	}
+	if len(st.mailer.messages) != 1 {
+		t.Fatalf("sent %d emails, want 1", len(st.mailer.messages))
+	}
+	if msg := st.mailer.messages[0]; msg.To != alice.Email || !strings.Contains(msg.Body, "3 attempt(s): Insufficient balance") {
+		t.Errorf("sent %+v", msg)
+	}
+}
+
+func TestSchedulerCron(t *testing.T) {
+	st := newSchedulerTest(t)
+	alice, aliceAccount := st.customer(t, "alice@example.com", dbutil.RoleCustomer, "AUD")
+	_, bobAccount := st.customer(t, "bob@example.com", dbutil.RoleCustomer, "AUD")
+	// 09:00 on Mondays that fall on odd days; 2 March 2026 is a Monday
+	id := st.schedule(t, alice, aliceAccount, bobAccount, 500, dbutil.FrequencyCron, "0 9 */2 * 1", 0)
+
+	p, _ := st.payment(t, id)
+	if want := time.Date(2026, 3, 9, 9, 0, 0, 0, time.UTC); !p.DueAt.Equal(want) {
+		t.Fatalf("first due %s, want %s", p.DueAt, want)
+	}
+	st.run(t, 7*24*time.Hour, 1)
+	p, _ = st.payment(t, id)
+	if want := time.Date(2026, 3, 23, 9, 0, 0, 0, time.UTC); !p.DueAt.Equal(want) {
+		t.Errorf("next due %s, want %s", p.DueAt, want)
+	}
+}
@@ -1,16 +1,17 @@
 package server
 
 import (
+	"context"
 	"fmt"
 	"html/template"
 	"io"
 	"log"
-	"minibank/dbutil/sqlite"
+	"minibank/dbutil"
 	"net/http"
 
-	"github.com/gorilla/sessions"
 	"github.com/labstack/echo-contrib/session"
 	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
 )
 
 type TemplateRegistry struct {
@@ -24,9 +25,16 @@ func (t *TemplateRegistry) Render(w io.Writer, name string, data interface{}, c
 	userID, ok := sess.Values["userID"]
 	isLoggedIn := ok && userID != nil
 
-	// Add the IsLoggedIn variable to the template data
+	// Staff get links to pages customers cannot open
+	customer := currentCustomer(c)
+	staff := customer != nil && isStaff(customer)
+
+	// Every form posts this back for csrfProtection to check
+	csrfToken, _ := c.Get(middleware.DefaultCSRFConfig.ContextKey).(string)
+
+	// Add the IsLoggedIn, IsStaff and CSRFToken variables to the template data
 	if data == nil {
-		data = map[string]interface{}{"IsLoggedIn": isLoggedIn}
+		data = map[string]interface{}{"IsLoggedIn": isLoggedIn, "IsStaff": staff, "CSRFToken": csrfToken}
 	} else {
 		dataMap, ok := data.(map[string]interface{}) // Type assertion without the 'ok' check
 		if !ok {
@@ -35,6 +43,8 @@ func (t *TemplateRegistry) Render(w io.Writer, name string, data interface{}, c
 			return fmt.Errorf("invalid template data type: %T", data) // Return an error
 		}
 		dataMap["IsLoggedIn"] = isLoggedIn
+		dataMap["IsStaff"] = staff
+		dataMap["CSRFToken"] = csrfToken
 	}
 
 	tmpl, ok := t.templates[name]
@@ -45,13 +55,32 @@ func (t *TemplateRegistry) Render(w io.Writer, name string, data interface{}, c
 }
 
 func Run() {
-	db := sqlite.New()
-	db.Init()
-	tmp := db.GetAccounts()
+	cfg := LoadConfig()
+
+	// Startup work is not tied to any request
+	ctx := context.Background()
+
+	db := openDatabase(cfg.DatabaseURL)
+	db.Init(ctx)
+	tmp := db.GetAccounts(ctx)
 	if len(tmp) == 0 {
-		db.MockData()
+		db.MockData(ctx)
 	}
+	if err := db.CheckLedger(ctx); err != nil {
+		log.Fatal("Ledger check failed: ", err)
+	}
+
+	e := newServer(db, cfg)
+
+	// Makes scheduled payments for as long as the server runs
+	startScheduler(ctx, db, cfg)
 
+	e.Logger.Fatal(e.Start(":3000"))
+}
+
+// newServer sets up the site and API on db, which must be migrated. The
+// templates are read from the working directory.
+func newServer(db dbutil.Database, cfg Config) *echo.Echo {
 	templates := make(map[string]*template.Template)
 	templates["create-account"] = template.Must(template.ParseFiles("templates/create-account.gohtml"))
 	templates["delete-account"] = template.Must(template.ParseFiles("templates/delete-account.gohtml"))
@@ -59,66 +88,150 @@ func Run() {
 	templates["account"] = template.Must(template.ParseFiles("templates/account.gohtml"))
 	templates["all-accounts"] = template.Must(template.ParseFiles("templates/all-accounts.gohtml"))
 	templates["login"] = template.Must(template.ParseFiles("templates/login.gohtml"))
+	templates["two-factor"] = template.Must(template.ParseFiles("templates/two-factor.gohtml"))
+	templates["forgot-password"] = template.Must(template.ParseFiles("templates/forgot-password.gohtml"))
+	templates["reset-password"] = template.Must(template.ParseFiles("templates/reset-password.gohtml"))
+	templates["verify-email"] = template.Must(template.ParseFiles("templates/verify-email.gohtml"))
+	templates["scheduled-payments"] = template.Must(template.ParseFiles("templates/scheduled-payments.gohtml"))
+	templates["bulk-payments"] = template.Must(template.ParseFiles("templates/bulk-payments.gohtml"))
 
 	templates["transactions"] = template.Must(template.ParseFiles("templates/transactions.gohtml"))
 	templates["single-transaction"] = template.Must(template.ParseFiles("templates/single-transaction.gohtml"))
 	// Add more templates if needed
 
 	e := echo.New()
+	e.IPExtractor = ipExtractor(cfg)
 
 	e.Renderer = &TemplateRegistry{
 		templates: templates,
 	}
 
-	e.Use(session.Middleware(sessions.NewCookieStore([]byte("secret"))))
+	// Cancels the request context, and with it any queries and open
+	// transactions, once the deadline passes or the client goes away.
+	e.Use(middleware.ContextTimeoutWithConfig(middleware.ContextTimeoutConfig{
+		Timeout: cfg.RequestTimeout,
+	}))
+	e.Use(session.Middleware(newSessionStore(cfg, db)))
+	e.Use(sessionTimeouts(cfg))
+	e.Use(csrfProtection(cfg))
 
 	e.GET("/", func(c echo.Context) error {
-		return accountHandler(&db, c)
-	})
+		return accountHandler(db, c)
+	}, requireLogin(db))
 	e.POST("/account", func(c echo.Context) error {
-		return accountHandler(&db, c)
-	})
+		return accountHandler(db, c)
+	}, requireLogin(db))
+	e.POST("/open-account", func(c echo.Context) error {
+		return openAccountHandler(db, c)
+	}, requireLogin(db))
 	e.GET("/payment", func(c echo.Context) error {
-		return paymentHandler(&db, c)
-	})
+		return paymentHandler(db, cfg, c)
+	}, requireLogin(db))
 	e.POST("/payment", func(c echo.Context) error {
-		return paymentHandler(&db, c)
-	})
+		return paymentHandler(db, cfg, c)
+	}, requireLogin(db))
+	e.GET("/scheduled-payments", func(c echo.Context) error {
+		return scheduledPaymentsHandler(db, cfg, c)
+	}, requireLogin(db))
+	e.POST("/scheduled-payments", func(c echo.Context) error {
+		return createScheduledPaymentHandler(db, cfg, c)
+	}, requireLogin(db))
+	e.POST("/scheduled-payments/:id/cancel", func(c echo.Context) error {
+		return cancelScheduledPaymentHandler(db, cfg, c)
+	}, requireLogin(db))
+	e.GET("/bulk-payments", func(c echo.Context) error {
+		return bulkPaymentsHandler(db, c)
+	}, requireLogin(db))
+	e.POST("/bulk-payments/preview", func(c echo.Context) error {
+		return previewBulkPaymentsHandler(db, cfg, c)
+	}, requireLogin(db))
+	e.POST("/bulk-payments", func(c echo.Context) error {
+		return executeBulkPaymentsHandler(db, cfg, c)
+	}, requireLogin(db))
 	e.GET("/all-accounts", func(c echo.Context) error {
-		return allAccountsHandler(&db, c)
-	})
+		return allAccountsHandler(db, c)
+	}, requireLogin(db), requireRole(dbutil.RoleTeller, dbutil.RoleAdmin))
 	e.GET("/create-account", func(c echo.Context) error {
-		return createAccountHandler(&db, c)
+		return createAccountHandler(db, cfg, c)
 	})
 	e.POST("/create-account", func(c echo.Context) error {
-		return createAccountHandler(&db, c)
+		return createAccountHandler(db, cfg, c)
 	})
 
 	e.GET("/delete-account", func(c echo.Context) error {
-		return deleteAccountHandler(&db, c)
-	})
+		return deleteAccountHandler(db, c)
+	}, requireLogin(db))
 	e.POST("/delete-account", func(c echo.Context) error {
-		return deleteAccountHandler(&db, c)
-	})
+		return deleteAccountHandler(db, c)
+	}, requireLogin(db))
 
 	e.GET("/transactions", func(c echo.Context) error {
-		return transactionsHandler(&db, c)
-	})
+		return transactionsHandler(db, c)
+	}, requireLogin(db))
+	e.GET("/statement", func(c echo.Context) error {
+		return statementHandler(db, cfg, c)
+	}, requireLogin(db))
 
 	e.GET("/single-transaction/:transaction_id", func(c echo.Context) error {
-		return singleTransactionHandler(&db, c)
-	})
+		return singleTransactionHandler(db, c)
+	}, requireLogin(db))
+	e.POST("/single-transaction/:transaction_id/refund", func(c echo.Context) error {
+		return refundTransactionHandler(db, cfg, c)
+	}, requireLogin(db))
 
 	e.GET("/login", func(c echo.Context) error {
-		return loginHandler(&db, c)
+		return loginHandler(db, cfg, c)
 	})
 	e.POST("/login", func(c echo.Context) error {
-		return loginHandler(&db, c)
+		return loginHandler(db, cfg, c)
+	})
+
+	e.POST("/login/two-factor", func(c echo.Context) error {
+		return loginTwoFactorHandler(db, cfg, c)
 	})
 
-	e.GET("/logout", func(c echo.Context) error {
+	e.GET("/forgot-password", func(c echo.Context) error {
+		return forgotPasswordHandler(db, cfg, c)
+	})
+	e.POST("/forgot-password", func(c echo.Context) error {
+		return forgotPasswordHandler(db, cfg, c)
+	})
+	e.GET("/reset-password", func(c echo.Context) error {
+		return resetPasswordHandler(db, cfg, c)
+	})
+	e.POST("/reset-password", func(c echo.Context) error {
+		return resetPasswordHandler(db, cfg, c)
+	})
+	e.GET("/verify-email", func(c echo.Context) error {
+		return verifyEmailHandler(db, cfg, c)
+	})
+	e.POST("/verify-email/resend", func(c echo.Context) error {
+		return resendVerificationHandler(db, cfg, c)
+	}, requireLogin(db))
+
+	e.GET("/two-factor", func(c echo.Context) error {
+		return twoFactorHandler(db, c)
+	}, requireLogin(db))
+	e.POST("/two-factor/enroll", func(c echo.Context) error {
+		return twoFactorEnrollHandler(db, cfg, c)
+	}, requireLogin(db))
+	e.POST("/two-factor/confirm", func(c echo.Context) error {
+		return twoFactorConfirmHandler(db, cfg, c)
+	}, requireLogin(db))
+	e.POST("/two-factor/recovery-codes", func(c echo.Context) error {
+		return twoFactorRecoveryCodesHandler(db, cfg, c)
+	}, requireLogin(db))
+	e.POST("/two-factor/disable", func(c echo.Context) error {
+		return twoFactorDisableHandler(db, cfg, c)
+	}, requireLogin(db))
+
+	e.POST("/logout", func(c echo.Context) error {
 		return logoutHandler(c)
 	})
+	e.POST("/logout-all", func(c echo.Context) error {
+		return logoutAllHandler(db, cfg, c)
+	}, requireLogin(db))
 
-	e.Logger.Fatal(e.Start(":3000"))
+	registerAPI(e, db, cfg)
+	return e
 }
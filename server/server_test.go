@@ -0,0 +1,219 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"minibank/dbutil"
+	"minibank/dbutil/dbtest"
+	"minibank/dbutil/sqlite"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testPassword is the password of every customer tests create.
+const testPassword = "correct horse battery staple"
+
+// testServer is the whole site and API on an empty SQLite database.
+type testServer struct {
+	db  dbutil.Database
+	cfg Config
+	URL string
+}
+
+// newTestServer starts a server with the default settings, changed by
+// configure if it is not nil. It is stopped when the test ends.
+func newTestServer(t *testing.T, configure func(cfg *Config)) *testServer {
+	t.Helper()
+
+	s := sqlite.Open(filepath.Join(t.TempDir(), "minibank"))
+	s.Init(context.Background())
+	var db dbutil.Database = &s
+
+	cfg := LoadConfig()
+	cfg.SessionKeys = [][]byte{[]byte("0123456789abcdef0123456789abcdef")}
+	cfg.SessionStore = "cookie"
+	if configure != nil {
+		configure(&cfg)
+	}
+
+	// The templates and queries are read from the repository root
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(".."); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	e := newServer(db, cfg)
+
+	srv := httptest.NewServer(e)
+	t.Cleanup(srv.Close)
+	return &testServer{db: db, cfg: cfg, URL: srv.URL}
+}
+
+// phoneNumbers hands out the unique phone numbers customers need.
+var phoneNumbers atomic.Int64
+
+// customer creates a customer with role, testPassword and a verified email
+// address, with a checking account in currency funded with
+// dbutil.StimulusAmount.
+func (ts *testServer) customer(t *testing.T, email, role, currency string) (*dbutil.Customer, *dbutil.Account) {
+	t.Helper()
+
+	now := time.Now().UTC()
+	customer := &dbutil.Customer{
+		First_name:        "Test",
+		Last_name:         strings.Split(email, "@")[0],
+		Email:             email,
+		Phone_number:      500000000 + int(phoneNumbers.Add(1)),
+		Role:              role,
+		Email_verified_at: &now,
+		Created_at:        now,
+		Updated_at:        now,
+	}
+	customer.ChangePassword(testPassword)
+	account := &dbutil.Account{
+		Type:       dbutil.AccountChecking,
+		Balance:    dbutil.NewMoney(0, currency),
+		Held:       dbutil.NewMoney(0, currency),
+		Created_at: now,
+		Updated_at: now,
+		Status:     dbutil.StatusActive,
+	}
+	if err := ts.db.CreateCustomer(context.Background(), customer, account); err != nil {
+		t.Fatalf("creating customer %s: %v", email, err)
+	}
+	dbtest.Fund(t, ts.db, account)
+	return customer, account
+}
+
+// testClient is a browser: it keeps cookies, sends the CSRF token back
+// with every unsafe request and does not follow redirects.
+type testClient struct {
+	ts     *testServer
+	client *http.Client
+}
+
+func (ts *testServer) client(t *testing.T) *testClient {
+	t.Helper()
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc := &testClient{ts: ts, client: &http.Client{
+		Jar: jar,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}}
+	// Any page sets the CSRF cookie
+	tc.do(t, http.MethodGet, "/login", "", nil).Body.Close()
+	return tc
+}
+
+// login opens a client logged in as email.
+func (ts *testServer) login(t *testing.T, email string) *testClient {
+	t.Helper()
+	tc := ts.client(t)
+	resp := tc.postForm(t, "/login", url.Values{"email": {email}, "password": {testPassword}})
+	body := readBody(t, resp)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("logging in as %s: %d %s", email, resp.StatusCode, body)
+	}
+	return tc
+}
+
+// csrfToken returns the token from the CSRF cookie.
+func (tc *testClient) csrfToken() string {
+	u, _ := url.Parse(tc.ts.URL)
+	for _, cookie := range tc.client.Jar.Cookies(u) {
+		if cookie.Name == "_csrf" {
+			return cookie.Value
+		}
+	}
+	return ""
+}
+
+// do sends a request with body of contentType, and the CSRF token unless
+// the method is safe. header adds to or overrides the headers.
+func (tc *testClient) do(t *testing.T, method, path, contentType string, body io.Reader, header ...string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, tc.ts.URL+path, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if method != http.MethodGet && method != http.MethodHead {
+		req.Header.Set("X-CSRF-Token", tc.csrfToken())
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		if header[i+1] == "" {
+			req.Header.Del(header[i])
+		} else {
+			req.Header.Set(header[i], header[i+1])
+		}
+	}
+	resp, err := tc.client.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	return resp
+}
+
+func (tc *testClient) get(t *testing.T, path string) *http.Response {
+	t.Helper()
+	return tc.do(t, http.MethodGet, path, "", nil)
+}
+
+func (tc *testClient) postForm(t *testing.T, path string, form url.Values) *http.Response {
+	t.Helper()
+	return tc.do(t, http.MethodPost, path, "application/x-www-form-urlencoded", strings.NewReader(form.Encode()))
+}
+
+// doJSON sends v as JSON, with header pairs as for do.
+func (tc *testClient) doJSON(t *testing.T, method, path string, v interface{}, header ...string) *http.Response {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tc.do(t, method, path, "application/json", strings.NewReader(string(data)), header...)
+}
+
+// readBody reads and closes the body of resp.
+func readBody(t *testing.T, resp *http.Response) string {
+	t.Helper()
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func (ts *testServer) balance(t *testing.T, accountId int) dbutil.Money {
+	t.Helper()
+	return dbtest.Balance(t, ts.db, accountId)
+}
+
+// expectStatus fails t unless resp has status want, and returns the body.
+func expectStatus(t *testing.T, resp *http.Response, want int) string {
+	t.Helper()
+	body := readBody(t, resp)
+	if resp.StatusCode != want {
+		t.Errorf("%s %s: status %d, want %d: %s", resp.Request.Method, resp.Request.URL, resp.StatusCode, want, body)
+	}
+	return body
+}
@@ -0,0 +1,299 @@
+package server
+
+import (
+	"encoding/base32"
+	"errors"
+	"log"
+	"minibank/dbutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+// newSessionStore builds the session store described by cfg. Cookies are
+// always HttpOnly and live no longer than the absolute timeout.
+func newSessionStore(cfg Config, db dbutil.Database) sessions.Store {
+	keys := cfg.SessionKeys
+	if keys == nil {
+		log.Println("SESSION_KEYS is not set, using random session keys")
+		keys = [][]byte{securecookie.GenerateRandomKey(64), securecookie.GenerateRandomKey(32)}
+	}
+
+	options := &sessions.Options{
+		Path:     "/",
+		MaxAge:   int(cfg.SessionAbsoluteTimeout.Seconds()),
+		HttpOnly: true,
+		Secure:   cfg.SessionSecure,
+		SameSite: cfg.SessionSameSite,
+	}
+
+	if cfg.SessionStore == "database" {
+		codecs := securecookie.CodecsFromPairs(keys...)
+		for _, codec := range codecs {
+			codec.(*securecookie.SecureCookie).MaxAge(options.MaxAge)
+		}
+		return &dbSessionStore{db: db, codecs: codecs, options: options, clientIP: ipExtractor(cfg)}
+	}
+
+	store := sessions.NewCookieStore(keys...)
+	store.Options = options
+	store.MaxAge(options.MaxAge)
+	return store
+}
+
+// dbSessionStore is a sessions.Store that keeps session values in the
+// database and only a signed session ID in the cookie, so that sessions can
+// be listed and revoked.
+type dbSessionStore struct {
+	db      dbutil.Database
+	codecs  []securecookie.Codec
+	options *sessions.Options
+	// clientIP is the echo.IPExtractor the server uses, so that sessions
+	// record the address c.RealIP returns
+	clientIP echo.IPExtractor
+}
+
+func (s *dbSessionStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+// New loads the session named by the request's cookie, or returns a new
+// empty one if there is no cookie or the session was revoked or expired.
+func (s *dbSessionStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	sess := sessions.NewSession(s, name)
+	options := *s.options
+	sess.Options = &options
+	sess.IsNew = true
+
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return sess, nil
+	}
+	var id string
+	err = securecookie.DecodeMulti(name, cookie.Value, &id, s.codecs...)
+	if err != nil {
+		return sess, err
+	}
+
+	stored, err := s.db.GetSession(r.Context(), id)
+	if errors.Is(err, dbutil.ErrSessionNotFound) {
+		return sess, nil
+	}
+	if err != nil {
+		return sess, err
+	}
+	err = securecookie.DecodeMulti(name, stored.Data, &sess.Values, s.codecs...)
+	if err != nil {
+		return sess, err
+	}
+
+	sess.ID = id
+	sess.IsNew = false
+	return sess, nil
+}
+
+// Save stores the session and sets its cookie. A negative MaxAge deletes the
+// session.
+func (s *dbSessionStore) Save(r *http.Request, w http.ResponseWriter, sess *sessions.Session) error {
+	ctx := r.Context()
+
+	if sess.Options.MaxAge < 0 {
+		if sess.ID != "" {
+			err := s.db.DeleteSession(ctx, sess.ID)
+			if err != nil {
+				return err
+			}
+		}
+		http.SetCookie(w, sessions.NewCookie(sess.Name(), "", sess.Options))
+		return nil
+	}
+
+	if sess.ID == "" {
+		sess.ID = strings.TrimRight(base32.StdEncoding.EncodeToString(securecookie.GenerateRandomKey(32)), "=")
+	}
+	data, err := securecookie.EncodeMulti(sess.Name(), sess.Values, s.codecs...)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	customerID, _ := sess.Values["userID"].(int)
+	err = s.db.SaveSession(ctx, &dbutil.Session{
+		Id:         sess.ID,
+		CustomerId: customerID,
+		Data:       data,
+		UserAgent:  r.UserAgent(),
+		IP:         s.clientIP(r),
+		CreatedAt:  now,
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(time.Duration(sess.Options.MaxAge) * time.Second),
+	})
+	if err != nil {
+		return err
+	}
+
+	encoded, err := securecookie.EncodeMulti(sess.Name(), sess.ID, s.codecs...)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, sessions.NewCookie(sess.Name(), encoded, sess.Options))
+	return nil
+}
+
+// ipExtractor finds the client address of a request for c.RealIP: the
+// address of the connection, or the one a trusted proxy puts in
+// X-Forwarded-For. Headers from anyone else are ignored.
+func ipExtractor(cfg Config) echo.IPExtractor {
+	if len(cfg.TrustedProxies) == 0 {
+		return echo.ExtractIPDirect()
+	}
+	options := []echo.TrustOption{echo.TrustLoopback(false), echo.TrustLinkLocal(false), echo.TrustPrivateNet(false)}
+	for _, ipRange := range cfg.TrustedProxies {
+		options = append(options, echo.TrustIPRange(ipRange))
+	}
+	return echo.ExtractIPFromXFFHeader(options...)
+}
+
+// sessionTimeouts logs out sessions that have been idle for longer than the
+// idle timeout or have outlived the absolute timeout, and records activity on
+// the others. It must run after the session middleware.
+func sessionTimeouts(cfg Config) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			sess, _ := session.Get("session", c)
+			if _, ok := sess.Values["userID"].(int); !ok {
+				return next(c)
+			}
+
+			now := time.Now()
+			createdAt, _ := sess.Values["createdAt"].(int64)
+			lastSeen, _ := sess.Values["lastSeen"].(int64)
+			idle := now.Sub(time.Unix(lastSeen, 0))
+			if now.Sub(time.Unix(createdAt, 0)) > cfg.SessionAbsoluteTimeout || idle > cfg.SessionIdleTimeout {
+				delete(sess.Values, "userID")
+			} else if idle > time.Minute {
+				// Coarse enough that the cookie or row is not rewritten on
+				// every request
+				sess.Values["lastSeen"] = now.Unix()
+			} else {
+				return next(c)
+			}
+
+			err := sess.Save(c.Request(), c.Response())
+			if err != nil {
+				log.Println("Error saving session:", err)
+			}
+			return next(c)
+		}
+	}
+}
+
+type sessionInfoResponse struct {
+	ID         string    `json:"id"`
+	Current    bool      `json:"current"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+}
+
+type sessionListResponse struct {
+	Sessions []sessionInfoResponse `json:"sessions"`
+}
+
+// sessionsNotSupported answers requests to list or revoke sessions when they
+// are kept in cookies, which the server cannot enumerate or take back.
+func sessionsNotSupported(c echo.Context) error {
+	return apiFail(c, http.StatusNotImplemented, "not_supported", "Sessions can only be listed and revoked with SESSION_STORE=database")
+}
+
+func apiSessionsHandler(db dbutil.Database, cfg Config, c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if cfg.SessionStore != "database" {
+		return sessionsNotSupported(c)
+	}
+
+	stored, err := db.ListSessions(ctx, apiCustomerID(c))
+	if err != nil {
+		log.Println("Error listing sessions:", err)
+		return apiFail(c, http.StatusInternalServerError, "internal_error", "Error listing sessions")
+	}
+
+	sess, _ := session.Get("session", c)
+	res := sessionListResponse{Sessions: make([]sessionInfoResponse, 0, len(stored))}
+	for _, s := range stored {
+		res.Sessions = append(res.Sessions, sessionInfoResponse{
+			ID:         s.Id,
+			Current:    s.Id == sess.ID,
+			UserAgent:  s.UserAgent,
+			IP:         s.IP,
+			CreatedAt:  s.CreatedAt,
+			LastSeenAt: s.LastSeenAt,
+		})
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+// apiRevokeSessionHandler revokes one of the customer's sessions.
+func apiRevokeSessionHandler(db dbutil.Database, cfg Config, c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if cfg.SessionStore != "database" {
+		return sessionsNotSupported(c)
+	}
+
+	stored, err := db.GetSession(ctx, c.Param("id"))
+	if errors.Is(err, dbutil.ErrSessionNotFound) || (err == nil && stored.CustomerId != apiCustomerID(c)) {
+		return apiFail(c, http.StatusNotFound, "session_not_found", "Session not found")
+	}
+	if err != nil {
+		log.Println("Error fetching session:", err)
+		return apiFail(c, http.StatusInternalServerError, "internal_error", "Error fetching session")
+	}
+
+	err = db.DeleteSession(ctx, stored.Id)
+	if err != nil {
+		log.Println("Error revoking session:", err)
+		return apiFail(c, http.StatusInternalServerError, "internal_error", "Error revoking session")
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// apiRevokeOtherSessionsHandler logs the customer out everywhere except the
+// session making the request.
+func apiRevokeOtherSessionsHandler(db dbutil.Database, cfg Config, c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if cfg.SessionStore != "database" {
+		return sessionsNotSupported(c)
+	}
+
+	sess, _ := session.Get("session", c)
+	_, err := db.DeleteCustomerSessions(ctx, apiCustomerID(c), sess.ID)
+	if err != nil {
+		log.Println("Error revoking sessions:", err)
+		return apiFail(c, http.StatusInternalServerError, "internal_error", "Error revoking sessions")
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// logoutAllHandler logs the customer out of every device, this one included.
+func logoutAllHandler(db dbutil.Database, cfg Config, c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if cfg.SessionStore == "database" {
+		_, err := db.DeleteCustomerSessions(ctx, currentCustomer(c).Id, "")
+		if err != nil {
+			log.Println("Error revoking sessions:", err)
+			return c.String(http.StatusInternalServerError, "Error logging out")
+		}
+	}
+	logOut(c)
+	return c.Redirect(http.StatusSeeOther, "/")
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"minibank/dbutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/securecookie"
+)
+
+func TestLogout(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.SessionStore = "database"
+	})
+	ts.customer(t, "alice@example.com", dbutil.RoleCustomer, "AUD")
+	tc := ts.login(t, "alice@example.com")
+
+	// A link, an image or another site cannot log the customer out
+	expectStatus(t, tc.get(t, "/logout"), http.StatusMethodNotAllowed)
+	expectStatus(t, tc.do(t, http.MethodPost, "/logout", "", nil, "X-CSRF-Token", ""), http.StatusForbidden)
+	body := expectStatus(t, tc.get(t, "/"), http.StatusOK)
+
+	// The navigation bar posts the token as _csrf
+	token := tc.csrfToken()
+	if !strings.Contains(body, `<form method="POST" action="/logout"`) || !strings.Contains(body, `name="_csrf" value="`+token+`"`) {
+		t.Errorf("page has no logout form with the CSRF token: %s", body)
+	}
+	id := tc.sessionID(t)
+	form := url.Values{"_csrf": {token}}.Encode()
+	resp := tc.do(t, http.MethodPost, "/logout", "application/x-www-form-urlencoded", strings.NewReader(form), "X-CSRF-Token", "")
+	expectStatus(t, resp, http.StatusSeeOther)
+
+	resp = tc.get(t, "/")
+	expectStatus(t, resp, http.StatusSeeOther)
+	if location := resp.Header.Get("Location"); location != "/login" {
+		t.Errorf("redirected to %q, want /login", location)
+	}
+	if _, err := ts.db.GetSession(context.Background(), id); !errors.Is(err, dbutil.ErrSessionNotFound) {
+		t.Errorf("session after logout: %v, want it deleted", err)
+	}
+}
+
+func TestLogoutAll(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.SessionStore = "database"
+	})
+	ts.customer(t, "alice@example.com", dbutil.RoleCustomer, "AUD")
+	laptop := ts.login(t, "alice@example.com")
+	phone := ts.login(t, "alice@example.com")
+
+	// A link or another site cannot log everyone out
+	expectStatus(t, laptop.get(t, "/logout-all"), http.StatusMethodNotAllowed)
+	expectStatus(t, laptop.do(t, http.MethodPost, "/logout-all", "", nil, "X-CSRF-Token", ""), http.StatusForbidden)
+	expectStatus(t, phone.get(t, "/"), http.StatusOK)
+
+	// The form sends the token as _csrf
+	form := url.Values{"_csrf": {laptop.csrfToken()}}.Encode()
+	resp := laptop.do(t, http.MethodPost, "/logout-all", "application/x-www-form-urlencoded", strings.NewReader(form), "X-CSRF-Token", "")
+	expectStatus(t, resp, http.StatusSeeOther)
+
+	for _, tc := range []*testClient{laptop, phone} {
+		resp := tc.get(t, "/")
+		expectStatus(t, resp, http.StatusSeeOther)
+		if location := resp.Header.Get("Location"); location != "/login" {
+			t.Errorf("redirected to %q, want /login", location)
+		}
+	}
+}
+
+// sessionID returns the ID of the client's server-side session, or "" if it
+// has none.
+func (tc *testClient) sessionID(t *testing.T) string {
+	t.Helper()
+	u, _ := url.Parse(tc.ts.URL)
+	for _, cookie := range tc.client.Jar.Cookies(u) {
+		if cookie.Name == "session" {
+			var id string
+			if err := securecookie.DecodeMulti(cookie.Name, cookie.Value, &id, securecookie.CodecsFromPairs(tc.ts.cfg.SessionKeys...)...); err != nil {
+				t.Fatal(err)
+			}
+			return id
+		}
+	}
+	return ""
+}
+
+func TestLoginRotatesSession(t *testing.T) {
+	now := time.Date(2026, 3, 2, 9, 0, 0, 0, time.UTC)
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.Clock = func() time.Time { return now }
+		cfg.SessionStore = "database"
+	})
+	alice, _ := ts.customer(t, "alice@example.com", dbutil.RoleCustomer, "AUD")
+	ts.enableTwoFactor(t, alice, now)
+	tc := ts.client(t)
+
+	// The password starts a session that waits for the code
+	expectStatus(t, tc.postForm(t, "/login", url.Values{"email": {alice.Email}, "password": {testPassword}}), http.StatusOK)
+	pending := tc.sessionID(t)
+	if pending == "" {
+		t.Fatal("no session after the password")
+	}
+	expectStatus(t, tc.postForm(t, "/login/two-factor", url.Values{"code": {totpCode(t, now)}}), http.StatusOK)
+
+	ctx := context.Background()
+	if id := tc.sessionID(t); id == pending {
+		t.Error("session ID kept at login")
+	} else if sess, err := ts.db.GetSession(ctx, id); err != nil || sess.CustomerId != alice.Id {
+		t.Errorf("new session %+v, %v, want one for Alice", sess, err)
+	}
+	if _, err := ts.db.GetSession(ctx, pending); !errors.Is(err, dbutil.ErrSessionNotFound) {
+		t.Errorf("session from before login: %v, want it deleted", err)
+	}
+}
@@ -0,0 +1,184 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"minibank/dbutil"
+	"minibank/statement"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// statementQuery is the query string of a statement download. The period
+// bounds take the same forms as a transaction history's, so until takes in
+// the whole of a date; by default the statement runs from the start of the
+// month to now. Format is one of statement.Formats, csv by default.
+type statementQuery struct {
+	Since  string `query:"since"`
+	Until  string `query:"until"`
+	Format string `query:"format"`
+}
+
+// buildStatement makes the statement of account that q asks for and returns
+// it with its format. Errors in q come back as errStatementQuery.
+func buildStatement(ctx context.Context, db dbutil.Database, cfg Config, account *dbutil.Account, q statementQuery) (*statement.Statement, string, error) {
+	format := q.Format
+	if format == "" {
+		format = statement.CSV
+	}
+	if !statement.ValidFormat(format) {
+		return nil, "", fmt.Errorf("%w: format must be one of %v", errStatementQuery, statement.Formats)
+	}
+
+	now := cfg.now().UTC()
+	since, err := parseHistoryTime(q.Since, false)
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: since must be a date (YYYY-MM-DD) or an RFC 3339 time", errStatementQuery)
+	}
+	if since == nil {
+		start := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+		since = &start
+	}
+	until, err := parseHistoryTime(q.Until, true)
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: until must be a date (YYYY-MM-DD) or an RFC 3339 time", errStatementQuery)
+	}
+	if until == nil {
+		until = &now
+	}
+	if !since.Before(*until) {
+		return nil, "", fmt.Errorf("%w: the period must end after it starts", errStatementQuery)
+	}
+
+	owner, err := db.GetCustomer(ctx, account.Customer_id)
+	if err != nil {
+		return nil, "", fmt.Errorf("error fetching owner of account %d: %w", account.Id, err)
+	}
+	opening, err := db.AccountBalanceAt(ctx, account.Id, *since)
+	if err != nil {
+		return nil, "", err
+	}
+	// Every transaction settled in the period, oldest first, so the running
+	// balance can be worked out from the opening one
+	page, err := db.ListTransactionsFromAccount(ctx, dbutil.TransactionFilter{
+		AccountId: account.Id,
+		Since:     since,
+		Until:     until,
+		Settled:   true,
+		Sort:      dbutil.SortOldest,
+	})
+	if err != nil {
+		return nil, "", fmt.Errorf("error fetching transactions for account %d: %w", account.Id, err)
+	}
+
+	holder := owner.First_name + " " + owner.Last_name
+	return statement.New(account, holder, *since, *until, opening, page.Transactions, now), format, nil
+}
+
+// errStatementQuery marks an error in a statement query, whose message is
+// fit to show the customer.
+var errStatementQuery = errors.New("invalid statement query")
+
+// statementContentTypes returns the media type of each statement format.
+func statementContentTypes() []string {
+	types := make([]string, len(statement.Formats))
+	for i, format := range statement.Formats {
+		types[i] = statement.ContentType(format)
+	}
+	return types
+}
+
+// sendStatement writes s in format as a download.
+func sendStatement(c echo.Context, s *statement.Statement, format string) error {
+	var body bytes.Buffer
+	if err := s.Write(&body, format); err != nil {
+		return err
+	}
+	c.Response().Header().Set(echo.HeaderContentDisposition, `attachment; filename="`+s.FileName(format)+`"`)
+	return c.Blob(http.StatusOK, statement.ContentType(format), body.Bytes())
+}
+
+func statementHandler(db dbutil.Database, cfg Config, c echo.Context) error {
+	ctx := c.Request().Context()
+
+	var q statementQuery
+	if err := (&echo.DefaultBinder{}).BindQueryParams(c, &q); err != nil {
+		return c.String(http.StatusBadRequest, "Invalid statement request")
+	}
+	accountID := primaryAccount(currentAccounts(c)).Id
+	if param := c.QueryParam("account_id"); param != "" {
+		id, err := strconv.Atoi(param)
+		if err != nil {
+			return c.String(http.StatusBadRequest, "Invalid account ID")
+		}
+		accountID = id
+	}
+	account, err := db.GetAccount(ctx, accountID)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && !canViewAccount(currentCustomer(c), account)) {
+		return c.String(http.StatusForbidden, "Forbidden")
+	}
+	if err != nil {
+		log.Printf("Error fetching account details for ID %d: %v", accountID, err)
+		return c.String(http.StatusInternalServerError, "Error fetching account details")
+	}
+
+	s, format, err := buildStatement(ctx, db, cfg, account, q)
+	if errors.Is(err, errStatementQuery) {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+	if err != nil {
+		log.Println("Error building statement:", err)
+		return c.String(http.StatusInternalServerError, "Error building statement")
+	}
+	if err := sendStatement(c, s, format); err != nil {
+		log.Println("Error writing statement:", err)
+		return c.String(http.StatusInternalServerError, "Error building statement")
+	}
+	return nil
+}
+
+func apiStatementHandler(db dbutil.Database, cfg Config, c echo.Context) error {
+	ctx := c.Request().Context()
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return apiFail(c, http.StatusBadRequest, "invalid_id", "Account ID must be a number")
+	}
+	var q statementQuery
+	if err := (&echo.DefaultBinder{}).BindQueryParams(c, &q); err != nil {
+		return apiFail(c, http.StatusBadRequest, "invalid_query", "Query string is not valid")
+	}
+
+	account, err := db.GetAccount(ctx, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return apiFail(c, http.StatusNotFound, "account_not_found", "Account not found")
+	}
+	if err != nil {
+		log.Printf("Error fetching account %d: %v", id, err)
+		return apiFail(c, http.StatusInternalServerError, "internal_error", "Error fetching account")
+	}
+	if !canViewAccount(currentCustomer(c), account) {
+		return apiFail(c, http.StatusForbidden, "forbidden", "You can only view your own accounts")
+	}
+
+	s, format, err := buildStatement(ctx, db, cfg, account, q)
+	if errors.Is(err, errStatementQuery) {
+		return apiFail(c, http.StatusBadRequest, "invalid_query", err.Error())
+	}
+	if err != nil {
+		log.Println("Error building statement:", err)
+		return apiFail(c, http.StatusInternalServerError, "internal_error", "Error building statement")
+	}
+	if err := sendStatement(c, s, format); err != nil {
+		log.Println("Error writing statement:", err)
+		return apiFail(c, http.StatusInternalServerError, "internal_error", "Error building statement")
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log"
+	"minibank/dbutil"
+	"time"
+)
+
+// errFundingAccount is returned when asked to freeze or close the funding
+// account, which backs every balance in the ledger.
+var errFundingAccount = errors.New("the funding account cannot change status")
+
+// changeAccountStatus moves account to status on behalf of actor, from a
+// client at ip, and records the change and reason in the audit log. Closing
+// the last open account of a customer logs them out everywhere their
+// sessions are kept server-side.
+func changeAccountStatus(ctx context.Context, db dbutil.Database, actor *dbutil.Customer, account *dbutil.Account, status, reason, ip string) error {
+	owner, err := db.GetCustomer(ctx, account.Customer_id)
+	if err != nil {
+		return err
+	}
+	if owner.Email == dbutil.FundingAccountEmail {
+		return errFundingAccount
+	}
+
+	now := time.Now()
+	err = db.SetAccountStatus(ctx, account.Id, status, reason, now)
+	if err != nil {
+		return err
+	}
+
+	if status == dbutil.StatusClosed {
+		accounts, err := db.ListCustomerAccounts(ctx, owner.Id)
+		if err == nil && !hasOpenAccount(accounts) {
+			_, err = db.DeleteCustomerSessions(ctx, owner.Id, "")
+		}
+		if err != nil {
+			log.Printf("Error ending sessions of customer %d: %v", owner.Id, err)
+		}
+	}
+
+	err = db.CreateAuditEvent(ctx, &dbutil.AuditEvent{
+		CustomerId: owner.Id,
+		AccountId:  account.Id,
+		ActorId:    actor.Id,
+		Event:      dbutil.AuditAccountStatusChanged,
+		Detail:     account.Status + " -> " + status + ": " + reason,
+		IP:         ip,
+		CreatedAt:  now,
+	})
+	if err != nil {
+		log.Println("Error writing audit event:", err)
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"minibank/dbutil"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// errAccountLocked is returned by authenticate while an email is locked out
+// after too many failed logins.
+var errAccountLocked = errors.New("too many failed logins, account temporarily locked")
+
+// loginDelayError is returned by authenticate when a login is attempted
+// before the backoff after the previous failure has passed.
+type loginDelayError struct {
+	Wait time.Duration
+}
+
+func (e *loginDelayError) Error() string {
+	return fmt.Sprintf("too many failed logins, try again in %s", e.Wait.Round(time.Second))
+}
+
+// setRetryAfter tells the client how many whole seconds to wait.
+func setRetryAfter(c echo.Context, wait time.Duration) {
+	c.Response().Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+}
+
+// Failed logins are counted per email address, whether or not a customer
+// has it, and per client IP. Each failure doubles the wait before the next
+// attempt, starting at loginBackoffBase; an email is locked for
+// LoginLockout once it reaches LoginMaxFailures. IPs are only slowed down,
+// and only after LoginMaxFailures failures, since many users can share one.
+const loginBackoffBase = time.Second
+
+func emailThrottleKey(email string) string {
+	return "email:" + strings.ToLower(email)
+}
+
+func ipThrottleKey(ip string) string {
+	return "ip:" + ip
+}
+
+// loginBackoff is how long to wait after failures failed logins, once grace
+// failures have been allowed for free.
+func loginBackoff(failures, grace int, limit time.Duration) time.Duration {
+	n := failures - grace
+	if n <= 0 {
+		return 0
+	}
+	if n > 30 {
+		return limit
+	}
+	wait := loginBackoffBase << (n - 1)
+	if wait > limit {
+		return limit
+	}
+	return wait
+}
+
+// checkLoginThrottle refuses a login for email from ip while it is locked
+// out or still backing off.
+func checkLoginThrottle(ctx context.Context, db dbutil.Database, cfg Config, email, ip string, now time.Time) error {
+	byEmail, err := db.GetLoginThrottle(ctx, emailThrottleKey(email))
+	if err != nil {
+		return err
+	}
+	if now.Before(byEmail.LockedUntil) {
+		return errAccountLocked
+	}
+	byIP, err := db.GetLoginThrottle(ctx, ipThrottleKey(ip))
+	if err != nil {
+		return err
+	}
+
+	var wait time.Duration
+	if now.Sub(byEmail.LastFailureAt) < cfg.LoginLockout {
+		wait = byEmail.LastFailureAt.Add(loginBackoff(byEmail.Failures, 0, cfg.LoginLockout)).Sub(now)
+	}
+	if now.Sub(byIP.LastFailureAt) < cfg.LoginLockout {
+		ipWait := byIP.LastFailureAt.Add(loginBackoff(byIP.Failures, cfg.LoginMaxFailures, cfg.LoginLockout)).Sub(now)
+		if ipWait > wait {
+			wait = ipWait
+		}
+	}
+	if wait > 0 {
+		return &loginDelayError{Wait: wait}
+	}
+	return nil
+}
+
+// recordLoginFailure counts a failed login and locks the email once it has
+// failed LoginMaxFailures times within LoginLockout.
+func recordLoginFailure(ctx context.Context, db dbutil.Database, cfg Config, email, ip string, now time.Time) error {
+	resetBefore := now.Add(-cfg.LoginLockout)
+
+	_, err := db.RecordLoginFailure(ctx, ipThrottleKey(ip), now, resetBefore)
+	if err != nil {
+		return err
+	}
+	byEmail, err := db.RecordLoginFailure(ctx, emailThrottleKey(email), now, resetBefore)
+	if err != nil {
+		return err
+	}
+	if byEmail.Failures < cfg.LoginMaxFailures {
+		return nil
+	}
+
+	until := now.Add(cfg.LoginLockout)
+	err = db.LockLogin(ctx, byEmail.Key, until)
+	if err != nil {
+		return err
+	}
+
+	event := &dbutil.AuditEvent{
+		Event:     dbutil.AuditAccountLocked,
+		Detail:    fmt.Sprintf("%d failed logins for %s, locked until %s", byEmail.Failures, email, until.UTC().Format(time.RFC3339)),
+		IP:        ip,
+		CreatedAt: now,
+	}
+	if customer, err := db.GetCustomerByEmail(ctx, email); err == nil {
+		event.CustomerId = customer.Id
+	}
+	err = db.CreateAuditEvent(ctx, event)
+	if err != nil {
+		log.Println("Error writing audit event:", err)
+	}
+	return nil
+}
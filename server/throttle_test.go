@@ -0,0 +1,53 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestLoginThrottleClientIP(t *testing.T) {
+	tests := []struct {
+		name           string
+		trustedProxies string
+		// counted is the address failures are counted against
+		counted string
+	}{
+		{"direct", "", "127.0.0.1"},
+		{"behind a proxy", "127.0.0.1", "203.0.113.7"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("TRUSTED_PROXIES", tt.trustedProxies)
+			ts := newTestServer(t, func(cfg *Config) {
+				cfg.TrustedProxies = ipRangesEnv("TRUSTED_PROXIES")
+			})
+			tc := ts.client(t)
+
+			// A client that makes up a new address for every guess
+			for i := 0; i < 3; i++ {
+				form := url.Values{"email": {fmt.Sprintf("guess%d@example.com", i)}, "password": {"wrong"}}
+				resp := tc.do(t, http.MethodPost, "/login", "application/x-www-form-urlencoded", strings.NewReader(form.Encode()),
+					"X-Forwarded-For", fmt.Sprintf("203.0.113.%d, 203.0.113.7", i), "X-Real-IP", "198.51.100.1")
+				readBody(t, resp)
+			}
+
+			for _, ip := range []string{"127.0.0.1", "203.0.113.0", "203.0.113.7", "198.51.100.1"} {
+				throttle, err := ts.db.GetLoginThrottle(context.Background(), ipThrottleKey(ip))
+				if err != nil {
+					t.Fatal(err)
+				}
+				want := 0
+				if ip == tt.counted {
+					want = 3
+				}
+				if throttle.Failures != want {
+					t.Errorf("%s has %d failures, want %d", ip, throttle.Failures, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,478 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"minibank/dbutil"
+	"minibank/totp"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+	"github.com/skip2/go-qrcode"
+)
+
+// twoFactorIssuer names the bank in authenticator apps.
+const twoFactorIssuer = "MiniBank"
+
+// twoFactorLoginWindow is how long a login that passed the password check
+// waits for its two-factor code.
+const twoFactorLoginWindow = 5 * time.Minute
+
+var (
+	// errTwoFactorRequired is returned by authenticate, along with the
+	// customer, when the password was right but the customer also needs a
+	// two-factor code; see authenticateSecondFactor.
+	errTwoFactorRequired = errors.New("two-factor code required")
+
+	errInvalidTwoFactorCode = errors.New("invalid two-factor code")
+
+	// errStepUpRequired is returned by confirmStepUp when no confirmation
+	// was given at all.
+	errStepUpRequired = errors.New("payment must be confirmed")
+)
+
+// loadTwoFactor returns the customer's two-factor settings, or nil if it has
+// never started enrolling.
+func loadTwoFactor(ctx context.Context, db dbutil.Database, customerID int) (*dbutil.TwoFactor, error) {
+	tf, err := db.GetTwoFactor(ctx, customerID)
+	if errors.Is(err, dbutil.ErrTwoFactorNotFound) {
+		return nil, nil
+	}
+	return tf, err
+}
+
+// verifySecondFactor accepts a current TOTP code that has not been used
+// before, or one of the customer's unused recovery codes.
+func verifySecondFactor(ctx context.Context, db dbutil.Database, cfg Config, tf *dbutil.TwoFactor, code, ip string) error {
+	code = strings.TrimSpace(code)
+	now := cfg.now()
+
+	if len(code) == totp.Digits {
+		step, ok := totp.Validate(tf.Secret, code, now, tf.LastUsedStep)
+		if !ok {
+			return errInvalidTwoFactorCode
+		}
+		err := db.UseTwoFactorStep(ctx, tf.CustomerId, step)
+		if errors.Is(err, dbutil.ErrTwoFactorCodeUsed) {
+			return errInvalidTwoFactorCode
+		}
+		return err
+	}
+
+	err := db.UseRecoveryCode(ctx, tf.CustomerId, dbutil.HashRecoveryCode(code), now)
+	if errors.Is(err, dbutil.ErrRecoveryCodeNotFound) {
+		return errInvalidTwoFactorCode
+	}
+	if err != nil {
+		return err
+	}
+	err = db.CreateAuditEvent(ctx, &dbutil.AuditEvent{
+		CustomerId: tf.CustomerId,
+		ActorId:    tf.CustomerId,
+		Event:      dbutil.AuditRecoveryCodeUsed,
+		IP:         ip,
+		CreatedAt:  now,
+	})
+	if err != nil {
+		log.Println("Error writing audit event:", err)
+	}
+	return nil
+}
+
+// authenticateSecondFactor checks the two-factor code for a customer that
+// has already given their password. Wrong codes count as failed logins, so
+// they are throttled and lock their login just like wrong passwords.
+func authenticateSecondFactor(ctx context.Context, db dbutil.Database, cfg Config, customer *dbutil.Customer, code, ip string) error {
+	now := cfg.now()
+	err := checkLoginThrottle(ctx, db, cfg, customer.Email, ip, now)
+	if err != nil {
+		return err
+	}
+
+	tf, err := loadTwoFactor(ctx, db, customer.Id)
+	if err != nil {
+		return err
+	}
+	if tf.Enabled() {
+		err = verifySecondFactor(ctx, db, cfg, tf, code, ip)
+		if errors.Is(err, errInvalidTwoFactorCode) {
+			err = recordLoginFailure(ctx, db, cfg, customer.Email, ip, now)
+			if err != nil {
+				return err
+			}
+			return errInvalidTwoFactorCode
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return db.ClearLoginThrottle(ctx, emailThrottleKey(customer.Email))
+}
+
+// needsStepUp reports whether a payment of amount must be confirmed again.
+func needsStepUp(ctx context.Context, db dbutil.Database, cfg Config, amount dbutil.Money) bool {
+	return stepUpThreshold(ctx, db, cfg, amount.Currency).LessThan(amount)
+}
+
+// stepUpThreshold returns cfg.StepUpThreshold in currency, converted at the
+// current exchange rate. Without a rate it is zero, so every payment in that
+// currency must be confirmed.
+func stepUpThreshold(ctx context.Context, db dbutil.Database, cfg Config, currency string) dbutil.Money {
+	if currency == cfg.StepUpThreshold.Currency {
+		return cfg.StepUpThreshold
+	}
+	rate, err := db.GetExchangeRate(ctx, cfg.StepUpThreshold.Currency, currency)
+	if err != nil {
+		if !errors.Is(err, dbutil.ErrNoExchangeRate) {
+			log.Println("Error fetching exchange rate:", err)
+		}
+		return dbutil.NewMoney(0, currency)
+	}
+	threshold, _, err := rate.Convert(cfg.StepUpThreshold)
+	if err != nil {
+		log.Println("Error converting step-up threshold:", err)
+		return dbutil.NewMoney(0, currency)
+	}
+	return threshold
+}
+
+// confirmStepUp checks the confirmation for a large payment: a two-factor
+// code for accounts that have two-factor authentication, or else the
+// password.
+func confirmStepUp(ctx context.Context, db dbutil.Database, cfg Config, customer *dbutil.Customer, confirmation, ip string) error {
+	if confirmation == "" {
+		return errStepUpRequired
+	}
+
+	tf, err := loadTwoFactor(ctx, db, customer.Id)
+	if err != nil {
+		return err
+	}
+	if tf.Enabled() {
+		return authenticateSecondFactor(ctx, db, cfg, customer, confirmation, ip)
+	}
+	_, err = authenticate(ctx, db, cfg, customer.Email, confirmation, ip)
+	return err
+}
+
+// stepUpRefusal returns how a refusal from confirmStepUp is reported, or nil
+// if err is not one. required says what must be confirmed. A customer who
+// has to wait before trying again is told how long with Retry-After.
+func stepUpRefusal(c echo.Context, err error, required string) *requestError {
+	var delay *loginDelayError
+	switch {
+	case errors.Is(err, errStepUpRequired):
+		return &requestError{status: http.StatusForbidden, code: "step_up_required", message: required + " must be confirmed"}
+	case errors.Is(err, errInvalidTwoFactorCode) || errors.Is(err, errInvalidCredentials):
+		return &requestError{status: http.StatusForbidden, code: "step_up_failed", message: "Confirmation failed"}
+	case errors.As(err, &delay):
+		setRetryAfter(c, delay.Wait)
+		return &requestError{status: http.StatusTooManyRequests, code: "too_many_attempts", message: "Too many failed attempts. Please wait a moment and try again."}
+	case errors.Is(err, errAccountLocked):
+		return &requestError{status: http.StatusTooManyRequests, code: "too_many_attempts", message: "Too many failed attempts. Please try again later."}
+	}
+	return nil
+}
+
+// stepUpMethod tells the payment page what to ask for when confirming a
+// large payment.
+func stepUpMethod(ctx context.Context, db dbutil.Database, customerID int) (string, error) {
+	tf, err := loadTwoFactor(ctx, db, customerID)
+	if err != nil {
+		return "", err
+	}
+	if tf.Enabled() {
+		return "code", nil
+	}
+	return "password", nil
+}
+
+// startTwoFactorLogin remembers a customer that passed the password check
+// until their two-factor code arrives. They are not logged in yet.
+func startTwoFactorLogin(c echo.Context, customerID int, now time.Time) error {
+	sess, _ := session.Get("session", c)
+	sess.Values["pendingUserID"] = customerID
+	sess.Values["pendingAt"] = now.Unix()
+	return sess.Save(c.Request(), c.Response())
+}
+
+// pendingTwoFactorLogin returns the customer waiting for their two-factor code,
+// if it has not waited too long.
+func pendingTwoFactorLogin(c echo.Context, now time.Time) (int, bool) {
+	sess, _ := session.Get("session", c)
+	customerID, ok := sess.Values["pendingUserID"].(int)
+	if !ok {
+		return 0, false
+	}
+	pendingAt, _ := sess.Values["pendingAt"].(int64)
+	if now.Sub(time.Unix(pendingAt, 0)) > twoFactorLoginWindow {
+		return 0, false
+	}
+	return customerID, true
+}
+
+// loginTwoFactorHandler finishes a login started by loginHandler for an
+// customer with two-factor authentication.
+func loginTwoFactorHandler(db dbutil.Database, cfg Config, c echo.Context) error {
+	ctx := c.Request().Context()
+
+	customerID, ok := pendingTwoFactorLogin(c, cfg.now())
+	if !ok {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Your login has expired. Please enter your password again."})
+	}
+	customer, err := db.GetCustomer(ctx, customerID)
+	if err != nil {
+		log.Printf("Error fetching customer %d: %v", customerID, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "An error occurred. Please try again."})
+	}
+
+	err = authenticateSecondFactor(ctx, db, cfg, customer, c.FormValue("code"), c.RealIP())
+	if errors.Is(err, errInvalidTwoFactorCode) {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid code."})
+	}
+	if errors.Is(err, errAccountLocked) {
+		return c.JSON(http.StatusLocked, map[string]string{"error": "Too many failed logins. Please try again later."})
+	}
+	var delay *loginDelayError
+	if errors.As(err, &delay) {
+		setRetryAfter(c, delay.Wait)
+		return c.JSON(http.StatusTooManyRequests, map[string]string{"error": "Too many failed logins. Please wait a moment and try again."})
+	}
+	if err != nil {
+		log.Println("Error checking two-factor code:", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "An error occurred. Please try again."})
+	}
+
+	logIn(c, db, customer.Id)
+	return c.JSON(http.StatusOK, map[string]string{"status": "success"})
+}
+
+// renderTwoFactor renders the two-factor settings page with data, adding
+// whether two-factor authentication is on and how many recovery codes are
+// left.
+func renderTwoFactor(db dbutil.Database, c echo.Context, status int, data map[string]interface{}) error {
+	ctx := c.Request().Context()
+	customer := currentCustomer(c)
+
+	tf, err := loadTwoFactor(ctx, db, customer.Id)
+	if err != nil {
+		log.Println("Error fetching two-factor settings:", err)
+		return c.String(http.StatusInternalServerError, "Error fetching two-factor settings")
+	}
+	remaining := 0
+	if tf.Enabled() {
+		remaining, err = db.CountRecoveryCodes(ctx, customer.Id)
+		if err != nil {
+			log.Println("Error counting recovery codes:", err)
+			return c.String(http.StatusInternalServerError, "Error fetching two-factor settings")
+		}
+	}
+
+	if data == nil {
+		data = map[string]interface{}{}
+	}
+	data["Enabled"] = tf.Enabled()
+	data["RecoveryCodesLeft"] = remaining
+	return c.Render(status, "two-factor", data)
+}
+
+// twoFactorCodeError renders the settings page again after a two-factor code
+// was refused, or fails for unexpected errors.
+func twoFactorCodeError(db dbutil.Database, c echo.Context, err error) error {
+	message := ""
+	var delay *loginDelayError
+	switch {
+	case errors.Is(err, errInvalidTwoFactorCode):
+		message = "Invalid code."
+	case errors.Is(err, errAccountLocked), errors.As(err, &delay):
+		message = "Too many failed attempts. Please try again later."
+	default:
+		log.Println("Error checking two-factor code:", err)
+		return c.String(http.StatusInternalServerError, "Error checking two-factor code")
+	}
+	return renderTwoFactor(db, c, http.StatusBadRequest, map[string]interface{}{"Error": message})
+}
+
+func twoFactorHandler(db dbutil.Database, c echo.Context) error {
+	return renderTwoFactor(db, c, http.StatusOK, nil)
+}
+
+// twoFactorEnrollHandler generates a new secret and shows it, as a QR code
+// and as text, for the customer to add to their authenticator app. Two-factor
+// authentication stays off until twoFactorConfirmHandler sees a code.
+func twoFactorEnrollHandler(db dbutil.Database, cfg Config, c echo.Context) error {
+	ctx := c.Request().Context()
+	customer := currentCustomer(c)
+
+	tf, err := loadTwoFactor(ctx, db, customer.Id)
+	if err != nil {
+		log.Println("Error fetching two-factor settings:", err)
+		return c.String(http.StatusInternalServerError, "Error fetching two-factor settings")
+	}
+	if tf.Enabled() {
+		return c.Redirect(http.StatusSeeOther, "/two-factor")
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		log.Println("Error generating two-factor secret:", err)
+		return c.String(http.StatusInternalServerError, "Error setting up two-factor authentication")
+	}
+	err = db.SaveTwoFactor(ctx, &dbutil.TwoFactor{CustomerId: customer.Id, Secret: secret, CreatedAt: cfg.now()})
+	if err != nil {
+		log.Println("Error saving two-factor secret:", err)
+		return c.String(http.StatusInternalServerError, "Error setting up two-factor authentication")
+	}
+
+	data, err := twoFactorEnrollment(customer, secret)
+	if err != nil {
+		log.Println(err)
+		return c.String(http.StatusInternalServerError, "Error setting up two-factor authentication")
+	}
+	return renderTwoFactor(db, c, http.StatusOK, data)
+}
+
+// twoFactorEnrollment returns what the settings page shows while secret
+// waits to be confirmed: the secret, and a QR code of it for authenticator
+// apps to scan. The QR code is drawn here, as a PNG data URI, so the secret
+// is never handed to a script from another site.
+func twoFactorEnrollment(customer *dbutil.Customer, secret string) (map[string]interface{}, error) {
+	png, err := qrcode.Encode(totp.ProvisioningURI(twoFactorIssuer, customer.Email, secret), qrcode.Medium, 200)
+	if err != nil {
+		return nil, fmt.Errorf("error drawing two-factor QR code: %w", err)
+	}
+	return map[string]interface{}{
+		"Secret": secret,
+		"QRCode": template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(png)),
+	}, nil
+}
+
+// twoFactorConfirmHandler turns two-factor authentication on once the
+// customer sends a code generated from the new secret, and shows their recovery
+// codes. They are not shown again.
+func twoFactorConfirmHandler(db dbutil.Database, cfg Config, c echo.Context) error {
+	ctx := c.Request().Context()
+	customer := currentCustomer(c)
+
+	tf, err := loadTwoFactor(ctx, db, customer.Id)
+	if err != nil {
+		log.Println("Error fetching two-factor settings:", err)
+		return c.String(http.StatusInternalServerError, "Error fetching two-factor settings")
+	}
+	if tf == nil || tf.Enabled() {
+		return c.Redirect(http.StatusSeeOther, "/two-factor")
+	}
+
+	now := cfg.now()
+	step, ok := totp.Validate(tf.Secret, strings.TrimSpace(c.FormValue("code")), now, 0)
+	if !ok {
+		data, err := twoFactorEnrollment(customer, tf.Secret)
+		if err != nil {
+			log.Println(err)
+			return c.String(http.StatusInternalServerError, "Error setting up two-factor authentication")
+		}
+		data["Error"] = "That code did not match. Check your device's clock and try again."
+		return renderTwoFactor(db, c, http.StatusBadRequest, data)
+	}
+
+	codes, hashes, err := dbutil.NewRecoveryCodes()
+	if err != nil {
+		log.Println(err)
+		return c.String(http.StatusInternalServerError, "Error setting up two-factor authentication")
+	}
+	err = db.ConfirmTwoFactor(ctx, customer.Id, step, now, hashes)
+	if err != nil {
+		log.Println("Error confirming two-factor secret:", err)
+		return c.String(http.StatusInternalServerError, "Error setting up two-factor authentication")
+	}
+
+	err = db.CreateAuditEvent(ctx, &dbutil.AuditEvent{
+		CustomerId: customer.Id,
+		ActorId:    customer.Id,
+		Event:      dbutil.AuditTwoFactorEnabled,
+		IP:         c.RealIP(),
+		CreatedAt:  now,
+	})
+	if err != nil {
+		log.Println("Error writing audit event:", err)
+	}
+
+	return renderTwoFactor(db, c, http.StatusOK, map[string]interface{}{
+		"RecoveryCodes": codes,
+	})
+}
+
+// twoFactorRecoveryCodesHandler replaces the customer's recovery codes, after
+// a code from their authenticator app or a recovery code.
+func twoFactorRecoveryCodesHandler(db dbutil.Database, cfg Config, c echo.Context) error {
+	ctx := c.Request().Context()
+	customer := currentCustomer(c)
+
+	err := authenticateSecondFactor(ctx, db, cfg, customer, c.FormValue("code"), c.RealIP())
+	if err != nil {
+		return twoFactorCodeError(db, c, err)
+	}
+
+	codes, hashes, err := dbutil.NewRecoveryCodes()
+	if err != nil {
+		log.Println(err)
+		return c.String(http.StatusInternalServerError, "Error generating recovery codes")
+	}
+	err = db.ReplaceRecoveryCodes(ctx, customer.Id, hashes)
+	if err != nil {
+		log.Println("Error replacing recovery codes:", err)
+		return c.String(http.StatusInternalServerError, "Error generating recovery codes")
+	}
+
+	err = db.CreateAuditEvent(ctx, &dbutil.AuditEvent{
+		CustomerId: customer.Id,
+		ActorId:    customer.Id,
+		Event:      dbutil.AuditRecoveryCodesRenewed,
+		IP:         c.RealIP(),
+		CreatedAt:  cfg.now(),
+	})
+	if err != nil {
+		log.Println("Error writing audit event:", err)
+	}
+
+	return renderTwoFactor(db, c, http.StatusOK, map[string]interface{}{
+		"RecoveryCodes": codes,
+	})
+}
+
+// twoFactorDisableHandler turns two-factor authentication off, after a code
+// from the authenticator app or a recovery code.
+func twoFactorDisableHandler(db dbutil.Database, cfg Config, c echo.Context) error {
+	ctx := c.Request().Context()
+	customer := currentCustomer(c)
+
+	err := authenticateSecondFactor(ctx, db, cfg, customer, c.FormValue("code"), c.RealIP())
+	if err != nil {
+		return twoFactorCodeError(db, c, err)
+	}
+
+	err = db.DeleteTwoFactor(ctx, customer.Id)
+	if err != nil {
+		log.Println("Error turning off two-factor authentication:", err)
+		return c.String(http.StatusInternalServerError, "Error turning off two-factor authentication")
+	}
+
+	err = db.CreateAuditEvent(ctx, &dbutil.AuditEvent{
+		CustomerId: customer.Id,
+		ActorId:    customer.Id,
+		Event:      dbutil.AuditTwoFactorDisabled,
+		IP:         c.RealIP(),
+		CreatedAt:  cfg.now(),
+	})
+	if err != nil {
+		log.Println("Error writing audit event:", err)
+	}
+	return c.Redirect(http.StatusSeeOther, "/two-factor")
+}
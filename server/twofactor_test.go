@@ -0,0 +1,225 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"html"
+	"image/png"
+	"minibank/dbutil"
+	"minibank/totp"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testTOTPSecret is the two-factor secret of every customer tests enroll,
+// so which codes are right does not depend on chance.
+const testTOTPSecret = "JBSWY3DPEHPK3PXPJBSWY3DPEHPK3PXP"
+
+// enableTwoFactor turns on two-factor authentication for customer with
+// testTOTPSecret, as if enrolled at now, and returns the recovery codes.
+func (ts *testServer) enableTwoFactor(t *testing.T, customer *dbutil.Customer, now time.Time) []string {
+	t.Helper()
+	codes, hashes, err := dbutil.NewRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := ts.db.SaveTwoFactor(ctx, &dbutil.TwoFactor{CustomerId: customer.Id, Secret: testTOTPSecret, CreatedAt: now}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.db.ConfirmTwoFactor(ctx, customer.Id, 0, now, hashes); err != nil {
+		t.Fatal(err)
+	}
+	return codes
+}
+
+// totpCode returns the code for testTOTPSecret at t.
+func totpCode(t *testing.T, at time.Time) string {
+	t.Helper()
+	code, err := totp.Code(testTOTPSecret, at)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
+
+func TestEnrollTwoFactor(t *testing.T) {
+	now := time.Date(2026, 3, 2, 9, 0, 0, 0, time.UTC)
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.Clock = func() time.Time { return now }
+	})
+	alice, _ := ts.customer(t, "alice@example.com", dbutil.RoleCustomer, "AUD")
+	session := ts.login(t, alice.Email)
+
+	body := expectStatus(t, session.postForm(t, "/two-factor/enroll", nil), http.StatusOK)
+	// The QR code is an image from the bank, not drawn by a script that is
+	// handed the secret
+	if strings.Contains(body, "<script src=") {
+		t.Error("enrollment page loads a script")
+	}
+	match := regexp.MustCompile(`<img src="data:image/png;base64,([^"]+)"`).FindStringSubmatch(body)
+	if match == nil {
+		t.Fatalf("no QR code on the enrollment page: %s", body)
+	}
+	data, err := base64.StdEncoding.DecodeString(html.UnescapeString(match[1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := png.Decode(bytes.NewReader(data)); err != nil {
+		t.Errorf("QR code is not a PNG: %v", err)
+	}
+
+	tf, err := ts.db.GetTwoFactor(context.Background(), alice.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(body, "<code>"+tf.Secret+"</code>") {
+		t.Error("enrollment page does not show the key")
+	}
+	body = expectStatus(t, session.postForm(t, "/two-factor/confirm", url.Values{"code": {"not a code"}}), http.StatusBadRequest)
+	if !strings.Contains(body, "data:image/png;base64,") {
+		t.Error("QR code not shown again after a wrong code")
+	}
+	code, err := totp.Code(tf.Secret, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body = expectStatus(t, session.postForm(t, "/two-factor/confirm", url.Values{"code": {code}}), http.StatusOK)
+	if !strings.Contains(body, "recovery codes") {
+		t.Errorf("recovery codes not shown: %s", body)
+	}
+}
+
+func TestLoginTwoFactor(t *testing.T) {
+	now := time.Date(2026, 3, 2, 9, 0, 0, 0, time.UTC)
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.Clock = func() time.Time { return now }
+	})
+	alice, _ := ts.customer(t, "alice@example.com", dbutil.RoleCustomer, "AUD")
+	recovery := ts.enableTwoFactor(t, alice, now)
+
+	// logIn gives the password and then code, and reports whether the
+	// client ends up logged in
+	logIn := func(code string) bool {
+		t.Helper()
+		tc := ts.client(t)
+		body := expectStatus(t, tc.postForm(t, "/login", url.Values{"email": {alice.Email}, "password": {testPassword}}), http.StatusOK)
+		if !strings.Contains(body, "two_factor_required") {
+			t.Fatalf("password accepted without asking for the code: %s", body)
+		}
+		// The password alone does not log in
+		expectStatus(t, tc.get(t, "/two-factor"), http.StatusSeeOther)
+
+		resp := tc.postForm(t, "/login/two-factor", url.Values{"code": {code}})
+		readBody(t, resp)
+		if resp.StatusCode != http.StatusOK {
+			// Failed codes slow down the next login by a second or two,
+			// which stays within the same step
+			now = now.Add(5 * time.Second)
+			return false
+		}
+		expectStatus(t, tc.get(t, "/two-factor"), http.StatusOK)
+		return true
+	}
+
+	// A code from well outside the skew is as good as a wrong guess
+	if logIn(totpCode(t, now.Add(5*totp.Period))) {
+		t.Error("logged in with a wrong code")
+	}
+	code := totpCode(t, now)
+	if !logIn(code) {
+		t.Fatal("current code refused")
+	}
+	if logIn(code) {
+		t.Error("logged in with a code that was already used")
+	}
+	// A code from the step before the used one is still within the skew,
+	// but is refused too
+	if logIn(totpCode(t, now.Add(-totp.Period))) {
+		t.Error("logged in with a code older than the one used")
+	}
+	now = now.Add(totp.Period)
+	if !logIn(totpCode(t, now)) {
+		t.Error("next code refused")
+	}
+
+	// Each recovery code works once, with any spacing and case
+	if !logIn(" " + strings.ToUpper(recovery[0]) + " ") {
+		t.Error("recovery code refused")
+	}
+	if logIn(recovery[0]) {
+		t.Error("logged in with a recovery code that was already used")
+	}
+	if !logIn(recovery[1]) {
+		t.Error("second recovery code refused")
+	}
+
+	// The code has to follow the password within twoFactorLoginWindow
+	tc := ts.client(t)
+	expectStatus(t, tc.postForm(t, "/login", url.Values{"email": {alice.Email}, "password": {testPassword}}), http.StatusOK)
+	now = now.Add(twoFactorLoginWindow + time.Minute)
+	expectStatus(t, tc.postForm(t, "/login/two-factor", url.Values{"code": {totpCode(t, now)}}), http.StatusUnauthorized)
+}
+
+func TestPaymentStepUp(t *testing.T) {
+	now := time.Date(2026, 3, 2, 9, 0, 0, 0, time.UTC)
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.Clock = func() time.Time { return now }
+		cfg.StepUpThreshold = dbutil.NewMoney(5000, "AUD")
+	})
+	alice, aliceAccount := ts.customer(t, "alice@example.com", dbutil.RoleCustomer, "AUD")
+	_, bobAccount := ts.customer(t, "bob@example.com", dbutil.RoleCustomer, "AUD")
+	ts.enableTwoFactor(t, alice, now)
+
+	// Alice logs in with the code from the step before, so the current one
+	// is still unused
+	session := ts.client(t)
+	expectStatus(t, session.postForm(t, "/login", url.Values{"email": {alice.Email}, "password": {testPassword}}), http.StatusOK)
+	expectStatus(t, session.postForm(t, "/login/two-factor", url.Values{"code": {totpCode(t, now.Add(-totp.Period))}}), http.StatusOK)
+
+	// pay sends amount to Bob, confirmed with stepUp, and returns the
+	// status
+	pay := func(amount, stepUp string) int {
+		t.Helper()
+		resp := session.postForm(t, "/payment", url.Values{
+			"from_account": {strconv.Itoa(aliceAccount.Id)},
+			"recipient":    {"bob@example.com"},
+			"amount":       {amount},
+			"step_up":      {stepUp},
+		})
+		readBody(t, resp)
+		if resp.StatusCode != http.StatusSeeOther {
+			now = now.Add(5 * time.Second)
+		}
+		return resp.StatusCode
+	}
+	before := ts.balance(t, bobAccount.Id)
+
+	if got := pay("60.00", ""); got != http.StatusForbidden {
+		t.Errorf("unconfirmed large payment: status %d, want %d", got, http.StatusForbidden)
+	}
+	// With two-factor authentication the password is not enough
+	if got := pay("60.00", testPassword); got != http.StatusForbidden {
+		t.Errorf("large payment confirmed with the password: status %d, want %d", got, http.StatusForbidden)
+	}
+	code := totpCode(t, now)
+	if got := pay("60.00", code); got != http.StatusSeeOther {
+		t.Errorf("large payment confirmed with the code: status %d, want %d", got, http.StatusSeeOther)
+	}
+	if got := pay("60.00", code); got != http.StatusForbidden {
+		t.Errorf("large payment confirmed with a used code: status %d, want %d", got, http.StatusForbidden)
+	}
+	if got := pay("50.00", ""); got != http.StatusSeeOther {
+		t.Errorf("payment at the threshold: status %d, want %d", got, http.StatusSeeOther)
+	}
+
+	if got, want := ts.balance(t, bobAccount.Id), before.Add(dbutil.NewMoney(11000, "AUD")); got != want {
+		t.Errorf("Bob has %s, want %s", got, want)
+	}
+}
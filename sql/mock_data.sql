@@ -1,7 +1,16 @@
--- Insert some mock data into the account table
-INSERT INTO account (first_name, last_name, email, phone_number, encrypted_password, balance, created_at, updated_at) VALUES
-('Government', '', 'MockGov@gov.com', 000, 'something', 0, '2024-11-01T12:00:00Z', '2024-11-01T12:00:00Z'),
-('John', 'Doe', 'john.doe@example.com', 1234567890, 'encrypted_password_1', 1000.00, '2024-11-01T12:00:00Z', '2024-11-01T12:00:00Z'),
-('Jane', 'Smith', 'jane.smith@example.com', 9876543210, 'encrypted_password_2', 500.50, '2024-10-20T09:30:00Z', '2024-10-20T09:30:00Z'),
-('Alice', 'Johnson', 'alice.johnson@example.com', 5551237890, 'encrypted_password_3', 2500.75, '2024-09-15T15:45:00Z', '2024-09-15T15:45:00Z'),
-('Bob', 'Williams', 'bob.williams@example.com', 1112223330, 'encrypted_password_4', 100.00, '2024-11-01T08:15:00Z', '2024-11-01T08:15:00Z');
\ No newline at end of file
+-- Insert some mock data into the customers table
+INSERT INTO customers (first_name, last_name, email, phone_number, encrypted_password, created_at, updated_at) VALUES
+('Government', '', 'MockGov@gov.com', 000, 'something', '2024-11-01T12:00:00Z', '2024-11-01T12:00:00Z'),
+('John', 'Doe', 'john.doe@example.com', 1234567890, 'encrypted_password_1', '2024-11-01T12:00:00Z', '2024-11-01T12:00:00Z'),
+('Jane', 'Smith', 'jane.smith@example.com', 9876543210, 'encrypted_password_2', '2024-10-20T09:30:00Z', '2024-10-20T09:30:00Z'),
+('Alice', 'Johnson', 'alice.johnson@example.com', 5551237890, 'encrypted_password_3', '2024-09-15T15:45:00Z', '2024-09-15T15:45:00Z'),
+('Bob', 'Williams', 'bob.williams@example.com', 1112223330, 'encrypted_password_4', '2024-11-01T08:15:00Z', '2024-11-01T08:15:00Z');
+
+-- And an account for each of them, with Alice also keeping savings
+INSERT INTO account (customer_id, type, nickname, balance, created_at, updated_at) VALUES
+((SELECT id FROM customers WHERE email = 'MockGov@gov.com'), 'checking', '', 0, '2024-11-01T12:00:00Z', '2024-11-01T12:00:00Z'),
+((SELECT id FROM customers WHERE email = 'john.doe@example.com'), 'checking', '', 100000, '2024-11-01T12:00:00Z', '2024-11-01T12:00:00Z'),
+((SELECT id FROM customers WHERE email = 'jane.smith@example.com'), 'checking', '', 50050, '2024-10-20T09:30:00Z', '2024-10-20T09:30:00Z'),
+((SELECT id FROM customers WHERE email = 'alice.johnson@example.com'), 'checking', '', 200075, '2024-09-15T15:45:00Z', '2024-09-15T15:45:00Z'),
+((SELECT id FROM customers WHERE email = 'alice.johnson@example.com'), 'savings', 'Rainy day', 50000, '2024-09-15T15:45:00Z', '2024-09-15T15:45:00Z'),
+((SELECT id FROM customers WHERE email = 'bob.williams@example.com'), 'checking', '', 10000, '2024-11-01T08:15:00Z', '2024-11-01T08:15:00Z');
@@ -1 +1 @@
-select * from account;
\ No newline at end of file
+select id, first_name, last_name, email, phone_number, encrypted_password, role, email_verified_at, created_at, updated_at from customers where email != 'funding@minibank.internal';
\ No newline at end of file
@@ -0,0 +1,147 @@
+package statement
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Page layout of PDF statements, in points: A4 with the text set in 8 point
+// Courier, whose characters are all 0.6 em wide, so the columns line up.
+const (
+	pageWidth    = 595
+	pageHeight   = 842
+	pageMargin   = 40
+	fontSize     = 8
+	lineHeight   = 11
+	linesPerPage = (pageHeight - 2*pageMargin) / lineHeight
+)
+
+// pdfLine is one line of text on a page, in bold or not.
+type pdfLine struct {
+	text string
+	bold bool
+}
+
+// WritePDF writes the statement as a printable PDF: the account and period,
+// then a table of the transactions with the running balance between the
+// opening and closing balances, over as many pages as it takes.
+func (s *Statement) WritePDF(w io.Writer) error {
+	heading := []pdfLine{
+		{text: "MiniBank account statement", bold: true},
+		{},
+		{text: "Account holder:  " + s.Holder},
+		{text: fmt.Sprintf("Account:         %s, number %d, in %s", s.AccountName, s.AccountId, s.Currency)},
+		{text: fmt.Sprintf("Period:          %s to %s", s.Since.Format("2 January 2006"), s.LastDay().Format("2 January 2006"))},
+		{text: fmt.Sprintf("Opening balance: %s %s", s.Opening, s.Currency)},
+		{text: fmt.Sprintf("Closing balance: %s %s", s.Closing, s.Currency)},
+		{text: "Times are UTC. Produced " + s.CreatedAt.Format("2 January 2006 15:04") + "."},
+		{},
+	}
+	header := pdfLine{text: pdfRow("Date", "ID", "Type", "Description", "Amount", "Balance"), bold: true}
+
+	rows := []pdfLine{{text: pdfRow(s.Since.Format("2006-01-02 15:04"), "", "", "Opening balance", "", s.Opening.String())}}
+	for _, line := range s.Lines {
+		rows = append(rows, pdfLine{text: pdfRow(line.Date.Format("2006-01-02 15:04"), strconv.Itoa(line.TransactionId),
+			line.Type, line.Description, line.Amount.String(), line.Balance.String())})
+	}
+	rows = append(rows, pdfLine{text: pdfRow(s.Until.Format("2006-01-02 15:04"), "", "", "Closing balance", "", s.Closing.String()), bold: true})
+
+	// Every page repeats the table header and ends with its number, which
+	// leaves the lines in between for rows
+	var pages [][]pdfLine
+	page := append(append([]pdfLine{}, heading...), header)
+	for _, row := range rows {
+		if len(page) == linesPerPage-2 {
+			pages = append(pages, page)
+			page = []pdfLine{header}
+		}
+		page = append(page, row)
+	}
+	pages = append(pages, page)
+	for i := range pages {
+		pages[i] = append(pages[i], pdfLine{}, pdfLine{text: fmt.Sprintf("Page %d of %d", i+1, len(pages))})
+	}
+
+	return writePDF(w, pages)
+}
+
+// pdfRow lays out a row of the transaction table in fixed-width columns,
+// cutting the description short if it does not fit.
+func pdfRow(date, id, kind, description, amount, balance string) string {
+	if runes := []rune(description); len(runes) > 38 {
+		description = string(runes[:37]) + "~"
+	}
+	return fmt.Sprintf("%-16s %6s %-14s %-38s %13s %13s", date, id, kind, description, amount, balance)
+}
+
+// writePDF writes pages of text as a PDF 1.4 document. It uses the standard
+// Courier fonts, which every PDF reader has, so nothing is embedded.
+func writePDF(w io.Writer, pages [][]pdfLine) error {
+	var buf bytes.Buffer
+	var offsets []int
+	object := func(body string) {
+		offsets = append(offsets, buf.Len())
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+
+	buf.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+
+	// Objects 1 to 4 are the catalog, the page tree and the two fonts;
+	// each page is then a page object followed by its contents.
+	kids := make([]string, len(pages))
+	for i := range pages {
+		kids[i] = fmt.Sprintf("%d 0 R", 5+2*i)
+	}
+	object("<< /Type /Catalog /Pages 2 0 R >>")
+	object(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(pages)))
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Courier /Encoding /WinAnsiEncoding >>")
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Courier-Bold /Encoding /WinAnsiEncoding >>")
+
+	for i, page := range pages {
+		var content bytes.Buffer
+		fmt.Fprintf(&content, "BT\n%d TL\n%d %d Td\n", lineHeight, pageMargin, pageHeight-pageMargin)
+		for _, line := range page {
+			font := "F1"
+			if line.bold {
+				font = "F2"
+			}
+			fmt.Fprintf(&content, "/%s %d Tf\n(%s) Tj\nT*\n", font, fontSize, pdfString(line.text))
+		}
+		content.WriteString("ET")
+
+		object(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %d %d] "+
+			"/Resources << /Font << /F1 3 0 R /F2 4 0 R >> >> /Contents %d 0 R >>", pageWidth, pageHeight, 6+2*i))
+		object(fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", content.Len(), content.String()))
+	}
+
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// pdfString escapes s for a PDF string literal in WinAnsiEncoding, which
+// covers Latin-1; anything beyond it is replaced with "?".
+func pdfString(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '\\' || r == '(' || r == ')':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r < ' ' || (r > '~' && r < 0xa0) || r > 0xff:
+			b.WriteByte('?')
+		default:
+			b.WriteByte(byte(r))
+		}
+	}
+	return b.String()
+}
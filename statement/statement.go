@@ -0,0 +1,253 @@
+// Package statement renders account statements: the posted transactions of
+// an account over a period, with the balance before the period, after it and
+// after each transaction. Statements can be written as CSV for spreadsheets,
+// as OFX (or QFX, the same under Quicken's file extension) for personal
+// finance tools, and as a printable PDF.
+package statement
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"minibank/dbutil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Formats a statement can be written in.
+const (
+	CSV = "csv"
+	OFX = "ofx"
+	QFX = "qfx"
+	PDF = "pdf"
+)
+
+// Formats lists every format, the default first.
+var Formats = []string{CSV, OFX, QFX, PDF}
+
+// ValidFormat reports whether format is one of Formats.
+func ValidFormat(format string) bool {
+	for _, f := range Formats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// ContentType returns the media type of a statement in format.
+func ContentType(format string) string {
+	switch format {
+	case OFX:
+		return "application/x-ofx"
+	case QFX:
+		return "application/vnd.intu.qfx"
+	case PDF:
+		return "application/pdf"
+	default:
+		return "text/csv; charset=utf-8"
+	}
+}
+
+// Statement is an account's history over the period from Since up to, but
+// not including, Until. Balances are in the account's currency.
+type Statement struct {
+	AccountId   int
+	AccountName string
+	AccountType string
+	Holder      string
+	Currency    string
+	Since       time.Time
+	Until       time.Time
+	Opening     dbutil.Money
+	Closing     dbutil.Money
+	Lines       []Line
+	CreatedAt   time.Time
+}
+
+// Line is one transaction on a statement, dated when it settled. Amount is
+// what it did to the balance, negative for money out, and Balance is the
+// balance after it.
+type Line struct {
+	TransactionId int
+	Date          time.Time
+	Type          string
+	Description   string
+	Amount        dbutil.Money
+	Balance       dbutil.Money
+}
+
+// New makes the statement of account over [since, until) from opening, the
+// balance at since, and transactions, the transactions settled in the
+// period oldest first.
+func New(account *dbutil.Account, holder string, since, until time.Time, opening dbutil.Money, transactions []dbutil.Transaction, now time.Time) *Statement {
+	s := &Statement{
+		AccountId:   account.Id,
+		AccountName: account.Name(),
+		AccountType: account.Type,
+		Holder:      holder,
+		Currency:    account.Currency(),
+		Since:       since.UTC(),
+		Until:       until.UTC(),
+		Opening:     opening,
+		CreatedAt:   now.UTC(),
+	}
+	balance := opening
+	for i := range transactions {
+		t := &transactions[i]
+		change := t.BalanceChange(account.Id)
+		balance = balance.Add(change)
+		date := t.CreatedAt
+		if t.SettledAt != nil {
+			date = *t.SettledAt
+		}
+		s.Lines = append(s.Lines, Line{
+			TransactionId: t.Id,
+			Date:          date.UTC(),
+			Type:          t.TransactionType,
+			Description:   describe(t, account.Id),
+			Amount:        change,
+			Balance:       balance,
+		})
+	}
+	s.Closing = balance
+	return s
+}
+
+// describe says where a transaction came from or went to, as seen from
+// accountId.
+func describe(t *dbutil.Transaction, accountId int) string {
+	var description string
+	if accountId == t.ToAccount {
+		description = fmt.Sprintf("%s from account %d", t.TransactionType, t.FromAccount)
+	} else {
+		description = fmt.Sprintf("%s to account %d", t.TransactionType, t.ToAccount)
+	}
+	if t.Reverses != 0 {
+		description += fmt.Sprintf(", refunding transaction %d", t.Reverses)
+	}
+	if t.Reference != "" {
+		description += ", ref " + t.Reference
+	}
+	if t.Converted() && accountId == t.FromAccount {
+		description += fmt.Sprintf(", %s %s at %s", t.DestinationAmount, t.DestinationAmount.Currency, t.Rate)
+		if t.Fee.IsPositive() {
+			description += fmt.Sprintf(" incl. fee %s", t.Fee)
+		}
+	}
+	return description
+}
+
+// LastDay returns the last day the statement covers.
+func (s *Statement) LastDay() time.Time {
+	return s.Until.Add(-time.Nanosecond)
+}
+
+// FileName returns the name to download the statement in format as.
+func (s *Statement) FileName(format string) string {
+	return fmt.Sprintf("statement-%d-%s-%s.%s", s.AccountId, s.Since.Format("20060102"), s.LastDay().Format("20060102"), format)
+}
+
+// Write writes the statement to w in format.
+func (s *Statement) Write(w io.Writer, format string) error {
+	switch format {
+	case CSV:
+		return s.WriteCSV(w)
+	case OFX, QFX:
+		return s.WriteOFX(w)
+	case PDF:
+		return s.WritePDF(w)
+	default:
+		return fmt.Errorf("unknown statement format %q", format)
+	}
+}
+
+const dateTimeFormat = "2006-01-02 15:04:05"
+
+// WriteCSV writes the statement as CSV: a header, the opening balance, one
+// row per transaction with the running balance, and the closing balance.
+// Times are UTC.
+func (s *Statement) WriteCSV(w io.Writer) error {
+	out := csv.NewWriter(w)
+	out.Write([]string{"Date", "Transaction ID", "Type", "Description", "Amount", "Currency", "Balance"})
+	out.Write([]string{s.Since.Format(dateTimeFormat), "", "", "Opening balance", "", s.Currency, s.Opening.String()})
+	for _, line := range s.Lines {
+		out.Write([]string{
+			line.Date.Format(dateTimeFormat), strconv.Itoa(line.TransactionId), line.Type, line.Description,
+			line.Amount.String(), s.Currency, line.Balance.String(),
+		})
+	}
+	out.Write([]string{s.Until.Format(dateTimeFormat), "", "", "Closing balance", "", s.Currency, s.Closing.String()})
+	out.Flush()
+	return out.Error()
+}
+
+// WriteOFX writes the statement as an OFX 1.0.2 bank statement, which
+// personal finance tools import. OFX has no place for the opening or running
+// balances; the closing balance is the ledger balance as of the end of the
+// period. Each transaction's id is its FITID, so importing overlapping
+// statements does not duplicate transactions.
+//
+// The same file serves as QFX. Quicken's Web Connect would also want an
+// INTU.BID, which Intuit assigns to a bank and we do not have, so Quicken
+// users import it through File > Import instead.
+func (s *Statement) WriteOFX(w io.Writer) error {
+	var b strings.Builder
+	b.WriteString("OFXHEADER:100\r\nDATA:OFXSGML\r\nVERSION:102\r\nSECURITY:NONE\r\nENCODING:USASCII\r\n" +
+		"CHARSET:1252\r\nCOMPRESSION:NONE\r\nOLDFILEUID:NONE\r\nNEWFILEUID:NONE\r\n\r\n")
+
+	accountType := "CHECKING"
+	if s.AccountType == dbutil.AccountSavings {
+		accountType = "SAVINGS"
+	}
+	b.WriteString("<OFX>\r\n<SIGNONMSGSRSV1>\r\n<SONRS>\r\n")
+	b.WriteString("<STATUS>\r\n<CODE>0\r\n<SEVERITY>INFO\r\n</STATUS>\r\n")
+	fmt.Fprintf(&b, "<DTSERVER>%s\r\n<LANGUAGE>ENG\r\n<FI>\r\n<ORG>MiniBank\r\n</FI>\r\n", ofxTime(s.CreatedAt))
+	b.WriteString("</SONRS>\r\n</SIGNONMSGSRSV1>\r\n")
+	b.WriteString("<BANKMSGSRSV1>\r\n<STMTTRNRS>\r\n<TRNUID>0\r\n")
+	b.WriteString("<STATUS>\r\n<CODE>0\r\n<SEVERITY>INFO\r\n</STATUS>\r\n")
+	fmt.Fprintf(&b, "<STMTRS>\r\n<CURDEF>%s\r\n", s.Currency)
+	fmt.Fprintf(&b, "<BANKACCTFROM>\r\n<BANKID>MINIBANK\r\n<ACCTID>%d\r\n<ACCTTYPE>%s\r\n</BANKACCTFROM>\r\n", s.AccountId, accountType)
+	fmt.Fprintf(&b, "<BANKTRANLIST>\r\n<DTSTART>%s\r\n<DTEND>%s\r\n", ofxTime(s.Since), ofxTime(s.Until))
+	for _, line := range s.Lines {
+		trnType := "CREDIT"
+		if line.Amount.IsNegative() {
+			trnType = "DEBIT"
+		}
+		fmt.Fprintf(&b, "<STMTTRN>\r\n<TRNTYPE>%s\r\n<DTPOSTED>%s\r\n<TRNAMT>%s\r\n<FITID>%d\r\n<NAME>%s\r\n<MEMO>%s\r\n</STMTTRN>\r\n",
+			trnType, ofxTime(line.Date), line.Amount, line.TransactionId, ofxText(line.Type, 32), ofxText(line.Description, 255))
+	}
+	b.WriteString("</BANKTRANLIST>\r\n")
+	fmt.Fprintf(&b, "<LEDGERBAL>\r\n<BALAMT>%s\r\n<DTASOF>%s\r\n</LEDGERBAL>\r\n", s.Closing, ofxTime(s.Until))
+	b.WriteString("</STMTRS>\r\n</STMTTRNRS>\r\n</BANKMSGSRSV1>\r\n</OFX>\r\n")
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// ofxTime formats t as an OFX date and time in UTC.
+func ofxTime(t time.Time) string {
+	return t.UTC().Format("20060102150405") + "[0:GMT]"
+}
+
+// ofxText makes s safe for an OFX element of at most max characters in
+// US-ASCII. The limit counts characters before escaping, as an escape is
+// one character to the reader, and cutting first never splits one.
+func ofxText(s string, max int) string {
+	s = ascii(s)
+	if len(s) > max {
+		s = s[:max]
+	}
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(s)
+}
+
+// ascii replaces anything outside printable US-ASCII in s with "?".
+func ascii(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r < ' ' || r > '~' {
+			return '?'
+		}
+		return r
+	}, s)
+}
@@ -0,0 +1,260 @@
+package statement
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"minibank/dbutil"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testStatement is March 2026 for account 7, in AUD: a payment converted
+// into USD and then a refund of an earlier payment.
+func testStatement(t *testing.T) *Statement {
+	t.Helper()
+	at := func(day, hour int) *time.Time {
+		d := time.Date(2026, 3, day, hour, 0, 0, 0, time.UTC)
+		return &d
+	}
+	aud := func(minor int64) dbutil.Money { return dbutil.NewMoney(minor, "AUD") }
+	account := &dbutil.Account{Id: 7, Type: dbutil.AccountChecking, Balance: aud(0)}
+	transactions := []dbutil.Transaction{
+		{
+			Id:                11,
+			FromAccount:       7,
+			ToAccount:         9,
+			Amount:            aud(5000),
+			DestinationAmount: dbutil.NewMoney(3250, "USD"),
+			Rate:              "0.65",
+			Fee:               aud(50),
+			TransactionType:   "Transfer",
+			CreatedAt:         *at(3, 9),
+			SettledAt:         at(3, 9),
+			Reference:         "Rent & <March>",
+		},
+		{
+			Id:                12,
+			FromAccount:       8,
+			ToAccount:         7,
+			Amount:            aud(2000),
+			DestinationAmount: aud(2000),
+			Fee:               aud(0),
+			TransactionType:   "Refund",
+			// Held on the 4th and settled on the 5th
+			CreatedAt: *at(4, 12),
+			SettledAt: at(5, 8),
+			Reverses:  10,
+		},
+	}
+	since := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	until := time.Date(2026, 4, 1, 0, 0, 0, 0, time.UTC)
+	return New(account, "Alice Example", since, until, aud(10000), transactions, time.Date(2026, 4, 2, 10, 0, 0, 0, time.UTC))
+}
+
+func TestNew(t *testing.T) {
+	s := testStatement(t)
+	if got, want := s.Closing, dbutil.NewMoney(6950, "AUD"); got != want {
+		t.Errorf("closing balance %s, want %s", got, want)
+	}
+	if len(s.Lines) != 2 {
+		t.Fatalf("%d lines, want 2", len(s.Lines))
+	}
+	if got, want := s.Lines[1].Date, time.Date(2026, 3, 5, 8, 0, 0, 0, time.UTC); !got.Equal(want) {
+		t.Errorf("refund dated %s, want when it settled, %s", got, want)
+	}
+	if got, want := s.FileName(CSV), "statement-7-20260301-20260331.csv"; got != want {
+		t.Errorf("file name %s, want %s", got, want)
+	}
+}
+
+func TestWriteCSV(t *testing.T) {
+	var buf bytes.Buffer
+	if err := testStatement(t).Write(&buf, CSV); err != nil {
+		t.Fatal(err)
+	}
+	got, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{
+		{"Date", "Transaction ID", "Type", "Description", "Amount", "Currency", "Balance"},
+		{"2026-03-01 00:00:00", "", "", "Opening balance", "", "AUD", "100.00"},
+		{"2026-03-03 09:00:00", "11", "Transfer", "Transfer to account 9, ref Rent & <March>, 32.50 USD at 0.65 incl. fee 0.50", "-50.50", "AUD", "49.50"},
+		{"2026-03-05 08:00:00", "12", "Refund", "Refund from account 8, refunding transaction 10", "20.00", "AUD", "69.50"},
+		{"2026-04-01 00:00:00", "", "", "Closing balance", "", "AUD", "69.50"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got\n%q\nwant\n%q", got, want)
+	}
+}
+
+func TestWriteOFX(t *testing.T) {
+	var buf bytes.Buffer
+	if err := testStatement(t).Write(&buf, QFX); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, want := range []string{
+		"<CURDEF>AUD\r\n",
+		"<ACCTID>7\r\n<ACCTTYPE>CHECKING\r\n",
+		"<DTSTART>20260301000000[0:GMT]\r\n<DTEND>20260401000000[0:GMT]\r\n",
+		"<TRNTYPE>DEBIT\r\n<DTPOSTED>20260303090000[0:GMT]\r\n<TRNAMT>-50.50\r\n<FITID>11\r\n<NAME>Transfer\r\n" +
+			"<MEMO>Transfer to account 9, ref Rent &amp; &lt;March&gt;, 32.50 USD at 0.65 incl. fee 0.50\r\n",
+		"<TRNTYPE>CREDIT\r\n<DTPOSTED>20260305080000[0:GMT]\r\n<TRNAMT>20.00\r\n<FITID>12\r\n",
+		"<LEDGERBAL>\r\n<BALAMT>69.50\r\n<DTASOF>20260401000000[0:GMT]\r\n</LEDGERBAL>\r\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("OFX does not contain %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestOFXText(t *testing.T) {
+	tests := []struct {
+		s    string
+		max  int
+		want string
+	}{
+		{"Rent & <March>", 255, "Rent &amp; &lt;March&gt;"},
+		// The limit counts each escape as one character
+		{"A&B", 3, "A&amp;B"},
+		{"AB&C", 3, "AB&amp;"},
+		{"ABC&D", 3, "ABC"},
+		{"Café", 255, "Caf?"},
+		{"line\nbreak", 255, "line?break"},
+	}
+	for _, tt := range tests {
+		if got := ofxText(tt.s, tt.max); got != tt.want {
+			t.Errorf("ofxText(%q, %d) = %q, want %q", tt.s, tt.max, got, tt.want)
+		}
+	}
+}
+
+// pdfPages returns the text shown on each page of a PDF written by
+// writePDF, checking the cross-reference table on the way.
+func pdfPages(t *testing.T, pdf []byte) [][]string {
+	t.Helper()
+	if !bytes.HasPrefix(pdf, []byte("%PDF-1.4\n")) || !bytes.HasSuffix(pdf, []byte("%%EOF\n")) {
+		t.Fatalf("not a PDF: %q", pdf)
+	}
+
+	// Every object is where the cross-reference table says it is
+	match := regexp.MustCompile(`startxref\n(\d+)\n`).FindSubmatch(pdf)
+	if match == nil {
+		t.Fatal("no startxref")
+	}
+	xref, _ := strconv.Atoi(string(match[1]))
+	entries := regexp.MustCompile(`(\d{10}) 00000 n `).FindAllSubmatch(pdf[xref:], -1)
+	for i, entry := range entries {
+		offset, _ := strconv.Atoi(string(entry[1]))
+		if want := fmt.Sprintf("%d 0 obj\n", i+1); !bytes.HasPrefix(pdf[offset:], []byte(want)) {
+			t.Errorf("object %d is not at %d", i+1, offset)
+		}
+	}
+
+	count := regexp.MustCompile(`/Count (\d+)`).FindSubmatch(pdf)
+	if count == nil {
+		t.Fatal("no page count")
+	}
+	var pages [][]string
+	for _, stream := range regexp.MustCompile(`(?s)stream\n(.*?)\nendstream`).FindAllSubmatch(pdf, -1) {
+		var lines []string
+		for _, text := range regexp.MustCompile(`\((.*)\) Tj`).FindAllSubmatch(stream[1], -1) {
+			lines = append(lines, string(text[1]))
+		}
+		pages = append(pages, lines)
+	}
+	if n, _ := strconv.Atoi(string(count[1])); n != len(pages) {
+		t.Errorf("page count %d, but %d pages", n, len(pages))
+	}
+	return pages
+}
+
+func TestWritePDF(t *testing.T) {
+	var buf bytes.Buffer
+	if err := testStatement(t).Write(&buf, PDF); err != nil {
+		t.Fatal(err)
+	}
+	pages := pdfPages(t, buf.Bytes())
+	if len(pages) != 1 {
+		t.Fatalf("%d pages, want 1", len(pages))
+	}
+	text := strings.Join(pages[0], "\n")
+	for _, want := range []string{
+		"Account holder:  Alice Example",
+		"Period:          1 March 2026 to 31 March 2026",
+		"Opening balance: 100.00 AUD",
+		"Closing balance: 69.50 AUD",
+		pdfRow("2026-03-01 00:00", "", "", "Opening balance", "", "100.00"),
+		// Long descriptions are cut short
+		pdfRow("2026-03-03 09:00", "11", "Transfer", "Transfer to account 9, ref Rent & <Ma~", "-50.50", "49.50"),
+		pdfRow("2026-03-05 08:00", "12", "Refund", "Refund from account 8, refunding tran~", "20.00", "69.50"),
+		pdfRow("2026-04-01 00:00", "", "", "Closing balance", "", "69.50"),
+		"Page 1 of 1",
+	} {
+		if !strings.Contains(text, pdfString(want)) {
+			t.Errorf("PDF does not show %q:\n%s", want, text)
+		}
+	}
+}
+
+func TestWritePDFPages(t *testing.T) {
+	s := testStatement(t)
+	base := s.Lines[0]
+	s.Lines = nil
+	for i := 0; i < 200; i++ {
+		line := base
+		line.TransactionId = 1000 + i
+		s.Lines = append(s.Lines, line)
+	}
+
+	var buf bytes.Buffer
+	if err := s.WritePDF(&buf); err != nil {
+		t.Fatal(err)
+	}
+	pages := pdfPages(t, buf.Bytes())
+	// 202 rows with the opening and closing balances: 57 on the first
+	// page under the heading, then 66 a page
+	if len(pages) != 4 {
+		t.Fatalf("%d pages, want 4", len(pages))
+	}
+	header := pdfString(pdfRow("Date", "ID", "Type", "Description", "Amount", "Balance"))
+	seen := make(map[string]int)
+	for i, page := range pages {
+		if len(page) > linesPerPage {
+			t.Errorf("page %d has %d lines, more than fit", i+1, len(page))
+		}
+		headers := 0
+		for _, line := range page {
+			if line == header {
+				headers++
+			}
+			if fields := strings.Fields(line); len(fields) > 2 {
+				if id, err := strconv.Atoi(fields[2]); err == nil && id >= 1000 {
+					seen[fields[2]]++
+				}
+			}
+		}
+		if headers != 1 {
+			t.Errorf("page %d has %d table headers, want 1", i+1, headers)
+		}
+		if want := fmt.Sprintf("Page %d of %d", i+1, len(pages)); page[len(page)-1] != want {
+			t.Errorf("page %d ends %q, want %q", i+1, page[len(page)-1], want)
+		}
+	}
+	// Every transaction is shown once
+	for i := 0; i < 200; i++ {
+		if id := strconv.Itoa(1000 + i); seen[id] != 1 {
+			t.Errorf("transaction %s shown %d times", id, seen[id])
+		}
+	}
+	last := pages[len(pages)-1]
+	if want := pdfString(pdfRow("2026-04-01 00:00", "", "", "Closing balance", "", s.Closing.String())); last[len(last)-3] != want {
+		t.Errorf("last page ends with %q, want the closing balance", last[len(last)-3])
+	}
+}
@@ -0,0 +1,105 @@
+package totp
+
+import (
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA1 key of the RFC 6238 test vectors,
+// "12345678901234567890", in base32.
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestCodeRFC6238(t *testing.T) {
+	// The RFC gives eight digits; six-digit codes are the last six of them
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		got, err := Code(rfcSecret, time.Unix(tt.unix, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("at %d: %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestValidateSkew(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	for _, tt := range []struct {
+		steps int
+		ok    bool
+	}{
+		{-2, false},
+		{-1, true},
+		{0, true},
+		{1, true},
+		{2, false},
+	} {
+		at := now.Add(time.Duration(tt.steps) * Period)
+		code, err := Code(rfcSecret, at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		step, ok := Validate(rfcSecret, code, now, 0)
+		if ok != tt.ok {
+			t.Errorf("code from %d steps away: accepted %t, want %t", tt.steps, ok, tt.ok)
+		}
+		if ok && step != Step(at) {
+			t.Errorf("code from %d steps away matched step %d, want %d", tt.steps, step, Step(at))
+		}
+	}
+}
+
+func TestValidateReplay(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	code, err := Code(rfcSecret, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	step, ok := Validate(rfcSecret, code, now, 0)
+	if !ok {
+		t.Fatal("current code refused")
+	}
+	if _, ok := Validate(rfcSecret, code, now, step); ok {
+		t.Error("code accepted again after its step was used")
+	}
+
+	// Nor is an older code that is still within the skew
+	previous, err := Code(rfcSecret, now.Add(-Period))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := Validate(rfcSecret, previous, now, step); ok {
+		t.Error("code from before the used step accepted")
+	}
+	// but the next one is
+	next, err := Code(rfcSecret, now.Add(Period))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := Validate(rfcSecret, next, now, step); !ok {
+		t.Error("code from after the used step refused")
+	}
+}
+
+func TestValidateInvalid(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	for _, code := range []string{"", "00592", "0005924", "abcdef"} {
+		if _, ok := Validate(rfcSecret, code, now, 0); ok {
+			t.Errorf("Validate(%q) succeeded", code)
+		}
+	}
+	if _, ok := Validate("not base32!", "005924", now, 0); ok {
+		t.Error("Validate with an invalid secret succeeded")
+	}
+}